@@ -17,21 +17,59 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"time"
 
 	"github.com/ceph/ceph-csi/pkg/cephfs"
+	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/ceph/ceph-csi/pkg/util"
 	"k8s.io/klog"
 )
 
 var (
-	endpoint        = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName      = flag.String("drivername", "cephfs.csi.ceph.com", "name of the driver")
-	nodeID          = flag.String("nodeid", "", "node id")
-	volumeMounter   = flag.String("volumemounter", "", "default volume mounter (possible options are 'kernel', 'fuse')")
-	metadataStorage = flag.String("metadatastorage", "", "metadata persistence method [node|k8s_configmap]")
-	mountCacheDir   = flag.String("mountcachedir", "", "mount info cache save dir")
+	endpoint          = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	tlsCert           = flag.String("tlscert", "", "PEM file of the server certificate of tcp:// endpoints")
+	tlsKey            = flag.String("tlskey", "", "PEM file of the server key of tcp:// endpoints")
+	clientCA          = flag.String("clientca", "", "PEM file of the CA verifying client certificates of tcp:// endpoints, clients must present one if set")
+	insecureTCP       = flag.Bool("insecure-tcp", false, "allow tcp:// endpoints without TLS, for testing only")
+	driverName        = flag.String("drivername", "cephfs.csi.ceph.com", "name of the driver")
+	nodeID            = flag.String("nodeid", "", "node id")
+	volumeMounter     = flag.String("volumemounter", "", "default volume mounter (possible options are 'kernel', 'fuse')")
+	metadataStorage   = flag.String("metadatastorage", "", "metadata persistence method [node|k8s_configmap]")
+	upgradeSchema     = flag.Bool("upgrademetadataschema", false, "migrate the metadata store to the current schema version before serving RPCs, failing the start if it fails, only for the provisioner as it updates the entries")
+	metadataChecksums = flag.Bool("metadatachecksums", false, "write metadata entries with a checksum, verified on read (entries without checksum are still read)")
+	pidLimit          = flag.Int("pidlimit", 0, "throttle the exec'd helpers below the pid limit of the pod, -1 reads it from the pids cgroup, 0 disables the throttling")
+	teardownWorkers   = flag.Int("teardownworkers", 0, "number of workers the unmounts of NodeUnpublishVolume and NodeUnstageVolume run on, in order for each volume, 0 runs them in the RPC handlers")
+	allowNonEmpty     = flag.Bool("allownonemptytargets", false, "publish volumes on target directories with files in them, which the mount shadows, instead of failing with FailedPrecondition")
+	mountCacheDir     = flag.String("mountcachedir", "", "mount info cache save dir")
+	configRoot        = flag.String("configroot", "", "directory of the cluster configurations, or k8s_objects, with the credentials GetCapacity runs with, GetCapacity is only advertised if set")
+	opTimeouts        = flag.String("optimeouts", "", "comma separated <operation>=<duration> timeouts of backend operations [createVolume|purgeVolume|mount]")
+	slowCallThreshold = flag.Duration("slowcallthreshold", 30*time.Second, "log the phase timings of CreateVolume calls taking longer, 0 disables the logging")
+	logBackendCalls   = flag.Bool("logbackendcalls", false, "log the backend commands run, with their secrets stripped, duration and exit status, as done at -v=5")
+	logLevels         = flag.String("loglevels", "", "comma separated <module>=<level> verbosities of the logs of [mount|backend|metadata], default sets the others, unknown modules are ignored, untagged logs keep -v")
+	logLevelsFile     = flag.String("loglevelsfile", "", "file with the loglevels setting, overriding it, reloaded on SIGHUP")
+	trackAttachments  = flag.Bool("enableattachtracking", false, "advertise ControllerPublishVolume/ControllerUnpublishVolume and record the nodes volumes are published to in the metadata store")
+	cephFusePath      = flag.String("cephfusepath", "ceph-fuse", "path of the ceph-fuse binary")
+	mountPath         = flag.String("mountpath", "mount", "path of the mount binary used for kernel mounts and bind-mounts")
+	rejectUnknown     = flag.Bool("rejectunknownparameters", false, "fail CreateVolume requests with unknown parameters, instead of only logging them")
+	rejectOversized   = flag.Bool("rejectoversizedvolumes", false, "fail CreateVolume requests larger than the space available in the data pool, times the overcommit ratio")
+	overcommitRatio   = flag.Float64("overcommitratio", 1, "ratio of the space available in the data pool which provisioned volumes may exceed, with rejectoversizedvolumes")
+	skipFsValidation  = flag.Bool("skipfsvalidation", false, "don't check that the fsName of volumes exists at CreateVolume, for credentials which can't list the filesystems (fsID is rejected), the pool is still checked")
+	backendMetadata   = flag.String("backendmetadata", "", "comma separated <parameter>=<backend key> pairs, the parameters set as user.<backend key> extended attributes of new volume directories")
+	skipCapsCheck     = flag.Bool("skipcapscheck", false, "don't check the caps of the admin credentials before provisioning volumes, for credentials which may not read their caps")
+	skipFullCheck     = flag.Bool("skipfullcheck", false, "don't reject creating volumes with ResourceExhausted while ceph health reports OSD_FULL or POOL_FULL, for credentials which may not read the health")
+	leaderElection    = flag.Bool("leader-election", false, "only serve the controller RPCs while holding the Lease named after the driver in the namespace of the pod, for several controller replicas")
+	leaseDuration     = flag.Duration("leader-election-lease-duration", 15*time.Second, "time standby replicas wait after the last renewal of the Lease before taking it over")
+	renewDeadline     = flag.Duration("leader-election-renew-deadline", 10*time.Second, "time the leader tries to renew the Lease for before giving up the leadership")
+	retryPeriod       = flag.Duration("leader-election-retry-period", 2*time.Second, "time between attempts to acquire or renew the Lease")
+	maintenanceFile   = flag.String("maintenancefile", "", "JSON file of the maintenance level [off|no-provision|read-only] rejecting the matching RPCs with Unavailable, reloaded on SIGHUP and every 10s")
+	policyWebhookURL  = flag.String("policy-webhook-url", "", "URL CreateVolume posts the name, parameters, size, cluster and topology of new volumes to, the webhook allows, denies or overrides their parameters")
+	policyTimeout     = flag.Duration("policy-webhook-timeout", 5*time.Second, "timeout of the calls of the policy webhook")
+	policyFailure     = flag.String("policy-webhook-failure-policy", csicommon.PolicyFailClosed, "provisioning when the policy webhook fails [fail-closed|fail-open], fail-closed rejects the volumes with Unavailable")
+	auditLocks        = flag.Bool("auditlocks", false, "log the RPCs returning with locks held, as a debugging aid for lock leaks")
+	recoverSessions   = flag.Bool("recoversessions", false, "reconnect evicted CephFS client sessions and remount stale staging paths (requires mountcachedir)")
 )
 
 func init() {
@@ -48,16 +86,110 @@ func main() {
 	if err != nil {
 		klog.Fatalln(err)
 	}
+	timeouts, err := util.ParseOperationTimeouts(*opTimeouts)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	metadataMapping, err := util.ParseBackendMetadataMapping(*backendMetadata)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	if err = util.SetPIDLimit(*pidLimit); err != nil {
+		klog.Fatalln(err)
+	}
+	if err = util.SetTeardownWorkers(*teardownWorkers, timeouts[util.OpMount]); err != nil {
+		klog.Fatalln(err)
+	}
+	util.SlowCallThreshold = *slowCallThreshold
+	util.LogBackendCalls = *logBackendCalls
+	util.AllowNonEmptyTargets = *allowNonEmpty
+	if err = util.SetLogLevels(*logLevels); err != nil {
+		klog.Fatalln(err)
+	}
+	if *logLevelsFile != "" {
+		if err = util.LoadLogLevels(*logLevelsFile); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+	go util.WatchLogLevels(context.Background(), *logLevelsFile)
+
 	//update plugin name
 	cephfs.PluginFolder = cephfs.PluginFolder + *driverName
+	cephfs.CephFuseBinary = *cephFusePath
+	cephfs.MountBinary = *mountPath
 
-	cp, err := util.CreatePersistanceStorage(cephfs.PluginFolder, *metadataStorage, *driverName)
+	cp, err := util.CreatePersistanceStorage(cephfs.PluginFolder, *metadataStorage, *driverName, *metadataChecksums)
 	if err != nil {
 		os.Exit(1)
 	}
 
 	driver := cephfs.NewDriver()
-	driver.Run(*driverName, *nodeID, *endpoint, *volumeMounter, *mountCacheDir, cp)
+	serverOptions := csicommon.ServerOptions{
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+		ClientCA:    *clientCA,
+		InsecureTCP: *insecureTCP,
+		AuditLocks:  *auditLocks,
+	}
+	if *leaderElection {
+		var identity string
+		if identity, err = util.LeaderElectionIdentity(); err != nil {
+			klog.Fatalln(err)
+		}
+
+		var elector *util.LeaderElector
+		elector, err = util.NewLeaderElector(util.LeaderElectionConfig{
+			LeaseName:     *driverName,
+			Namespace:     util.GetK8sNamespace(),
+			Identity:      identity,
+			LeaseDuration: *leaseDuration,
+			RenewDeadline: *renewDeadline,
+			RetryPeriod:   *retryPeriod,
+		})
+		if err != nil {
+			klog.Fatalln(err)
+		}
+
+		serverOptions.ControllerGate = elector
+	}
+	if *maintenanceFile != "" {
+		var maintenance *csicommon.Maintenance
+		if maintenance, err = csicommon.NewMaintenance(*maintenanceFile); err != nil {
+			klog.Fatalln(err)
+		}
+
+		go maintenance.Run(context.Background())
+		serverOptions.Maintenance = maintenance
+	}
+	if *policyWebhookURL != "" {
+		if serverOptions.PolicyWebhook, err = csicommon.NewPolicyWebhook(*policyWebhookURL, *driverName, *policyTimeout, *policyFailure); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+
+	driver.Run(cephfs.DriverOptions{
+		DriverName:              *driverName,
+		NodeID:                  *nodeID,
+		Endpoint:                *endpoint,
+		VolumeMounter:           *volumeMounter,
+		MountCacheDir:           *mountCacheDir,
+		ConfigRoot:              *configRoot,
+		RecoverSessions:         *recoverSessions,
+		TrackAttachments:        *trackAttachments,
+		RejectUnknownParameters: *rejectUnknown,
+		RejectOversizedVolumes:  *rejectOversized,
+		OvercommitRatio:         *overcommitRatio,
+		SkipFsValidation:        *skipFsValidation,
+		BackendMetadata:         metadataMapping,
+		SkipCapsCheck:           *skipCapsCheck,
+		SkipFullCheck:           *skipFullCheck,
+		UpgradeMetadataSchema:   *upgradeSchema,
+		Timeouts:                timeouts,
+		CachePersister:          cp,
+		ServerOptions:           serverOptions,
+	})
 
 	os.Exit(0)
 }
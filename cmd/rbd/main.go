@@ -17,21 +17,58 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"time"
 
+	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/ceph/ceph-csi/pkg/rbd"
 	"github.com/ceph/ceph-csi/pkg/util"
 	"k8s.io/klog"
 )
 
 var (
-	endpoint        = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName      = flag.String("drivername", "rbd.csi.ceph.com", "name of the driver")
-	nodeID          = flag.String("nodeid", "", "node id")
-	containerized   = flag.Bool("containerized", true, "whether run as containerized")
-	metadataStorage = flag.String("metadatastorage", "", "metadata persistence method [node|k8s_configmap]")
-	configRoot      = flag.String("configroot", "/etc/csi-config", "directory in which CSI specific Ceph"+
+	endpoint            = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	tlsCert             = flag.String("tlscert", "", "PEM file of the server certificate of tcp:// endpoints")
+	tlsKey              = flag.String("tlskey", "", "PEM file of the server key of tcp:// endpoints")
+	clientCA            = flag.String("clientca", "", "PEM file of the CA verifying client certificates of tcp:// endpoints, clients must present one if set")
+	insecureTCP         = flag.Bool("insecure-tcp", false, "allow tcp:// endpoints without TLS, for testing only")
+	driverName          = flag.String("drivername", "rbd.csi.ceph.com", "name of the driver")
+	nodeID              = flag.String("nodeid", "", "node id")
+	containerized       = flag.Bool("containerized", true, "whether run as containerized")
+	trackAttachments    = flag.Bool("enableattachtracking", false, "record the nodes volumes are published to in the metadata store on ControllerPublishVolume/ControllerUnpublishVolume")
+	verifySnapshots     = flag.Bool("verifysnapshotsonretry", false, "check that snapshots exist in the backend before answering CreateSnapshot retries from the metadata store")
+	readAffinity        = flag.Bool("enable-read-affinity", false, "localize reads to the OSDs closest to the node, using its crush location")
+	crushLocationLabels = flag.String("crush-location-labels", "", "comma separated node labels forming the crush location of the node, e.g. topology.kubernetes.io/zone becomes zone=<label value>")
+	backendMetadata     = flag.String("backendmetadata", "", "comma separated <parameter>=<image-meta key> pairs, the parameters set as image-meta of new images")
+	skipCapsCheck       = flag.Bool("skipcapscheck", false, "don't check the caps of the credentials before creating volumes and snapshots, for credentials which may neither read their caps nor list images")
+	skipFullCheck       = flag.Bool("skipfullcheck", false, "don't reject creating volumes and snapshots with ResourceExhausted while ceph health reports OSD_FULL or POOL_FULL, for credentials which may not read the health")
+	opTimeouts          = flag.String("optimeouts", "", "comma separated <operation>=<duration> timeouts of backend operations [createVolume|purgeVolume|snapshotCreate|snapshotDelete|mount]")
+	slowCallThreshold   = flag.Duration("slowcallthreshold", 30*time.Second, "log the phase timings of CreateVolume and CreateSnapshot calls taking longer, 0 disables the logging")
+	logBackendCalls     = flag.Bool("logbackendcalls", false, "log the backend commands run, with their secrets stripped, duration and exit status, as done at -v=5")
+	logLevels           = flag.String("loglevels", "", "comma separated <module>=<level> verbosities of the logs of [mount|backend|metadata], default sets the others, unknown modules are ignored, untagged logs keep -v")
+	logLevelsFile       = flag.String("loglevelsfile", "", "file with the loglevels setting, overriding it, reloaded on SIGHUP")
+	metadataStorage     = flag.String("metadatastorage", "", "metadata persistence method [node|k8s_configmap]")
+	upgradeSchema       = flag.Bool("upgrademetadataschema", false, "migrate the metadata store to the current schema version before serving RPCs, failing the start if it fails, only for the provisioner as it updates the entries")
+	metadataChecksums   = flag.Bool("metadatachecksums", false, "write metadata entries with a checksum, verified on read (entries without checksum are still read)")
+	pidLimit            = flag.Int("pidlimit", 0, "throttle the exec'd helpers below the pid limit of the pod, -1 reads it from the pids cgroup, 0 disables the throttling")
+	teardownWorkers     = flag.Int("teardownworkers", 0, "number of workers the unmounts and unmaps of NodeUnpublishVolume run on, in order for each volume, 0 runs them in the RPC handlers")
+	allowNonEmpty       = flag.Bool("allownonemptytargets", false, "publish volumes on target directories with files in them, which the mount shadows, instead of failing with FailedPrecondition")
+	rejectUnknownParams = flag.Bool("rejectunknownparameters", false, "fail CreateVolume and CreateSnapshot requests with unknown parameters, instead of only logging them")
+	leaderElection      = flag.Bool("leader-election", false, "only serve the controller RPCs while holding the Lease named after the driver in the namespace of the pod, for several controller replicas")
+	leaseDuration       = flag.Duration("leader-election-lease-duration", 15*time.Second, "time standby replicas wait after the last renewal of the Lease before taking it over")
+	renewDeadline       = flag.Duration("leader-election-renew-deadline", 10*time.Second, "time the leader tries to renew the Lease for before giving up the leadership")
+	retryPeriod         = flag.Duration("leader-election-retry-period", 2*time.Second, "time between attempts to acquire or renew the Lease")
+	maintenanceFile     = flag.String("maintenancefile", "", "JSON file of the maintenance level [off|no-provision|read-only] rejecting the matching RPCs with Unavailable, reloaded on SIGHUP and every 10s")
+	policyWebhookURL    = flag.String("policy-webhook-url", "", "URL CreateVolume posts the name, parameters, size, cluster and topology of new volumes to, the webhook allows, denies or overrides their parameters")
+	policyTimeout       = flag.Duration("policy-webhook-timeout", 5*time.Second, "timeout of the calls of the policy webhook")
+	policyFailure       = flag.String("policy-webhook-failure-policy", csicommon.PolicyFailClosed, "provisioning when the policy webhook fails [fail-closed|fail-open], fail-closed rejects the volumes with Unavailable")
+	auditLocks          = flag.Bool("auditlocks", false, "log the RPCs returning with locks held, as a debugging aid for lock leaks")
+	snapshotGC          = flag.Bool("snapshotgc", false, "delete the snapshots in the metadata store without VolumeSnapshotContent and exit, instead of running the driver")
+	snapshotGCOlderThan = flag.Duration("snapshotgcolderthan", 720*time.Hour, "minimum age of the snapshots deleted by --snapshotgc")
+	snapshotGCDryRun    = flag.Bool("snapshotgcdryrun", false, "only report the snapshots --snapshotgc would delete")
+	configRoot          = flag.String("configroot", "/etc/csi-config", "directory in which CSI specific Ceph"+
 		" cluster configurations are present, OR the value \"k8s_objects\" if present as kubernetes secrets")
 )
 
@@ -49,16 +86,114 @@ func main() {
 	if err != nil {
 		klog.Fatalln(err)
 	}
+
+	timeouts, err := util.ParseOperationTimeouts(*opTimeouts)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	metadataMapping, err := util.ParseBackendMetadataMapping(*backendMetadata)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	if err = util.SetPIDLimit(*pidLimit); err != nil {
+		klog.Fatalln(err)
+	}
+	if err = util.SetTeardownWorkers(*teardownWorkers, timeouts[util.OpMount]); err != nil {
+		klog.Fatalln(err)
+	}
+	util.SlowCallThreshold = *slowCallThreshold
+	util.LogBackendCalls = *logBackendCalls
+	util.AllowNonEmptyTargets = *allowNonEmpty
+	if err = util.SetLogLevels(*logLevels); err != nil {
+		klog.Fatalln(err)
+	}
+	if *logLevelsFile != "" {
+		if err = util.LoadLogLevels(*logLevelsFile); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+	go util.WatchLogLevels(context.Background(), *logLevelsFile)
+
 	//update plugin name
 	rbd.PluginFolder = rbd.PluginFolder + *driverName
 
-	cp, err := util.CreatePersistanceStorage(rbd.PluginFolder, *metadataStorage, *driverName)
+	cp, err := util.CreatePersistanceStorage(rbd.PluginFolder, *metadataStorage, *driverName, *metadataChecksums)
 	if err != nil {
 		os.Exit(1)
 	}
 
 	driver := rbd.NewDriver()
-	driver.Run(*driverName, *nodeID, *endpoint, *configRoot, *containerized, cp)
+	if *snapshotGC {
+		if err = driver.RunSnapshotGC(*driverName, *configRoot, *snapshotGCOlderThan, *snapshotGCDryRun, timeouts, cp); err != nil {
+			klog.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+
+	serverOptions := csicommon.ServerOptions{
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+		ClientCA:    *clientCA,
+		InsecureTCP: *insecureTCP,
+		AuditLocks:  *auditLocks,
+	}
+	if *leaderElection {
+		var identity string
+		if identity, err = util.LeaderElectionIdentity(); err != nil {
+			klog.Fatalln(err)
+		}
+
+		var elector *util.LeaderElector
+		elector, err = util.NewLeaderElector(util.LeaderElectionConfig{
+			LeaseName:     *driverName,
+			Namespace:     util.GetK8sNamespace(),
+			Identity:      identity,
+			LeaseDuration: *leaseDuration,
+			RenewDeadline: *renewDeadline,
+			RetryPeriod:   *retryPeriod,
+		})
+		if err != nil {
+			klog.Fatalln(err)
+		}
+
+		serverOptions.ControllerGate = elector
+	}
+	if *maintenanceFile != "" {
+		var maintenance *csicommon.Maintenance
+		if maintenance, err = csicommon.NewMaintenance(*maintenanceFile); err != nil {
+			klog.Fatalln(err)
+		}
+
+		go maintenance.Run(context.Background())
+		serverOptions.Maintenance = maintenance
+	}
+	if *policyWebhookURL != "" {
+		if serverOptions.PolicyWebhook, err = csicommon.NewPolicyWebhook(*policyWebhookURL, *driverName, *policyTimeout, *policyFailure); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+
+	driver.Run(rbd.DriverOptions{
+		DriverName:              *driverName,
+		NodeID:                  *nodeID,
+		Endpoint:                *endpoint,
+		ConfigRoot:              *configRoot,
+		Containerized:           *containerized,
+		TrackAttachments:        *trackAttachments,
+		VerifySnapshotsOnRetry:  *verifySnapshots,
+		ReadAffinity:            *readAffinity,
+		CrushLocationLabels:     *crushLocationLabels,
+		RejectUnknownParameters: *rejectUnknownParams,
+		BackendMetadata:         metadataMapping,
+		SkipCapsCheck:           *skipCapsCheck,
+		SkipFullCheck:           *skipFullCheck,
+		UpgradeMetadataSchema:   *upgradeSchema,
+		Timeouts:                timeouts,
+		CachePersister:          cp,
+		ServerOptions:           serverOptions,
+	})
 
 	os.Exit(0)
 }
@@ -0,0 +1,65 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+)
+
+// provisionCapRequirements returns the caps the admin credentials need to
+// provision volumes with the options
+func provisionCapRequirements(volOptions *volumeOptions) []util.CapRequirement {
+	reqs := []util.CapRequirement{
+		{Daemon: "mon", Perms: "rwx", Purpose: "creating the ceph users of volumes"},
+		{Daemon: "mds", Perms: "rwp", Purpose: "creating volume directories with quotas and layouts"},
+	}
+	if volOptions.ExportNFS {
+		reqs = append(reqs, util.CapRequirement{Daemon: "mgr", Perms: "rw", Purpose: "NFS exports"})
+	}
+
+	return reqs
+}
+
+// checkProvisionCaps fails with PermissionDenied if the admin credentials
+// lack caps required to provision the volume. The canary, run if the
+// credentials may not read their own caps, is an auth get-or-create of the
+// admin entity, which requires the mon caps of creating ceph users and
+// doesn't change an existing entity.
+func checkProvisionCaps(ctx context.Context, checker *util.CapsChecker, volOptions *volumeOptions, adminCr *credentials) error {
+	opClass := util.OpClassProvision
+	if volOptions.ExportNFS {
+		opClass += "-nfs"
+	}
+
+	authGet := func() (map[string]string, error) {
+		ent, err := getSingleCephEntity(ctx, adminCephArgs(volOptions, adminCr, "auth", "get", cephEntityClientPrefix+adminCr.id)...)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]string{"mon": ent.Caps.Mon, "mds": ent.Caps.Mds, "osd": ent.Caps.Osd, "mgr": ent.Caps.Mgr}, nil
+	}
+
+	canary := func() error {
+		_, err := getSingleCephEntity(ctx, adminCephArgs(volOptions, adminCr, "auth", "get-or-create", cephEntityClientPrefix+adminCr.id)...)
+		return err
+	}
+
+	return checker.Check(util.CapsCheckKey(volOptions.Monitors, adminCr.id, adminCr.key, opClass), provisionCapRequirements(volOptions), authGet, canary)
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package cephfs
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -29,6 +30,7 @@ type cephEntityCaps struct {
 	Mds string `json:"mds"`
 	Mon string `json:"mon"`
 	Osd string `json:"osd"`
+	Mgr string `json:"mgr,omitempty"`
 }
 
 type cephEntity struct {
@@ -48,9 +50,9 @@ func getCephUserName(volID volumeID) string {
 	return cephUserPrefix + string(volID)
 }
 
-func getSingleCephEntity(args ...string) (*cephEntity, error) {
+func getSingleCephEntity(ctx context.Context, args ...string) (*cephEntity, error) {
 	var ents []cephEntity
-	if err := execCommandJSON(&ents, "ceph", args...); err != nil {
+	if err := execCommandJSON(ctx, &ents, "ceph", args...); err != nil {
 		return nil, err
 	}
 
@@ -65,10 +67,10 @@ func genUserIDs(adminCr *credentials, volID volumeID) (adminID, userID string) {
 	return cephEntityClientPrefix + adminCr.id, cephEntityClientPrefix + getCephUserName(volID)
 }
 
-func getCephUser(volOptions *volumeOptions, adminCr *credentials, volID volumeID) (*cephEntity, error) {
+func getCephUser(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID) (*cephEntity, error) {
 	adminID, userID := genUserIDs(adminCr, volID)
 
-	return getSingleCephEntity(
+	return getSingleCephEntity(ctx,
 		"-m", volOptions.Monitors,
 		"-n", adminID,
 		"--key="+adminCr.key,
@@ -78,10 +80,10 @@ func getCephUser(volOptions *volumeOptions, adminCr *credentials, volID volumeID
 	)
 }
 
-func createCephUser(volOptions *volumeOptions, adminCr *credentials, volID volumeID) (*cephEntity, error) {
+func createCephUser(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID) (*cephEntity, error) {
 	adminID, userID := genUserIDs(adminCr, volID)
 
-	return getSingleCephEntity(
+	return getSingleCephEntity(ctx,
 		"-m", volOptions.Monitors,
 		"-n", adminID,
 		"--key="+adminCr.key,
@@ -95,10 +97,10 @@ func createCephUser(volOptions *volumeOptions, adminCr *credentials, volID volum
 	)
 }
 
-func deleteCephUser(volOptions *volumeOptions, adminCr *credentials, volID volumeID) error {
+func deleteCephUser(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID) error {
 	adminID, userID := genUserIDs(adminCr, volID)
 
-	return execCommandErr("ceph",
+	return execCommandErr(ctx, "ceph",
 		"-m", volOptions.Monitors,
 		"-n", adminID,
 		"--key="+adminCr.key,
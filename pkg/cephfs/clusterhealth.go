@@ -0,0 +1,32 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+)
+
+// checkClusterNotFull fails with ResourceExhausted if the cluster of the
+// volume reached its full ratio, creating the volume would hang otherwise
+func checkClusterNotFull(ctx context.Context, checker *util.ClusterHealthChecker, volOptions *volumeOptions, adminCr *credentials) error {
+	return checker.CheckNotFull(volOptions.Monitors, func() ([]byte, error) {
+		stdout, _, err := execCommand(ctx, "ceph", adminCephArgs(volOptions, adminCr, "health")...)
+		return stdout, err
+	})
+}
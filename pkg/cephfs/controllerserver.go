@@ -17,6 +17,11 @@ limitations under the License.
 package cephfs
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
 	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/ceph/ceph-csi/pkg/util"
 
@@ -25,7 +30,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
-	"k8s.io/kubernetes/pkg/util/keymutex"
 )
 
 // ControllerServer struct of CEPH CSI driver with supported methods of CSI
@@ -33,15 +37,78 @@ import (
 type ControllerServer struct {
 	*csicommon.DefaultControllerServer
 	MetadataStore util.CachePersister
+	timeouts      util.OperationTimeouts
+	// attachments is nil unless attachment tracking is enabled
+	attachments *csicommon.AttachmentTracker
+	// operations answers DeleteVolume retries while the volume is purged
+	operations *util.OperationTracker
+	// poolCapacity is nil unless oversized volumes are rejected
+	poolCapacity *poolCapacityChecker
+	// filesystems is nil unless the filesystems of volumes are validated
+	filesystems *filesystemResolver
+	// pools is nil unless the data pools of volumes are validated
+	pools *poolValidator
+	// backendMetadata maps the parameters set as extended attributes of the
+	// directories of new volumes
+	backendMetadata util.BackendMetadataMapping
+	// caps is nil unless the caps of the credentials are checked
+	caps *util.CapsChecker
+	// health is nil unless operations on full clusters are rejected
+	health *util.ClusterHealthChecker
+	// clusters holds the credentials GetCapacity runs with, it's nil unless
+	// cluster configurations are set up
+	clusters *util.ConfigStore
+	// policy is nil unless new volumes are reviewed by a policy webhook
+	policy *csicommon.PolicyWebhook
 }
 
 type controllerCacheEntry struct {
 	VolOptions volumeOptions
 	VolumeID   volumeID
+	// Imported is set for volumes adopted by the driver that were not
+	// created by it, their names don't need to carry volumeIDPrefix
+	Imported bool `json:"imported,omitempty"`
+	// NFSExport is the pseudo path of the NFS export of the volume, it's
+	// cleared once the export is removed
+	NFSExport string `json:"nfsExport,omitempty"`
+	// ClusterFSID is the FSID of the cluster the volume was created on, it
+	// is verified before the volume is purged
+	ClusterFSID string `json:"clusterFSID,omitempty"`
+	// Capacity is the size of the volume when it was created, the quota of
+	// provisioned volumes
+	Capacity int64 `json:"capacity,omitempty"`
+	// Deleting is set once DeleteVolume starts removing the volume, a
+	// volume of the same name can't be created until the removal completes
+	Deleting bool `json:"deleting,omitempty"`
+	// Creating is set before CreateVolume creates the directory of the
+	// volume and cleared once it succeeded, retries reuse the directory
+	// left over by a failed call instead of taking it for a collision
+	Creating bool `json:"creating,omitempty"`
+	// PolicyParameters are the parameters the policy webhook overrode when
+	// the volume was created, retries reuse them instead of calling it again
+	PolicyParameters map[string]string `json:"policyParameters,omitempty"`
+}
+
+// checkPurgeAllowed refuses to purge volumes whose cache entry doesn't look
+// like one of ours, a corrupted entry must not lead to deleting user data
+func checkPurgeAllowed(volID volumeID, ce *controllerCacheEntry) error {
+	if ce.Imported {
+		return nil
+	}
+
+	if ce.VolumeID != volID {
+		return fmt.Errorf("metadata for volume %s records a different volume %s", volID, ce.VolumeID)
+	}
+
+	if !strings.HasPrefix(string(volID), volumeIDPrefix) {
+		return fmt.Errorf("volume %s is missing the %s prefix", volID, volumeIDPrefix)
+	}
+
+	return nil
 }
 
 var (
-	mtxControllerVolumeID = keymutex.NewHashed(0)
+	mtxControllerVolumeID = csicommon.NewKeyMutex("controllerVolumeID")
 )
 
 // CreateVolume creates the volume in backend and store the volume metadata
@@ -51,8 +118,58 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, err
 	}
 
+	// the backend paths and the ceph user are derived from the volume ID, a
+	// PVC name suffix is part of it
+	volName := req.GetName()
+	suffix, err := util.BackendNameSuffix(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if suffix != "" {
+		volName += "-" + suffix
+	}
+	volID := makeVolumeID(volName)
+
+	ctx, timer := util.WithPhaseTimer(ctx)
+	defer timer.LogIfSlow("CreateVolume", req.GetName())
+
+	endPhase := util.StartPhase(ctx, "lock")
+	mtxControllerVolumeID.LockKey(string(volID))
+	endPhase()
+	defer mustUnlock(mtxControllerVolumeID, string(volID))
+
+	endPhase = util.StartPhase(ctx, "checkName")
+	recorded, err := cs.checkVolumeName(volID)
+	endPhase()
+	if err != nil {
+		klog.Errorf("can't create volume %s: %v", req.GetName(), err)
+		return nil, err
+	}
+
+	// retries reuse the decision of the webhook for the recorded volume
+	var overrides map[string]string
+	if recorded != nil {
+		overrides = recorded.PolicyParameters
+	} else {
+		endPhase = util.StartPhase(ctx, "reviewPolicy")
+		overrides, err = cs.policy.Review(ctx, req)
+		endPhase()
+		if err != nil {
+			klog.Errorf("can't create volume %s: %v", req.GetName(), err)
+			return nil, err
+		}
+	}
+	req = csicommon.OverrideParameters(req, overrides)
+	if reviewed, _ := util.BackendNameSuffix(req.GetParameters()); reviewed != suffix {
+		return nil, status.Errorf(codes.InvalidArgument, "the policy webhook can't change the backend name of volume %s", req.GetName())
+	}
+
 	// Configuration
 
+	if err = volumeParameters.Validate(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	secret := req.GetSecrets()
 	volOptions, err := newVolumeOptions(req.GetParameters(), secret)
 	if err != nil {
@@ -60,13 +177,56 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	volID := makeVolumeID(req.GetName())
+	metadata, err := cs.backendMetadata.Metadata(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	mtxControllerVolumeID.LockKey(string(volID))
-	defer mustUnlock(mtxControllerVolumeID, string(volID))
+	endPhase = util.StartPhase(ctx, "resolveFs")
+	err = cs.filesystems.resolve(ctx, volOptions, secret)
+	endPhase()
+	if err != nil {
+		klog.Errorf("invalid filesystem for volume %s: %v", req.GetName(), err)
+		return nil, err
+	}
+
+	if recorded != nil {
+		// the StorageClass may have been changed since the volume was
+		// created by a previous call
+		if err = checkRecordedOptions(&recorded.VolOptions, volOptions); err != nil {
+			klog.Errorf("volume %s already exists with other options: %v", req.GetName(), err)
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with other options: %v", req.GetName(), err)
+		}
+	}
 
 	// Create a volume in case the user didn't provide one
 
+	// statically provisioned volumes have the size they were first
+	// requested with, provisioned volumes the size of their quota. Without
+	// a required size the limit is the quota, volumes are unlimited by
+	// default.
+	requested := csicommon.CapacityToProvision(req.GetCapacityRange(), 0)
+	capacity := requested
+	if recorded != nil && !volOptions.ProvisionVolume && recorded.Capacity > 0 {
+		capacity = recorded.Capacity
+		if err = csicommon.CheckExistingCapacity(req.GetCapacityRange(), req.GetName(), capacity); err != nil {
+			return nil, err
+		}
+	}
+	nfsExport := ""
+	clusterFSID := ""
+	// the metadata recorded while the volume is created, if any
+	var creating *controllerCacheEntry
+
+	// what this request created is removed again, in reverse order, if it
+	// fails later on
+	cleanup := util.NewCleanupStack("CreateVolume " + req.GetName())
+	defer func() {
+		cleanupCtx, cancel := cs.timeouts.WithTimeout(util.Detach(ctx), util.OpPurgeVolume)
+		defer cancel()
+		cleanup.Run(cleanupCtx)
+	}()
+
 	if volOptions.ProvisionVolume {
 		// Admin credentials are required
 		cr, err := getAdminCredentials(secret)
@@ -74,36 +234,250 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 
-		if err = createVolume(volOptions, cr, volID, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+		createCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpCreateVolume)
+		defer cancel()
+
+		endPhase = util.StartPhase(createCtx, "checkCaps")
+		err = checkProvisionCaps(createCtx, cs.caps, volOptions, cr)
+		endPhase()
+		if err != nil {
+			klog.Errorf("can't provision volume %s: %v", req.GetName(), err)
+			return nil, err
+		}
+
+		// retries find the volume created already
+		if recorded == nil || recorded.Creating {
+			endPhase = util.StartPhase(createCtx, "checkClusterFull")
+			err = checkClusterNotFull(createCtx, cs.health, volOptions, cr)
+			endPhase()
+			if err != nil {
+				klog.Errorf("can't provision volume %s: %v", req.GetName(), err)
+				return nil, err
+			}
+		}
+
+		// a typo in the pool would only fail setting the layout otherwise
+		endPhase = util.StartPhase(createCtx, "checkPool")
+		err = cs.pools.check(createCtx, volOptions, cr, req.GetParameters()["clusterID"])
+		endPhase()
+		if err != nil {
+			klog.Errorf("invalid pool for volume %s: %v", req.GetName(), err)
+			return nil, err
+		}
+
+		// volumes without a recorded FSID are purged without verifying their
+		// cluster, this doesn't fail the volume
+		endPhase = util.StartPhase(createCtx, "getFSID")
+		clusterFSID, err = getClusterFSID(createCtx, volOptions, cr)
+		endPhase()
+		if err != nil {
+			klog.Warningf("not recording the cluster fsid of volume %s: %v", req.GetName(), err)
+		}
+
+		if volOptions.ExportNFS {
+			endPhase = util.StartPhase(createCtx, "checkNFS")
+			err = checkNFSSupported(createCtx, volOptions, cr)
+			endPhase()
+			if err != nil {
+				klog.Errorf("can't export volume %s over NFS: %v", req.GetName(), err)
+				if _, ok := err.(*nfsNotSupported); ok {
+					return nil, status.Error(codes.FailedPrecondition, err.Error())
+				}
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		endPhase = util.StartPhase(createCtx, "checkPoolCapacity")
+		err = cs.poolCapacity.check(createCtx, volOptions, cr, requested)
+		endPhase()
+		if err != nil {
+			klog.Errorf("rejecting volume %s: %v", req.GetName(), err)
+			return nil, err
+		}
+
+		if err = util.CheckContext(createCtx, "creating the volume"); err != nil {
+			return nil, err
+		}
+
+		// the volume is recorded as being created before its directory,
+		// a directory which isn't recorded is left over by another volume
+		if recorded == nil {
+			creating = &controllerCacheEntry{VolOptions: *volOptions, VolumeID: volID, ClusterFSID: clusterFSID,
+				Capacity: requested, PolicyParameters: overrides, Creating: true}
+			endPhase = util.StartPhase(createCtx, "recordCreating")
+			err = cs.MetadataStore.Create(string(volID), creating)
+			endPhase()
+			if err != nil {
+				klog.Errorf("failed to store a cache entry for volume %s: %v", volID, err)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		} else if recorded.Creating {
+			creating = recorded
+		}
+
+		// a volume which couldn't be purged keeps its metadata, so that
+		// retries reuse it
+		volumeLeft := false
+		if creating != nil {
+			cleanup.Push("metadata of volume "+string(volID), func(ctx context.Context) error {
+				if volumeLeft {
+					klog.Warningf("cephfs: keeping the metadata of volume %s, it wasn't purged", volID)
+					return nil
+				}
+				return cs.MetadataStore.Delete(string(volID))
+			})
+		}
+
+		endPhase = util.StartPhase(createCtx, "createVolume")
+		var created bool
+		capacity, created, err = createVolume(createCtx, volOptions, cr, volID, recorded != nil, requested, metadata)
+		endPhase()
+		// the directory left over by a failed call belongs to this one
+		created = created || recorded != nil && recorded.Creating
+		if created {
+			// the ceph user and the NFS export are derived from the volume
+			// ID, they belong to the volume created by this request too
+			cleanup.Push("volume "+string(volID), func(ctx context.Context) error {
+				err := purgeVolume(ctx, volID, cr, volOptions)
+				volumeLeft = err != nil
+				return err
+			})
+		}
+		if err != nil {
 			klog.Errorf("failed to create volume %s: %v", req.GetName(), err)
+			if _, ok := err.(*volumeNameCollision); ok {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 
-		if _, err = createCephUser(volOptions, cr, volID); err != nil {
+		// the volume may exist already, with another size or without quota
+		if capacity == 0 && req.GetCapacityRange() != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists without quota", req.GetName())
+		}
+		if err = csicommon.CheckExistingCapacity(req.GetCapacityRange(), req.GetName(), capacity); err != nil {
+			return nil, err
+		}
+
+		if err = util.CheckContext(createCtx, "creating the ceph user"); err != nil {
+			return nil, err
+		}
+
+		endPhase = util.StartPhase(createCtx, "createCephUser")
+		_, err = createCephUser(createCtx, volOptions, cr, volID)
+		endPhase()
+		if created {
+			cleanup.Push("ceph user of "+string(volID), func(ctx context.Context) error {
+				return deleteCephUser(ctx, volOptions, cr, volID)
+			})
+		}
+		if err != nil {
 			klog.Errorf("failed to create ceph user for volume %s: %v", req.GetName(), err)
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 
+		if volOptions.ExportNFS {
+			if err = util.CheckContext(createCtx, "creating the NFS export"); err != nil {
+				return nil, err
+			}
+
+			endPhase = util.StartPhase(createCtx, "createNFSExport")
+			nfsExport, err = createNFSExport(createCtx, volOptions, cr, volID)
+			endPhase()
+			if err != nil {
+				klog.Errorf("failed to create NFS export for volume %s: %v", req.GetName(), err)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if created {
+				export := nfsExport
+				cleanup.Push("NFS export "+export, func(ctx context.Context) error {
+					return deleteNFSExport(ctx, volOptions, cr, export)
+				})
+			}
+		}
+
 		klog.Infof("cephfs: successfully created volume %s", volID)
 	} else {
 		klog.Infof("cephfs: volume %s is provisioned statically", volID)
 	}
 
-	ce := &controllerCacheEntry{VolOptions: *volOptions, VolumeID: volID}
-	if err := cs.MetadataStore.Create(string(volID), ce); err != nil {
+	ce := &controllerCacheEntry{VolOptions: *volOptions, VolumeID: volID, NFSExport: nfsExport, ClusterFSID: clusterFSID, Capacity: capacity, PolicyParameters: overrides}
+	endPhase = util.StartPhase(ctx, "storeMetadata")
+	if creating != nil {
+		err = cs.MetadataStore.Update(string(volID), ce)
+	} else {
+		err = cs.MetadataStore.Create(string(volID), ce)
+	}
+	endPhase()
+	if err != nil {
 		klog.Errorf("failed to store a cache entry for volume %s: %v", volID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	cleanup.Done()
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      string(volID),
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			VolumeContext: req.GetParameters(),
+			CapacityBytes: capacity,
+			VolumeContext: volumeContext(req.GetParameters(), volOptions, volID, nfsExport),
 		},
 	}, nil
 }
 
+// checkVolumeName returns the metadata of the volume of the ID, if it's
+// recorded, in which case CreateVolume is retried and may reuse it. It fails
+// if the recorded volume is being deleted, the new volume would get the
+// backend directory and ceph user of the old one.
+func (cs *ControllerServer) checkVolumeName(volID volumeID) (*controllerCacheEntry, error) {
+	ce := &controllerCacheEntry{}
+	if err := cs.MetadataStore.Get(string(volID), ce); err != nil {
+		if _, ok := err.(*util.CacheEntryNotFound); ok {
+			return nil, nil
+		}
+
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if ce.Deleting {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s of the same name is being deleted, "+
+			"it can only be created again once DeleteVolume of the old volume succeeded", volID)
+	}
+
+	return ce, nil
+}
+
+// volumeContext returns the parameters of the volume, with the filesystem
+// name instead of the fsID it was resolved from, so that nodes don't need to
+// resolve it again, the CephFS path of provisioned volumes, and the pseudo
+// path of its NFS export, if any
+func volumeContext(parameters map[string]string, volOptions *volumeOptions, volID volumeID, nfsExport string) map[string]string {
+	_, hasFsID := parameters["fsID"]
+	if !hasFsID && !volOptions.ProvisionVolume && nfsExport == "" {
+		return parameters
+	}
+
+	volContext := make(map[string]string, len(parameters)+1)
+	for k, v := range parameters {
+		volContext[k] = v
+	}
+	if hasFsID {
+		delete(volContext, "fsID")
+		volContext["fsName"] = volOptions.FsName
+	}
+	if volOptions.ProvisionVolume {
+		volContext[volumePathKey] = getVolumeRootPathCeph(volID)
+	}
+	if nfsExport != "" {
+		volContext[nfsExportPathKey] = nfsExport
+	}
+
+	return volContext
+}
+
 // DeleteVolume deletes the volume in backend
 // and removes the volume metadata from store
 // nolint: gocyclo
@@ -118,13 +492,26 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		secrets = req.GetSecrets()
 	)
 
+	// the CO retries every few seconds while a large volume is purged, the
+	// result of a finished purge is collected below
+	if state, ok := cs.operations.Get(string(volID)); ok {
+		if purgeRunning(volID) {
+			return nil, status.Error(codes.Aborted, state)
+		}
+		cs.operations.Forget(string(volID))
+	}
+
 	ce := &controllerCacheEntry{}
 	if err := cs.MetadataStore.Get(string(volID), ce); err != nil {
 		if err, ok := err.(*util.CacheEntryNotFound); ok {
-			klog.Infof("cephfs: metadata for volume %s not found, assuming the volume to be already deleted (%v)", volID, err)
+			util.LogBenign("cephfs: metadata for volume %s not found, assuming the volume to be already deleted (%v)", volID, err)
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -135,10 +522,20 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
+	if err := checkPurgeAllowed(volID, ce); err != nil {
+		klog.Errorf("refusing to delete volume %s: %v", volID, err)
+		return nil, status.Errorf(codes.FailedPrecondition, "refusing to delete volume, it has to be cleaned up manually: %v", err)
+	}
+
 	// mons may have changed since create volume,
 	// retrieve the latest mons and override old mons
 	if mon, secretsErr := getMonValFromSecret(secrets); secretsErr == nil && len(mon) > 0 {
-		klog.Infof("overriding monitors [%q] with [%q] for volume %s", ce.VolOptions.Monitors, mon, volID)
+		if mon, secretsErr = util.NormalizeMonitors(mon); secretsErr != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid monitors in secret: %v", secretsErr)
+		}
+		if stored, normErr := util.NormalizeMonitors(ce.VolOptions.Monitors); normErr != nil || stored != mon {
+			klog.Infof("overriding monitors [%q] with [%q] for volume %s", ce.VolOptions.Monitors, mon, volID)
+		}
 		ce.VolOptions.Monitors = mon
 	}
 
@@ -153,12 +550,62 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	mtxControllerVolumeID.LockKey(string(volID))
 	defer mustUnlock(mtxControllerVolumeID, string(volID))
 
-	if err = purgeVolume(volID, cr, &ce.VolOptions); err != nil {
+	purgeCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpPurgeVolume)
+	defer cancel()
+
+	if err = util.CheckContext(purgeCtx, "purging the volume"); err != nil {
+		return nil, err
+	}
+
+	if err = checkVolumeCluster(purgeCtx, volID, ce, cr); err != nil {
+		return nil, err
+	}
+
+	// a volume of the same name must not reuse what's left of this one if
+	// the removal doesn't complete
+	if !ce.Deleting {
+		ce.Deleting = true
+		if err = cs.MetadataStore.Update(string(volID), ce); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// the export is removed first, NFS clients must not see the volume
+	// being purged
+	if ce.NFSExport != "" {
+		if err = deleteNFSExport(purgeCtx, &ce.VolOptions, cr, ce.NFSExport); err != nil {
+			klog.Errorf("failed to delete NFS export %s of volume %s: %v", ce.NFSExport, volID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		ce.NFSExport = ""
+		if err = cs.MetadataStore.Update(string(volID), ce); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = purgeVolume(purgeCtx, volID, cr, &ce.VolOptions)
+	if _, ok := err.(*purgeInProgress); ok {
+		// the metadata is kept until the volume is gone, a retry collects
+		// the purge
+		cs.operations.Set(string(volID), err.Error())
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	cs.operations.Forget(string(volID))
+
+	if err != nil {
 		klog.Errorf("failed to delete volume %s: %v", volID, err)
+		if _, ok := err.(*volumesRootNotFound); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if err = deleteCephUser(&ce.VolOptions, cr, volID); err != nil {
+	if err = util.CheckContext(purgeCtx, "deleting the ceph user"); err != nil {
+		return nil, err
+	}
+
+	if err = deleteCephUser(purgeCtx, &ce.VolOptions, cr, volID); err != nil {
 		klog.Errorf("failed to delete ceph user for volume %s: %v", volID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -172,20 +619,225 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-// ValidateVolumeCapabilities checks whether the volume capabilities requested
-// are supported.
+// ListVolumes lists the volumes in the metadata store, sorted by ID, with
+// the capacity they were created with. The starting token is the index of
+// the first volume to return.
+func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		klog.Warningf("invalid list volumes req: %v", req)
+		return nil, err
+	}
+
+	var start int
+	if token := req.GetStartingToken(); token != "" {
+		i, err := strconv.ParseUint(token, 10, 32)
+		if err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %s: %v", token, err)
+		}
+		start = int(i)
+	}
+
+	var volumes []*csi.Volume
+	ce := &controllerCacheEntry{}
+	err := cs.MetadataStore.ForAll("^"+volumeIDPrefix, ce, func(identifier string) error {
+		// volumes being created weren't returned by CreateVolume yet
+		if !ce.Creating {
+			volumes = append(volumes, &csi.Volume{VolumeId: identifier, CapacityBytes: ce.Capacity})
+		}
+		*ce = controllerCacheEntry{}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if start > len(volumes) {
+		return nil, status.Errorf(codes.Aborted, "invalid starting token %d, only %d volumes left", start, len(volumes))
+	}
+
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].VolumeId < volumes[j].VolumeId })
+
+	end := len(volumes)
+	resp := &csi.ListVolumesResponse{}
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+		resp.NextToken = strconv.Itoa(end)
+	}
+
+	for _, vol := range volumes[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{Volume: vol})
+	}
+
+	return resp, nil
+}
+
+// GetCapacity returns the space available in the data pool of the
+// StorageClass parameters. The request carries no secrets, the monitors and
+// credentials are the ones of the cluster configuration of the clusterID
+// parameter.
+func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		klog.Warningf("invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	params := req.GetParameters()
+	if params["clusterID"] == "" || params["pool"] == "" {
+		return nil, status.Error(codes.InvalidArgument, "GetCapacity requires the clusterID and pool parameters")
+	}
+
+	volOptions, cr, err := cs.capacityOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	capacityCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpCreateVolume)
+	defer cancel()
+
+	if err = cs.filesystems.resolveWithCredentials(capacityCtx, volOptions, cr); err != nil {
+		return nil, err
+	}
+
+	maxAvail, err := queryPoolMaxAvail(capacityCtx, volOptions, cr)
+	if err != nil {
+		if _, ok := err.(*poolNotFound); ok {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if volOptions.FsName != "" {
+		var found bool
+		if found, err = isDataPool(capacityCtx, volOptions, cr); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !found {
+			return nil, status.Errorf(codes.InvalidArgument, "pool %s is not a data pool of filesystem %s", volOptions.Pool, volOptions.FsName)
+		}
+	}
+
+	return &csi.GetCapacityResponse{AvailableCapacity: maxAvail}, nil
+}
+
+// capacityOptions returns the volume options and the credentials of the
+// provisioning in the cluster configuration of the parameters
+func (cs *ControllerServer) capacityOptions(params map[string]string) (*volumeOptions, *credentials, error) {
+	clusterID := params["clusterID"]
+
+	mons, err := cs.clusters.Mons(clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	adminID, err := cs.clusters.AdminID(clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &credentials{id: cs.clusters.IDForOperation(clusterID, util.OpClassProvision, adminID)}
+	if cr.key, err = cs.clusters.KeyForUser(clusterID, cr.id); err != nil {
+		return nil, nil, err
+	}
+
+	volOptions := &volumeOptions{
+		Monitors:        mons,
+		Pool:            params["pool"],
+		FsName:          params["fsName"],
+		FsID:            params["fsID"],
+		ProvisionVolume: true,
+	}
+	if err = volOptions.validateFs(); err != nil {
+		return nil, nil, err
+	}
+
+	return volOptions, cr, nil
+}
+
+// ControllerPublishVolume records the attachment of the volume to the node,
+// when attachment tracking is enabled
+func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if cs.attachments == nil {
+		return cs.DefaultControllerServer.ControllerPublishVolume(ctx, req)
+	}
+
+	return cs.attachments.ControllerPublishVolume(ctx, req)
+}
+
+// ControllerUnpublishVolume removes the record of the volume being attached to
+// the node, when attachment tracking is enabled
+func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if cs.attachments == nil {
+		return cs.DefaultControllerServer.ControllerUnpublishVolume(ctx, req)
+	}
+
+	return cs.attachments.ControllerUnpublishVolume(ctx, req)
+}
+
+// access modes of the mount volumes ValidateVolumeCapabilities confirms
+var validatedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER: true,
+}
+
+// ValidateVolumeCapabilities confirms the capabilities of a volume recorded in
+// the metadata store if all of them are supported, otherwise the message of
+// the response names the first unsupported one.
 func (cs *ControllerServer) ValidateVolumeCapabilities(
 	ctx context.Context,
 	req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	// Cephfs doesn't support Block volume
-	for _, cap := range req.VolumeCapabilities {
-		if cap.GetBlock() != nil {
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: ""}, nil
+	volID := volumeID(req.GetVolumeId())
+	if volID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
+	}
+
+	ce := &controllerCacheEntry{}
+	if err := cs.MetadataStore.Get(string(volID), ce); err != nil {
+		if _, ok := err.(*util.CacheEntryNotFound); ok {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volID)
 		}
+
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, status.Error(codes.Internal, err.Error())
 	}
+
+	for _, cap := range req.GetVolumeCapabilities() {
+		if msg := validateVolumeCapability(cap); msg != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+		}
+	}
+
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: req.VolumeCapabilities,
+			VolumeCapabilities: req.GetVolumeCapabilities(),
 		},
 	}, nil
 }
+
+// validateVolumeCapability returns why the capability isn't supported, or an
+// empty string if it is. CephFS is mounted as is, the fs type can only be the
+// one of the kernel client.
+func validateVolumeCapability(cap *csi.VolumeCapability) string {
+	mount := cap.GetMount()
+	if mount == nil {
+		if cap.GetBlock() != nil {
+			return "block volumes are not supported"
+		}
+		return "volume capability without access type"
+	}
+
+	if fsType := mount.GetFsType(); fsType != "" && fsType != "ceph" {
+		return fmt.Sprintf("fs type %s is not supported, CephFS volumes are mounted as ceph", fsType)
+	}
+
+	if mode := cap.GetAccessMode().GetMode(); !validatedAccessModes[mode] {
+		return fmt.Sprintf("access mode %s is not supported", mode)
+	}
+
+	return ""
+}
@@ -0,0 +1,515 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain fails the tests of the package if locks are still held once they
+// ran, i.e. some RPC returned without releasing them
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if held := csicommon.HeldLocks(); len(held) > 0 {
+		fmt.Fprintf(os.Stderr, "FAIL: locks still held after the tests: %v\n", held)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// auditLocks runs the call of the RPC method, failing the test if it returns
+// holding locks
+func auditLocks(t *testing.T, method string, call func()) {
+	t.Helper()
+	if err := csicommon.AuditLocks(method, call); err != nil {
+		t.Errorf("Failed: %v", err)
+	}
+}
+
+func TestCheckPurgeAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		volID   volumeID
+		ce      controllerCacheEntry
+		allowed bool
+	}{
+		{"csi volume", "csi-cephfs-pvc-1", controllerCacheEntry{VolumeID: "csi-cephfs-pvc-1"}, true},
+		{"mismatching entry", "csi-cephfs-pvc-1", controllerCacheEntry{VolumeID: "data"}, false},
+		{"missing prefix", "data", controllerCacheEntry{VolumeID: "data"}, false},
+		{"imported volume", "data", controllerCacheEntry{VolumeID: "data", Imported: true}, true},
+	}
+
+	for _, tt := range tests {
+		err := checkPurgeAllowed(tt.volID, &tt.ce)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: checkPurgeAllowed() = %v, expected allowed=%v", tt.name, err, tt.allowed)
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-list")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	for i, name := range []string{"c", "a", "b"} {
+		volID := makeVolumeID(name)
+		ce := &controllerCacheEntry{VolumeID: volID, Capacity: int64(i+1) << 30}
+		if err = store.Create(string(volID), ce); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+	// other entries in the store aren't volumes
+	if err = store.Create(util.AttachmentPrefix+"x", &csicommon.VolumeAttachment{}); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	// volumes being created aren't listed yet
+	if err = store.Create(string(makeVolumeID("d")), &controllerCacheEntry{VolumeID: makeVolumeID("d"), Creating: true}); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	})
+	cs := NewControllerServer(d, store, nil, false)
+
+	// TEST: the volumes are paged in the order of their IDs
+	var (
+		ids   []string
+		token string
+		pages int
+	)
+	for pages = 1; ; pages++ {
+		resp, listErr := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if listErr != nil {
+			t.Fatalf("Failed: want (nil), got (%v)", listErr)
+		}
+		for _, e := range resp.GetEntries() {
+			ids = append(ids, e.GetVolume().GetVolumeId())
+		}
+		if token = resp.GetNextToken(); token == "" {
+			break
+		}
+	}
+
+	want := []string{"csi-cephfs-a", "csi-cephfs-b", "csi-cephfs-c"}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] || ids[2] != want[2] || pages != 2 {
+		t.Errorf("Failed: want (%v) in 2 pages, got (%v) in %d pages", want, ids, pages)
+	}
+
+	// TEST: the capacity is the one the volume was created with
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil || len(resp.GetEntries()) != 3 || resp.GetEntries()[0].GetVolume().GetCapacityBytes() != 2<<30 {
+		t.Errorf("Failed: want 3 volumes with (%d) bytes first, got (%v) error (%v)", 2<<30, resp, err)
+	}
+
+	// TEST: tokens past the end are rejected
+	if _, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "4"}); status.Code(err) != codes.Aborted {
+		t.Errorf("Failed: want (%v), got (%v)", codes.Aborted, err)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	_, cleanup := fakeCeph(t, `case "$*" in
+*df*) echo '{"pools":[{"name":"cephfs_data","stats":{"max_avail":1000}},{"name":"fast_data","stats":{"max_avail":5000}}]}' ;;
+*"fs ls"*) echo '[{"name":"cephfs","data_pools":["cephfs_data"]},{"name":"fast","data_pools":["fast_data"]}]' ;;
+esac`)
+	defer cleanup()
+
+	configRoot, err := ioutil.TempDir("", "cephfs-capacity")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(configRoot)
+
+	clusterDir := filepath.Join(configRoot, "ceph-cluster-cluster1")
+	if err = os.Mkdir(clusterDir, 0700); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	for key, value := range map[string]string{"monitors": "mon1", "adminid": "admin", "adminkey": "key"} {
+		if err = ioutil.WriteFile(filepath.Join(clusterDir, key), []byte(value), 0600); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	})
+	cs := NewControllerServer(d, nil, nil, false)
+	cs.clusters = &util.ConfigStore{StoreReader: &util.FileConfig{BasePath: configRoot}}
+
+	tests := []struct {
+		name         string
+		params       map[string]string
+		wantCode     codes.Code
+		wantCapacity int64
+	}{
+		{"default filesystem", map[string]string{"clusterID": "cluster1", "pool": "cephfs_data"}, codes.OK, 1000},
+		{"named filesystem", map[string]string{"clusterID": "cluster1", "pool": "fast_data", "fsName": "fast"}, codes.OK, 5000},
+		{"no clusterID", map[string]string{"pool": "cephfs_data"}, codes.InvalidArgument, 0},
+		{"no pool", map[string]string{"clusterID": "cluster1"}, codes.InvalidArgument, 0},
+		{"unknown cluster", map[string]string{"clusterID": "cluster2", "pool": "cephfs_data"}, codes.InvalidArgument, 0},
+		{"missing pool", map[string]string{"clusterID": "cluster1", "pool": "missing"}, codes.InvalidArgument, 0},
+		// TEST: the pool has to be a data pool of the filesystem
+		{"pool of another filesystem", map[string]string{"clusterID": "cluster1", "pool": "cephfs_data", "fsName": "fast"}, codes.InvalidArgument, 0},
+	}
+
+	for _, tt := range tests {
+		resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: tt.params})
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+			continue
+		}
+		if resp.GetAvailableCapacity() != tt.wantCapacity {
+			t.Errorf("%s: Failed: want (%d), got (%d)", tt.name, tt.wantCapacity, resp.GetAvailableCapacity())
+		}
+	}
+}
+
+func TestVolumeNameCollision(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-collision")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pluginFolder, cephFuseBinary, mounters := PluginFolder, CephFuseBinary, availableMounters
+	defer func() { PluginFolder, CephFuseBinary, availableMounters = pluginFolder, cephFuseBinary, mounters }()
+	PluginFolder = tmpDir
+	// mounting the ceph root fails, the purge of DeleteVolume doesn't
+	// complete
+	CephFuseBinary = "false"
+	availableMounters = []string{volumeMounterFuse}
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	volID := makeVolumeID("pvc-1")
+	ce := &controllerCacheEntry{
+		VolOptions: volumeOptions{Monitors: "mon1", Pool: "cephfs_data", Mounter: volumeMounterFuse, ProvisionVolume: true},
+		VolumeID:   volID,
+	}
+	if err = store.Create(string(volID), ce); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, store, nil, false)
+
+	// TEST: a recorded volume may be reused by a retry
+	if recorded, nameErr := cs.checkVolumeName(volID); recorded == nil || nameErr != nil {
+		t.Errorf("Failed: want the recorded volume, got (%v, %v)", recorded, nameErr)
+	}
+	if recorded, nameErr := cs.checkVolumeName(makeVolumeID("pvc-2")); recorded != nil || nameErr != nil {
+		t.Errorf("Failed: want (nil, nil), got (%v, %v)", recorded, nameErr)
+	}
+
+	// TEST: a volume left over by a failed call is recorded as being
+	// created, retries reuse its directory
+	creating := &controllerCacheEntry{VolOptions: ce.VolOptions, VolumeID: makeVolumeID("pvc-3"), Creating: true}
+	if err = store.Create(string(creating.VolumeID), creating); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if recorded, nameErr := cs.checkVolumeName(creating.VolumeID); recorded == nil || !recorded.Creating || nameErr != nil {
+		t.Errorf("Failed: want the volume being created, got (%v, %v)", recorded, nameErr)
+	}
+
+	// TEST: a volume whose deletion didn't complete is never reused
+	secrets := map[string]string{"adminID": "admin", "adminKey": "key"}
+	auditLocks(t, "DeleteVolume", func() {
+		_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: string(volID), Secrets: secrets})
+	})
+	if err == nil {
+		t.Fatalf("Failed: want the purge to fail, got (nil)")
+	}
+	if err = store.Get(string(volID), ce); err != nil || !ce.Deleting {
+		t.Errorf("Failed: want the volume marked as deleting, got (%+v) error (%v)", ce, err)
+	}
+	auditLocks(t, "CreateVolume", func() {
+		_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-1",
+			Parameters:         map[string]string{"monitors": "mon1", "provisionVolume": "true", "pool": "cephfs_data"},
+			Secrets:            secrets,
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}},
+		})
+	})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("Failed: want (%v), got (%v)", codes.FailedPrecondition, err)
+	}
+
+	// TEST: an existing directory which isn't recorded is never reused
+	volRoot := getCephRootVolumePathLocal(makeVolumeID("pvc-2"))
+	if err = os.MkdirAll(volRoot, 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	created, err := createVolumeDirectory(context.Background(), &ce.VolOptions, &credentials{id: "admin", key: "key"}, makeVolumeID("pvc-2"), false, 0, nil)
+	if _, ok := err.(*volumeNameCollision); !ok || created {
+		t.Errorf("Failed: want (false, volumeNameCollision), got (%v, %v)", created, err)
+	}
+	created, err = createVolumeDirectory(context.Background(), &ce.VolOptions, &credentials{id: "admin", key: "key"}, makeVolumeID("pvc-2"), true, 0, nil)
+	if err != nil || created {
+		t.Errorf("Failed: want (false, nil), got (%v, %v)", created, err)
+	}
+}
+
+func TestCreateVolumeExistingStaticSize(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-existing")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	volID := makeVolumeID("pvc-static")
+	ce := &controllerCacheEntry{
+		VolOptions: volumeOptions{Monitors: "mon1", RootPath: "/static", Mounter: volumeMounterFuse},
+		VolumeID:   volID,
+		Capacity:   2 << 30,
+	}
+	if err = store.Create(string(volID), ce); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, store, nil, false)
+
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		wantCode codes.Code
+	}{
+		// TEST: the recorded size is reported, not the requested one
+		{"smaller request", &csi.CapacityRange{RequiredBytes: 1 << 30}, codes.OK},
+		{"larger request", &csi.CapacityRange{RequiredBytes: 3 << 30}, codes.AlreadyExists},
+		{"larger than limit", &csi.CapacityRange{RequiredBytes: 1 << 30, LimitBytes: 1 << 30}, codes.AlreadyExists},
+	}
+
+	for _, tt := range tests {
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-static",
+			CapacityRange:      tt.capRange,
+			Parameters:         map[string]string{"monitors": "mon1", "provisionVolume": "false", "rootPath": "/static", "mounter": volumeMounterFuse},
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}},
+		})
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+			continue
+		}
+		if err == nil && resp.GetVolume().GetCapacityBytes() != 2<<30 {
+			t.Errorf("%s: Failed: want (%d) bytes, got (%d)", tt.name, 2<<30, resp.GetVolume().GetCapacityBytes())
+		}
+	}
+}
+
+func TestCreateVolumePolicyRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-policy")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	calls := 0
+	response := `{"apiVersion":"v1","allowed":true,"parameters":{"rootPath":"/tenant-a"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(response)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, store, nil, false)
+	if cs.policy, err = csicommon.NewPolicyWebhook(server.URL, "cephfs.csi.ceph.com", time.Second, csicommon.PolicyFailClosed); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-policy",
+		Parameters:         map[string]string{"monitors": "mon1", "provisionVolume": "false", "rootPath": "/static", "mounter": volumeMounterFuse},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}},
+	}
+
+	// TEST: new volumes are created with the parameters of the webhook
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+	if root := resp.GetVolume().GetVolumeContext()["rootPath"]; root != "/tenant-a" || calls != 1 {
+		t.Errorf("Failed: want rootPath (/tenant-a) after (1) review, got (%s) after (%d)", root, calls)
+	}
+
+	// TEST: retries reuse the decision, whatever the webhook answers now
+	for _, response = range []string{
+		`{"apiVersion":"v1","allowed":false,"message":"quota exceeded"}`,
+		`{"apiVersion":"v1","allowed":true,"parameters":{"rootPath":"/tenant-b"}}`,
+	} {
+		resp, err = cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+			continue
+		}
+		if root := resp.GetVolume().GetVolumeContext()["rootPath"]; root != "/tenant-a" || calls != 1 {
+			t.Errorf("Failed: want rootPath (/tenant-a) after (1) review, got (%s) after (%d)", root, calls)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-validate")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	volID := makeVolumeID("pvc-validate")
+	ce := &controllerCacheEntry{
+		VolOptions: volumeOptions{Monitors: "mon1", Pool: "cephfs_data", Mounter: volumeMounterFuse, ProvisionVolume: true},
+		VolumeID:   volID,
+	}
+	if err = store.Create(string(volID), ce); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("cephfs.csi.ceph.com", version, "node")
+	cs := NewControllerServer(d, store, nil, false)
+
+	mountCap := func(fsType string, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+
+	tests := []struct {
+		name      string
+		volID     volumeID
+		caps      []*csi.VolumeCapability
+		code      codes.Code
+		confirmed bool
+	}{
+		{"supported", volID, []*csi.VolumeCapability{
+			mountCap("", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			mountCap("ceph", csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			mountCap("", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		}, codes.OK, true},
+		// TEST: a single unsupported capability isn't confirmed
+		{"block", volID, []*csi.VolumeCapability{mountCap("", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), blockCap}, codes.OK, false},
+		{"fs type", volID, []*csi.VolumeCapability{mountCap("ext4", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, codes.OK, false},
+		{"access mode", volID, []*csi.VolumeCapability{mountCap("", csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER)}, codes.OK, false},
+		{"no access type", volID, []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}}, codes.OK, false},
+		// TEST: unknown volumes aren't validated
+		{"unknown volume", makeVolumeID("pvc-unknown"), []*csi.VolumeCapability{mountCap("", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, codes.NotFound, false},
+		{"no capabilities", volID, nil, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           string(tt.volID),
+			VolumeCapabilities: tt.caps,
+		})
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if confirmed := resp.GetConfirmed() != nil; confirmed != tt.confirmed {
+			t.Errorf("%s: Failed: want confirmed (%v), got (%v)", tt.name, tt.confirmed, resp)
+		}
+		if !tt.confirmed && resp.GetMessage() == "" {
+			t.Errorf("%s: Failed: want a message explaining the rejection, got none", tt.name)
+		}
+		if tt.confirmed && len(resp.GetConfirmed().GetVolumeCapabilities()) != len(tt.caps) {
+			t.Errorf("%s: Failed: want (%d) confirmed capabilities, got (%v)", tt.name, len(tt.caps), resp.GetConfirmed())
+		}
+	}
+}
+
+func TestVolumeContextVolumePath(t *testing.T) {
+	params := map[string]string{"provisionVolume": "true", "pool": "cephfs_data"}
+	volContext := volumeContext(params, &volumeOptions{ProvisionVolume: true}, "csi-cephfs-vol", "")
+
+	// TEST: provisioned volumes carry their CephFS path
+	if p := volContext[volumePathKey]; p != "/csi-volumes/csi-cephfs-vol" {
+		t.Errorf("Failed: want (/csi-volumes/csi-cephfs-vol), got (%s)", p)
+	}
+	if getVolumeRootPathFromContext("csi-cephfs-vol", volContext) != volContext[volumePathKey] {
+		t.Errorf("Failed: want nodes to mount the path of the volume context")
+	}
+
+	// TEST: volumes created without it have the path derived from their ID
+	if p := getVolumeRootPathFromContext("csi-cephfs-vol", params); p != "/csi-volumes/csi-cephfs-vol" {
+		t.Errorf("Failed: want (/csi-volumes/csi-cephfs-vol), got (%s)", p)
+	}
+
+	// TEST: static volumes only carry their parameters
+	static := map[string]string{"provisionVolume": "false", "rootPath": "/volumes/a"}
+	if _, ok := volumeContext(static, &volumeOptions{}, "csi-cephfs-vol", "")[volumePathKey]; ok {
+		t.Errorf("Failed: want no %s for static volumes", volumePathKey)
+	}
+}
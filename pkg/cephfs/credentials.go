@@ -16,7 +16,11 @@ limitations under the License.
 
 package cephfs
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+)
 
 const (
 	credUserID   = "userID"
@@ -56,6 +60,21 @@ func getAdminCredentials(secrets map[string]string) (*credentials, error) {
 	return getCredentials(credAdminID, credAdminKey, secrets)
 }
 
+// validateStageSecrets checks that the secrets of NodeStageVolume have the
+// credentials the volume is mounted with: the admin credentials fetching the
+// ceph user of provisioned volumes, the user credentials of static volumes
+func validateStageSecrets(volOptions *volumeOptions, secrets map[string]string) error {
+	idField, keyField := credUserID, credUserKey
+	if volOptions.ProvisionVolume {
+		idField, keyField = credAdminID, credAdminKey
+	}
+
+	if err := util.ValidateSecretID(secrets, idField); err != nil {
+		return err
+	}
+	return util.ValidateSecretKey(secrets, keyField)
+}
+
 func getMonValFromSecret(secrets map[string]string) (string, error) {
 	if mons, ok := secrets[credMonitors]; ok {
 		return mons, nil
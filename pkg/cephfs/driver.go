@@ -17,6 +17,8 @@ limitations under the License.
 package cephfs
 
 import (
+	"time"
+
 	"k8s.io/klog"
 
 	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
@@ -29,6 +31,9 @@ const (
 
 	// version of ceph driver
 	version = "1.0.0"
+
+	// interval of the stale mount checks done by the node plugin
+	staleMountCheckInterval = 30 * time.Second
 )
 
 // PluginFolder defines the location of ceph plugin
@@ -48,6 +53,10 @@ var (
 	DefaultVolumeMounter string
 )
 
+// metadataSchema lists the migrations of the cephfs metadata schema, append
+// new migrations at the end
+var metadataSchema = &util.MetadataSchema{Name: "cephfs"}
+
 // NewDriver returns new ceph driver
 func NewDriver() *Driver {
 	return &Driver{}
@@ -61,24 +70,80 @@ func NewIdentityServer(d *csicommon.CSIDriver) *IdentityServer {
 }
 
 // NewControllerServer initialize a controller server for ceph CSI driver
-func NewControllerServer(d *csicommon.CSIDriver, cachePersister util.CachePersister) *ControllerServer {
-	return &ControllerServer{
+func NewControllerServer(d *csicommon.CSIDriver, cachePersister util.CachePersister, timeouts util.OperationTimeouts, trackAttachments bool) *ControllerServer {
+	cs := &ControllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		MetadataStore:           cachePersister,
+		timeouts:                timeouts,
+		operations:              util.NewOperationTracker(purgeStateValidity, maxTrackedPurges),
+	}
+	if trackAttachments {
+		cs.attachments = &csicommon.AttachmentTracker{MetadataStore: cachePersister}
 	}
+	return cs
 }
 
 // NewNodeServer initialize a node server for ceph CSI driver.
-func NewNodeServer(d *csicommon.CSIDriver) *NodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, timeouts util.OperationTimeouts) *NodeServer {
 	return &NodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		mounter:           newNodeMounter(),
+		timeouts:          timeouts,
+		newVolumeMounter:  newMounter,
 	}
 }
 
+// DriverOptions configures the cephfs driver
+type DriverOptions struct {
+	// DriverName and NodeID identify the driver and the node it runs on
+	DriverName string
+	NodeID     string
+	// Endpoint is the unix:// or tcp:// endpoint the driver serves on
+	Endpoint string
+	// VolumeMounter is the default mounter, the first available one if
+	// empty
+	VolumeMounter string
+	// MountCacheDir is the directory the mounts are recorded in, to
+	// remount them after a restart, the mount cache is off if empty
+	MountCacheDir string
+	// ConfigRoot is the directory of the cluster configurations GetCapacity
+	// reads the credentials from, GetCapacity isn't advertised if empty
+	ConfigRoot string
+	// RecoverSessions reconnects evicted clients and remounts their stale
+	// staging paths
+	RecoverSessions bool
+	// TrackAttachments records the nodes volumes are published to
+	TrackAttachments bool
+	// RejectUnknownParameters fails requests with unknown parameters
+	RejectUnknownParameters bool
+	// RejectOversizedVolumes fails volumes larger than the space available
+	// in their data pool, times OvercommitRatio
+	RejectOversizedVolumes bool
+	OvercommitRatio        float64
+	// SkipFsValidation doesn't check that the filesystem of volumes exists
+	SkipFsValidation bool
+	// BackendMetadata maps the parameters set as extended attributes of
+	// new volume directories
+	BackendMetadata util.BackendMetadataMapping
+	// SkipCapsCheck and SkipFullCheck don't check the caps of the
+	// credentials and the health of the cluster before provisioning
+	// volumes
+	SkipCapsCheck bool
+	SkipFullCheck bool
+	// UpgradeMetadataSchema migrates the metadata store before serving
+	UpgradeMetadataSchema bool
+	// Timeouts of the backend operations
+	Timeouts util.OperationTimeouts
+	// CachePersister is the metadata store
+	CachePersister util.CachePersister
+	// ServerOptions configures the gRPC server
+	ServerOptions csicommon.ServerOptions
+}
+
 // Run start a non-blocking grpc controller,node and identityserver for
 // ceph CSI driver which can serve multiple parallel requests
-func (fs *Driver) Run(driverName, nodeID, endpoint, volumeMounter, mountCacheDir string, cachePersister util.CachePersister) {
-	klog.Infof("Driver: %v version: %v", driverName, version)
+func (fs *Driver) Run(opts DriverOptions) {
+	klog.Infof("Driver: %v version: %v", opts.DriverName, version)
 
 	// Configuration
 
@@ -86,11 +151,13 @@ func (fs *Driver) Run(driverName, nodeID, endpoint, volumeMounter, mountCacheDir
 		klog.Fatalf("cephfs: failed to load ceph mounters: %v", err)
 	}
 
-	if volumeMounter != "" {
-		if err := validateMounter(volumeMounter); err != nil {
+	if opts.VolumeMounter != "" {
+		if err := validateMounter(opts.VolumeMounter); err != nil {
 			klog.Fatalln(err)
+		} else if opts.VolumeMounter == volumeMounterFuse && !isMounterAvailable(opts.VolumeMounter) {
+			klog.Fatalf("cephfs: fuse is the configured default volume mounter, but %s can't be run, set --cephfusepath to its location", CephFuseBinary)
 		} else {
-			DefaultVolumeMounter = volumeMounter
+			DefaultVolumeMounter = opts.VolumeMounter
 		}
 	} else {
 		// Pick the first available mounter as the default one.
@@ -101,27 +168,68 @@ func (fs *Driver) Run(driverName, nodeID, endpoint, volumeMounter, mountCacheDir
 
 	klog.Infof("cephfs: setting default volume mounter to %s", DefaultVolumeMounter)
 
+	if opts.RejectOversizedVolumes && opts.OvercommitRatio <= 0 {
+		klog.Fatalf("cephfs: invalid overcommit ratio %g, expected a positive ratio", opts.OvercommitRatio)
+	}
+
+	sessionRecovery = opts.RecoverSessions
+	volumeParameters.RejectUnknown = opts.RejectUnknownParameters
+	volumeParameters.Recognize(opts.BackendMetadata.Parameters()...)
+
 	if err := writeCephConfig(); err != nil {
 		klog.Fatalf("failed to write ceph configuration file: %v", err)
 	}
 
-	initVolumeMountCache(driverName, mountCacheDir, cachePersister)
-	if mountCacheDir != "" {
-		if err := remountCachedVolumes(); err != nil {
+	// GetCapacity carries no secrets, the credentials are read from the
+	// cluster configurations
+	var clusters *util.ConfigStore
+	if opts.ConfigRoot != "" {
+		var err error
+		if clusters, err = util.NewConfigStore(opts.ConfigRoot); err != nil {
+			klog.Fatalf("failed to set up the cluster configurations: %v", err)
+		}
+	}
+
+	// the metadata is migrated while no RPCs are served, by the leader of
+	// several replicas before it admits RPCs
+	if opts.UpgradeMetadataSchema {
+		upgrade := func() error { return metadataSchema.Upgrade(opts.CachePersister) }
+		if gate := opts.ServerOptions.ControllerGate; gate != nil {
+			gate.BeforeAdmitting(upgrade)
+		} else if err := upgrade(); err != nil {
+			klog.Fatalf("failed to upgrade the metadata schema: %v", err)
+		}
+	}
+
+	initVolumeMountCache(opts.DriverName, opts.MountCacheDir, opts.CachePersister)
+	if opts.MountCacheDir != "" {
+		if err := remountCachedVolumes(opts.Timeouts); err != nil {
 			klog.Warningf("failed to remount cached volumes: %v", err)
 			//ignore remount fail
 		}
+
+		if sessionRecovery {
+			go recoverStaleMounts(staleMountCheckInterval, opts.Timeouts)
+		}
 	}
 	// Initialize default library driver
 
-	fs.cd = csicommon.NewCSIDriver(driverName, version, nodeID)
+	fs.cd = csicommon.NewCSIDriver(opts.DriverName, version, opts.NodeID)
 	if fs.cd == nil {
 		klog.Fatalln("failed to initialize CSI driver")
 	}
 
-	fs.cd.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	csc := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-	})
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	}
+	if opts.TrackAttachments {
+		csc = append(csc, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	}
+	if clusters != nil {
+		csc = append(csc, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	}
+	fs.cd.AddControllerServiceCapabilities(csc)
 
 	fs.cd.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
@@ -130,11 +238,27 @@ func (fs *Driver) Run(driverName, nodeID, endpoint, volumeMounter, mountCacheDir
 	// Create gRPC servers
 
 	fs.is = NewIdentityServer(fs.cd)
-	fs.ns = NewNodeServer(fs.cd)
+	fs.ns = NewNodeServer(fs.cd, opts.Timeouts)
 
-	fs.cs = NewControllerServer(fs.cd, cachePersister)
+	fs.cs = NewControllerServer(fs.cd, opts.CachePersister, opts.Timeouts, opts.TrackAttachments)
+	if opts.RejectOversizedVolumes {
+		fs.cs.poolCapacity = newPoolCapacityChecker(opts.OvercommitRatio)
+	}
+	if !opts.SkipFsValidation {
+		fs.cs.filesystems = newFilesystemResolver()
+	}
+	fs.cs.pools = newPoolValidator()
+	fs.cs.backendMetadata = opts.BackendMetadata
+	if !opts.SkipCapsCheck {
+		fs.cs.caps = util.NewCapsChecker()
+	}
+	if !opts.SkipFullCheck {
+		fs.cs.health = util.NewClusterHealthChecker()
+	}
+	fs.cs.clusters = clusters
+	fs.cs.policy = opts.ServerOptions.PolicyWebhook
 
-	server := csicommon.NewNonBlockingGRPCServer()
-	server.Start(endpoint, fs.is, fs.cs, fs.ns)
+	server := csicommon.NewNonBlockingGRPCServer(opts.ServerOptions)
+	server.Start(opts.Endpoint, fs.is, fs.cs, fs.ns)
 	server.Wait()
 }
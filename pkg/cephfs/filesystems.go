@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the filesystems of a cluster are shared by the CreateVolume calls within
+// filesystemsValidity, so that the validation doesn't cost a ceph fs dump
+// each
+const filesystemsValidity = time.Minute
+
+type filesystemListing struct {
+	// names of the filesystems keyed by their ID
+	names   map[int64]string
+	fetched time.Time
+}
+
+// filesystemResolver validates the filesystem of volumes against the
+// filesystems of their cluster, and resolves filesystem IDs to names
+type filesystemResolver struct {
+	mtx      sync.Mutex
+	listings map[string]filesystemListing
+}
+
+func newFilesystemResolver() *filesystemResolver {
+	return &filesystemResolver{listings: make(map[string]filesystemListing)}
+}
+
+// resolve sets the FsName of the volume options from their FsID, and checks
+// that the filesystem exists. It returns InvalidArgument, listing the
+// filesystems of the cluster, otherwise. The filesystems are listed with the
+// credentials the volume is created with, or mounted with for statically
+// provisioned volumes. A nil resolver doesn't validate FsName and can't
+// resolve FsID.
+func (r *filesystemResolver) resolve(ctx context.Context, volOptions *volumeOptions, secrets map[string]string) error {
+	// no filesystems need to be listed
+	if r == nil || volOptions.FsName == "" && volOptions.FsID == "" {
+		return r.resolveWithCredentials(ctx, volOptions, nil)
+	}
+
+	cr, err := getAdminCredentials(secrets)
+	if !volOptions.ProvisionVolume {
+		cr, err = getUserCredentials(secrets)
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return r.resolveWithCredentials(ctx, volOptions, cr)
+}
+
+// resolveWithCredentials is resolve, listing the filesystems with cr
+func (r *filesystemResolver) resolveWithCredentials(ctx context.Context, volOptions *volumeOptions, cr *credentials) error {
+	if volOptions.FsName == "" && volOptions.FsID == "" {
+		return nil
+	}
+
+	if r == nil {
+		if volOptions.FsID != "" {
+			return status.Errorf(codes.InvalidArgument, "fsID %s can't be resolved with filesystem validation disabled, use fsName", volOptions.FsID)
+		}
+		return nil
+	}
+
+	names, err := r.filesystems(ctx, volOptions, cr)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list the filesystems, disable the validation if the credentials can't list them: %v", err)
+	}
+
+	if volOptions.FsID != "" {
+		// validated as numeric with the volume options
+		id, _ := strconv.ParseInt(volOptions.FsID, 10, 64) // nolint: errcheck
+		name, ok := names[id]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "filesystem with ID %s not found, available filesystems: %s", volOptions.FsID, describeFilesystems(names))
+		}
+
+		volOptions.FsName = name
+		volOptions.FsID = ""
+		return nil
+	}
+
+	for _, name := range names {
+		if name == volOptions.FsName {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.InvalidArgument, "filesystem %s not found, available filesystems: %s", volOptions.FsName, describeFilesystems(names))
+}
+
+func (r *filesystemResolver) filesystems(ctx context.Context, volOptions *volumeOptions, cr *credentials) (map[int64]string, error) {
+	key := volOptions.Monitors
+
+	r.mtx.Lock()
+	listing, ok := r.listings[key]
+	r.mtx.Unlock()
+	if ok && time.Since(listing.fetched) < filesystemsValidity {
+		return listing.names, nil
+	}
+
+	var dump fsDump
+	if err := execCommandJSON(ctx, &dump, "ceph", adminCephArgs(volOptions, cr, "fs", "dump")...); err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string, len(dump.Filesystems))
+	for _, fs := range dump.Filesystems {
+		names[fs.ID] = fs.MDSMap.FsName
+	}
+
+	r.mtx.Lock()
+	r.listings[key] = filesystemListing{names: names, fetched: time.Now()}
+	r.mtx.Unlock()
+
+	return names, nil
+}
+
+// describeFilesystems returns the filesystems as "name (ID)", sorted by ID
+func describeFilesystems(names map[int64]string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+
+	ids := make([]int64, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	descs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		descs = append(descs, fmt.Sprintf("%s (%d)", names[id], id))
+	}
+
+	return strings.Join(descs, ", ")
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilesystemResolver(t *testing.T) {
+	tmpDir, cleanup := fakeCeph(t, `echo '{"filesystems":[{"id":3,"mdsmap":{"fs_name":"fast"}},{"id":1,"mdsmap":{"fs_name":"cephfs"}}]}'`)
+	defer cleanup()
+
+	secrets := map[string]string{"adminID": "admin", "adminKey": "key"}
+	tests := []struct {
+		fsName, fsID string
+		wantCode     codes.Code
+		wantFsName   string
+	}{
+		// TEST: the default filesystem isn't validated
+		{"", "", codes.OK, ""},
+		{"fast", "", codes.OK, "fast"},
+		// TEST: a typo'd name is rejected, listing the filesystems
+		{"fats", "", codes.InvalidArgument, "fats"},
+		// TEST: IDs are resolved to names
+		{"", "1", codes.OK, "cephfs"},
+		{"", "2", codes.InvalidArgument, ""},
+	}
+
+	r := newFilesystemResolver()
+	for _, tt := range tests {
+		volOptions := &volumeOptions{Monitors: "mon1", ProvisionVolume: true, FsName: tt.fsName, FsID: tt.fsID}
+		err := r.resolve(context.Background(), volOptions, secrets)
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("Failed: want (%v), got (%v)", tt.wantCode, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "cephfs (1), fast (3)") {
+			t.Errorf("Failed: want the available filesystems in (%v)", err)
+		}
+		if volOptions.FsName != tt.wantFsName {
+			t.Errorf("Failed: want fsName (%s), got (%s)", tt.wantFsName, volOptions.FsName)
+		}
+	}
+
+	// TEST: the filesystems are listed once within filesystemsValidity
+	if calls := fakeCephCalls(t, tmpDir); len(calls) != 1 {
+		t.Errorf("Failed: want (1) ceph fs dump, got (%v)", calls)
+	}
+
+	// TEST: without validation names are taken as is, IDs are rejected
+	r = nil
+	volOptions := &volumeOptions{FsName: "fats"}
+	if err := r.resolve(context.Background(), volOptions, nil); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	volOptions = &volumeOptions{FsID: "1"}
+	if err := r.resolve(context.Background(), volOptions, nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Failed: want (%v), got (%v)", codes.InvalidArgument, err)
+	}
+}
+
+func TestVolumeContextFsID(t *testing.T) {
+	params := map[string]string{"provisionVolume": "true", "fsID": "1"}
+	volContext := volumeContext(params, &volumeOptions{FsName: "cephfs"}, "csi-cephfs-vol", "")
+
+	// TEST: nodes get the resolved name instead of the ID
+	if _, ok := volContext["fsID"]; ok || volContext["fsName"] != "cephfs" {
+		t.Errorf("Failed: want fsName (cephfs) without fsID, got (%v)", volContext)
+	}
+	if _, ok := params["fsName"]; ok {
+		t.Errorf("Failed: the parameters of the request were modified")
+	}
+}
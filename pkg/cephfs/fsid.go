@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+type clusterFSID struct {
+	FSID string `json:"fsid"`
+}
+
+// getClusterFSID returns the FSID of the cluster the monitors belong to
+func getClusterFSID(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (string, error) {
+	var fsid clusterFSID
+	if err := execCommandJSON(ctx, &fsid, "ceph", adminCephArgs(volOptions, adminCr, "fsid")...); err != nil {
+		return "", err
+	}
+
+	return fsid.FSID, nil
+}
+
+// checkVolumeCluster verifies that the monitors of the volume still belong
+// to the cluster it was created on, and that its filesystem and pool exist
+// there, before the volume is purged. Secrets remapped to the monitors of
+// another cluster since fail with FailedPrecondition, instead of the purge
+// targeting whatever has the volume's path on the other cluster. Volumes
+// created before their cluster's FSID was recorded aren't checked.
+func checkVolumeCluster(ctx context.Context, volID volumeID, ce *controllerCacheEntry, adminCr *credentials) error {
+	if ce.ClusterFSID == "" {
+		return nil
+	}
+
+	volOptions := &ce.VolOptions
+	fsid, err := getClusterFSID(ctx, volOptions, adminCr)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get the fsid of the cluster of volume %s: %v", volID, err)
+	}
+	if fsid != ce.ClusterFSID {
+		klog.Errorf("cephfs: volume %s was created on the cluster with fsid %s, but monitors %s belong to the cluster with fsid %s", volID, ce.ClusterFSID, volOptions.Monitors, fsid)
+		return status.Errorf(codes.FailedPrecondition, "volume %s was created on the cluster with fsid %s, but its monitors belong to the cluster with fsid %s",
+			volID, ce.ClusterFSID, fsid)
+	}
+
+	found, err := isDataPool(ctx, volOptions, adminCr)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list the filesystems of the cluster of volume %s: %v", volID, err)
+	}
+	if found {
+		return nil
+	}
+
+	if volOptions.FsName != "" {
+		return status.Errorf(codes.FailedPrecondition, "filesystem %s with data pool %s of volume %s not found on the cluster with fsid %s",
+			volOptions.FsName, volOptions.Pool, volID, fsid)
+	}
+	return status.Errorf(codes.FailedPrecondition, "no filesystem with data pool %s of volume %s found on the cluster with fsid %s", volOptions.Pool, volID, fsid)
+}
+
+// isDataPool tells whether the pool of the volume options is a data pool of
+// their filesystem, or of any filesystem for the default one
+func isDataPool(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (bool, error) {
+	filesystems, err := listFilesystems(ctx, volOptions, adminCr)
+	if err != nil {
+		return false, err
+	}
+
+	for _, fs := range filesystems {
+		if volOptions.FsName != "" && fs.Name != volOptions.FsName {
+			continue
+		}
+		for _, pool := range fs.DataPools {
+			if pool == volOptions.Pool {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckVolumeCluster(t *testing.T) {
+	const fsid = "b1ebd8d6-4f4c-11e9-8c1f-0242ac110002"
+	_, cleanup := fakeCeph(t, `case "$*" in
+*fsid*) echo '{"fsid":"`+fsid+`"}' ;;
+*"fs ls"*) echo '[{"name":"cephfs","data_pools":["cephfs_data"]},{"name":"fast","data_pools":["fast_data","fast_ec"]}]' ;;
+esac`)
+	defer cleanup()
+
+	adminCr := &credentials{id: "admin", key: "key"}
+	tests := []struct {
+		name        string
+		clusterFSID string
+		fsName      string
+		pool        string
+		wantCode    codes.Code
+	}{
+		{"same cluster", fsid, "", "cephfs_data", codes.OK},
+		{"named filesystem", fsid, "fast", "fast_ec", codes.OK},
+		// TEST: volumes created before the FSID was recorded aren't checked
+		{"no recorded fsid", "", "", "missing", codes.OK},
+		// TEST: the monitors were remapped to another cluster
+		{"other cluster", "c3f9a1e2-4f4c-11e9-8c1f-0242ac110003", "", "cephfs_data", codes.FailedPrecondition},
+		{"missing pool", fsid, "", "missing", codes.FailedPrecondition},
+		{"pool of another filesystem", fsid, "fast", "cephfs_data", codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		ce := &controllerCacheEntry{
+			VolOptions:  volumeOptions{Monitors: "mon1", FsName: tt.fsName, Pool: tt.pool},
+			ClusterFSID: tt.clusterFSID,
+		}
+		err := checkVolumeCluster(context.Background(), "csi-cephfs-vol", ce, adminCr)
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package cephfs
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,24 +31,38 @@ type volumeMountCacheMap struct {
 	volumes        map[string]volumeMountCacheEntry
 	nodeCacheStore util.NodeCache
 	metadataStore  util.CachePersister
+	mounter        util.Mounter
+	driverName     string
 }
 
 var (
 	volumeMountCachePrefix = "cephfs-mount-cache-"
 	volumeMountCache       volumeMountCacheMap
 	volumeMountCacheMtx    sync.Mutex
+
+	// kubeletPodsDir holds the pod volume directories scanned for target
+	// paths missing from the cache
+	kubeletPodsDir = "/var/lib/kubelet/pods"
+
+	// number of stale staging mounts recovered since the plugin started
+	sessionRecoveryCount int64
+	// number of cache entries dropped or updated at startup, as their staging
+	// or target paths were unmounted or mounted while the plugin was down
+	reconciledEntryCount int64
 )
 
 func initVolumeMountCache(driverName string, mountCacheDir string, cachePersister util.CachePersister) {
 	volumeMountCache.volumes = make(map[string]volumeMountCacheEntry)
 
 	volumeMountCache.metadataStore = cachePersister
+	volumeMountCache.mounter = newNodeMounter()
+	volumeMountCache.driverName = driverName
 	volumeMountCache.nodeCacheStore.BasePath = mountCacheDir
 	volumeMountCache.nodeCacheStore.CacheDir = driverName
 	klog.Infof("mount-cache: name: %s, version: %s, mountCacheDir: %s", driverName, version, mountCacheDir)
 }
 
-func remountCachedVolumes() error {
+func remountCachedVolumes(timeouts util.OperationTimeouts) error {
 	if err := os.MkdirAll(volumeMountCache.nodeCacheStore.BasePath, 0755); err != nil {
 		klog.Errorf("mount-cache: failed to create %s: %v", volumeMountCache.nodeCacheStore.BasePath, err)
 		return err
@@ -53,15 +72,22 @@ func remountCachedVolumes() error {
 	ce := &controllerCacheEntry{}
 	err := volumeMountCache.nodeCacheStore.ForAll(volumeMountCachePrefix, me, func(identifier string) error {
 		volID := me.VolumeID
+		if !reconcileCacheEntry(me) {
+			*me = volumeMountCacheEntry{}
+			return nil
+		}
 		if err := volumeMountCache.metadataStore.Get(volID, ce); err != nil {
 			if err, ok := err.(*util.CacheEntryNotFound); ok {
-				klog.Infof("mount-cache: metadata not found, assuming the volume %s to be already deleted (%v)", volID, err)
+				util.LogBenign("mount-cache: metadata not found, assuming the volume %s to be already deleted (%v)", volID, err)
 				if err := volumeMountCache.nodeCacheStore.Delete(genVolumeMountCacheFileName(volID)); err == nil {
 					klog.Infof("mount-cache: metadata not found, delete volume cache entry for volume %s", volID)
 				}
 			}
 		} else {
-			if err := mountOneCacheEntry(ce, me); err == nil {
+			ctx, cancel := timeouts.WithTimeout(context.Background(), util.OpMount)
+			err := mountOneCacheEntry(ctx, ce, me)
+			cancel()
+			if err == nil {
 				remountSuccCount++
 				volumeMountCache.volumes[me.VolumeID] = *me
 				klog.Infof("mount-cache: successfully remounted volume %s", volID)
@@ -70,12 +96,17 @@ func remountCachedVolumes() error {
 				klog.Errorf("mount-cache: failed to remount volume %s", volID)
 			}
 		}
+		// entries are decoded into me, don't let them share their maps
+		*me = volumeMountCacheEntry{}
 		return nil
 	})
 	if err != nil {
 		klog.Infof("mount-cache: metastore list cache fail %v", err)
 		return err
 	}
+	if reconciled := atomic.LoadInt64(&reconciledEntryCount); reconciled > 0 {
+		klog.Infof("mount-cache: reconciled %d cache entries with the staging and target paths", reconciled)
+	}
 	if remountFailCount > 0 {
 		klog.Infof("mount-cache: successfully remounted %d volumes, failed to remount %d volumes", remountSuccCount, remountFailCount)
 	} else {
@@ -84,10 +115,212 @@ func remountCachedVolumes() error {
 	return nil
 }
 
-func mountOneCacheEntry(ce *controllerCacheEntry, me *volumeMountCacheEntry) error {
+// reconcileCacheEntry drops the entry of a volume whose staging path isn't
+// mounted anymore, e.g. as the node rebooted while the plugin was down, and
+// the target paths of the entry which aren't mounted anymore. Targets of the
+// volume found in the pod volume directories of kubelet, which are missing
+// from the entry, are added to it. It returns false if the volume isn't
+// staged anymore.
+func reconcileCacheEntry(me *volumeMountCacheEntry) bool {
+	if !isCachedMountPoint(me.StagingPath) {
+		klog.Infof("mount-cache: staging path %s of volume %s isn't mounted anymore, deleting its cache entry", me.StagingPath, me.VolumeID)
+		if err := volumeMountCache.nodeCacheStore.Delete(genVolumeMountCacheFileName(me.VolumeID)); err != nil {
+			klog.Warningf("mount-cache: failed to delete cache entry of volume %s: %v", me.VolumeID, err)
+		}
+		atomic.AddInt64(&reconciledEntryCount, 1)
+		return false
+	}
+
+	if me.TargetPaths == nil {
+		me.TargetPaths = make(map[string]bool)
+	}
+
+	changed := false
+	for targetPath := range me.TargetPaths {
+		if !isCachedMountPoint(targetPath) {
+			klog.Infof("mount-cache: target path %s of volume %s isn't mounted anymore, dropping it", targetPath, me.VolumeID)
+			delete(me.TargetPaths, targetPath)
+			changed = true
+		}
+	}
+
+	for _, targetPath := range kubeletTargetPaths(me.VolumeID) {
+		if _, ok := me.TargetPaths[targetPath]; ok || !isCachedMountPoint(targetPath) {
+			continue
+		}
+		klog.Infof("mount-cache: target path %s of volume %s is missing from its cache entry, adding it", targetPath, me.VolumeID)
+		me.TargetPaths[targetPath] = isReadOnlyMount(targetPath)
+		changed = true
+	}
+
+	if changed {
+		if err := volumeMountCache.nodeCacheStore.Update(genVolumeMountCacheFileName(me.VolumeID), me); err != nil {
+			klog.Warningf("mount-cache: failed to update cache entry of volume %s: %v", me.VolumeID, err)
+		}
+		atomic.AddInt64(&reconciledEntryCount, 1)
+	}
+
+	return true
+}
+
+// isCachedMountPoint returns whether the cached mount point is still mounted.
+// Corrupted mounts, e.g. of a ceph-fuse process which exited along with the
+// plugin, are kept to be mounted again, as are mount points which can't be
+// checked.
+func isCachedMountPoint(mountPoint string) bool {
+	if _, err := os.Stat(mountPoint); isCorruptedMnt(err) {
+		return true
+	}
+
+	isMnt, err := util.IsMountPoint(volumeMountCache.mounter, mountPoint)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+		klog.Warningf("mount-cache: failed to check mount point %s: %v", mountPoint, err)
+		return true
+	}
+
+	return isMnt
+}
+
+// kubeletVolumeData is the part of the vol_data.json file which kubelet
+// stores next to the target path of CSI volumes
+type kubeletVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// kubeletTargetPaths scans the pod volume directories of kubelet for the
+// target paths of the volume
+func kubeletTargetPaths(volID string) []string {
+	files, err := filepath.Glob(filepath.Join(kubeletPodsDir, "*", "volumes", "kubernetes.io~csi", "*", "vol_data.json"))
+	if err != nil {
+		klog.Warningf("mount-cache: failed to scan %s: %v", kubeletPodsDir, err)
+		return nil
+	}
+
+	var targetPaths []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file) // #nosec
+		if err != nil {
+			klog.Warningf("mount-cache: failed to read %s: %v", file, err)
+			continue
+		}
+		vd := kubeletVolumeData{}
+		if err = json.Unmarshal(data, &vd); err != nil {
+			klog.Warningf("mount-cache: failed to decode %s: %v", file, err)
+			continue
+		}
+		if vd.DriverName == volumeMountCache.driverName && vd.VolumeHandle == volID {
+			targetPaths = append(targetPaths, filepath.Join(filepath.Dir(file), "mount"))
+		}
+	}
+
+	return targetPaths
+}
+
+func isReadOnlyMount(mountPoint string) bool {
+	mps, err := volumeMountCache.mounter.List()
+	if err != nil {
+		klog.Warningf("mount-cache: failed to list mounts: %v", err)
+		return false
+	}
+	for _, mp := range mps {
+		if mp.Path != mountPoint {
+			continue
+		}
+		for _, opt := range mp.Opts {
+			if opt == "ro" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recoverStaleMounts periodically checks the staging paths of the cached
+// volumes and remounts the ones whose CephFS session got evicted or
+// blacklisted by the MDS. The bind-mounts of the volume are re-created
+// on top of the new staging mount.
+func recoverStaleMounts(interval time.Duration, timeouts util.OperationTimeouts) {
+	klog.Infof("mount-cache: checking for stale mounts every %v", interval)
+
+	for range time.Tick(interval) {
+		volumeMountCacheMtx.Lock()
+		volIDs := make([]string, 0, len(volumeMountCache.volumes))
+		for volID := range volumeMountCache.volumes {
+			volIDs = append(volIDs, volID)
+		}
+		volumeMountCacheMtx.Unlock()
+
+		for _, volID := range volIDs {
+			recoverStaleMount(volID, timeouts)
+		}
+	}
+}
+
+// recoverStaleMount remounts the staging path of the volume if it's stale,
+// holding the lock of the volume against NodeStageVolume
+func recoverStaleMount(volID string, timeouts util.OperationTimeouts) {
+	mtxNodeVolumeID.LockKey(volID)
+	defer mustUnlock(mtxNodeVolumeID, volID)
+
+	// the volume may have been unstaged or staged again meanwhile, the
+	// entry is copied as node RPCs update its target paths
+	me, ok := cachedVolume(volID)
+	if !ok {
+		return
+	}
+
+	_, err := os.Stat(me.StagingPath)
+	if !isCorruptedMnt(err) {
+		return
+	}
+
+	klog.Warningf("mount-cache: staging path %s of volume %s is stale (%v), remounting", me.StagingPath, me.VolumeID, err)
+
+	ce := &controllerCacheEntry{}
+	if err = volumeMountCache.metadataStore.Get(me.VolumeID, ce); err != nil {
+		klog.Errorf("mount-cache: failed to get metadata for volume %s: %v", me.VolumeID, err)
+		return
+	}
+
+	ctx, cancel := timeouts.WithTimeout(context.Background(), util.OpMount)
+	defer cancel()
+
+	if err = mountOneCacheEntry(ctx, ce, &me); err != nil {
+		klog.Errorf("mount-cache: failed to recover stale mount of volume %s: %v", me.VolumeID, err)
+		return
+	}
+
+	klog.Infof("mount-cache: successfully recovered volume %s, %d stale mounts recovered so far",
+		me.VolumeID, atomic.AddInt64(&sessionRecoveryCount, 1))
+}
+
+// cachedVolume returns a copy of the cache entry of the volume
+func cachedVolume(volID string) (volumeMountCacheEntry, bool) {
 	volumeMountCacheMtx.Lock()
 	defer volumeMountCacheMtx.Unlock()
 
+	me, ok := volumeMountCache.volumes[volID]
+	if !ok {
+		return me, false
+	}
+
+	targetPaths := make(map[string]bool, len(me.TargetPaths))
+	for targetPath, readOnly := range me.TargetPaths {
+		targetPaths[targetPath] = readOnly
+	}
+	me.TargetPaths = targetPaths
+
+	return me, true
+}
+
+// mountOneCacheEntry mounts the staging path of the volume and re-creates
+// its bind-mounts. It doesn't hold the cache lock across the backend calls,
+// callers hold the lock of the volume or run before RPCs are served.
+func mountOneCacheEntry(ctx context.Context, ce *controllerCacheEntry, me *volumeMountCacheEntry) error {
 	var (
 		err error
 		cr  *credentials
@@ -102,7 +335,7 @@ func mountOneCacheEntry(ce *controllerCacheEntry, me *volumeMountCacheEntry) err
 			return err
 		}
 		var entity *cephEntity
-		entity, err = getCephUser(&volOptions, cr, volID)
+		entity, err = getCephUser(ctx, &volOptions, cr, volID)
 		if err != nil {
 			return err
 		}
@@ -114,7 +347,7 @@ func mountOneCacheEntry(ce *controllerCacheEntry, me *volumeMountCacheEntry) err
 		}
 	}
 
-	err = cleanupMountPoint(me.StagingPath)
+	err = cleanupMountPoint(ctx, me.StagingPath)
 	if err != nil {
 		klog.Infof("mount-cache: failed to cleanup volume mount point %s, remove it: %s %v", volID, me.StagingPath, err)
 		return err
@@ -132,14 +365,14 @@ func mountOneCacheEntry(ce *controllerCacheEntry, me *volumeMountCacheEntry) err
 			klog.Errorf("mount-cache: failed to create mounter for volume %s: %v", volID, err)
 			return err
 		}
-		if err := m.mount(me.StagingPath, cr, &volOptions); err != nil {
+		if err := m.mount(ctx, me.StagingPath, cr, &volOptions); err != nil {
 			klog.Errorf("mount-cache: failed to mount volume %s: %v", volID, err)
 			return err
 		}
 	}
 	for targetPath, readOnly := range me.TargetPaths {
-		if err := cleanupMountPoint(targetPath); err == nil {
-			if err := bindMount(me.StagingPath, targetPath, readOnly); err != nil {
+		if err := cleanupMountPoint(ctx, targetPath); err == nil {
+			if err := bindMount(ctx, me.StagingPath, targetPath, readOnly); err != nil {
 				klog.Errorf("mount-cache: failed to bind-mount volume %s: %s %s %v %v",
 					volID, me.StagingPath, targetPath, readOnly, err)
 			} else {
@@ -151,11 +384,11 @@ func mountOneCacheEntry(ce *controllerCacheEntry, me *volumeMountCacheEntry) err
 	return nil
 }
 
-func cleanupMountPoint(mountPoint string) error {
+func cleanupMountPoint(ctx context.Context, mountPoint string) error {
 	if _, err := os.Stat(mountPoint); err != nil {
 		if isCorruptedMnt(err) {
 			klog.Infof("mount-cache: corrupted mount point %s, need unmount", mountPoint)
-			err := execCommandErr("umount", mountPoint)
+			err := execCommandErr(ctx, "umount", mountPoint)
 			if err != nil {
 				klog.Infof("mount-cache: failed to umount %s %v", mountPoint, err)
 				//ignore error return err
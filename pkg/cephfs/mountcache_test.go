@@ -1,7 +1,14 @@
 package cephfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
 	"testing"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 func init() {
@@ -36,3 +43,109 @@ func TestEncodeDecodeCredentials(t *testing.T) {
 		}
 	}
 }
+
+func TestReconcileCacheEntry(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-mount-cache")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	saved, savedPodsDir := volumeMountCache, kubeletPodsDir
+	defer func() { volumeMountCache, kubeletPodsDir = saved, savedPodsDir }()
+	mounter := util.NewFakeMounter()
+	volumeMountCache.mounter = mounter
+	volumeMountCache.driverName = "cephfs.csi.ceph.com"
+	volumeMountCache.nodeCacheStore = util.NodeCache{BasePath: basePath, CacheDir: "cache"}
+	if err = volumeMountCache.nodeCacheStore.EnsureCacheDirectory("cache"); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	kubeletPodsDir = path.Join(basePath, "pods")
+
+	stagingPath := path.Join(basePath, "staging")
+	unmountedPath := path.Join(basePath, "unmounted")
+	targetPath := path.Join(basePath, "target")
+	unmountedTargetPath := path.Join(basePath, "unmounted-target")
+	volDir := path.Join(kubeletPodsDir, "pod-1", "volumes", "kubernetes.io~csi", "pvc-1")
+	kubeletTargetPath := path.Join(volDir, "mount")
+	for _, p := range []string{stagingPath, unmountedPath, targetPath, unmountedTargetPath, kubeletTargetPath} {
+		if err = os.MkdirAll(p, 0750); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+	volData := `{"driverName":"cephfs.csi.ceph.com","volumeHandle":"csi-cephfs-staged"}`
+	if err = ioutil.WriteFile(path.Join(volDir, "vol_data.json"), []byte(volData), 0640); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	mounter.MountPoints = []mount.MountPoint{
+		{Path: stagingPath},
+		{Path: targetPath},
+		{Path: kubeletTargetPath, Opts: []string{"bind", "ro"}},
+	}
+
+	newEntry := func(volID, stagingPath string) *volumeMountCacheEntry {
+		me := &volumeMountCacheEntry{
+			VolumeID:    volID,
+			StagingPath: stagingPath,
+			TargetPaths: map[string]bool{
+				targetPath:                     false,
+				unmountedTargetPath:            false,
+				path.Join(basePath, "removed"): true,
+			},
+		}
+		if err = volumeMountCache.nodeCacheStore.Create(genVolumeMountCacheFileName(volID), me); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		return me
+	}
+
+	// TEST: entries whose staging path was removed or isn't mounted are deleted
+	for _, p := range []string{path.Join(basePath, "removed"), unmountedPath} {
+		me := newEntry("csi-cephfs-unstaged", p)
+		if reconcileCacheEntry(me) {
+			t.Errorf("Failed: want the unstaged volume at %s dropped", p)
+		}
+		err = volumeMountCache.nodeCacheStore.Get(genVolumeMountCacheFileName(me.VolumeID), &volumeMountCacheEntry{})
+		if _, ok := err.(*util.CacheEntryNotFound); !ok {
+			t.Errorf("Failed: want (CacheEntryNotFound), got (%v)", err)
+		}
+	}
+
+	// TEST: unmounted target paths are dropped from staged entries, and the
+	// ones kubelet knows about are added
+	me := newEntry("csi-cephfs-staged", stagingPath)
+	if !reconcileCacheEntry(me) {
+		t.Errorf("Failed: want the staged volume kept")
+	}
+	stored := &volumeMountCacheEntry{}
+	if err = volumeMountCache.nodeCacheStore.Get(genVolumeMountCacheFileName(me.VolumeID), stored); err != nil {
+		t.Fatalf("Failed: want the entry kept, got (%v)", err)
+	}
+	want := map[string]bool{targetPath: false, kubeletTargetPath: true}
+	if !reflect.DeepEqual(stored.TargetPaths, want) {
+		t.Errorf("Failed: want (%v), got (%v)", want, stored.TargetPaths)
+	}
+}
+
+func TestCachedVolume(t *testing.T) {
+	saved := volumeMountCache
+	defer func() { volumeMountCache = saved }()
+	volumeMountCache.volumes = map[string]volumeMountCacheEntry{
+		"csi-cephfs-staged": {VolumeID: "csi-cephfs-staged", StagingPath: "/staging", TargetPaths: map[string]bool{"/target": false}},
+	}
+
+	// TEST: volumes unstaged meanwhile aren't recovered
+	if _, ok := cachedVolume("csi-cephfs-unstaged"); ok {
+		t.Errorf("Failed: want no entry for the unstaged volume")
+	}
+
+	// TEST: the copy doesn't share the target paths node RPCs update
+	me, ok := cachedVolume("csi-cephfs-staged")
+	if !ok || me.StagingPath != "/staging" {
+		t.Fatalf("Failed: want the entry of the staged volume, got (%v, %v)", me, ok)
+	}
+	me.TargetPaths["/other"] = true
+	if _, shared := volumeMountCache.volumes["csi-cephfs-staged"].TargetPaths["/other"]; shared {
+		t.Errorf("Failed: want the target paths copied")
+	}
+}
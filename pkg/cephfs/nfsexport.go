@@ -0,0 +1,181 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+const (
+	// mgr module managing the exports of nfs-ganesha clusters
+	nfsMgrModule = "nfs"
+
+	// VolumeContext key of the pseudo path of the NFS export of the volume
+	nfsExportPathKey = "nfsExportPath"
+)
+
+// nfsNotSupported is returned if the cluster can't manage NFS exports
+type nfsNotSupported struct {
+	error
+}
+
+type mgrModules struct {
+	AlwaysOnModules []string `json:"always_on_modules"`
+	EnabledModules  []string `json:"enabled_modules"`
+}
+
+// fsInfo is a filesystem as listed by ceph fs ls
+type fsInfo struct {
+	Name      string   `json:"name"`
+	DataPools []string `json:"data_pools"`
+}
+
+// getNFSExportPath returns the pseudo path the volume is exported at
+func getNFSExportPath(volID volumeID) string {
+	return path.Join("/", string(volID))
+}
+
+func adminCephArgs(volOptions *volumeOptions, adminCr *credentials, args ...string) []string {
+	return append([]string{
+		"-m", volOptions.Monitors,
+		"-n", cephEntityClientPrefix + adminCr.id,
+		"--key=" + adminCr.key,
+		"-c", cephConfigPath,
+		"-f", "json",
+	}, args...)
+}
+
+// checkNFSSupported fails with nfsNotSupported if the nfs mgr module isn't
+// enabled in the cluster
+func checkNFSSupported(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) error {
+	var modules mgrModules
+	if err := execCommandJSON(ctx, &modules, "ceph", adminCephArgs(volOptions, adminCr, "mgr", "module", "ls")...); err != nil {
+		return err
+	}
+
+	for _, m := range append(modules.AlwaysOnModules, modules.EnabledModules...) {
+		if m == nfsMgrModule {
+			return nil
+		}
+	}
+
+	return &nfsNotSupported{fmt.Errorf("the %s mgr module is not enabled, NFS exports are not supported by the cluster", nfsMgrModule)}
+}
+
+// listFilesystems returns the filesystems of the cluster with their data
+// pools
+func listFilesystems(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) ([]fsInfo, error) {
+	var filesystems []fsInfo
+	if err := execCommandJSON(ctx, &filesystems, "ceph", adminCephArgs(volOptions, adminCr, "fs", "ls")...); err != nil {
+		return nil, err
+	}
+
+	return filesystems, nil
+}
+
+// getFsName returns the filesystem of the volume options, or the name of the
+// filesystem using pool as a data pool if it isn't set
+func getFsName(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (string, error) {
+	if volOptions.FsName != "" {
+		return volOptions.FsName, nil
+	}
+
+	filesystems, err := listFilesystems(ctx, volOptions, adminCr)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fs := range filesystems {
+		for _, pool := range fs.DataPools {
+			if pool == volOptions.Pool {
+				return fs.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no filesystem uses pool %s as a data pool", volOptions.Pool)
+}
+
+// nfsExportExists returns whether the nfs-ganesha cluster of the volume
+// options has an export at pseudoPath
+func nfsExportExists(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, pseudoPath string) (bool, error) {
+	var exports []string
+	if err := execCommandJSON(ctx, &exports, "ceph", adminCephArgs(volOptions, adminCr,
+		"nfs", "export", "ls",
+		"--cluster-id", volOptions.NFSCluster,
+	)...); err != nil {
+		return false, err
+	}
+
+	for _, export := range exports {
+		if export == pseudoPath {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// createNFSExport exports the volume in the nfs-ganesha cluster of the volume
+// options, and returns the pseudo path of the export
+func createNFSExport(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID) (string, error) {
+	pseudoPath := getNFSExportPath(volID)
+
+	// a retry of CreateVolume finds the export already created
+	exists, err := nfsExportExists(ctx, volOptions, adminCr, pseudoPath)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return pseudoPath, nil
+	}
+
+	fsName, err := getFsName(ctx, volOptions, adminCr)
+	if err != nil {
+		return "", err
+	}
+
+	err = execCommandErr(ctx, "ceph", adminCephArgs(volOptions, adminCr,
+		"nfs", "export", "create", "cephfs",
+		"--cluster-id", volOptions.NFSCluster,
+		"--pseudo-path", pseudoPath,
+		"--fsname", fsName,
+		"--path", getVolumeRootPathCeph(volID),
+	)...)
+	if err != nil {
+		return "", err
+	}
+
+	return pseudoPath, nil
+}
+
+// deleteNFSExport removes the export at pseudoPath, an export which doesn't
+// exist is considered removed already
+func deleteNFSExport(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, pseudoPath string) error {
+	exists, err := nfsExportExists(ctx, volOptions, adminCr, pseudoPath)
+	if err != nil || !exists {
+		return err
+	}
+
+	return execCommandErr(ctx, "ceph", adminCephArgs(volOptions, adminCr,
+		"nfs", "export", "rm",
+		"--cluster-id", volOptions.NFSCluster,
+		"--pseudo-path", pseudoPath,
+	)...)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// fakeCephNFS answers the ceph commands of NFS exports, with the nfs mgr
+// module enabled if nfsEnabled is set
+func fakeCephNFS(t *testing.T, nfsEnabled bool) (tmpDir string, cleanup func()) {
+	modules := `"iostat"`
+	if nfsEnabled {
+		modules += `,"nfs"`
+	}
+
+	// the exports are kept in a file next to the script
+	return fakeCeph(t, `exports="$(dirname "$0")/exports"
+case "$*" in
+*"mgr module ls"*) echo '{"always_on_modules":["balancer"],"enabled_modules":[`+modules+`]}' ;;
+*"fs ls"*) echo '[{"name":"other","data_pools":["other_data"]},{"name":"myfs","data_pools":["data"]}]' ;;
+*"nfs export ls"*) cat "$exports" 2>/dev/null || echo '[]' ;;
+*"nfs export create"*) echo '["/csi-cephfs-vol"]' > "$exports"; echo '{"bind":"/csi-cephfs-vol"}' ;;
+*"nfs export rm"*) echo '[]' > "$exports" ;;
+esac`)
+}
+
+func TestCheckNFSSupported(t *testing.T) {
+	adminCr := &credentials{id: "admin", key: "key"}
+	volOptions := &volumeOptions{Monitors: "mon1", Pool: "data", NFSCluster: "nfs1"}
+
+	// TEST: clusters without the nfs mgr module are rejected
+	_, cleanup := fakeCephNFS(t, false)
+	err := checkNFSSupported(context.Background(), volOptions, adminCr)
+	if _, ok := err.(*nfsNotSupported); !ok {
+		t.Errorf("Failed: want (nfsNotSupported), got (%v)", err)
+	}
+	cleanup()
+
+	_, cleanup = fakeCephNFS(t, true)
+	defer cleanup()
+	if err = checkNFSSupported(context.Background(), volOptions, adminCr); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
+
+func TestNFSExportLifecycle(t *testing.T) {
+	tmpDir, cleanup := fakeCephNFS(t, true)
+	defer cleanup()
+
+	adminCr := &credentials{id: "admin", key: "key"}
+	volOptions := &volumeOptions{Monitors: "mon1", Pool: "data", NFSCluster: "nfs1"}
+	volID := volumeID("csi-cephfs-vol")
+
+	// TEST: the volume is exported from the filesystem of its data pool
+	pseudoPath, err := createNFSExport(context.Background(), volOptions, adminCr, volID)
+	if err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+	if pseudoPath != "/csi-cephfs-vol" {
+		t.Errorf("Failed: want (/csi-cephfs-vol), got (%s)", pseudoPath)
+	}
+
+	// TEST: a retry finds the export created already
+	if pseudoPath, err = createNFSExport(context.Background(), volOptions, adminCr, volID); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if pseudoPath != "/csi-cephfs-vol" {
+		t.Errorf("Failed: want (/csi-cephfs-vol), got (%s)", pseudoPath)
+	}
+
+	if err = deleteNFSExport(context.Background(), volOptions, adminCr, pseudoPath); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	// TEST: removing an export which is gone already succeeds
+	if err = deleteNFSExport(context.Background(), volOptions, adminCr, pseudoPath); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	calls := fakeCephCalls(t, tmpDir)
+	want := []string{
+		"nfs export ls --cluster-id nfs1",
+		"fs ls",
+		"nfs export create cephfs --cluster-id nfs1 --pseudo-path /csi-cephfs-vol --fsname myfs --path /csi-volumes/csi-cephfs-vol",
+		"nfs export ls --cluster-id nfs1",
+		"nfs export ls --cluster-id nfs1",
+		"nfs export rm --cluster-id nfs1 --pseudo-path /csi-cephfs-vol",
+		"nfs export ls --cluster-id nfs1",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("Failed: want (%v), got (%v)", want, calls)
+	}
+	for i := range want {
+		if !strings.HasSuffix(calls[i], want[i]) {
+			t.Errorf("Failed: want (%s), got (%s)", want[i], calls[i])
+		}
+	}
+
+	// TEST: pools which aren't data pools of a filesystem can't be exported
+	volOptions.Pool = "metadata"
+	if _, err = createNFSExport(context.Background(), volOptions, adminCr, volID); err == nil {
+		t.Errorf("Failed: want the export of pool metadata refused")
+	}
+}
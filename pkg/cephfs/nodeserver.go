@@ -22,25 +22,29 @@ import (
 	"os"
 
 	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
-	"k8s.io/kubernetes/pkg/util/keymutex"
 )
 
 // NodeServer struct of ceph CSI driver with supported methods of CSI
 // node server spec.
 type NodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter  util.Mounter
+	timeouts util.OperationTimeouts
+	// newVolumeMounter picks the fuse or kernel mounter of the volume
+	newVolumeMounter func(volOptions *volumeOptions) (volumeMounter, error)
 }
 
 var (
-	mtxNodeVolumeID = keymutex.NewHashed(0)
+	mtxNodeVolumeID = csicommon.NewKeyMutex("nodeVolumeID")
 )
 
-func getCredentialsForVolume(volOptions *volumeOptions, volID volumeID, req *csi.NodeStageVolumeRequest) (*credentials, error) {
+func getCredentialsForVolume(ctx context.Context, volOptions *volumeOptions, volID volumeID, req *csi.NodeStageVolumeRequest) (*credentials, error) {
 	var (
 		cr      *credentials
 		secrets = req.GetSecrets()
@@ -58,7 +62,7 @@ func getCredentialsForVolume(volOptions *volumeOptions, volID volumeID, req *csi
 
 		// Then get the ceph user
 
-		entity, err := getCephUser(volOptions, adminCr, volID)
+		entity, err := getCephUser(ctx, volOptions, adminCr, volID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get ceph user: %v", err)
 		}
@@ -95,9 +99,15 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// a typo in the secret would only fail in the mount helper otherwise
+	if err = validateStageSecrets(volOptions, req.GetSecrets()); err != nil {
+		klog.Errorf("invalid secret for volume %s: %v", volID, err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	if volOptions.ProvisionVolume {
 		// Dynamically provisioned volumes don't have their root path set, do it here
-		volOptions.RootPath = getVolumeRootPathCeph(volID)
+		volOptions.RootPath = getVolumeRootPathFromContext(volID, req.GetVolumeContext())
 	}
 
 	if err = createMountPoint(stagingTargetPath); err != nil {
@@ -110,7 +120,7 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 
 	// Check if the volume is already mounted
 
-	isMnt, err := isMountPoint(stagingTargetPath)
+	isMnt, err := util.IsMountPoint(ns.mounter, stagingTargetPath)
 
 	if err != nil {
 		klog.Errorf("stat failed: %v", err)
@@ -118,12 +128,14 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}
 
 	if isMnt {
-		klog.Infof("cephfs: volume %s is already mounted to %s, skipping", volID, stagingTargetPath)
+		util.LogBenign("cephfs: volume %s is already mounted to %s, skipping", volID, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	// It's not, mount now
-	if err = ns.mount(volOptions, req); err != nil {
+	// It's not, mount now. The ceph-fuse process of a corrupted mount which
+	// was just unmounted is reaped first
+	releaseFuseProcess(stagingTargetPath)
+	if err = ns.mount(ctx, volOptions, req); err != nil {
 		return nil, err
 	}
 
@@ -132,26 +144,42 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (*NodeServer) mount(volOptions *volumeOptions, req *csi.NodeStageVolumeRequest) error {
+func (ns *NodeServer) mount(ctx context.Context, volOptions *volumeOptions, req *csi.NodeStageVolumeRequest) error {
 	stagingTargetPath := req.GetStagingTargetPath()
 	volID := volumeID(req.GetVolumeId())
 
-	cr, err := getCredentialsForVolume(volOptions, volID, req)
+	ctx, cancel := ns.timeouts.WithTimeout(ctx, util.OpMount)
+	defer cancel()
+
+	cr, err := getCredentialsForVolume(ctx, volOptions, volID, req)
 	if err != nil {
 		klog.Errorf("failed to get ceph credentials for volume %s: %v", volID, err)
+		if util.IsPermissionDenied(err) {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
 		return status.Error(codes.Internal, err.Error())
 	}
 
-	m, err := newMounter(volOptions)
+	m, err := ns.newVolumeMounter(volOptions)
 	if err != nil {
 		klog.Errorf("failed to create mounter for volume %s: %v", volID, err)
 		return status.Error(codes.Internal, err.Error())
 	}
 
-	klog.V(4).Infof("cephfs: mounting volume %s with %s", volID, m.name())
+	util.V(util.LogMount, 4).Infof("cephfs: mounting volume %s with %s", volID, m.name())
 
-	if err = m.mount(stagingTargetPath, cr, volOptions); err != nil {
+	if err = m.mount(ctx, stagingTargetPath, cr, volOptions); err != nil {
 		klog.Errorf("failed to mount volume %s: %v", volID, err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			ns.cleanupCancelledMount(stagingTargetPath)
+			if ctxErr == context.DeadlineExceeded {
+				return status.Errorf(codes.DeadlineExceeded, "mounting volume %s timed out: %v", volID, err)
+			}
+			return status.Errorf(codes.Canceled, "mounting volume %s was canceled: %v", volID, err)
+		}
+		if util.IsPermissionDenied(err) {
+			return status.Errorf(codes.PermissionDenied, "mounting volume %s failed, %s: %v", volID, util.PermissionDeniedReason(err, cr.id), err)
+		}
 		return status.Error(codes.Internal, err.Error())
 	}
 	if err := volumeMountCache.nodeStageVolume(req.GetVolumeId(), stagingTargetPath, req.GetSecrets()); err != nil {
@@ -160,6 +188,27 @@ func (*NodeServer) mount(volOptions *volumeOptions, req *csi.NodeStageVolumeRequ
 	return nil
 }
 
+// cleanupCancelledMount unmounts the staging path if the mount helpers killed
+// on cancellation completed the mount before dying, the mount is unexpected
+// to the retries of NodeStageVolume
+func (ns *NodeServer) cleanupCancelledMount(stagingTargetPath string) {
+	isMnt, err := util.IsMountPoint(ns.mounter, stagingTargetPath)
+	if err != nil {
+		klog.Warningf("cephfs: failed to check %s after a canceled mount: %v", stagingTargetPath, err)
+		return
+	}
+
+	if isMnt {
+		klog.Warningf("cephfs: %s was mounted by a canceled mount, unmounting it", stagingTargetPath)
+		if err = ns.mounter.Unmount(stagingTargetPath); err != nil {
+			klog.Errorf("cephfs: failed to unmount %s after a canceled mount: %v", stagingTargetPath, err)
+			return
+		}
+	}
+
+	releaseFuseProcess(stagingTargetPath)
+}
+
 // NodePublishVolume mounts the volume mounted to the staging path to the target
 // path
 func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -179,7 +228,7 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	// Check if the volume is already mounted
 
-	isMnt, err := isMountPoint(targetPath)
+	isMnt, err := util.IsMountPoint(ns.mounter, targetPath)
 
 	if err != nil {
 		klog.Errorf("stat failed: %v", err)
@@ -187,13 +236,33 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	if isMnt {
-		klog.Infof("cephfs: volume %s is already bind-mounted to %s", volID, targetPath)
+		util.LogBenign("cephfs: volume %s is already bind-mounted to %s", volID, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// after a reboot kubelet may publish volumes whose staging mount is gone,
+	// fail fast to have them staged again
+	isStaged, err := util.IsMountPoint(ns.mounter, req.GetStagingTargetPath())
+	if err != nil && !os.IsNotExist(err) {
+		klog.Errorf("cephfs: failed to check staging path %s of volume %s: %v", req.GetStagingTargetPath(), volID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !isStaged {
+		klog.Errorf("cephfs: staging path %s of volume %s is not mounted", req.GetStagingTargetPath(), volID)
+		return nil, status.Error(codes.FailedPrecondition, "staging path not mounted, expect NodeStageVolume")
+	}
+
+	// files left in the target by someone else would disappear under the
+	// bind-mount
+	if err = util.CheckTargetEmpty(targetPath); err != nil {
+		klog.Errorf("cephfs: not publishing volume %s: %v", volID, err)
+		return nil, err
+	}
+
 	// It's not, mount now
 
-	if err = bindMount(req.GetStagingTargetPath(), req.GetTargetPath(), req.GetReadonly()); err != nil {
+	if err = ns.mounter.BindMount(ctx, req.GetStagingTargetPath(), req.GetTargetPath(), req.GetReadonly()); err != nil {
 		klog.Errorf("failed to bind-mount volume %s: %v", volID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -217,17 +286,13 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	targetPath := req.GetTargetPath()
 
 	volID := req.GetVolumeId()
-	if err = volumeMountCache.nodeUnPublishVolume(volID, targetPath); err != nil {
-		klog.Warningf("mount-cache: failed to unpublish volume %s %s: %v", volID, targetPath, err)
-	}
 
 	// Unmount the bind-mount
-	if err = unmountVolume(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err = ns.queueUnmountTarget(ctx, volID, targetPath); err != nil {
+		return nil, err
 	}
-
-	if err = os.Remove(targetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err = volumeMountCache.nodeUnPublishVolume(volID, targetPath); err != nil {
+		klog.Warningf("mount-cache: failed to unpublish volume %s %s: %v", volID, targetPath, err)
 	}
 
 	klog.Infof("cephfs: successfully unbinded volume %s from %s", req.GetVolumeId(), targetPath)
@@ -245,17 +310,16 @@ func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	stagingTargetPath := req.GetStagingTargetPath()
 
 	volID := req.GetVolumeId()
-	if err = volumeMountCache.nodeUnStageVolume(volID); err != nil {
-		klog.Warningf("mount-cache: failed to unstage volume %s %s: %v", volID, stagingTargetPath, err)
-	}
 
 	// Unmount the volume
-	if err = unmountVolume(stagingTargetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err = ns.queueUnmountTarget(ctx, volID, stagingTargetPath); err != nil {
+		return nil, err
 	}
 
-	if err = os.Remove(stagingTargetPath); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// the staging metadata is removed last, so that the volume is still
+	// recovered if unmounting fails
+	if err = volumeMountCache.nodeUnStageVolume(volID); err != nil {
+		klog.Warningf("mount-cache: failed to unstage volume %s %s: %v", volID, stagingTargetPath, err)
 	}
 
 	klog.Infof("cephfs: successfully unmounted volume %s from %s", req.GetVolumeId(), stagingTargetPath)
@@ -263,6 +327,28 @@ func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// unmountTarget unmounts the target and removes it, missing targets and
+// targets which aren't mounted anymore are considered unmounted
+func (ns *NodeServer) unmountTarget(ctx context.Context, target string) error {
+	if err := util.UnmountTarget(ctx, ns.mounter, target); err != nil {
+		return err
+	}
+
+	releaseFuseProcess(target)
+	return nil
+}
+
+// queueUnmountTarget unmounts the target of the volume through the teardown
+// workers, the errors of the unmount are Internal
+func (ns *NodeServer) queueUnmountTarget(ctx context.Context, volID, target string) error {
+	return util.RunTeardown(ctx, volID, func(ctx context.Context) error {
+		if err := ns.unmountTarget(ctx, target); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
+	})
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
@@ -0,0 +1,381 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestNodeUnstageUnpublishVolume(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	tests := []struct {
+		name    string
+		exists  bool
+		mounted bool
+	}{
+		{"missing path", false, false},
+		{"not mounted", true, false},
+		{"mounted", true, true},
+	}
+
+	for _, tt := range tests {
+		for _, unstage := range []bool{true, false} {
+			p := path.Join(basePath, "target")
+			if tt.exists {
+				if err = os.Mkdir(p, 0750); err != nil {
+					t.Fatalf("Test setup error %s", err)
+				}
+			}
+
+			mounter := util.NewFakeMounter()
+			if tt.mounted {
+				mounter.MountPoints = []mount.MountPoint{{Device: "ceph-fuse", Path: p}}
+			}
+			ns := &NodeServer{mounter: mounter}
+
+			if unstage {
+				_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+					VolumeId:          "csi-cephfs-vol-1",
+					StagingTargetPath: p,
+				})
+			} else {
+				_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   "csi-cephfs-vol-1",
+					TargetPath: p,
+				})
+			}
+			if err != nil {
+				t.Errorf("%s (unstage %t): want success, got (%v)", tt.name, unstage, err)
+			}
+
+			if _, err = os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s (unstage %t): path wasn't removed: %v", tt.name, unstage, err)
+			}
+
+			if len(mounter.MountPoints) != 0 {
+				t.Errorf("%s (unstage %t): path wasn't unmounted", tt.name, unstage)
+			}
+		}
+	}
+}
+
+// fakeVolumeMounter mounts the volume to the fake mounter instead of running
+// ceph-fuse or the kernel client
+type fakeVolumeMounter struct {
+	mounter *util.FakeMounter
+}
+
+func (m *fakeVolumeMounter) mount(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+	return m.mounter.Mount(volOptions.Monitors+":"+volOptions.RootPath, mountPoint, "ceph", nil)
+}
+
+func (m *fakeVolumeMounter) name() string { return "fake mounter" }
+
+// lateVolumeMounter simulates a mount helper killed on cancellation, which
+// completed the mount before dying
+type lateVolumeMounter struct {
+	fakeVolumeMounter
+}
+
+func (m *lateVolumeMounter) mount(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+	<-ctx.Done()
+	if err := m.fakeVolumeMounter.mount(ctx, mountPoint, cr, volOptions); err != nil {
+		return err
+	}
+	return errors.New("signal: killed")
+}
+
+func mountActions(mounter *util.FakeMounter) []string {
+	actions := []string{}
+	for _, action := range mounter.Log {
+		actions = append(actions, action.Action)
+	}
+	return actions
+}
+
+func TestNodeStageVolumeMounts(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+	stagingPath := path.Join(basePath, "staging")
+
+	tests := []struct {
+		name      string
+		mounted   bool
+		corrupted bool
+		actions   []string
+	}{
+		{"not mounted", false, false, []string{mount.FakeActionMount}},
+		{"already mounted", true, false, []string{}},
+		{"corrupted mount", true, true, []string{mount.FakeActionUnmount, mount.FakeActionMount}},
+	}
+
+	for _, tt := range tests {
+		mounter := util.NewFakeMounter()
+		if tt.mounted {
+			mounter.MountPoints = []mount.MountPoint{{Device: "ceph-fuse", Path: stagingPath}}
+		}
+		if tt.corrupted {
+			// the ceph-fuse process serving the mount is gone
+			mounter.MountCheckErrors[stagingPath] = &os.PathError{Op: "stat", Path: stagingPath, Err: syscall.ENOTCONN}
+		}
+		ns := &NodeServer{
+			mounter:          mounter,
+			newVolumeMounter: func(*volumeOptions) (volumeMounter, error) { return &fakeVolumeMounter{mounter}, nil },
+		}
+
+		_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "csi-cephfs-vol-1",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  &csi.VolumeCapability{},
+			VolumeContext:     map[string]string{"monitors": "mon1:6789", "provisionVolume": "false", "rootPath": "/vol-1"},
+			Secrets:           map[string]string{"userID": "user", "userKey": "AQBvAbVcAAAAABAAjwnmzOwM9GDg7hDpeiYn7g=="},
+		})
+		if err != nil {
+			t.Errorf("%s: NodeStageVolume() = %v, want success", tt.name, err)
+		}
+
+		if actions := mountActions(mounter); !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("%s: want (%v), got (%v)", tt.name, tt.actions, actions)
+		}
+		if len(mounter.MountPoints) != 1 {
+			t.Errorf("%s: want the staging path mounted once, got (%v)", tt.name, mounter.MountPoints)
+		}
+	}
+}
+
+func TestNodePublishVolumeBindMounts(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+	stagingPath := path.Join(basePath, "staging")
+	targetPath := path.Join(basePath, "target")
+
+	if err = os.Mkdir(stagingPath, 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		staged     bool
+		mounted    bool
+		readOnly   bool
+		actions    []string
+		opts       []string
+		expectCode codes.Code
+	}{
+		{"bind-mount", true, false, false, []string{mount.FakeActionMount}, []string{"bind"}, codes.OK},
+		{"read-only bind-mount", true, false, true, []string{mount.FakeActionMount}, []string{"bind", "ro"}, codes.OK},
+		{"already mounted", true, true, false, []string{}, nil, codes.OK},
+		// after a reboot the staging path exists, but isn't mounted anymore
+		{"not staged", false, false, false, []string{}, nil, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		mounter := util.NewFakeMounter()
+		if tt.staged {
+			mounter.MountPoints = []mount.MountPoint{{Device: "mon1:6789:/vol-1", Path: stagingPath}}
+		}
+		if tt.mounted {
+			mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "mon1:6789:/vol-1", Path: targetPath})
+		}
+		ns := &NodeServer{mounter: mounter}
+
+		_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "csi-cephfs-vol-1",
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  &csi.VolumeCapability{},
+			Readonly:          tt.readOnly,
+		})
+		if status.Code(err) != tt.expectCode {
+			t.Errorf("%s: NodePublishVolume() = %v, want code %s", tt.name, err, tt.expectCode)
+		}
+
+		if actions := mountActions(mounter); !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("%s: want (%v), got (%v)", tt.name, tt.actions, actions)
+		}
+
+		for _, mp := range mounter.MountPoints {
+			if mp.Path != targetPath {
+				continue
+			}
+			if mp.Device != "mon1:6789:/vol-1" {
+				t.Errorf("%s: want the staged volume bind-mounted, got (%s)", tt.name, mp.Device)
+			}
+			if tt.opts != nil && !reflect.DeepEqual(mp.Opts, tt.opts) {
+				t.Errorf("%s: want options (%v), got (%v)", tt.name, tt.opts, mp.Opts)
+			}
+		}
+
+		if err = os.Remove(targetPath); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+}
+
+func TestNodeStageVolumeCanceledMount(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+	stagingPath := path.Join(basePath, "staging")
+
+	mounter := util.NewFakeMounter()
+	ns := &NodeServer{
+		mounter:          mounter,
+		newVolumeMounter: func(*volumeOptions) (volumeMounter, error) { return &lateVolumeMounter{fakeVolumeMounter{mounter}}, nil },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "csi-cephfs-vol-1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  &csi.VolumeCapability{},
+		VolumeContext:     map[string]string{"monitors": "mon1:6789", "provisionVolume": "false", "rootPath": "/vol-1"},
+		Secrets:           map[string]string{"userID": "user", "userKey": "AQBvAbVcAAAAABAAjwnmzOwM9GDg7hDpeiYn7g=="},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Failed: want (DeadlineExceeded), got (%v)", err)
+	}
+
+	// TEST: the mount completed after the cancellation is undone
+	want := []string{mount.FakeActionMount, mount.FakeActionUnmount}
+	if actions := mountActions(mounter); !reflect.DeepEqual(actions, want) {
+		t.Errorf("Failed: want (%v), got (%v)", want, actions)
+	}
+	if len(mounter.MountPoints) != 0 {
+		t.Errorf("Failed: want no mounts left, got (%v)", mounter.MountPoints)
+	}
+}
+
+func TestNodeStageVolumeInvalidSecrets(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+	stagingPath := path.Join(basePath, "staging")
+
+	tests := []struct {
+		name    string
+		context map[string]string
+		secrets map[string]string
+	}{
+		{"missing user key", map[string]string{"provisionVolume": "false", "rootPath": "/vol-1"}, map[string]string{"userID": "user"}},
+		{"wrong user key", map[string]string{"provisionVolume": "false", "rootPath": "/vol-1"}, map[string]string{"userID": "user", "userKey": "key"}},
+		{"user secret of provisioned volume", map[string]string{"provisionVolume": "true", "pool": "cephfs_data"}, map[string]string{"userID": "user", "userKey": "AQBvAbVcAAAAABAAjwnmzOwM9GDg7hDpeiYn7g=="}},
+	}
+
+	for _, tt := range tests {
+		mounter := util.NewFakeMounter()
+		ns := &NodeServer{
+			mounter:          mounter,
+			newVolumeMounter: func(*volumeOptions) (volumeMounter, error) { return &fakeVolumeMounter{mounter}, nil },
+		}
+
+		tt.context["monitors"] = "mon1:6789"
+		_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "csi-cephfs-vol-1",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  &csi.VolumeCapability{},
+			VolumeContext:     tt.context,
+			Secrets:           tt.secrets,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: Failed: want (InvalidArgument), got (%v)", tt.name, err)
+		}
+
+		// TEST: nothing is mounted with invalid secrets
+		if actions := mountActions(mounter); len(actions) != 0 {
+			t.Errorf("%s: Failed: want no mounts, got (%v)", tt.name, actions)
+		}
+	}
+}
+
+func TestNodePublishVolumeNonEmptyTarget(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "cephfs-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+	stagingPath := path.Join(basePath, "staging")
+	targetPath := path.Join(basePath, "target")
+
+	for _, p := range []string{stagingPath, targetPath} {
+		if err = os.Mkdir(p, 0750); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+	if err = ioutil.WriteFile(path.Join(targetPath, "data"), nil, 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	mounter := util.NewFakeMounter()
+	mounter.MountPoints = []mount.MountPoint{{Device: "mon1:6789:/vol-1", Path: stagingPath}}
+	ns := &NodeServer{mounter: mounter}
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "csi-cephfs-vol-1",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  &csi.VolumeCapability{},
+	}
+
+	// TEST: files in the target aren't shadowed
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "data") {
+		t.Errorf("Failed: want (FailedPrecondition) naming the file, got (%v)", err)
+	}
+	if actions := mountActions(mounter); len(actions) != 0 {
+		t.Errorf("Failed: want no mounts, got (%v)", actions)
+	}
+
+	// TEST: unless the driver allows it
+	util.AllowNonEmptyTargets = true
+	defer func() { util.AllowNonEmptyTargets = false }()
+	if _, err = ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
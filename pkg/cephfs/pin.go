@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+const (
+	pinTypeExport      = "export"
+	pinTypeDistributed = "distributed"
+	pinTypeRandom      = "random"
+
+	// extended attributes recording that the csi-volumes directory was
+	// created by the driver, and the pin applied to it
+	volumesRootOwnerAttr = "user.ceph-csi.owner"
+	volumesRootOwner     = "ceph-csi"
+	volumesRootPinAttr   = "user.ceph-csi.pin"
+)
+
+type fsDump struct {
+	Filesystems []struct {
+		ID     int64 `json:"id"`
+		MDSMap struct {
+			FsName string `json:"fs_name"`
+			MaxMDS int    `json:"max_mds"`
+		} `json:"mdsmap"`
+	} `json:"filesystems"`
+}
+
+// pinAttribute returns the CephFS extended attribute used for the pin type
+func pinAttribute(pinType string) string {
+	switch pinType {
+	case pinTypeDistributed:
+		return "ceph.dir.pin.distributed"
+	case pinTypeRandom:
+		return "ceph.dir.pin.random"
+	}
+	return "ceph.dir.pin"
+}
+
+func validatePin(pinType, setting string) error {
+	switch pinType {
+	case pinTypeExport:
+		rank, err := strconv.Atoi(setting)
+		if err != nil || rank < -1 {
+			return fmt.Errorf("invalid pinSetting '%s' for pin 'export', expected an MDS rank or -1", setting)
+		}
+	case pinTypeDistributed:
+		if setting != "0" && setting != "1" {
+			return fmt.Errorf("invalid pinSetting '%s' for pin 'distributed', expected 0 or 1", setting)
+		}
+	case pinTypeRandom:
+		p, err := strconv.ParseFloat(setting, 64)
+		if err != nil || p < 0 || p > 1 {
+			return fmt.Errorf("invalid pinSetting '%s' for pin 'random', expected a probability between 0.0 and 1.0", setting)
+		}
+	default:
+		return fmt.Errorf("unknown pin '%s'. Valid options are 'export', 'distributed' and 'random'", pinType)
+	}
+
+	return nil
+}
+
+// createVolumesRoot creates the csi-volumes directory in the mounted CephFS
+// root, marking it as created by the driver. The directory is prepared under
+// a temporary name so that the mark is never missing.
+func createVolumesRoot(ctx context.Context, volsRoot string, volID volumeID) error {
+	if pathExists(volsRoot) {
+		return nil
+	}
+
+	volsRootCreating := volsRoot + "-creating-" + string(volID)
+	if err := createMountPoint(volsRootCreating); err != nil {
+		return err
+	}
+
+	if err := setVolumeAttribute(ctx, volsRootCreating, volumesRootOwnerAttr, volumesRootOwner); err != nil {
+		return err
+	}
+
+	if err := os.Rename(volsRootCreating, volsRoot); err != nil {
+		// the directory was created by another CreateVolume in the meantime
+		if rmErr := os.Remove(volsRootCreating); rmErr != nil {
+			klog.Warningf("cephfs: failed to remove %s: %v", volsRootCreating, rmErr)
+		}
+		if !pathExists(volsRoot) {
+			return fmt.Errorf("couldn't create %s: %v", cephVolumesRoot, err)
+		}
+	}
+
+	return nil
+}
+
+// pinVolumesRoot pins the csi-volumes directory to MDS ranks, if it was
+// created by the driver and not pinned yet. Failures are only logged.
+func pinVolumesRoot(ctx context.Context, volsRoot string, volOptions *volumeOptions, adminCr *credentials) {
+	if owner, err := getVolumeAttribute(ctx, volsRoot, volumesRootOwnerAttr); err != nil || owner != volumesRootOwner {
+		klog.Warningf("cephfs: %s was not created by the driver, not pinning it", cephVolumesRoot)
+		return
+	}
+
+	requested := volOptions.Pin + "=" + volOptions.PinSetting
+	if pinned, err := getVolumeAttribute(ctx, volsRoot, volumesRootPinAttr); err == nil && pinned != "" {
+		if pinned != requested {
+			klog.Warningf("cephfs: %s is already pinned with %s, not pinning it with %s", cephVolumesRoot, pinned, requested)
+		}
+		return
+	}
+
+	if err := pinDirectory(ctx, volsRoot, volOptions, adminCr); err != nil {
+		klog.Warningf("cephfs: failed to pin %s: %v", cephVolumesRoot, err)
+		return
+	}
+
+	if err := setVolumeAttribute(ctx, volsRoot, volumesRootPinAttr, requested); err != nil {
+		klog.Warningf("cephfs: failed to record pin of %s: %v", cephVolumesRoot, err)
+	}
+}
+
+// pinDirectory pins the directory to MDS ranks, export pins are checked
+// against the number of active MDS ranks of the filesystem first
+func pinDirectory(ctx context.Context, dir string, volOptions *volumeOptions, adminCr *credentials) error {
+	if volOptions.Pin == pinTypeExport {
+		maxMDS, err := getMaxMDS(ctx, volOptions, adminCr)
+		if err != nil {
+			return err
+		}
+
+		// validated in volumeOptions.validate()
+		rank, _ := strconv.Atoi(volOptions.PinSetting) // nolint: errcheck
+		if rank >= maxMDS {
+			return fmt.Errorf("MDS rank %d is out of range, the filesystem has %d active MDS ranks", rank, maxMDS)
+		}
+	}
+
+	return setVolumeAttribute(ctx, dir, pinAttribute(volOptions.Pin), volOptions.PinSetting)
+}
+
+// getMaxMDS returns max_mds of the filesystem of the volume, the default one
+// if it isn't set
+func getMaxMDS(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (int, error) {
+	var dump fsDump
+
+	err := execCommandJSON(ctx, &dump, "ceph",
+		"-m", volOptions.Monitors,
+		"-n", cephEntityClientPrefix+adminCr.id,
+		"--key="+adminCr.key,
+		"-c", cephConfigPath,
+		"-f", "json",
+		"fs", "dump",
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(dump.Filesystems) == 0 {
+		return 0, fmt.Errorf("no filesystems found")
+	}
+
+	if volOptions.FsName == "" {
+		return dump.Filesystems[0].MDSMap.MaxMDS, nil
+	}
+
+	for _, fs := range dump.Filesystems {
+		if fs.MDSMap.FsName == volOptions.FsName {
+			return fs.MDSMap.MaxMDS, nil
+		}
+	}
+
+	return 0, fmt.Errorf("filesystem %s not found", volOptions.FsName)
+}
+
+func getVolumeAttribute(ctx context.Context, root, attrName string) (string, error) {
+	stdout, _, err := execCommand(ctx, "getfattr", "--only-values", "-n", attrName, root)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(stdout)), nil
+}
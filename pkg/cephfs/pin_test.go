@@ -0,0 +1,47 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"testing"
+)
+
+func TestValidatePin(t *testing.T) {
+	tests := []struct {
+		pinType string
+		setting string
+		valid   bool
+	}{
+		{pinTypeExport, "0", true},
+		{pinTypeExport, "-1", true},
+		{pinTypeExport, "-2", false},
+		{pinTypeExport, "rank1", false},
+		{pinTypeDistributed, "1", true},
+		{pinTypeDistributed, "2", false},
+		{pinTypeRandom, "0.01", true},
+		{pinTypeRandom, "1.5", false},
+		{pinTypeRandom, "", false},
+		{"ephemeral", "1", false},
+	}
+
+	for _, tt := range tests {
+		err := validatePin(tt.pinType, tt.setting)
+		if (err == nil) != tt.valid {
+			t.Errorf("Failed: validatePin(%s, %s) = %v, want valid (%t)", tt.pinType, tt.setting, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// the pool stats are shared by the CreateVolume calls within
+// poolStatsValidity, so that the check doesn't cost a ceph df each
+const poolStatsValidity = time.Minute
+
+type cephDf struct {
+	Pools []struct {
+		Name  string `json:"name"`
+		Stats struct {
+			MaxAvail int64 `json:"max_avail"`
+		} `json:"stats"`
+	} `json:"pools"`
+}
+
+type poolStats struct {
+	maxAvail int64
+	fetched  time.Time
+}
+
+// poolCapacityChecker rejects volumes larger than the space available in
+// their data pool, times the overcommit ratio
+type poolCapacityChecker struct {
+	overcommitRatio float64
+
+	mtx   sync.Mutex
+	stats map[string]poolStats
+}
+
+func newPoolCapacityChecker(overcommitRatio float64) *poolCapacityChecker {
+	return &poolCapacityChecker{
+		overcommitRatio: overcommitRatio,
+		stats:           make(map[string]poolStats),
+	}
+}
+
+// check returns OutOfRange if the volume doesn't fit in its data pool. Pool
+// stats which can't be read don't fail the provisioning.
+func (c *poolCapacityChecker) check(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, bytesQuota int64) error {
+	if c == nil || bytesQuota <= 0 {
+		return nil
+	}
+
+	maxAvail, err := c.maxAvail(ctx, volOptions, adminCr)
+	if err != nil {
+		klog.Warningf("cephfs: failed to get the space available in pool %s, not checking the volume size: %v", volOptions.Pool, err)
+		return nil
+	}
+
+	allowed := int64(float64(maxAvail) * c.overcommitRatio)
+	if bytesQuota > allowed {
+		return status.Errorf(codes.OutOfRange, "requested size of %d bytes exceeds the %d bytes available in pool %s (%d bytes with overcommit ratio %g)",
+			bytesQuota, maxAvail, volOptions.Pool, allowed, c.overcommitRatio)
+	}
+
+	return nil
+}
+
+func (c *poolCapacityChecker) maxAvail(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (int64, error) {
+	key := volOptions.Monitors + "/" + volOptions.Pool
+
+	c.mtx.Lock()
+	stats, ok := c.stats[key]
+	c.mtx.Unlock()
+	if ok && time.Since(stats.fetched) < poolStatsValidity {
+		return stats.maxAvail, nil
+	}
+
+	maxAvail, err := queryPoolMaxAvail(ctx, volOptions, adminCr)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mtx.Lock()
+	c.stats[key] = poolStats{maxAvail: maxAvail, fetched: time.Now()}
+	c.mtx.Unlock()
+
+	return maxAvail, nil
+}
+
+// poolNotFound is returned by queryPoolMaxAvail for pools ceph df doesn't
+// list
+type poolNotFound struct {
+	pool string
+}
+
+func (e *poolNotFound) Error() string {
+	return fmt.Sprintf("pool %s not found in ceph df", e.pool)
+}
+
+// queryPoolMaxAvail returns the space available in the pool of the volume
+// options according to ceph df
+func queryPoolMaxAvail(ctx context.Context, volOptions *volumeOptions, adminCr *credentials) (int64, error) {
+	var df cephDf
+	err := execCommandJSON(ctx, &df, "ceph",
+		"-m", volOptions.Monitors,
+		"-n", cephEntityClientPrefix+adminCr.id,
+		"--key="+adminCr.key,
+		"-c", cephConfigPath,
+		"-f", "json",
+		"df",
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pool := range df.Pools {
+		if pool.Name == volOptions.Pool {
+			return pool.Stats.MaxAvail, nil
+		}
+	}
+
+	return 0, &poolNotFound{pool: volOptions.Pool}
+}
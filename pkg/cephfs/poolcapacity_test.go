@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCeph puts a ceph running script on PATH, its arguments are recorded
+// in the calls file of tmpDir
+func fakeCeph(t *testing.T, script string) (tmpDir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-fake-ceph")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	path := os.Getenv("PATH")
+	cleanup = func() {
+		os.Setenv("PATH", path) // nolint: errcheck
+		os.RemoveAll(tmpDir)    // nolint: errcheck
+	}
+
+	script = "#!/bin/sh\necho \"$*\" >> " + filepath.Join(tmpDir, "calls") + "\n" + script + "\n"
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "ceph"), []byte(script), 0755); err != nil {
+		cleanup()
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+path); err != nil {
+		cleanup()
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	return tmpDir, cleanup
+}
+
+// fakeCephCalls returns the arguments of the runs of the fake ceph
+func fakeCephCalls(t *testing.T, tmpDir string) []string {
+	out, err := ioutil.ReadFile(filepath.Join(tmpDir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Test error %s", err)
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestPoolCapacityCheck(t *testing.T) {
+	// the df of a pool with 1000 bytes available
+	tmpDir, cleanup := fakeCeph(t, `echo '{"pools":[{"name":"other","stats":{"max_avail":5000}},{"name":"data","stats":{"max_avail":1000}}]}'`)
+	defer cleanup()
+
+	adminCr := &credentials{id: "admin", key: "key"}
+	tests := []struct {
+		name       string
+		pool       string
+		ratio      float64
+		size       int64
+		expectCode codes.Code
+	}{
+		{"fits", "data", 1, 1000, codes.OK},
+		{"oversized", "data", 1, 1001, codes.OutOfRange},
+		{"overcommitted", "data", 2.5, 2500, codes.OK},
+		{"oversized overcommitted", "data", 2.5, 2501, codes.OutOfRange},
+		{"no size", "data", 1, 0, codes.OK},
+		// the check doesn't fail the provisioning if the pool isn't known
+		{"unknown pool", "missing", 1, 1001, codes.OK},
+	}
+
+	for _, tt := range tests {
+		c := newPoolCapacityChecker(tt.ratio)
+		err := c.check(context.Background(), &volumeOptions{Monitors: "mon1", Pool: tt.pool}, adminCr, tt.size)
+		if status.Code(err) != tt.expectCode {
+			t.Errorf("%s: check() = %v, want code %s", tt.name, err, tt.expectCode)
+		}
+	}
+
+	// TEST: the stats of a pool are fetched once
+	before := len(fakeCephCalls(t, tmpDir))
+	c := newPoolCapacityChecker(1)
+	for i := 0; i < 3; i++ {
+		if err := c.check(context.Background(), &volumeOptions{Monitors: "mon1", Pool: "data"}, adminCr, 10); err != nil {
+			t.Fatalf("Failed: want (nil), got (%v)", err)
+		}
+	}
+	if got := len(fakeCephCalls(t, tmpDir)) - before; got != 1 {
+		t.Errorf("Failed: want (1) ceph df, got (%d)", got)
+	}
+
+	// TEST: a disabled check doesn't run ceph
+	var disabled *poolCapacityChecker
+	if err := disabled.check(context.Background(), &volumeOptions{Pool: "data"}, adminCr, 1<<40); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the pools of a cluster are shared by the CreateVolume calls within
+// poolsValidity, so that the validation doesn't cost a ceph osd lspools each.
+// Only pools found in the listing are trusted, pools missing from it are
+// looked up again, they may have been created since.
+const poolsValidity = 30 * time.Second
+
+type poolListing struct {
+	names   []string
+	fetched time.Time
+}
+
+// poolValidator checks that the data pool of provisioned volumes exists,
+// before it's set as the layout of their directory
+type poolValidator struct {
+	mtx      sync.Mutex
+	listings map[string]poolListing
+}
+
+func newPoolValidator() *poolValidator {
+	return &poolValidator{listings: make(map[string]poolListing)}
+}
+
+// check returns InvalidArgument, naming the pool, the cluster and the pools
+// of the cluster, if the pool of the volume options doesn't exist. clusterID
+// is the clusterID parameter of the volume, the monitors name the cluster if
+// it's empty. A nil validator doesn't check anything.
+func (v *poolValidator) check(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, clusterID string) error {
+	if v == nil {
+		return nil
+	}
+
+	names, cached, err := v.pools(ctx, volOptions, adminCr, true)
+	if err == nil && cached && !containsPool(names, volOptions.Pool) {
+		names, _, err = v.pools(ctx, volOptions, adminCr, false)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list the pools: %v", err)
+	}
+
+	if containsPool(names, volOptions.Pool) {
+		return nil
+	}
+
+	if clusterID == "" {
+		clusterID = volOptions.Monitors
+	}
+	available := "none"
+	if len(names) > 0 {
+		available = strings.Join(names, ", ")
+	}
+	return status.Errorf(codes.InvalidArgument, "pool %s not found in cluster %s, available pools: %s", volOptions.Pool, clusterID, available)
+}
+
+func containsPool(names []string, pool string) bool {
+	for _, name := range names {
+		if name == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// pools returns the names of the pools of the cluster, from the listing
+// fetched within poolsValidity if useCached is set. It returns whether the
+// names came from that listing.
+func (v *poolValidator) pools(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, useCached bool) ([]string, bool, error) {
+	key := volOptions.Monitors
+
+	if useCached {
+		v.mtx.Lock()
+		listing, ok := v.listings[key]
+		v.mtx.Unlock()
+		if ok && time.Since(listing.fetched) < poolsValidity {
+			return listing.names, true, nil
+		}
+	}
+
+	pools, err := util.ListPools(func() ([]byte, error) {
+		stdout, _, err := execCommand(ctx, "ceph", adminCephArgs(volOptions, adminCr, "osd", "lspools")...)
+		return stdout, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	names := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		names = append(names, pool.Name)
+	}
+	sort.Strings(names)
+
+	v.mtx.Lock()
+	v.listings[key] = poolListing{names: names, fetched: time.Now()}
+	v.mtx.Unlock()
+
+	return names, false, nil
+}
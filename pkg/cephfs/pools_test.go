@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPoolValidator(t *testing.T) {
+	tmpDir, cleanup := fakeCeph(t, `echo '[{"poolnum":2,"poolname":"cephfs_data"},{"poolnum":1,"poolname":"cephfs_metadata"}]'`)
+	defer cleanup()
+
+	cr := &credentials{id: "admin", key: "key"}
+	v := newPoolValidator()
+
+	for i := 0; i < 2; i++ {
+		if err := v.check(context.Background(), &volumeOptions{Monitors: "mon1", Pool: "cephfs_data"}, cr, "cluster-1"); err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	}
+
+	// TEST: the pools are listed once within poolsValidity
+	if calls := fakeCephCalls(t, tmpDir); len(calls) != 1 || !strings.Contains(calls[0], "osd lspools") {
+		t.Errorf("Failed: want (1) ceph osd lspools, got (%v)", calls)
+	}
+
+	// TEST: a typo'd pool is rejected, naming the cluster and its pools
+	err := v.check(context.Background(), &volumeOptions{Monitors: "mon1", Pool: "cephfs_dat"}, cr, "cluster-1")
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("Failed: want (%v), got (%v)", codes.InvalidArgument, err)
+	}
+	want := "pool cephfs_dat not found in cluster cluster-1, available pools: cephfs_data, cephfs_metadata"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Failed: want (%s), got (%v)", want, err)
+	}
+
+	// TEST: pools missing from the cached listing are looked up again, they
+	// may have been created since
+	if calls := fakeCephCalls(t, tmpDir); len(calls) != 2 {
+		t.Errorf("Failed: want (2) ceph osd lspools, got (%v)", calls)
+	}
+
+	// TEST: without validation the pool is taken as is
+	v = nil
+	if err = v.check(context.Background(), &volumeOptions{Pool: "cephfs_dat"}, nil, ""); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
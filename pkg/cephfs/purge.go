@@ -0,0 +1,218 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"k8s.io/klog"
+)
+
+// removing a large volume may take longer than a DeleteVolume call lasts, the
+// purge continues in the background and is collected by a retry
+type volumePurge struct {
+	// removed counts the removed files and directories, accessed atomically
+	removed int64
+	done    chan struct{}
+	err     error
+}
+
+const (
+	// DeleteVolume retries within purgeStateValidity of a purge in progress
+	// are answered with its last known progress
+	purgeStateValidity = 10 * time.Second
+	maxTrackedPurges   = 1024
+)
+
+var (
+	// volumePurges holds the purges in progress, and the finished ones which
+	// weren't collected by a retry yet
+	volumePurges    = make(map[volumeID]*volumePurge)
+	volumePurgesMtx sync.Mutex
+)
+
+// purgeInProgress is returned when the volume is still being removed after
+// the call ran out of time
+type purgeInProgress struct {
+	error
+}
+
+// purgeVolume removes the volume from the CephFS root. If it isn't removed
+// before ctx is done, purgeInProgress is returned and the removal continues,
+// a later call waits for it again and returns its result.
+func purgeVolume(ctx context.Context, volID volumeID, adminCr *credentials, volOptions *volumeOptions) error {
+	return runPurge(ctx, volID, func(removed *int64) error {
+		if err := mountCephRoot(ctx, volID, volOptions, adminCr); err != nil {
+			return err
+		}
+		defer unmountCephRoot(volID)
+
+		return purgeVolumeLocal(getCephRootPathLocal(volID), volID, removed)
+	})
+}
+
+// runPurge starts purge for the volume unless it's in progress already, and
+// waits for it until ctx is done
+func runPurge(ctx context.Context, volID volumeID, purge func(removed *int64) error) error {
+	volumePurgesMtx.Lock()
+	p, inProgress := volumePurges[volID]
+	if !inProgress {
+		p = &volumePurge{done: make(chan struct{})}
+		volumePurges[volID] = p
+	}
+	volumePurgesMtx.Unlock()
+
+	if inProgress {
+		klog.Infof("cephfs: volume %s is already being purged, waiting for it", volID)
+	} else {
+		go func() {
+			p.err = purge(&p.removed)
+			close(p.done)
+		}()
+	}
+
+	select {
+	case <-p.done:
+		volumePurgesMtx.Lock()
+		delete(volumePurges, volID)
+		volumePurgesMtx.Unlock()
+
+		return p.err
+	case <-ctx.Done():
+		return &purgeInProgress{fmt.Errorf("volume %s is still being purged, %d files and directories removed so far",
+			volID, atomic.LoadInt64(&p.removed))}
+	}
+}
+
+// purgeRunning returns whether the volume is still being removed in the
+// background, a finished purge which wasn't collected yet isn't running
+func purgeRunning(volID volumeID) bool {
+	volumePurgesMtx.Lock()
+	p, ok := volumePurges[volID]
+	volumePurgesMtx.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// volumesRootNotFound is returned when the csi-volumes directory itself is
+// missing from the CephFS root, as opposed to a single volume being missing
+type volumesRootNotFound struct {
+	error
+}
+
+// purgeVolumeLocal removes the volume from the CephFS root mounted at cephRoot,
+// counting the removed files and directories in removed
+func purgeVolumeLocal(cephRoot string, volID volumeID, removed *int64) error {
+	var (
+		volsRoot        = path.Join(cephRoot, cephVolumesRoot)
+		volRoot         = path.Join(volsRoot, string(volID))
+		volRootDeleting = volRoot + "-deleting"
+	)
+
+	if !pathExists(volsRoot) {
+		return &volumesRootNotFound{fmt.Errorf("cephfs: %s directory not found while deleting volume %s", cephVolumesRoot, volID)}
+	}
+
+	if pathExists(volRoot) {
+		if err := os.Rename(volRoot, volRootDeleting); err != nil {
+			return fmt.Errorf("couldn't mark volume %s for deletion: %v", volID, err)
+		}
+	} else {
+		if !pathExists(volRootDeleting) {
+			util.LogBenign("cephfs: volume %s not found, assuming it to be already deleted", volID)
+			return nil
+		}
+	}
+
+	if err := removeAll(volRootDeleting, removed); err != nil {
+		return fmt.Errorf("failed to delete volume %s: %v", volID, err)
+	}
+
+	return nil
+}
+
+// removeAll removes p and its children like os.RemoveAll, counting the
+// removed files and directories in removed
+func removeAll(p string, removed *int64) error {
+	err := os.Remove(p)
+	if err == nil {
+		atomic.AddInt64(removed, 1)
+		return nil
+	}
+
+	fi, statErr := os.Lstat(p)
+	if os.IsNotExist(statErr) {
+		return nil
+	}
+	if statErr != nil || !fi.IsDir() {
+		return err
+	}
+
+	for {
+		// the directory is read in batches, so that huge directories aren't
+		// listed in memory at once
+		names, readErr := readDirNames(p, 1024)
+		for _, name := range names {
+			if err = removeAll(path.Join(p, name), removed); err != nil {
+				return err
+			}
+		}
+
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if readErr == io.EOF || len(names) == 0 {
+			break
+		}
+	}
+
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	atomic.AddInt64(removed, 1)
+
+	return nil
+}
+
+func readDirNames(dir string, n int) ([]string, error) {
+	// #nosec
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close() // nolint: errcheck
+
+	return d.Readdirnames(n)
+}
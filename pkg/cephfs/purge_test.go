@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPurgeVolumeLocal(t *testing.T) {
+	cephRoot, err := ioutil.TempDir("", "cephfs-root")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(cephRoot)
+
+	volID := volumeID("csi-cephfs-test")
+	var removed int64
+	volRoot := path.Join(cephRoot, cephVolumesRoot, string(volID))
+
+	// TEST: missing csi-volumes directory is reported distinctly
+	err = purgeVolumeLocal(cephRoot, volID, &removed)
+	if _, ok := err.(*volumesRootNotFound); !ok {
+		t.Errorf("Failed: expected volumesRootNotFound, got %v", err)
+	}
+
+	// TEST: missing volume is treated as already deleted
+	if err = os.MkdirAll(path.Join(cephRoot, cephVolumesRoot), 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = purgeVolumeLocal(cephRoot, volID, &removed); err != nil {
+		t.Errorf("Failed: expected missing volume to succeed, got %v", err)
+	}
+
+	// TEST: existing volume is removed
+	if err = os.MkdirAll(path.Join(volRoot, "data"), 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = purgeVolumeLocal(cephRoot, volID, &removed); err != nil {
+		t.Errorf("Failed: expected purge to succeed, got %v", err)
+	}
+	if pathExists(volRoot) || pathExists(volRoot+"-deleting") {
+		t.Errorf("Failed: volume %s still exists after purge", volID)
+	}
+	// the volume root and its data directory
+	if removed != 2 {
+		t.Errorf("Failed: want (2) removed entries, got (%d)", removed)
+	}
+}
+
+func TestRunPurge(t *testing.T) {
+	volID := volumeID("csi-cephfs-test")
+	release := make(chan struct{})
+	var purges int
+	purge := func(removed *int64) error {
+		purges++
+		atomic.AddInt64(removed, 42)
+		<-release
+		return nil
+	}
+
+	// TEST: a purge which doesn't finish in time is reported as in progress
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := runPurge(ctx, volID, purge)
+	if _, ok := err.(*purgeInProgress); !ok {
+		t.Fatalf("Failed: want purgeInProgress, got (%v)", err)
+	}
+	if !strings.Contains(err.Error(), "42 files and directories removed") {
+		t.Errorf("Failed: want the progress in (%v)", err)
+	}
+
+	if !purgeRunning(volID) {
+		t.Errorf("Failed: want the purge running")
+	}
+
+	// TEST: a finished purge isn't running anymore before it's collected
+	close(release)
+	<-volumePurges[volID].done
+	if purgeRunning(volID) {
+		t.Errorf("Failed: want the finished purge not running")
+	}
+
+	// TEST: a retry collects the purge instead of starting one
+	if err = runPurge(context.Background(), volID, purge); err != nil {
+		t.Errorf("Failed: want success, got (%v)", err)
+	}
+	if purges != 1 {
+		t.Errorf("Failed: want (1) purge, got (%d)", purges)
+	}
+
+	// TEST: a collected purge is started again, e.g. after it failed
+	purge = func(removed *int64) error { return errors.New("purge failed") }
+	if err = runPurge(context.Background(), volID, purge); err == nil {
+		t.Errorf("Failed: want the purge to be started again")
+	}
+	if len(volumePurges) != 0 {
+		t.Errorf("Failed: want no purges left, got (%v)", volumePurges)
+	}
+}
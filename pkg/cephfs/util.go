@@ -18,9 +18,11 @@ package cephfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 
@@ -28,6 +30,7 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 
+	csicommon "github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/ceph/ceph-csi/pkg/util"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/kubernetes/pkg/util/keymutex"
@@ -36,6 +39,9 @@ import (
 
 type volumeID string
 
+// volumeIDPrefix is carried by the names of all volumes created by the driver
+const volumeIDPrefix = util.CephFSVolumePrefix
+
 func mustUnlock(m keymutex.KeyMutex, key string) {
 	if err := m.UnlockKey(key); err != nil {
 		klog.Fatalf("failed to unlock mutex for %s: %v", key, err)
@@ -43,10 +49,16 @@ func mustUnlock(m keymutex.KeyMutex, key string) {
 }
 
 func makeVolumeID(volName string) volumeID {
-	return volumeID("csi-cephfs-" + volName)
+	return volumeID(volumeIDPrefix + volName)
+}
+
+func execCommand(ctx context.Context, program string, args ...string) (stdout, stderr []byte, err error) {
+	return execCommandWithStdin(ctx, nil, program, args...)
 }
 
-func execCommand(program string, args ...string) (stdout, stderr []byte, err error) {
+// execCommandWithStdin runs the program like execCommand, with stdin streamed
+// to its standard input if it's not nil
+func execCommandWithStdin(ctx context.Context, stdin io.Reader, program string, args ...string) (stdout, stderr []byte, err error) {
 	var (
 		cmd           = exec.Command(program, args...) // nolint: gosec
 		sanitizedArgs = util.StripSecretInArgs(args)
@@ -57,23 +69,33 @@ func execCommand(program string, args ...string) (stdout, stderr []byte, err err
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
 
-	klog.V(4).Infof("cephfs: EXEC %s %s", program, sanitizedArgs)
+	release, err := util.StartExec(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start %s %v: %v", program, sanitizedArgs, err)
+	}
+	defer release()
+
+	util.V(util.LogBackend, 4).Infof("cephfs: EXEC %s %s", program, sanitizedArgs)
 
-	if err := cmd.Run(); err != nil {
-		return nil, nil, fmt.Errorf("an error occurred while running (%d) %s %v: %v: %s",
-			cmd.Process.Pid, program, sanitizedArgs, err, stderrBuf.Bytes())
+	// mount helpers fork further processes, they are killed with it
+	if err = util.RunCommandWithStdin(ctx, cmd, stdin); err != nil {
+		if cmd.Process == nil {
+			return nil, nil, util.PIDLimitError(fmt.Errorf("failed to start %s %v: %v", program, sanitizedArgs, err))
+		}
+		return nil, nil, util.PIDLimitError(fmt.Errorf("an error occurred while running (%d) %s %v: %v: %s",
+			cmd.Process.Pid, program, sanitizedArgs, err, stderrBuf.Bytes()))
 	}
 
 	return stdoutBuf.Bytes(), stderrBuf.Bytes(), nil
 }
 
-func execCommandErr(program string, args ...string) error {
-	_, _, err := execCommand(program, args...)
+func execCommandErr(ctx context.Context, program string, args ...string) error {
+	_, _, err := execCommand(ctx, program, args...)
 	return err
 }
 
-func execCommandJSON(v interface{}, program string, args ...string) error {
-	stdout, _, err := execCommand(program, args...)
+func execCommandJSON(ctx context.Context, v interface{}, program string, args ...string) error {
+	stdout, _, err := execCommand(ctx, program, args...)
 	if err != nil {
 		return err
 	}
@@ -104,8 +126,9 @@ func pathExists(p string) bool {
 
 // Controller service request validation
 func (cs *ControllerServer) validateCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
+	// the status code of the error tells the sidecars not to retry
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		return fmt.Errorf("invalid CreateVolumeRequest: %v", err)
+		return err
 	}
 
 	if req.GetName() == "" {
@@ -123,12 +146,14 @@ func (cs *ControllerServer) validateCreateVolumeRequest(req *csi.CreateVolumeReq
 		}
 	}
 
-	return nil
+	// quotas are byte granular, the required size is never rounded
+	return csicommon.ValidateCapacityRange(req.GetCapacityRange())
 }
 
 func (cs *ControllerServer) validateDeleteVolumeRequest() error {
+	// the status code of the error tells the sidecars not to retry
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		return fmt.Errorf("invalid DeleteVolumeRequest: %v", err)
+		return err
 	}
 
 	return nil
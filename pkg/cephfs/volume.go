@@ -17,19 +17,38 @@ limitations under the License.
 package cephfs
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
+	"github.com/ceph/ceph-csi/pkg/util"
 	"k8s.io/klog"
 )
 
 const (
 	cephVolumesRoot = "csi-volumes"
 
+	// VolumeContext key of the CephFS path of provisioned volumes
+	volumePathKey = "volumePath"
+
 	namespacePrefix = "ns-"
+
+	compressionModeAggressive = "aggressive"
+	compressionModePassive    = "passive"
+	compressionModeNone       = "none"
+
+	// prefix of the extended attributes holding the backend metadata
+	backendMetadataAttrPrefix = "user."
 )
 
+type poolCompressionMode struct {
+	CompressionMode string `json:"compression_mode"`
+}
+
 func getCephRootPathLocal(volID volumeID) string {
 	return fmt.Sprintf("%s/controller/volumes/root-%s", PluginFolder, string(volID))
 }
@@ -42,85 +61,216 @@ func getVolumeRootPathCeph(volID volumeID) string {
 	return path.Join("/", cephVolumesRoot, string(volID))
 }
 
+// getVolumeRootPathFromContext returns the CephFS path of a provisioned
+// volume from its volume context, volumes created before the path was part
+// of it have it derived from their ID
+func getVolumeRootPathFromContext(volID volumeID, volContext map[string]string) string {
+	if p := volContext[volumePathKey]; p != "" {
+		return p
+	}
+	return getVolumeRootPathCeph(volID)
+}
+
 func getVolumeNamespace(volID volumeID) string {
 	return namespacePrefix + string(volID)
 }
 
-func setVolumeAttribute(root, attrName, attrValue string) error {
-	return execCommandErr("setfattr", "-n", attrName, "-v", attrValue, root)
+func setVolumeAttribute(ctx context.Context, root, attrName, attrValue string) error {
+	return execCommandErr(ctx, "setfattr", "-n", attrName, "-v", attrValue, root)
 }
 
-func createVolume(volOptions *volumeOptions, adminCr *credentials, volID volumeID, bytesQuota int64) error {
-	if err := mountCephRoot(volID, volOptions, adminCr); err != nil {
-		return err
+// volumeNameCollision is returned when the directory of a volume exists
+// already, but isn't recorded in the metadata store, e.g. left over by a
+// volume of the same name whose deletion didn't complete
+type volumeNameCollision struct {
+	error
+}
+
+// createVolume creates the volume, if it doesn't exist yet, and returns its
+// quota in bytes, 0 if it has none, and whether the volume was created by
+// this call, even if it fails later on. An existing volume is only reused if
+// it's recorded in the metadata store.
+func createVolume(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID, recorded bool, bytesQuota int64, metadata map[string]string) (int64, bool, error) {
+	if err := mountCephRoot(ctx, volID, volOptions, adminCr); err != nil {
+		return 0, false, err
 	}
 	defer unmountCephRoot(volID)
 
+	volRoot := getCephRootVolumePathLocal(volID)
+	created, err := createVolumeDirectory(ctx, volOptions, adminCr, volID, recorded, bytesQuota, metadata)
+	if err != nil {
+		return 0, created, err
+	}
+
+	quota, err := getVolumeQuota(ctx, volRoot)
+	return quota, created, err
+}
+
+// createVolumeDirectory returns whether the volume was created, rather than
+// existing already. The backend metadata is set as user extended attributes
+// of the volume directory.
+func createVolumeDirectory(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID, recorded bool, bytesQuota int64, metadata map[string]string) (bool, error) {
+
 	var (
+		volsRoot        = path.Join(getCephRootPathLocal(volID), cephVolumesRoot)
 		volRoot         = getCephRootVolumePathLocal(volID)
 		volRootCreating = volRoot + "-creating"
 	)
 
 	if pathExists(volRoot) {
-		klog.V(4).Infof("cephfs: volume %s already exists, skipping creation", volID)
-		return nil
+		if !recorded {
+			return false, &volumeNameCollision{fmt.Errorf("directory %s of volume %s exists but isn't recorded in the metadata store, "+
+				"it may be left over by a volume of the same name whose deletion didn't complete: "+
+				"remove it manually if it's stale, it's never reused", getVolumeRootPathCeph(volID), volID)}
+		}
+		util.LogBenign("cephfs: volume %s already exists, skipping creation", volID)
+		return false, nil
+	}
+
+	if err := createVolumesRoot(ctx, volsRoot, volID); err != nil {
+		return false, err
+	}
+
+	if volOptions.Pin != "" {
+		pinVolumesRoot(ctx, volsRoot, volOptions, adminCr)
 	}
 
 	if err := createMountPoint(volRootCreating); err != nil {
-		return err
+		return false, err
+	}
+
+	if err := setVolumeOwnership(volRootCreating, volOptions); err != nil {
+		return false, err
 	}
 
 	if bytesQuota > 0 {
-		if err := setVolumeAttribute(volRootCreating, "ceph.quota.max_bytes", fmt.Sprintf("%d", bytesQuota)); err != nil {
-			return err
+		endPhase := util.StartPhase(ctx, "setQuota")
+		err := setVolumeAttribute(ctx, volRootCreating, "ceph.quota.max_bytes", fmt.Sprintf("%d", bytesQuota))
+		endPhase()
+		if err != nil {
+			return false, err
 		}
 	}
 
-	if err := setVolumeAttribute(volRootCreating, "ceph.dir.layout.pool", volOptions.Pool); err != nil {
-		return fmt.Errorf("%v\ncephfs: Does pool '%s' exist?", err, volOptions.Pool)
+	if err := setVolumeAttribute(ctx, volRootCreating, "ceph.dir.layout.pool", volOptions.Pool); err != nil {
+		return false, fmt.Errorf("%v\ncephfs: Does pool '%s' exist?", err, volOptions.Pool)
 	}
 
-	if err := setVolumeAttribute(volRootCreating, "ceph.dir.layout.pool_namespace", getVolumeNamespace(volID)); err != nil {
-		return err
+	if err := setVolumeAttribute(ctx, volRootCreating, "ceph.dir.layout.pool_namespace", getVolumeNamespace(volID)); err != nil {
+		return false, err
 	}
 
-	if err := os.Rename(volRootCreating, volRoot); err != nil {
-		return fmt.Errorf("couldn't mark volume %s as created: %v", volID, err)
+	err := util.SetBackendMetadata(metadata, func(key, value string) error {
+		// hex encoded, setfattr would decode values looking like 0x... or
+		// 0s... otherwise
+		return setVolumeAttribute(ctx, volRootCreating, backendMetadataAttrPrefix+key, "0x"+hex.EncodeToString([]byte(value)))
+	})
+	if err != nil {
+		return false, err
 	}
 
-	return nil
-}
+	if volOptions.CompressionMode != "" {
+		checkPoolCompression(ctx, volOptions, adminCr, volID)
+	}
 
-func purgeVolume(volID volumeID, adminCr *credentials, volOptions *volumeOptions) error {
-	if err := mountCephRoot(volID, volOptions, adminCr); err != nil {
-		return err
+	if volOptions.PinVolume {
+		if err := pinDirectory(ctx, volRootCreating, volOptions, adminCr); err != nil {
+			klog.Warningf("cephfs: failed to pin volume %s: %v", volID, err)
+		}
 	}
-	defer unmountCephRoot(volID)
 
-	var (
-		volRoot         = getCephRootVolumePathLocal(volID)
-		volRootDeleting = volRoot + "-deleting"
-	)
+	if err := os.Rename(volRootCreating, volRoot); err != nil {
+		return false, fmt.Errorf("couldn't mark volume %s as created: %v", volID, err)
+	}
 
-	if pathExists(volRoot) {
-		if err := os.Rename(volRoot, volRootDeleting); err != nil {
-			return fmt.Errorf("couldn't mark volume %s for deletion: %v", volID, err)
+	return true, nil
+}
+
+// setVolumeOwnership sets the uid, gid and mode of the volume options on the
+// root directory of the volume, the options are validated already
+func setVolumeOwnership(root string, volOptions *volumeOptions) error {
+	if volOptions.UID != "" || volOptions.GID != "" {
+		uid, gid := -1, -1
+		if volOptions.UID != "" {
+			id, _ := strconv.ParseUint(volOptions.UID, 10, 32) // nolint: errcheck
+			uid = int(id)
 		}
-	} else {
-		if !pathExists(volRootDeleting) {
-			klog.V(4).Infof("cephfs: volume %s not found, assuming it to be already deleted", volID)
-			return nil
+		if volOptions.GID != "" {
+			id, _ := strconv.ParseUint(volOptions.GID, 10, 32) // nolint: errcheck
+			gid = int(id)
+		}
+		if err := os.Chown(root, uid, gid); err != nil {
+			return fmt.Errorf("failed to set the owner of the volume: %v", err)
 		}
 	}
 
-	if err := os.RemoveAll(volRootDeleting); err != nil {
-		return fmt.Errorf("failed to delete volume %s: %v", volID, err)
+	if volOptions.Mode != "" {
+		m, _ := strconv.ParseUint(volOptions.Mode, 8, 32) // nolint: errcheck
+		// os.FileMode has its own bits for setuid, setgid and sticky
+		mode := os.FileMode(m) & os.ModePerm
+		if m&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if m&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if m&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		if err := os.Chmod(root, mode); err != nil {
+			return fmt.Errorf("failed to set the mode of the volume: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func mountCephRoot(volID volumeID, volOptions *volumeOptions, adminCr *credentials) error {
+// getVolumeQuota returns the max_bytes quota of the volume, 0 if it has none
+func getVolumeQuota(ctx context.Context, volRoot string) (int64, error) {
+	quota, err := getVolumeAttribute(ctx, volRoot, "ceph.quota.max_bytes")
+	if err != nil {
+		if strings.Contains(err.Error(), "No such attribute") {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if quota == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(quota, 10, 64)
+}
+
+// checkPoolCompression compares the requested compressionMode with the one
+// configured on the data pool. CephFS has no per-directory compression
+// setting, so a mismatch is only reported and never fails the provisioning.
+func checkPoolCompression(ctx context.Context, volOptions *volumeOptions, adminCr *credentials, volID volumeID) {
+	var poolMode poolCompressionMode
+
+	err := execCommandJSON(ctx, &poolMode, "ceph",
+		"-m", volOptions.Monitors,
+		"-n", cephEntityClientPrefix+adminCr.id,
+		"--key="+adminCr.key,
+		"-c", cephConfigPath,
+		"-f", "json",
+		"osd", "pool", "get", volOptions.Pool, "compression_mode",
+	)
+	if err != nil {
+		// compression_mode is not set on the pool at all
+		poolMode.CompressionMode = compressionModeNone
+		klog.V(4).Infof("cephfs: failed to get compression_mode of pool %s: %v", volOptions.Pool, err)
+	}
+
+	if poolMode.CompressionMode != volOptions.CompressionMode {
+		klog.Warningf("cephfs: volume %s requested compressionMode %s, but pool %s has compression_mode %s",
+			volID, volOptions.CompressionMode, volOptions.Pool, poolMode.CompressionMode)
+	}
+}
+
+func mountCephRoot(ctx context.Context, volID volumeID, volOptions *volumeOptions, adminCr *credentials) error {
+	defer util.StartPhase(ctx, "mountRoot")()
+
 	cephRoot := getCephRootPathLocal(volID)
 
 	// Root path is not set for dynamically provisioned volumes
@@ -136,7 +286,7 @@ func mountCephRoot(volID volumeID, volOptions *volumeOptions, adminCr *credentia
 		return fmt.Errorf("failed to create mounter: %v", err)
 	}
 
-	if err = m.mount(cephRoot, adminCr, volOptions); err != nil {
+	if err = m.mount(ctx, cephRoot, adminCr, volOptions); err != nil {
 		return fmt.Errorf("error mounting ceph root: %v", err)
 	}
 
@@ -146,7 +296,8 @@ func mountCephRoot(volID volumeID, volOptions *volumeOptions, adminCr *credentia
 func unmountCephRoot(volID volumeID) {
 	cephRoot := getCephRootPathLocal(volID)
 
-	if err := unmountVolume(cephRoot); err != nil {
+	// the root must be unmounted even if the operation ran out of time
+	if err := unmountVolume(context.Background(), cephRoot); err != nil {
 		klog.Errorf("failed to unmount %s with error %s", cephRoot, err)
 	} else {
 		if err := os.Remove(cephRoot); err != nil {
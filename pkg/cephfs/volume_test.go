@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSetVolumeOwnership(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cephfs-volume")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "csi-cephfs-vol-1-creating")
+	if err = createMountPoint(root); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// changing the group to one of our own groups needs no privileges
+	gid := strconv.Itoa(os.Getgid())
+	volOptions := &volumeOptions{UID: strconv.Itoa(os.Getuid()), GID: gid, Mode: "2775"}
+	if err = setVolumeOwnership(root, volOptions); err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Test error %s", err)
+	}
+	// TEST: the setgid bit is set along with the permissions
+	if want := os.ModeDir | os.ModeSetgid | 0775; fi.Mode() != want {
+		t.Errorf("Failed: want (%v), got (%v)", want, fi.Mode())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && strconv.Itoa(int(st.Gid)) != gid {
+		t.Errorf("Failed: want gid (%s), got (%d)", gid, st.Gid)
+	}
+
+	// TEST: without options the directory is left alone
+	if err = setVolumeOwnership(root, &volumeOptions{}); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
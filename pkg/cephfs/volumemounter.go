@@ -17,15 +17,21 @@ limitations under the License.
 package cephfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+
+	"github.com/ceph/ceph-csi/pkg/util"
 
 	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 const (
@@ -34,29 +40,117 @@ const (
 )
 
 var (
+	// CephFuseBinary is the path of the ceph-fuse binary
+	CephFuseBinary = "ceph-fuse"
+	// MountBinary is the path of the mount binary used for kernel mounts
+	// and bind-mounts
+	MountBinary = "mount"
+
 	availableMounters []string
 
+	// cephFuseVersion is the version of ceph-fuse, detected in
+	// loadAvailableMounters()
+	cephFuseVersion cephVersion
+	cephVersionRx   = regexp.MustCompile(`ceph version (\d+)\.(\d+)\.(\d+)`)
+
 	// maps a mountpoint to PID of its FUSE daemon
 	fusePidMap    = make(map[string]int)
 	fusePidMapMtx sync.Mutex
 
 	fusePidRx = regexp.MustCompile(`(?m)^ceph-fuse\[(.+)\]: starting fuse$`)
+
+	// sessionRecovery enables the client side options which let evicted
+	// clients reconnect, set from driver.go's Run()
+	sessionRecovery bool
+	// kernelRecoverSession is true if the kernel client understands
+	// the recover_session mount option
+	kernelRecoverSession bool
+)
+
+// recover_session mount option is available since Linux 5.4
+const (
+	recoverSessionKernelMajor = 5
+	recoverSessionKernelMinor = 4
+)
+
+// ceph-fuse options which are only passed to versions supporting them
+var (
+	// client_reconnect_stale is available since Nautilus
+	reconnectStaleVersion = cephVersion{major: 14}
+	// Pacific ceph-fuse is built with libfuse3, which rejects nonempty
+	fuse3Version = cephVersion{major: 16}
 )
 
+// cephVersion is a Ceph release version, development builds don't have a
+// version number and are considered to be newer than any release
+type cephVersion struct {
+	major, minor, patch int
+	dev                 bool
+}
+
+func (v cephVersion) String() string {
+	if v.dev {
+		return "development"
+	}
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v cephVersion) atLeast(o cephVersion) bool {
+	if v.dev {
+		return true
+	}
+	if v.major != o.major {
+		return v.major > o.major
+	}
+	if v.minor != o.minor {
+		return v.minor > o.minor
+	}
+	return v.patch >= o.patch
+}
+
+// parseCephVersion parses the output of `ceph-fuse --version`, e.g.
+// "ceph version 14.2.22 (ca74598065096e6fcbd8433c8779a2be0c889351) nautilus (stable)"
+// or "ceph version Development (no_version) pacific (dev)". The output may
+// contain other lines, like the FUSE library version.
+func parseCephVersion(output string) (cephVersion, error) {
+	if match := cephVersionRx.FindStringSubmatch(output); match != nil {
+		// the groups only match digits
+		major, _ := strconv.Atoi(match[1]) // nolint: errcheck
+		minor, _ := strconv.Atoi(match[2]) // nolint: errcheck
+		patch, _ := strconv.Atoi(match[3]) // nolint: errcheck
+		return cephVersion{major: major, minor: minor, patch: patch}, nil
+	}
+
+	if strings.Contains(output, "ceph version Development") {
+		return cephVersion{dev: true}, nil
+	}
+
+	return cephVersion{}, fmt.Errorf("unrecognized ceph version output: %q", output)
+}
+
 // Load available ceph mounters installed on system into availableMounters
 // Called from driver.go's Run()
 func loadAvailableMounters() error {
 	// #nosec
-	fuseMounterProbe := exec.Command("ceph-fuse", "--version")
+	fuseMounterProbe := exec.Command(CephFuseBinary, "--version")
 	// #nosec
 	kernelMounterProbe := exec.Command("mount.ceph")
 
-	if fuseMounterProbe.Run() == nil {
+	if out, err := fuseMounterProbe.CombinedOutput(); err == nil {
 		availableMounters = append(availableMounters, volumeMounterFuse)
+
+		if cephFuseVersion, err = parseCephVersion(string(out)); err != nil {
+			klog.Warningf("cephfs: failed to detect ceph-fuse version, version dependent options won't be used: %v", err)
+		} else {
+			klog.Infof("cephfs: detected ceph-fuse version %s", cephFuseVersion)
+		}
+	} else {
+		util.V(util.LogMount, 4).Infof("cephfs: %s not available: %v", CephFuseBinary, err)
 	}
 
 	if kernelMounterProbe.Run() == nil {
 		availableMounters = append(availableMounters, volumeMounterKernel)
+		kernelRecoverSession = kernelSupportsRecoverSession()
 	}
 
 	if len(availableMounters) == 0 {
@@ -66,8 +160,61 @@ func loadAvailableMounters() error {
 	return nil
 }
 
+func isMounterAvailable(mounter string) bool {
+	for _, availMounter := range availableMounters {
+		if availMounter == mounter {
+			return true
+		}
+	}
+	return false
+}
+
+func kernelSupportsRecoverSession() bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		klog.Warningf("cephfs: failed to get kernel version: %v", err)
+		return false
+	}
+
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+
+	return kernelVersionAtLeast(string(release), recoverSessionKernelMajor, recoverSessionKernelMinor)
+}
+
+// kernelVersionAtLeast parses a kernel release string like "5.4.0-42-generic"
+func kernelVersionAtLeast(release string, major, minor int) bool {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+
+	relMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+
+	// minor may carry a suffix, e.g. "4-rc1"
+	minorStr := parts[1]
+	if i := strings.IndexFunc(minorStr, func(r rune) bool { return r < '0' || r > '9' }); i != -1 {
+		minorStr = minorStr[:i]
+	}
+
+	relMinor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return false
+	}
+
+	return relMajor > major || (relMajor == major && relMinor >= minor)
+}
+
 type volumeMounter interface {
-	mount(mountPoint string, cr *credentials, volOptions *volumeOptions) error
+	mount(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error
 	name() string
 }
 
@@ -111,17 +258,29 @@ func newMounter(volOptions *volumeOptions) (volumeMounter, error) {
 
 type fuseMounter struct{}
 
-func mountFuse(mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+func mountFuse(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
 	args := [...]string{
 		mountPoint,
 		"-m", volOptions.Monitors,
 		"-c", cephConfigPath,
 		"-n", cephEntityClientPrefix + cr.id, "--key=" + cr.key,
 		"-r", volOptions.RootPath,
-		"-o", "nonempty",
 	}
 
-	_, stderr, err := execCommand("ceph-fuse", args[:]...)
+	fuseArgs := args[:]
+	// the version is zero if it couldn't be detected, only builds detected
+	// as libfuse3 ones don't get nonempty
+	if !cephFuseVersion.atLeast(fuse3Version) {
+		fuseArgs = append(fuseArgs, "-o", "nonempty")
+	}
+	if sessionRecovery && cephFuseVersion.atLeast(reconnectStaleVersion) {
+		fuseArgs = append(fuseArgs, "--client_reconnect_stale=true")
+	}
+	if volOptions.FsName != "" {
+		fuseArgs = append(fuseArgs, "--client_mds_namespace="+volOptions.FsName)
+	}
+
+	_, stderr, err := execCommand(ctx, CephFuseBinary, fuseArgs...)
 	if err != nil {
 		return err
 	}
@@ -147,48 +306,56 @@ func mountFuse(mountPoint string, cr *credentials, volOptions *volumeOptions) er
 	return nil
 }
 
-func (m *fuseMounter) mount(mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+func (m *fuseMounter) mount(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
 	if err := createMountPoint(mountPoint); err != nil {
 		return err
 	}
 
-	return mountFuse(mountPoint, cr, volOptions)
+	return mountFuse(ctx, mountPoint, cr, volOptions)
 }
 
 func (m *fuseMounter) name() string { return "Ceph FUSE driver" }
 
 type kernelMounter struct{}
 
-func mountKernel(mountPoint string, cr *credentials, volOptions *volumeOptions) error {
-	if err := execCommandErr("modprobe", "ceph"); err != nil {
+func mountKernel(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+	if err := execCommandErr(ctx, "modprobe", "ceph"); err != nil {
 		return err
 	}
 
-	return execCommandErr("mount",
+	optionsStr := fmt.Sprintf("name=%s,secret=%s", cr.id, cr.key)
+	if sessionRecovery && kernelRecoverSession {
+		optionsStr += ",recover_session=clean"
+	}
+	if volOptions.FsName != "" {
+		optionsStr += ",mds_namespace=" + volOptions.FsName
+	}
+
+	return execCommandErr(ctx, MountBinary,
 		"-t", "ceph",
 		fmt.Sprintf("%s:%s", volOptions.Monitors, volOptions.RootPath),
 		mountPoint,
-		"-o", fmt.Sprintf("name=%s,secret=%s", cr.id, cr.key),
+		"-o", optionsStr,
 	)
 }
 
-func (m *kernelMounter) mount(mountPoint string, cr *credentials, volOptions *volumeOptions) error {
+func (m *kernelMounter) mount(ctx context.Context, mountPoint string, cr *credentials, volOptions *volumeOptions) error {
 	if err := createMountPoint(mountPoint); err != nil {
 		return err
 	}
 
-	return mountKernel(mountPoint, cr, volOptions)
+	return mountKernel(ctx, mountPoint, cr, volOptions)
 }
 
 func (m *kernelMounter) name() string { return "Ceph kernel client" }
 
-func bindMount(from, to string, readOnly bool) error {
-	if err := execCommandErr("mount", "--bind", from, to); err != nil {
+func bindMount(ctx context.Context, from, to string, readOnly bool) error {
+	if err := execCommandErr(ctx, MountBinary, "--bind", from, to); err != nil {
 		return fmt.Errorf("failed to bind-mount %s to %s: %v", from, to, err)
 	}
 
 	if readOnly {
-		if err := execCommandErr("mount", "-o", "remount,ro,bind", to); err != nil {
+		if err := execCommandErr(ctx, MountBinary, "-o", "remount,ro,bind", to); err != nil {
 			return fmt.Errorf("failed read-only remount of %s: %v", to, err)
 		}
 	}
@@ -196,11 +363,34 @@ func bindMount(from, to string, readOnly bool) error {
 	return nil
 }
 
-func unmountVolume(mountPoint string) error {
-	if err := execCommandErr("umount", mountPoint); err != nil {
+// nodeMounter is the util.Mounter of the node server, bind-mounts are done
+// with MountBinary
+type nodeMounter struct {
+	util.Mounter
+}
+
+func newNodeMounter() util.Mounter {
+	return &nodeMounter{util.NewMounter(mount.New(""))}
+}
+
+func (m *nodeMounter) BindMount(ctx context.Context, from, to string, readOnly bool) error {
+	return bindMount(ctx, from, to, readOnly)
+}
+
+func unmountVolume(ctx context.Context, mountPoint string) error {
+	if err := execCommandErr(ctx, "umount", mountPoint); err != nil {
 		return err
 	}
 
+	releaseFuseProcess(mountPoint)
+
+	return nil
+}
+
+// releaseFuseProcess reaps the ceph-fuse process serving the unmounted mount
+// point, if any. The process exits once the mount is released, which is
+// delayed by lazy unmounts, so it's waited for in the background.
+func releaseFuseProcess(mountPoint string) {
 	fusePidMapMtx.Lock()
 	pid, ok := fusePidMap[mountPoint]
 	if ok {
@@ -208,18 +398,21 @@ func unmountVolume(mountPoint string) error {
 	}
 	fusePidMapMtx.Unlock()
 
-	if ok {
-		p, err := os.FindProcess(pid)
-		if err != nil {
-			klog.Warningf("failed to find process %d: %v", pid, err)
-		} else {
-			if _, err = p.Wait(); err != nil {
-				klog.Warningf("%d is not a child process: %v", pid, err)
-			}
-		}
+	if !ok {
+		return
 	}
 
-	return nil
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		klog.Warningf("failed to find process %d: %v", pid, err)
+		return
+	}
+
+	go func() {
+		if _, err := p.Wait(); err != nil {
+			klog.Warningf("%d is not a child process: %v", pid, err)
+		}
+	}()
 }
 
 func createMountPoint(root string) error {
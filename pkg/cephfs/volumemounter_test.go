@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"testing"
+)
+
+func TestKernelVersionAtLeast(t *testing.T) {
+	tests := map[string]bool{
+		"5.4.0-42-generic":        true,
+		"5.10.0":                  true,
+		"6.1":                     true,
+		"5.3.18-lp152.19-default": false,
+		"4.18.0-193.el8.x86_64":   false,
+		"3.10.0-1127.el7.x86_64":  false,
+		"5.4-rc1":                 true,
+		"garbage":                 false,
+		"":                        false,
+		"x.4.0":                   false,
+	}
+
+	for release, want := range tests {
+		if got := kernelVersionAtLeast(release, 5, 4); got != want {
+			t.Errorf("kernelVersionAtLeast(%q, 5, 4) = %v, want %v", release, got, want)
+		}
+	}
+}
+
+func TestParseCephVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   cephVersion
+		valid  bool
+	}{
+		{"ceph version 14.2.22 (ca74598065096e6fcbd8433c8779a2be0c889351) nautilus (stable)\n", cephVersion{major: 14, minor: 2, patch: 22}, true},
+		{"ceph version 15.2.13 (c44bc49e7a57a87d84dfff2a077a2058aa2172e2) octopus (stable)\n", cephVersion{major: 15, minor: 2, patch: 13}, true},
+		{"FUSE library version: 3.9.4\nceph version 16.2.5-387-g7282d81d (7282d81d2c500b5b0e929c07971b72444c6ac424) pacific (stable)\n", cephVersion{major: 16, minor: 2, patch: 5}, true},
+		{"ceph version Development (no_version) pacific (dev)\n", cephVersion{dev: true}, true},
+		{"ceph-fuse: unknown option --version\n", cephVersion{}, false},
+		{"", cephVersion{}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCephVersion(tt.output)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseCephVersion(%q) error = %v, want valid %v", tt.output, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCephVersion(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestCephVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v, o cephVersion
+		want bool
+	}{
+		{cephVersion{major: 14, minor: 2, patch: 22}, reconnectStaleVersion, true},
+		{cephVersion{major: 13, minor: 2, patch: 10}, reconnectStaleVersion, false},
+		{cephVersion{major: 15, minor: 2, patch: 13}, fuse3Version, false},
+		{cephVersion{major: 16}, fuse3Version, true},
+		{cephVersion{major: 16, minor: 2, patch: 4}, cephVersion{major: 16, minor: 2, patch: 5}, false},
+		{cephVersion{dev: true}, fuse3Version, true},
+		// an undetected version isn't treated as a libfuse3 build
+		{cephVersion{}, fuse3Version, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.v.atLeast(tt.o); got != tt.want {
+			t.Errorf("%v.atLeast(%v) = %v, want %v", tt.v, tt.o, got, tt.want)
+		}
+	}
+}
@@ -18,16 +18,50 @@ package cephfs
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+	"k8s.io/klog"
 )
 
+// StorageClass parameters recognized by the driver, in addition to the common
+// ones
+var volumeParameters = util.NewParameterValidator("provisionVolume", "rootPath",
+	"mounter", "compressionMode", "pin", "pinSetting", "pinVolume", "exactSize",
+	"exportNFS", "nfsCluster", "nfsServer", util.AppendPVCNameParameter,
+	"fsName", "fsID", "clusterID", "uid", "gid", "mode")
+
 type volumeOptions struct {
 	Monitors string `json:"monitors"`
 	Pool     string `json:"pool"`
 	RootPath string `json:"rootPath"`
 
+	// FsName is the filesystem the volume is in, the default one if empty.
+	// FsID is resolved to FsName when the volume is created.
+	FsName string `json:"fsName,omitempty"`
+	FsID   string `json:"fsID,omitempty"`
+
 	Mounter         string `json:"mounter"`
 	ProvisionVolume bool   `json:"provisionVolume"`
+	CompressionMode string `json:"compressionMode"`
+	Pin             string `json:"pin"`
+	PinSetting      string `json:"pinSetting"`
+	PinVolume       bool   `json:"pinVolume"`
+	// ExactSize is accepted for compatibility with rbd, quotas are byte
+	// granular and never rounded
+	ExactSize bool `json:"exactSize"`
+	// ExportNFS exports provisioned volumes in the nfs-ganesha cluster
+	// NFSCluster, served at NFSServer
+	ExportNFS  bool   `json:"exportNFS"`
+	NFSCluster string `json:"nfsCluster"`
+	NFSServer  string `json:"nfsServer"`
+	// UID, GID and Mode, in octal, are set on the root directory of
+	// provisioned volumes, it's owned by root with mode 0750 otherwise
+	UID  string `json:"uid,omitempty"`
+	GID  string `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
 
 	MonValueFromSecret string `json:"monValueFromSecret"`
 }
@@ -63,15 +97,172 @@ func (o *volumeOptions) validate() error {
 		}
 	}
 
+	if err := o.validateFs(); err != nil {
+		return err
+	}
+
 	if o.Mounter != "" {
 		if err := validateMounter(o.Mounter); err != nil {
 			return err
 		}
 	}
 
+	if o.CompressionMode != "" {
+		if !o.ProvisionVolume {
+			return fmt.Errorf("compressionMode is only supported with provisionVolume=true")
+		}
+
+		if err := validateCompressionMode(o.CompressionMode); err != nil {
+			return err
+		}
+	}
+
+	if o.Pin != "" {
+		if !o.ProvisionVolume {
+			return fmt.Errorf("pin is only supported with provisionVolume=true")
+		}
+
+		if err := validatePin(o.Pin, o.PinSetting); err != nil {
+			return err
+		}
+	} else if o.PinVolume {
+		return fmt.Errorf("pinVolume requires pin to be set")
+	}
+
+	if o.ExactSize && !o.ProvisionVolume {
+		return fmt.Errorf("exactSize is only supported with provisionVolume=true")
+	}
+
+	if o.UID != "" || o.GID != "" || o.Mode != "" {
+		if !o.ProvisionVolume {
+			return fmt.Errorf("uid, gid and mode are only supported with provisionVolume=true")
+		}
+
+		if err := validateOwnership(o.UID, o.GID, o.Mode); err != nil {
+			return err
+		}
+	}
+
+	if o.ExportNFS {
+		if !o.ProvisionVolume {
+			return fmt.Errorf("exportNFS is only supported with provisionVolume=true")
+		}
+
+		if err := validateNonEmptyField(o.NFSCluster, "nfsCluster"); err != nil {
+			return err
+		}
+
+		if err := validateNonEmptyField(o.NFSServer, "nfsServer"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateFs checks that the filesystem is selected by name or by numeric ID
+func (o *volumeOptions) validateFs() error {
+	if o.FsID == "" {
+		return nil
+	}
+
+	if o.FsName != "" {
+		return fmt.Errorf("fsName and fsID are mutually exclusive")
+	}
+
+	if _, err := strconv.ParseInt(o.FsID, 10, 64); err != nil {
+		return fmt.Errorf("invalid fsID '%s', expected the numeric ID of a filesystem", o.FsID)
+	}
+
+	return nil
+}
+
+// validateOwnership checks that uid and gid are numeric IDs and mode is an
+// octal permission, each of them may be empty
+func validateOwnership(uid, gid, mode string) error {
+	for name, id := range map[string]string{"uid": uid, "gid": gid} {
+		if id == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+			return fmt.Errorf("invalid %s '%s', expected a numeric ID", name, id)
+		}
+	}
+
+	if mode != "" {
+		if m, err := strconv.ParseUint(mode, 8, 32); err != nil || m > 07777 {
+			return fmt.Errorf("invalid mode '%s', expected octal permissions like 0775", mode)
+		}
+	}
+
 	return nil
 }
 
+// volumeOptionsMutability lists every field of volumeOptions with the values
+// retries of CreateVolume compare, recorded first, or nil if the field may
+// change between retries. Retries finding the volume with other values fail,
+// the PV would claim options the volume doesn't have. Fields added to
+// volumeOptions have to be listed.
+var volumeOptionsMutability = map[string]func(recorded, requested *volumeOptions) (string, string){
+	"Monitors": nil,
+	"Pool":     func(r, q *volumeOptions) (string, string) { return r.Pool, q.Pool },
+	"RootPath": func(r, q *volumeOptions) (string, string) {
+		// provisioned volumes record the CephFS root they're created in
+		if q.ProvisionVolume {
+			return "", ""
+		}
+		return r.RootPath, q.RootPath
+	},
+	// the filesystem ID is resolved to its name
+	"FsName":  func(r, q *volumeOptions) (string, string) { return r.FsName, q.FsName },
+	"FsID":    nil,
+	"Mounter": nil,
+	"ProvisionVolume": func(r, q *volumeOptions) (string, string) {
+		return strconv.FormatBool(r.ProvisionVolume), strconv.FormatBool(q.ProvisionVolume)
+	},
+	// only checked against the pool
+	"CompressionMode": nil,
+	// the csi-volumes directory is only pinned if it isn't yet
+	"Pin":        nil,
+	"PinSetting": nil,
+	"PinVolume": func(r, q *volumeOptions) (string, string) {
+		return strconv.FormatBool(r.PinVolume), strconv.FormatBool(q.PinVolume)
+	},
+	"ExactSize": nil,
+	"ExportNFS": func(r, q *volumeOptions) (string, string) {
+		return strconv.FormatBool(r.ExportNFS), strconv.FormatBool(q.ExportNFS)
+	},
+	"NFSCluster": func(r, q *volumeOptions) (string, string) { return r.NFSCluster, q.NFSCluster },
+	// only passed to the clients in the volume context
+	"NFSServer":          nil,
+	"MonValueFromSecret": nil,
+	// only applied when the volume is created, a retry finding the volume
+	// with other ones would leave it with the wrong ownership
+	"UID":  func(r, q *volumeOptions) (string, string) { return r.UID, q.UID },
+	"GID":  func(r, q *volumeOptions) (string, string) { return r.GID, q.GID },
+	"Mode": func(r, q *volumeOptions) (string, string) { return r.Mode, q.Mode },
+}
+
+// checkRecordedOptions returns the immutable options of the request which
+// differ from the ones the volume was recorded with
+func checkRecordedOptions(recorded, requested *volumeOptions) error {
+	var diffs []string
+	for field, compare := range volumeOptionsMutability {
+		if compare == nil {
+			continue
+		}
+		if r, q := compare(recorded, requested); r != q {
+			diffs = append(diffs, fmt.Sprintf("%s %q (requested %q)", field, r, q))
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	sort.Strings(diffs)
+	return fmt.Errorf("the volume was created with %s", strings.Join(diffs, ", "))
+}
+
 func extractOption(dest *string, optionLabel string, options map[string]string) error {
 	opt, ok := options[optionLabel]
 	if !ok {
@@ -93,6 +284,18 @@ func validateMounter(m string) error {
 	return nil
 }
 
+func validateCompressionMode(m string) error {
+	switch m {
+	case compressionModeAggressive:
+	case compressionModePassive:
+	case compressionModeNone:
+	default:
+		return fmt.Errorf("unknown compressionMode '%s'. Valid options are 'aggressive', 'passive' and 'none'", m)
+	}
+
+	return nil
+}
+
 func newVolumeOptions(volOptions, secret map[string]string) (*volumeOptions, error) {
 	var (
 		opts volumeOptions
@@ -111,6 +314,14 @@ func newVolumeOptions(volOptions, secret map[string]string) (*volumeOptions, err
 		if err = extractOption(&opts.Monitors, "monitors", volOptions); err != nil {
 			return nil, fmt.Errorf("either monitors or monValueFromSecret should be set")
 		}
+	} else if mon, ok := volOptions["monitors"]; ok {
+		if mon, err = util.NormalizeMonitors(mon); err == nil && mon != opts.Monitors {
+			klog.Infof("cephfs: monitors [%q] from the secret override monitors [%q]", opts.Monitors, mon)
+		}
+	}
+
+	if opts.Monitors, err = util.NormalizeMonitors(opts.Monitors); err != nil {
+		return nil, fmt.Errorf("invalid monitors: %v", err)
 	}
 
 	if err = extractNewVolOpt(&opts, volOptions); err != nil {
@@ -151,5 +362,44 @@ func extractNewVolOpt(opts *volumeOptions, volOpt map[string]string) error {
 	// nolint
 	//  (skip errcheck  and gosec as this is optional)
 	extractOption(&opts.Mounter, "mounter", volOpt)
+	// nolint
+	extractOption(&opts.FsName, "fsName", volOpt)
+	// nolint
+	extractOption(&opts.FsID, "fsID", volOpt)
+	// nolint
+	extractOption(&opts.CompressionMode, "compressionMode", volOpt)
+	// nolint
+	extractOption(&opts.Pin, "pin", volOpt)
+	// nolint
+	extractOption(&opts.PinSetting, "pinSetting", volOpt)
+
+	if pinVolume, ok := volOpt["pinVolume"]; ok {
+		if opts.PinVolume, err = strconv.ParseBool(pinVolume); err != nil {
+			return fmt.Errorf("failed to parse pinVolume: %v", err)
+		}
+	}
+
+	if exactSize, ok := volOpt["exactSize"]; ok {
+		if opts.ExactSize, err = strconv.ParseBool(exactSize); err != nil {
+			return fmt.Errorf("failed to parse exactSize: %v", err)
+		}
+	}
+
+	if exportNFS, ok := volOpt["exportNFS"]; ok {
+		if opts.ExportNFS, err = strconv.ParseBool(exportNFS); err != nil {
+			return fmt.Errorf("failed to parse exportNFS: %v", err)
+		}
+	}
+	// nolint
+	extractOption(&opts.NFSCluster, "nfsCluster", volOpt)
+	// nolint
+	extractOption(&opts.NFSServer, "nfsServer", volOpt)
+	// nolint
+	extractOption(&opts.UID, "uid", volOpt)
+	// nolint
+	extractOption(&opts.GID, "gid", volOpt)
+	// nolint
+	extractOption(&opts.Mode, "mode", volOpt)
+
 	return nil
 }
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVolumeOptionsMutability(t *testing.T) {
+	// TEST: every option is either compared by retries or mutable, new
+	// options need a decision
+	typ := reflect.TypeOf(volumeOptions{})
+	for i := 0; i < typ.NumField(); i++ {
+		if _, ok := volumeOptionsMutability[typ.Field(i).Name]; !ok {
+			t.Errorf("Failed: volumeOptions.%s is missing from volumeOptionsMutability", typ.Field(i).Name)
+		}
+	}
+	if len(volumeOptionsMutability) != typ.NumField() {
+		t.Errorf("Failed: want (%d) fields in volumeOptionsMutability, got (%d)", typ.NumField(), len(volumeOptionsMutability))
+	}
+}
+
+func TestCheckRecordedOptions(t *testing.T) {
+	// recorded by CreateVolume, which mounted the CephFS root
+	recorded := volumeOptions{
+		Monitors:        "mon1",
+		Pool:            "cephfs_data",
+		RootPath:        "/",
+		FsName:          "cephfs",
+		ProvisionVolume: true,
+		Mounter:         volumeMounterKernel,
+	}
+
+	tests := []struct {
+		name      string
+		change    func(o *volumeOptions)
+		wantDiffs []string
+	}{
+		{"same options", func(o *volumeOptions) {}, nil},
+		// TEST: mutable options may change between retries
+		{"other monitors and mounter", func(o *volumeOptions) {
+			o.Monitors = "mon2"
+			o.Mounter = volumeMounterFuse
+		}, nil},
+		{"fsID of the filesystem", func(o *volumeOptions) { o.FsID = "1" }, nil},
+		{"provisioned root path", func(o *volumeOptions) { o.RootPath = "" }, nil},
+		{"other pool", func(o *volumeOptions) { o.Pool = "fast_data" }, []string{`Pool "cephfs_data" (requested "fast_data")`}},
+		{"other pool and filesystem", func(o *volumeOptions) {
+			o.Pool = "fast_data"
+			o.FsName = "fast"
+		}, []string{`FsName "cephfs" (requested "fast")`, `Pool "cephfs_data" (requested "fast_data")`}},
+		{"exported", func(o *volumeOptions) {
+			o.ExportNFS = true
+			o.NFSCluster = "nfs1"
+		}, []string{`ExportNFS "false" (requested "true")`, `NFSCluster "" (requested "nfs1")`}},
+	}
+
+	for _, tt := range tests {
+		requested := recorded
+		requested.RootPath = ""
+		tt.change(&requested)
+
+		err := checkRecordedOptions(&recorded, &requested)
+		if tt.wantDiffs == nil {
+			if err != nil {
+				t.Errorf("%s: Failed: want (nil), got (%v)", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), strings.Join(tt.wantDiffs, ", ")) {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantDiffs, err)
+		}
+	}
+
+	// TEST: statically provisioned volumes compare their root path
+	static := volumeOptions{Monitors: "mon1", RootPath: "/volumes/a"}
+	if err := checkRecordedOptions(&static, &volumeOptions{Monitors: "mon1", RootPath: "/volumes/b"}); err == nil {
+		t.Errorf("Failed: want the other root path rejected")
+	}
+}
+
+func TestVolumeOptionsOwnership(t *testing.T) {
+	tests := []struct {
+		params  map[string]string
+		wantErr bool
+	}{
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "uid": "1000", "gid": "1000", "mode": "2775"}, false},
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "mode": "0750"}, false},
+		// TEST: IDs have to be numeric, the mode octal
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "uid": "nobody"}, true},
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "gid": "-1"}, true},
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "mode": "0789"}, true},
+		{map[string]string{"provisionVolume": "true", "pool": "cephfs_data", "mode": "17777"}, true},
+		// TEST: static volumes keep the ownership they have
+		{map[string]string{"provisionVolume": "false", "rootPath": "/volumes/a", "uid": "1000"}, true},
+	}
+
+	for _, tt := range tests {
+		tt.params["monitors"] = "mon1:6789"
+		_, err := newVolumeOptions(tt.params, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Failed: parameters %v: want error (%v), got (%v)", tt.params, tt.wantErr, err)
+		}
+	}
+}
+
+func TestVolumeOptionsCompressionMode(t *testing.T) {
+	tests := []struct {
+		name            string
+		compressionMode string
+		provision       bool
+		valid           bool
+	}{
+		{"unset", "", true, true},
+		{"aggressive", compressionModeAggressive, true, true},
+		{"passive", compressionModePassive, true, true},
+		{"none", compressionModeNone, true, true},
+		// TEST: unknown modes are rejected
+		{"unknown", "force", true, false},
+		// TEST: static volumes don't get their pool checked
+		{"static volume", compressionModePassive, false, false},
+		{"static volume unset", "", false, true},
+	}
+
+	for _, tt := range tests {
+		o := &volumeOptions{
+			Monitors:        "mon1",
+			Pool:            "cephfs_data",
+			ProvisionVolume: tt.provision,
+			CompressionMode: tt.compressionMode,
+		}
+		if !tt.provision {
+			o.RootPath = "/static"
+		}
+
+		if err := o.validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Failed: want valid (%v), got (%v)", tt.name, tt.valid, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// VolumeAttachment records that a volume was published to a node
+type VolumeAttachment struct {
+	VolumeID    string `json:"volumeID"`
+	NodeID      string `json:"nodeID"`
+	PublishedAt int64  `json:"publishedAt"`
+}
+
+// AttachmentTracker implements ControllerPublishVolume and
+// ControllerUnpublishVolume for drivers that don't need to attach volumes. It
+// only keeps a record of the nodes volumes are published to, node operations
+// must never depend on these records existing.
+type AttachmentTracker struct {
+	MetadataStore util.CachePersister
+}
+
+func attachmentIdentifier(volumeID, nodeID string) string {
+	return util.AttachmentPrefix + volumeID + "-" + nodeID
+}
+
+// ControllerPublishVolume records the attachment of the volume to the node
+func (at *AttachmentTracker) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+
+	identifier := attachmentIdentifier(req.GetVolumeId(), req.GetNodeId())
+	if err := at.MetadataStore.Get(identifier, &VolumeAttachment{}); err == nil {
+		util.LogBenign("volume %s is already published to node %s", req.GetVolumeId(), req.GetNodeId())
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	va := &VolumeAttachment{
+		VolumeID:    req.GetVolumeId(),
+		NodeID:      req.GetNodeId(),
+		PublishedAt: time.Now().Unix(),
+	}
+	if err := at.MetadataStore.Create(identifier, va); err != nil {
+		klog.Errorf("failed to record attachment of volume %s to node %s: %v", va.VolumeID, va.NodeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(4).Infof("recorded attachment of volume %s to node %s", va.VolumeID, va.NodeID)
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// ControllerUnpublishVolume removes the record of the volume being attached
+// to the node
+func (at *AttachmentTracker) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if req.GetNodeId() == "" {
+		// the volume has to be unpublished from all nodes
+		nodeIDs, err := at.PublishedNodeIDs(req.GetVolumeId())
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		for _, nodeID := range nodeIDs {
+			if err = at.MetadataStore.Delete(attachmentIdentifier(req.GetVolumeId(), nodeID)); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	identifier := attachmentIdentifier(req.GetVolumeId(), req.GetNodeId())
+	if err := at.MetadataStore.Get(identifier, &VolumeAttachment{}); err != nil {
+		if _, ok := err.(*util.CacheEntryNotFound); ok {
+			// the volume may have been published before tracking was enabled
+			util.LogBenign("no attachment of volume %s to node %s recorded", req.GetVolumeId(), req.GetNodeId())
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := at.MetadataStore.Delete(identifier); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(4).Infof("removed attachment of volume %s to node %s", req.GetVolumeId(), req.GetNodeId())
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// PublishedNodeIDs returns the IDs of the nodes the volume is recorded to be
+// published to
+func (at *AttachmentTracker) PublishedNodeIDs(volumeID string) ([]string, error) {
+	var nodeIDs []string
+
+	va := &VolumeAttachment{}
+	err := at.MetadataStore.ForAll("^"+util.AttachmentPrefix, va, func(identifier string) error {
+		if va.VolumeID == volumeID {
+			nodeIDs = append(nodeIDs, va.NodeID)
+		}
+		return nil
+	})
+
+	return nodeIDs, err
+}
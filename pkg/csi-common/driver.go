@@ -17,7 +17,7 @@ limitations under the License.
 package csicommon
 
 import (
-	"fmt"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -63,18 +63,26 @@ func NewCSIDriver(name string, v string, nodeID string) *CSIDriver {
 }
 
 // ValidateControllerServiceRequest validates the controller
-// plugin capabilities
+// plugin capabilities, requests of capabilities which aren't advertised fail
+// with Unimplemented, so that the sidecars don't retry them
 func (d *CSIDriver) ValidateControllerServiceRequest(c csi.ControllerServiceCapability_RPC_Type) error {
 	if c == csi.ControllerServiceCapability_RPC_UNKNOWN {
 		return nil
 	}
 
+	advertised := make([]string, 0, len(d.cap))
 	for _, cap := range d.cap {
 		if c == cap.GetRpc().GetType() {
 			return nil
 		}
+		advertised = append(advertised, cap.GetRpc().GetType().String())
 	}
-	return status.Error(codes.InvalidArgument, fmt.Sprintf("%s", c)) //nolint
+
+	if len(advertised) == 0 {
+		advertised = append(advertised, "none")
+	}
+	return status.Errorf(codes.Unimplemented, "controller service capability %s is not supported, the driver advertises %s",
+		c, strings.Join(advertised, ", "))
 }
 
 // AddControllerServiceCapabilities stores the controller capabilities
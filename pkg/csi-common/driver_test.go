@@ -0,0 +1,62 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateControllerServiceRequest(t *testing.T) {
+	d := NewCSIDriver("test.csi.ceph.com", "1.0.0", "node")
+
+	// TEST: nothing advertised
+	err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT)
+	if code := status.Code(err); code != codes.Unimplemented || !strings.Contains(err.Error(), "advertises none") {
+		t.Errorf("Failed: want (%v) without advertised capabilities, got (%v)", codes.Unimplemented, err)
+	}
+
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	})
+
+	// TEST: advertised and unknown capabilities are accepted
+	for _, c := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_UNKNOWN,
+	} {
+		if err = d.ValidateControllerServiceRequest(c); err != nil {
+			t.Errorf("Failed: want %s accepted, got (%v)", c, err)
+		}
+	}
+
+	// TEST: the error names the requested and the advertised capabilities
+	err = d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT)
+	if code := status.Code(err); code != codes.Unimplemented {
+		t.Errorf("Failed: want (%v), got (%v)", codes.Unimplemented, err)
+	}
+	for _, name := range []string{"CREATE_DELETE_SNAPSHOT", "CREATE_DELETE_VOLUME, LIST_VOLUMES"} {
+		if err != nil && !strings.Contains(err.Error(), name) {
+			t.Errorf("Failed: want (%s) in (%v)", name, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/keymutex"
+)
+
+var (
+	heldLocksMtx sync.Mutex
+	// heldLocks counts the holders of the keys of the KeyMutexes, as
+	// <mutex name>/<key>
+	heldLocks = make(map[string]int)
+)
+
+// auditedKeyMutex is a hashed keymutex recording the keys it holds
+type auditedKeyMutex struct {
+	name  string
+	mutex keymutex.KeyMutex
+}
+
+// NewKeyMutex returns a hashed keymutex whose held keys are listed by
+// HeldLocks under name. Unlocking a key which isn't held fails instead of
+// releasing the key sharing its hash.
+func NewKeyMutex(name string) keymutex.KeyMutex {
+	return &auditedKeyMutex{name: name, mutex: keymutex.NewHashed(0)}
+}
+
+func (m *auditedKeyMutex) LockKey(id string) {
+	m.mutex.LockKey(id)
+
+	heldLocksMtx.Lock()
+	heldLocks[m.name+"/"+id]++
+	heldLocksMtx.Unlock()
+}
+
+func (m *auditedKeyMutex) UnlockKey(id string) error {
+	key := m.name + "/" + id
+
+	heldLocksMtx.Lock()
+	if heldLocks[key] == 0 {
+		heldLocksMtx.Unlock()
+		return fmt.Errorf("lock %s is not held", key)
+	}
+	heldLocks[key]--
+	if heldLocks[key] == 0 {
+		delete(heldLocks, key)
+	}
+	heldLocksMtx.Unlock()
+
+	return m.mutex.UnlockKey(id)
+}
+
+// HeldLocks returns the sorted keys held in the KeyMutexes, as
+// <mutex name>/<key>, once per holder
+func HeldLocks() []string {
+	heldLocksMtx.Lock()
+	defer heldLocksMtx.Unlock()
+
+	var keys []string
+	for key, holders := range heldLocks {
+		for i := 0; i < holders; i++ {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// leakedLocks returns the keys of after which aren't in before, both sorted
+func leakedLocks(before, after []string) []string {
+	var leaked []string
+	i := 0
+	for _, key := range after {
+		for i < len(before) && before[i] < key {
+			i++
+		}
+		if i < len(before) && before[i] == key {
+			i++
+			continue
+		}
+		leaked = append(leaked, key)
+	}
+
+	return leaked
+}
+
+// AuditLocks runs call and returns an error naming method if it returned
+// holding more keys of the KeyMutexes than it started with. Locks taken by
+// concurrent calls are taken for leaks, the audit is exact for calls made
+// one at a time.
+func AuditLocks(method string, call func()) error {
+	before := HeldLocks()
+	call()
+	if leaked := leakedLocks(before, HeldLocks()); len(leaked) > 0 {
+		return fmt.Errorf("%s returned holding locks %v", method, leaked)
+	}
+
+	return nil
+}
+
+// auditLocks returns an interceptor logging the RPCs which return holding
+// locks
+func auditLocks(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var (
+			resp interface{}
+			err  error
+		)
+		if auditErr := AuditLocks(info.FullMethod, func() {
+			resp, err = next(ctx, req, info, handler)
+		}); auditErr != nil {
+			klog.Errorf("lock audit: %v", auditErr)
+		}
+
+		return resp, err
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditLocks(t *testing.T) {
+	names := NewKeyMutex("testName")
+	ids := NewKeyMutex("testID")
+	// keys of a mutex may share a hash, the ones held together are taken
+	// in different mutexes
+	snapshots := NewKeyMutex("testSnapshot")
+
+	// TEST: a balanced call passes the audit
+	err := AuditLocks("CreateVolume", func() {
+		names.LockKey("pvc-1")
+		defer names.UnlockKey("pvc-1") // nolint: errcheck
+		ids.LockKey("vol-1")
+		defer ids.UnlockKey("vol-1") // nolint: errcheck
+	})
+	if err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	// TEST: a leak is attributed to the method, locks held before the call
+	// aren't
+	ids.LockKey("vol-1")
+	err = AuditLocks("DeleteVolume", func() {
+		names.LockKey("pvc-1")
+		snapshots.LockKey("snap-1")
+		if unlockErr := snapshots.UnlockKey("snap-1"); unlockErr != nil {
+			t.Errorf("Failed: want (nil), got (%v)", unlockErr)
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "DeleteVolume") || !strings.Contains(err.Error(), "[testName/pvc-1]") {
+		t.Errorf("Failed: want the leak of testName/pvc-1 by DeleteVolume, got (%v)", err)
+	}
+	if held := HeldLocks(); !reflect.DeepEqual(held, []string{"testID/vol-1", "testName/pvc-1"}) {
+		t.Errorf("Failed: want ([testID/vol-1 testName/pvc-1]), got (%v)", held)
+	}
+
+	// TEST: a key which isn't held is never unlocked, whatever its hash
+	if err = names.UnlockKey("pvc-2"); err == nil {
+		t.Errorf("Failed: want an error unlocking a key which isn't held, got (nil)")
+	}
+
+	for m, key := range map[*auditedKeyMutex]string{names.(*auditedKeyMutex): "pvc-1", ids.(*auditedKeyMutex): "vol-1"} {
+		if err = m.UnlockKey(key); err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	}
+	if held := HeldLocks(); len(held) != 0 {
+		t.Errorf("Failed: want no locks held, got (%v)", held)
+	}
+}
+
+func TestLeakedLocks(t *testing.T) {
+	tests := []struct {
+		before, after, want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a/1"}, []string{"a/1"}, nil},
+		{nil, []string{"a/1", "b/2"}, []string{"a/1", "b/2"}},
+		// TEST: a key held once more than before is a leak
+		{[]string{"a/1"}, []string{"a/1", "a/1"}, []string{"a/1"}},
+		{[]string{"a/1", "b/2"}, []string{"b/2", "c/3"}, []string{"c/3"}},
+	}
+
+	for _, tt := range tests {
+		if got := leakedLocks(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Failed: want (%v), got (%v)", tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Maintenance levels, each one rejecting the RPCs of the previous one too
+const (
+	// MaintenanceOff serves all RPCs
+	MaintenanceOff = "off"
+	// MaintenanceNoProvision rejects the RPCs creating volumes and snapshots
+	MaintenanceNoProvision = "no-provision"
+	// MaintenanceReadOnly rejects all RPCs changing the backend, node RPCs
+	// and the controller RPCs reading or attaching volumes are still served
+	MaintenanceReadOnly = "read-only"
+)
+
+// maintenanceReloadInterval is the interval the maintenance file is read
+// again at, besides on SIGHUP, a ConfigMap mounted as the file is updated
+// without notifying the driver
+const maintenanceReloadInterval = 10 * time.Second
+
+var (
+	provisionMethods = map[string]bool{
+		controllerMethodPrefix + "CreateVolume":   true,
+		controllerMethodPrefix + "CreateSnapshot": true,
+	}
+	mutatingMethods = map[string]bool{
+		controllerMethodPrefix + "CreateVolume":           true,
+		controllerMethodPrefix + "DeleteVolume":           true,
+		controllerMethodPrefix + "CreateSnapshot":         true,
+		controllerMethodPrefix + "DeleteSnapshot":         true,
+		controllerMethodPrefix + "ControllerExpandVolume": true,
+	}
+)
+
+// MaintenanceState is the content of the maintenance file, in JSON
+type MaintenanceState struct {
+	// Level is one of off, no-provision and read-only, off if empty
+	Level string `json:"level"`
+	// Until is the time the maintenance is expected to end at, it's only
+	// reported in the errors of the rejected RPCs
+	Until *time.Time `json:"until,omitempty"`
+	// Message is added to the errors of the rejected RPCs
+	Message string `json:"message,omitempty"`
+}
+
+func (ms *MaintenanceState) validate() error {
+	switch ms.Level {
+	case "":
+		ms.Level = MaintenanceOff
+	case MaintenanceOff, MaintenanceNoProvision, MaintenanceReadOnly:
+	default:
+		return fmt.Errorf("unknown maintenance level %q, valid levels are %s, %s and %s",
+			ms.Level, MaintenanceOff, MaintenanceNoProvision, MaintenanceReadOnly)
+	}
+	return nil
+}
+
+// rejects tells whether the level rejects the RPC
+func (ms MaintenanceState) rejects(method string) bool {
+	switch ms.Level {
+	case MaintenanceNoProvision:
+		return provisionMethods[method]
+	case MaintenanceReadOnly:
+		return mutatingMethods[method]
+	}
+	return false
+}
+
+func (ms MaintenanceState) String() string {
+	s := ms.Level
+	if ms.Until != nil {
+		s += fmt.Sprintf(" until %s", ms.Until.Format(time.RFC3339))
+	}
+	if ms.Message != "" {
+		s += fmt.Sprintf(" (%s)", ms.Message)
+	}
+	return s
+}
+
+// Maintenance rejects the RPCs of the maintenance level set in a file, which
+// is read again on SIGHUP and every maintenanceReloadInterval. RPCs in flight
+// when the level changes aren't affected.
+type Maintenance struct {
+	path string
+
+	mtx   sync.RWMutex
+	state MaintenanceState
+}
+
+// NewMaintenance returns the maintenance of the file at path, a missing file
+// is the off level
+func NewMaintenance(path string) (*Maintenance, error) {
+	m := &Maintenance{path: path, state: MaintenanceState{Level: MaintenanceOff}}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// State returns the current maintenance state
+func (m *Maintenance) State() MaintenanceState {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.state
+}
+
+// Check returns the error the RPC is rejected with in the current
+// maintenance level, if it is
+func (m *Maintenance) Check(method string) error {
+	state := m.State()
+	if !state.rejects(method) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("the driver is in %s maintenance", state.Level)
+	if state.Until != nil {
+		msg += fmt.Sprintf(" until %s", state.Until.Format(time.RFC3339))
+	}
+	if state.Message != "" {
+		msg += ": " + state.Message
+	}
+	return status.Error(codes.Unavailable, msg)
+}
+
+// Run reloads the maintenance file on SIGHUP and every
+// maintenanceReloadInterval, until the context is done. Invalid files are
+// logged and leave the state unchanged.
+func (m *Maintenance) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(maintenanceReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+		}
+
+		if err := m.reload(); err != nil {
+			klog.Errorf("failed to reload maintenance file %s, keeping maintenance %s: %v", m.path, m.State().String(), err)
+		}
+	}
+}
+
+func (m *Maintenance) reload() error {
+	state := MaintenanceState{Level: MaintenanceOff}
+
+	// #nosec
+	content, err := ioutil.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &state); err != nil {
+			return fmt.Errorf("invalid maintenance file %s: %v", m.path, err)
+		}
+	}
+	if err = state.validate(); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	previous := m.state
+	m.state = state
+	m.mtx.Unlock()
+
+	if state.String() != previous.String() {
+		klog.Infof("maintenance changed from %s to %s", previous.String(), state.String())
+	}
+	return nil
+}
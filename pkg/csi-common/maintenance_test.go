@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-maintenance")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "maintenance")
+
+	// TEST: a missing file is the off level
+	m, err := NewMaintenance(file)
+	if err != nil || m.State().Level != MaintenanceOff {
+		t.Fatalf("Failed: want (%s), got (%v) error (%v)", MaintenanceOff, m, err)
+	}
+
+	interceptor := checkMaintenance(m, logGRPC)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "served", nil
+	}
+
+	tests := []struct {
+		state  string
+		method string
+		code   codes.Code
+	}{
+		{`{"level":"off"}`, "/csi.v1.Controller/CreateVolume", codes.OK},
+		{`{"level":"no-provision"}`, "/csi.v1.Controller/CreateVolume", codes.Unavailable},
+		{`{"level":"no-provision"}`, "/csi.v1.Controller/CreateSnapshot", codes.Unavailable},
+		{`{"level":"no-provision"}`, "/csi.v1.Controller/DeleteVolume", codes.OK},
+		{`{"level":"no-provision"}`, "/csi.v1.Node/NodeStageVolume", codes.OK},
+		{`{"level":"read-only"}`, "/csi.v1.Controller/DeleteVolume", codes.Unavailable},
+		{`{"level":"read-only"}`, "/csi.v1.Controller/ControllerExpandVolume", codes.Unavailable},
+		// TEST: mounts and attachments keep working
+		{`{"level":"read-only"}`, "/csi.v1.Controller/ControllerPublishVolume", codes.OK},
+		{`{"level":"read-only"}`, "/csi.v1.Node/NodePublishVolume", codes.OK},
+		{`{"level":"read-only"}`, "/csi.v1.Identity/Probe", codes.OK},
+	}
+
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(file, []byte(tt.state), 0600); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		if err = m.reload(); err != nil {
+			t.Fatalf("Failed: want (nil), got (%v)", err)
+		}
+
+		_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s %s: Failed: want (%v), got (%v)", tt.state, tt.method, tt.code, err)
+		}
+	}
+
+	// TEST: the rejection carries the end time and message
+	state := `{"level":"read-only","until":"2019-10-01T12:00:00Z","message":"ceph upgrade"}`
+	if err = ioutil.WriteFile(file, []byte(state), 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = m.reload(); err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+	err = m.Check("/csi.v1.Controller/DeleteVolume")
+	if err == nil || !strings.Contains(err.Error(), "2019-10-01T12:00:00Z") || !strings.Contains(err.Error(), "ceph upgrade") {
+		t.Errorf("Failed: want the end time and message, got (%v)", err)
+	}
+
+	// TEST: invalid files keep the current state
+	if err = ioutil.WriteFile(file, []byte(`{"level":"frozen"}`), 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = m.reload(); err == nil || m.State().Level != MaintenanceReadOnly {
+		t.Errorf("Failed: want (%s) kept, got (%s) error (%v)", MaintenanceReadOnly, m.State().Level, err)
+	}
+	if _, err = NewMaintenance(file); err == nil {
+		t.Errorf("Failed: want invalid files rejected at startup")
+	}
+
+	// TEST: the file is reloaded on SIGHUP, the signal doesn't terminate the
+	// test before Run handles it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	if err = ioutil.WriteFile(file, []byte(`{"level":"off"}`), 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.State().Level != MaintenanceOff && time.Now().Before(deadline) {
+		// Run may not handle the signal yet
+		if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("Test error %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if level := m.State().Level; level != MaintenanceOff {
+		t.Errorf("Failed: want (%s) after SIGHUP, got (%s)", MaintenanceOff, level)
+	}
+}
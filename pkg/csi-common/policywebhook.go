@@ -0,0 +1,225 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Failure policies of the policy webhook
+const (
+	// PolicyFailOpen provisions volumes as requested if the webhook fails
+	PolicyFailOpen = "fail-open"
+	// PolicyFailClosed rejects the volumes with Unavailable if the webhook
+	// fails
+	PolicyFailClosed = "fail-closed"
+)
+
+// policyReviewVersion is the version of the documents exchanged with the
+// policy webhook
+const policyReviewVersion = "v1"
+
+// maxPolicyResponseSize limits the response of the webhook read
+const maxPolicyResponseSize = 1 << 20
+
+// PolicyReview is the document CreateVolume posts to the policy webhook. It
+// never carries secrets.
+type PolicyReview struct {
+	APIVersion    string              `json:"apiVersion"`
+	Driver        string              `json:"driver"`
+	Name          string              `json:"name"`
+	Parameters    map[string]string   `json:"parameters"`
+	RequiredBytes int64               `json:"requiredBytes"`
+	LimitBytes    int64               `json:"limitBytes"`
+	ClusterID     string              `json:"clusterID,omitempty"`
+	Topology      []map[string]string `json:"topology,omitempty"`
+}
+
+// PolicyDecision is the response of the policy webhook. Allowed is
+// required, a denied volume fails with FailedPrecondition and Message.
+// Parameters, only valid for allowed volumes, override the parameters of the
+// request.
+type PolicyDecision struct {
+	APIVersion string            `json:"apiVersion"`
+	Allowed    *bool             `json:"allowed"`
+	Message    string            `json:"message,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+func (d *PolicyDecision) validate() error {
+	if d.APIVersion != policyReviewVersion {
+		return fmt.Errorf("unsupported apiVersion %q, expected %q", d.APIVersion, policyReviewVersion)
+	}
+	if d.Allowed == nil {
+		return fmt.Errorf("missing field allowed")
+	}
+	if !*d.Allowed && len(d.Parameters) > 0 {
+		return fmt.Errorf("parameters can't be overridden for a denied volume")
+	}
+	for k := range d.Parameters {
+		if k == "" {
+			return fmt.Errorf("empty parameter name in the overrides")
+		}
+	}
+
+	return nil
+}
+
+// PolicyWebhook lets an external service allow, deny or change the
+// parameters of new volumes before CreateVolume provisions them
+type PolicyWebhook struct {
+	url      string
+	driver   string
+	failOpen bool
+	client   *http.Client
+}
+
+// NewPolicyWebhook returns the webhook at url, called with the timeout and
+// handling its failures according to failurePolicy
+func NewPolicyWebhook(url, driver string, timeout time.Duration, failurePolicy string) (*PolicyWebhook, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid policy webhook timeout %v, expected a positive duration", timeout)
+	}
+
+	w := &PolicyWebhook{url: url, driver: driver, client: &http.Client{Timeout: timeout}}
+	switch failurePolicy {
+	case PolicyFailOpen:
+		w.failOpen = true
+	case PolicyFailClosed:
+	default:
+		return nil, fmt.Errorf("invalid policy webhook failure policy %q, expected %s or %s", failurePolicy, PolicyFailOpen, PolicyFailClosed)
+	}
+
+	return w, nil
+}
+
+// Review returns the parameters the webhook overrides for the new volume of
+// the request, none if the webhook is nil. CreateVolume only calls it for
+// volumes which don't exist yet, retries reuse the decision of the first
+// call.
+func (w *PolicyWebhook) Review(ctx context.Context, req *csi.CreateVolumeRequest) (map[string]string, error) {
+	if w == nil {
+		return nil, nil
+	}
+
+	decision, err := w.call(ctx, w.review(req))
+	if err != nil {
+		if w.failOpen {
+			klog.Warningf("policy webhook failed for volume %s, provisioning it as requested: %v", req.GetName(), err)
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Unavailable, "policy webhook failed for volume %s: %v", req.GetName(), err)
+	}
+
+	if !*decision.Allowed {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s denied by policy: %s", req.GetName(), decision.Message)
+	}
+
+	return decision.Parameters, nil
+}
+
+// OverrideParameters returns a copy of the request with the parameters the
+// webhook decided, the request itself is left as received
+func OverrideParameters(req *csi.CreateVolumeRequest, overrides map[string]string) *csi.CreateVolumeRequest {
+	if len(overrides) == 0 {
+		return req
+	}
+
+	params := make(map[string]string, len(req.GetParameters())+len(overrides))
+	for k, v := range req.GetParameters() {
+		params[k] = v
+	}
+	for k, v := range overrides {
+		if params[k] != v {
+			klog.Infof("policy webhook set parameter %s of volume %s to %q (requested %q)", k, req.GetName(), v, params[k])
+		}
+		params[k] = v
+	}
+
+	reviewed := proto.Clone(req).(*csi.CreateVolumeRequest)
+	reviewed.Parameters = params
+	return reviewed
+}
+
+func (w *PolicyWebhook) review(req *csi.CreateVolumeRequest) *PolicyReview {
+	review := &PolicyReview{
+		APIVersion:    policyReviewVersion,
+		Driver:        w.driver,
+		Name:          req.GetName(),
+		Parameters:    req.GetParameters(),
+		RequiredBytes: req.GetCapacityRange().GetRequiredBytes(),
+		LimitBytes:    req.GetCapacityRange().GetLimitBytes(),
+		ClusterID:     req.GetParameters()["clusterID"],
+	}
+	for _, t := range req.GetAccessibilityRequirements().GetRequisite() {
+		review.Topology = append(review.Topology, t.GetSegments())
+	}
+
+	return review
+}
+
+func (w *PolicyWebhook) call(ctx context.Context, review *PolicyReview) (*PolicyDecision, error) {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPolicyResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	decision := &PolicyDecision{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(decision); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	if err = decision.validate(); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+
+	return decision, nil
+}
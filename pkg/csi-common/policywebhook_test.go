@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPolicyWebhook(t *testing.T) {
+	var (
+		response string
+		review   PolicyReview
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			t.Errorf("Failed: invalid review posted: %v", err)
+		}
+		if response == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(response)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		response      string
+		failurePolicy string
+		wantCode      codes.Code
+		wantPool      string
+	}{
+		{"allowed", `{"apiVersion":"v1","allowed":true}`, PolicyFailClosed, codes.OK, "rbd"},
+		// TEST: the webhook may force the pool of the tenant
+		{"overridden", `{"apiVersion":"v1","allowed":true,"parameters":{"pool":"tenant-a"}}`, PolicyFailClosed, codes.OK, "tenant-a"},
+		{"denied", `{"apiVersion":"v1","allowed":false,"message":"quota exceeded"}`, PolicyFailClosed, codes.FailedPrecondition, ""},
+		// TEST: responses not following the schema are failures
+		{"missing allowed", `{"apiVersion":"v1"}`, PolicyFailClosed, codes.Unavailable, ""},
+		{"unknown field", `{"apiVersion":"v1","allowed":true,"pool":"tenant-a"}`, PolicyFailClosed, codes.Unavailable, ""},
+		{"denied with overrides", `{"apiVersion":"v1","allowed":false,"parameters":{"pool":"tenant-a"}}`, PolicyFailClosed, codes.Unavailable, ""},
+		{"server error", "", PolicyFailClosed, codes.Unavailable, ""},
+		// TEST: failures provision the volume as requested when failing open
+		{"server error failing open", "", PolicyFailOpen, codes.OK, "rbd"},
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{"clusterID": "cluster-1", "pool": "rbd"},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{"zone": "a"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		w, err := NewPolicyWebhook(server.URL, "rbd.csi.ceph.com", time.Second, tt.failurePolicy)
+		if err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		response = tt.response
+		overrides, err := w.Review(context.Background(), req)
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+		}
+		if tt.wantCode != codes.OK {
+			continue
+		}
+		if reviewed := OverrideParameters(req, overrides); reviewed.GetParameters()["pool"] != tt.wantPool {
+			t.Errorf("%s: Failed: want pool (%s), got (%v)", tt.name, tt.wantPool, reviewed)
+		}
+	}
+
+	// TEST: the review carries the request, which is left as received
+	if review.Name != "pvc-1" || review.ClusterID != "cluster-1" || review.RequiredBytes != 1<<30 ||
+		len(review.Topology) != 1 || review.Topology[0]["zone"] != "a" {
+		t.Errorf("Failed: unexpected review (%+v)", review)
+	}
+	if req.GetParameters()["pool"] != "rbd" {
+		t.Errorf("Failed: the request was modified (%v)", req.GetParameters())
+	}
+
+	if _, err := NewPolicyWebhook(server.URL, "rbd.csi.ceph.com", time.Second, "fail-maybe"); err == nil {
+		t.Errorf("Failed: want an error for an invalid failure policy, got (nil)")
+	}
+
+	// TEST: a nil webhook overrides nothing
+	var w *PolicyWebhook
+	if overrides, err := w.Review(context.Background(), req); err != nil || overrides != nil {
+		t.Errorf("Failed: want no overrides, got (%v), err (%v)", overrides, err)
+	}
+}
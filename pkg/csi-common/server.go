@@ -17,12 +17,20 @@ limitations under the License.
 package csicommon
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"k8s.io/klog"
 )
 
@@ -38,20 +46,64 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
+// ServerOptions configures the transport of tcp:// endpoints, unix sockets
+// don't support TLS
+type ServerOptions struct {
+	// TLSCert and TLSKey are the PEM files of the server certificate
+	TLSCert string
+	TLSKey  string
+	// ClientCA is the PEM file of the CA client certificates are verified
+	// with, clients must present one if it is set
+	ClientCA string
+	// InsecureTCP allows tcp:// endpoints without TLS
+	InsecureTCP bool
+	// ControllerGate, if set, admits the controller RPCs, identity and
+	// node RPCs are always served
+	ControllerGate ControllerGate
+	// Maintenance, if set, rejects the RPCs of its maintenance level
+	Maintenance *Maintenance
+	// PolicyWebhook, if set, reviews the parameters of the volumes
+	// CreateVolume provisions, the controller servers call it once they
+	// found no volume of the name
+	PolicyWebhook *PolicyWebhook
+	// AuditLocks logs the RPCs returning with locks of the KeyMutexes held
+	AuditLocks bool
+}
+
+// ControllerGate decides whether controller RPCs are served, e.g. only by
+// the leader of several controller replicas
+type ControllerGate interface {
+	// Enter returns the context to serve the RPC with and the function to
+	// call once it's done, or the error the RPC fails with if it isn't
+	// served
+	Enter(ctx context.Context) (context.Context, func(), error)
+	// BeforeAdmitting registers f to run each time before the gate starts
+	// admitting RPCs, e.g. to reload the state other replicas changed
+	BeforeAdmitting(f func() error)
+	// Run decides about admitting RPCs until ctx is done, the server runs
+	// it once started
+	Run(ctx context.Context)
+}
+
 // NewNonBlockingGRPCServer return non-blocking GRPC
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+func NewNonBlockingGRPCServer(opts ServerOptions) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{opts: opts}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
 	server *grpc.Server
+	opts   ServerOptions
 }
 
 // Start start service on endpoint
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 
+	if s.opts.ControllerGate != nil {
+		go s.opts.ControllerGate.Run(context.Background())
+	}
+
 	s.wg.Add(1)
 	go s.serve(endpoint, ids, cs, ns)
 }
@@ -73,26 +125,24 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 
-	proto, addr, err := parseEndpoint(endpoint)
+	listener, opts, err := newListener(endpoint, s.opts)
 	if err != nil {
-		klog.Fatal(err.Error())
+		klog.Fatalf("Failed to listen: %v", err)
 	}
 
-	if proto == "unix" {
-		addr = "/" + addr
-		if e := os.Remove(addr); e != nil && !os.IsNotExist(e) {
-			klog.Fatalf("Failed to remove %s, error: %s", addr, e.Error())
-		}
+	var interceptor grpc.UnaryServerInterceptor = logGRPC
+	if s.opts.AuditLocks {
+		interceptor = auditLocks(interceptor)
 	}
-
-	listener, err := net.Listen(proto, addr)
-	if err != nil {
-		klog.Fatalf("Failed to listen: %v", err)
+	if s.opts.Maintenance != nil {
+		interceptor = checkMaintenance(s.opts.Maintenance, interceptor)
 	}
-
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+	// standby replicas reject controller RPCs as such, whatever the
+	// maintenance
+	if s.opts.ControllerGate != nil {
+		interceptor = gateControllerRPCs(s.opts.ControllerGate, interceptor)
 	}
+	opts = append(opts, grpc.UnaryInterceptor(interceptor))
 	server := grpc.NewServer(opts...)
 	s.server = server
 
@@ -113,3 +163,113 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		klog.Fatalf("Failed to server: %v", err)
 	}
 }
+
+// newListener listens on the unix:// or tcp:// endpoint, and returns the
+// server options of its transport
+func newListener(endpoint string, opts ServerOptions) (net.Listener, []grpc.ServerOption, error) {
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var serverOpts []grpc.ServerOption
+	switch strings.ToLower(proto) {
+	case "unix":
+		if opts.TLSCert != "" || opts.ClientCA != "" {
+			return nil, nil, fmt.Errorf("TLS is only supported for tcp:// endpoints, not %s", endpoint)
+		}
+
+		addr = "/" + addr
+		if err = removeStaleSocket(addr); err != nil {
+			return nil, nil, err
+		}
+		proto = "unix"
+	case "tcp":
+		creds, credsErr := tcpCredentials(opts)
+		if credsErr != nil {
+			return nil, nil, credsErr
+		}
+
+		if creds == nil {
+			if !opts.InsecureTCP {
+				return nil, nil, fmt.Errorf("refusing to serve %s without TLS, configure a certificate or allow insecure tcp endpoints", endpoint)
+			}
+			klog.Warningf("serving %s without TLS, any client reaching it can use the driver", endpoint)
+		} else {
+			serverOpts = append(serverOpts, grpc.Creds(creds))
+		}
+		proto = "tcp"
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return listener, serverOpts, nil
+}
+
+// removeStaleSocket removes the socket left behind by a previous instance,
+// other files at the address aren't removed
+func removeStaleSocket(addr string) error {
+	fi, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket, refusing to remove it", addr)
+	}
+
+	if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", addr, err)
+	}
+
+	return nil
+}
+
+// tcpCredentials returns the TLS credentials of tcp:// endpoints, nil if no
+// certificate is configured
+func tcpCredentials(opts ServerOptions) (credentials.TransportCredentials, error) {
+	if opts.TLSCert == "" && opts.TLSKey == "" {
+		if opts.ClientCA != "" {
+			return nil, errors.New("a client CA requires a server certificate and key")
+		}
+		return nil, nil
+	}
+
+	if opts.TLSCert == "" || opts.TLSKey == "" {
+		return nil, errors.New("both the server certificate and key are required for TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.ClientCA != "" {
+		// #nosec
+		ca, err := ioutil.ReadFile(opts.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in the client CA %s", opts.ClientCA)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(config), nil
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate signed by it
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *rsa.PrivateKey
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	pki := &testPKI{dir: dir, ca: ca, caKey: caKey}
+	pki.writePEM(t, "ca.crt", "CERTIFICATE", caDER)
+
+	serverDER, serverKey := pki.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	pki.writePEM(t, "server.crt", "CERTIFICATE", serverDER)
+	pki.writePEM(t, "server.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(serverKey))
+
+	clientDER, clientKey := pki.issue(t, 3, x509.ExtKeyUsageClientAuth)
+	pki.client = tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+
+	return pki
+}
+
+func (pki *testPKI) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) ([]byte, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.ca, &key.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	return der, key
+}
+
+func (pki *testPKI) writePEM(t *testing.T, name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path.Join(pki.dir, name), data, 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+}
+
+func (pki *testPKI) file(name string) string {
+	return path.Join(pki.dir, name)
+}
+
+func TestNewListenerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-endpoint")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "csi.sock")
+
+	// TEST: the socket of a previous instance is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	// keep the socket file when closing the listener, as after a crash
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close() // nolint: errcheck
+
+	listener, _, err := newListener("unix:/"+socket, ServerOptions{})
+	if err != nil {
+		t.Fatalf("Failed: want the stale socket replaced, got (%v)", err)
+	}
+	listener.Close() // nolint: errcheck
+
+	// TEST: other files aren't removed
+	file := path.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if _, _, err = newListener("unix:/"+file, ServerOptions{}); err == nil {
+		t.Errorf("Failed: want a regular file at the endpoint refused")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Errorf("Failed: regular file was removed: %v", err)
+	}
+
+	// TEST: TLS isn't supported on unix sockets
+	if _, _, err = newListener("unix:/"+socket, ServerOptions{TLSCert: "tls.crt", TLSKey: "tls.key"}); err == nil {
+		t.Errorf("Failed: want TLS refused for unix sockets")
+	}
+}
+
+func TestNewListenerTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-endpoint")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pki := newTestPKI(t, dir)
+
+	tests := []struct {
+		name       string
+		opts       ServerOptions
+		expectFail bool
+	}{
+		{"plain tcp", ServerOptions{}, true},
+		{"insecure tcp", ServerOptions{InsecureTCP: true}, false},
+		{"tls", ServerOptions{TLSCert: pki.file("server.crt"), TLSKey: pki.file("server.key")}, false},
+		{"mtls", ServerOptions{TLSCert: pki.file("server.crt"), TLSKey: pki.file("server.key"), ClientCA: pki.file("ca.crt")}, false},
+		{"key missing", ServerOptions{TLSCert: pki.file("server.crt")}, true},
+		{"client CA without certificate", ServerOptions{ClientCA: pki.file("ca.crt"), InsecureTCP: true}, true},
+		{"invalid client CA", ServerOptions{TLSCert: pki.file("server.crt"), TLSKey: pki.file("server.key"), ClientCA: pki.file("server.key")}, true},
+	}
+
+	for _, tt := range tests {
+		listener, _, err := newListener("tcp://127.0.0.1:0", tt.opts)
+		if (err != nil) != tt.expectFail {
+			t.Errorf("%s: newListener() = %v, want failure (%t)", tt.name, err, tt.expectFail)
+		}
+		if listener != nil {
+			listener.Close() // nolint: errcheck
+		}
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-endpoint")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	pki := newTestPKI(t, dir)
+
+	listener, opts, err := newListener("tcp://127.0.0.1:0", ServerOptions{
+		TLSCert:  pki.file("server.crt"),
+		TLSKey:   pki.file("server.key"),
+		ClientCA: pki.file("ca.crt"),
+	})
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	server := grpc.NewServer(opts...)
+	csi.RegisterIdentityServer(server, NewDefaultIdentityServer(NewCSIDriver("test.csi.ceph.com", "1.0.0", "node")))
+	go server.Serve(listener) // nolint: errcheck
+	defer server.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca)
+
+	for _, withCert := range []bool{true, false} {
+		config := &tls.Config{RootCAs: roots}
+		if withCert {
+			config.Certificates = []tls.Certificate{pki.client}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(config)))
+		if err != nil {
+			cancel()
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		_, err = csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		if withCert && err != nil {
+			t.Errorf("Failed: want the client with a certificate served, got (%v)", err)
+		}
+		if !withCert && err == nil {
+			t.Errorf("Failed: want the client without a certificate refused")
+		}
+
+		conn.Close() // nolint: errcheck
+		cancel()
+	}
+}
+
+// testGate admits the controller RPCs while open
+type testGate struct {
+	open    bool
+	entered int
+}
+
+func (g *testGate) Enter(ctx context.Context) (context.Context, func(), error) {
+	if !g.open {
+		return nil, nil, status.Error(codes.Unavailable, "standby")
+	}
+	g.entered++
+	return ctx, func() { g.entered-- }, nil
+}
+
+func (g *testGate) BeforeAdmitting(f func() error) {}
+
+func (g *testGate) Run(ctx context.Context) {}
+
+func TestGateControllerRPCs(t *testing.T) {
+	gate := &testGate{}
+	interceptor := gateControllerRPCs(gate, logGRPC)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "served", nil
+	}
+
+	tests := []struct {
+		method string
+		open   bool
+		code   codes.Code
+	}{
+		// TEST: identity and node RPCs are served by standby replicas
+		{"/csi.v1.Identity/Probe", false, codes.OK},
+		{"/csi.v1.Node/NodeStageVolume", false, codes.OK},
+		{"/csi.v1.Controller/CreateVolume", false, codes.Unavailable},
+		{"/csi.v1.Controller/CreateVolume", true, codes.OK},
+	}
+
+	for _, tt := range tests {
+		gate.open = tt.open
+		resp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.method, tt.code, err)
+		}
+		if err == nil && resp != "served" {
+			t.Errorf("%s: Failed: want the RPC served, got (%v)", tt.method, resp)
+		}
+	}
+
+	// TEST: admitted RPCs are done once they return
+	if gate.entered != 0 {
+		t.Errorf("Failed: want (0) RPCs in flight, got (%d)", gate.entered)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 )
 
@@ -42,6 +44,61 @@ func NewVolumeCapabilityAccessMode(mode csi.VolumeCapability_AccessMode_Mode) *c
 	return &csi.VolumeCapability_AccessMode{Mode: mode}
 }
 
+// ValidateCapacityRange checks the capacity range of a CreateVolume request,
+// if it's set: the required size or the limit has to be positive, and the
+// required size at most the limit, if one is set
+func ValidateCapacityRange(capRange *csi.CapacityRange) error {
+	if capRange == nil {
+		return nil
+	}
+
+	required, limit := capRange.GetRequiredBytes(), capRange.GetLimitBytes()
+	if required < 0 || (required == 0 && limit == 0) {
+		return status.Errorf(codes.InvalidArgument, "required volume size of %d bytes is invalid, it has to be positive", required)
+	}
+	if limit < 0 {
+		return status.Errorf(codes.InvalidArgument, "volume size limit of %d bytes is invalid, it can't be negative", limit)
+	}
+	if limit > 0 && limit < required {
+		return status.Errorf(codes.InvalidArgument, "volume size limit of %d bytes is smaller than the required size of %d bytes", limit, required)
+	}
+
+	return nil
+}
+
+// CapacityToProvision returns the size to provision a volume of the capacity
+// range with: the required size, or for ranges with only a limit the default
+// size, capped at the limit. A default size of 0 is unlimited.
+func CapacityToProvision(capRange *csi.CapacityRange, defaultSize int64) int64 {
+	required, limit := capRange.GetRequiredBytes(), capRange.GetLimitBytes()
+	if required > 0 {
+		return required
+	}
+	if limit > 0 && (defaultSize <= 0 || defaultSize > limit) {
+		return limit
+	}
+
+	return defaultSize
+}
+
+// CheckExistingCapacity checks that the size of an existing volume of the
+// name of a CreateVolume request satisfies its capacity range, retries must
+// not be handed back a volume of another size
+func CheckExistingCapacity(capRange *csi.CapacityRange, name string, size int64) error {
+	if capRange == nil {
+		return nil
+	}
+
+	if required := capRange.GetRequiredBytes(); size < required {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists with a size of %d bytes, smaller than the required %d bytes", name, size, required)
+	}
+	if limit := capRange.GetLimitBytes(); limit > 0 && size > limit {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists with a size of %d bytes, larger than the limit of %d bytes", name, size, limit)
+	}
+
+	return nil
+}
+
 // NewDefaultNodeServer initializes default node server
 func NewDefaultNodeServer(d *CSIDriver) *DefaultNodeServer {
 	return &DefaultNodeServer{
@@ -78,7 +135,7 @@ func NewControllerServiceCapability(cap csi.ControllerServiceCapability_RPC_Type
 func RunNodePublishServer(endpoint string, d *CSIDriver, ns csi.NodeServer) {
 	ids := NewDefaultIdentityServer(d)
 
-	s := NewNonBlockingGRPCServer()
+	s := NewNonBlockingGRPCServer(ServerOptions{})
 	s.Start(endpoint, ids, nil, ns)
 	s.Wait()
 }
@@ -87,7 +144,7 @@ func RunNodePublishServer(endpoint string, d *CSIDriver, ns csi.NodeServer) {
 func RunControllerPublishServer(endpoint string, d *CSIDriver, cs csi.ControllerServer) {
 	ids := NewDefaultIdentityServer(d)
 
-	s := NewNonBlockingGRPCServer()
+	s := NewNonBlockingGRPCServer(ServerOptions{})
 	s.Start(endpoint, ids, cs, nil)
 	s.Wait()
 }
@@ -96,7 +153,7 @@ func RunControllerPublishServer(endpoint string, d *CSIDriver, cs csi.Controller
 func RunControllerandNodePublishServer(endpoint string, d *CSIDriver, cs csi.ControllerServer, ns csi.NodeServer) {
 	ids := NewDefaultIdentityServer(d)
 
-	s := NewNonBlockingGRPCServer()
+	s := NewNonBlockingGRPCServer(ServerOptions{})
 	s.Start(endpoint, ids, cs, ns)
 	s.Wait()
 }
@@ -112,3 +169,39 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+// controllerMethodPrefix prefixes the full method names of the RPCs of the
+// controller service
+const controllerMethodPrefix = "/csi.v1.Controller/"
+
+// gateControllerRPCs returns an interceptor which only passes the controller
+// RPCs admitted by the gate on to next
+func gateControllerRPCs(gate ControllerGate, next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, controllerMethodPrefix) {
+			return next(ctx, req, info, handler)
+		}
+
+		ctx, done, err := gate.Enter(ctx)
+		if err != nil {
+			klog.V(3).Infof("GRPC call: %s not served: %v", info.FullMethod, err)
+			return nil, err
+		}
+		defer done()
+
+		return next(ctx, req, info, handler)
+	}
+}
+
+// checkMaintenance returns an interceptor which rejects the RPCs of the
+// current maintenance level, and passes the others on to next
+func checkMaintenance(m *Maintenance, next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := m.Check(info.FullMethod); err != nil {
+			klog.V(3).Infof("GRPC call: %s not served: %v", info.FullMethod, err)
+			return nil, err
+		}
+
+		return next(ctx, req, info, handler)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateCapacityRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		wantCode codes.Code
+	}{
+		// TEST: the drivers pick a default size without a capacity range
+		{"no range", nil, codes.OK},
+		{"required", &csi.CapacityRange{RequiredBytes: 1}, codes.OK},
+		{"required and limit", &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 1 << 30}, codes.OK},
+		{"limit equal to required", &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 1 << 20}, codes.OK},
+		{"zero", &csi.CapacityRange{}, codes.InvalidArgument},
+		{"only limit", &csi.CapacityRange{LimitBytes: 1 << 30}, codes.OK},
+		{"negative", &csi.CapacityRange{RequiredBytes: -1}, codes.InvalidArgument},
+		{"negative limit", &csi.CapacityRange{RequiredBytes: 1, LimitBytes: -1}, codes.InvalidArgument},
+		{"limit below required", &csi.CapacityRange{RequiredBytes: 1 << 30, LimitBytes: 1 << 20}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		if code := status.Code(ValidateCapacityRange(tt.capRange)); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, code)
+		}
+	}
+}
+
+func TestCapacityToProvision(t *testing.T) {
+	tests := []struct {
+		name        string
+		capRange    *csi.CapacityRange
+		defaultSize int64
+		want        int64
+	}{
+		{"no range", nil, 1 << 30, 1 << 30},
+		{"required", &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 1 << 40}, 1 << 30, 1 << 20},
+		{"limit above default", &csi.CapacityRange{LimitBytes: 1 << 40}, 1 << 30, 1 << 30},
+		{"limit below default", &csi.CapacityRange{LimitBytes: 1 << 20}, 1 << 30, 1 << 20},
+		{"limit of unlimited default", &csi.CapacityRange{LimitBytes: 1 << 40}, 0, 1 << 40},
+		{"unlimited default", nil, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := CapacityToProvision(tt.capRange, tt.defaultSize); got != tt.want {
+			t.Errorf("%s: Failed: want (%d), got (%d)", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestCheckExistingCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		size     int64
+		wantCode codes.Code
+	}{
+		{"no range", nil, 1 << 20, codes.OK},
+		{"equal", &csi.CapacityRange{RequiredBytes: 1 << 30}, 1 << 30, codes.OK},
+		{"larger", &csi.CapacityRange{RequiredBytes: 1 << 20}, 1 << 30, codes.OK},
+		{"larger within limit", &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 1 << 30}, 1 << 30, codes.OK},
+		// TEST: retries aren't handed back a volume of another size
+		{"smaller", &csi.CapacityRange{RequiredBytes: 1 << 30}, 1 << 20, codes.AlreadyExists},
+		{"larger than limit", &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 1 << 21}, 1 << 30, codes.AlreadyExists},
+	}
+
+	for _, tt := range tests {
+		if code := status.Code(CheckExistingCapacity(tt.capRange, "pvc-1", tt.size)); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, code)
+		}
+	}
+}
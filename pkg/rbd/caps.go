@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type cephEntity struct {
+	Caps map[string]string `json:"caps"`
+}
+
+// provisionCapRequirements returns the caps the admin credentials need to
+// create and delete images, and their snapshots, in pool
+func provisionCapRequirements(pool string) []util.CapRequirement {
+	return []util.CapRequirement{
+		{Daemon: "mon", Perms: "r", Purpose: "image operations"},
+		{Daemon: "osd", Perms: "rwx", Pool: pool, Purpose: "image operations"},
+	}
+}
+
+// checkVolumeCaps fails with PermissionDenied if the admin credentials of
+// the volume lack caps required to manage its image
+func (cs *ControllerServer) checkVolumeCaps(ctx context.Context, rbdVol *rbdVolume, credentials map[string]string) error {
+	if cs.caps == nil {
+		return nil
+	}
+
+	mon, err := getMon(rbdVol, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkProvisionCaps(ctx, cs.caps, rbdVol.ClusterID, rbdVol.Pool, mon, rbdVol.AdminID, credentials)
+}
+
+// checkSnapshotCaps fails with PermissionDenied if the admin credentials of
+// the snapshot lack caps required to manage it
+func (cs *ControllerServer) checkSnapshotCaps(ctx context.Context, rbdSnap *rbdSnapshot, credentials map[string]string) error {
+	if cs.caps == nil {
+		return nil
+	}
+
+	mon, err := getSnapMon(rbdSnap, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkProvisionCaps(ctx, cs.caps, rbdSnap.ClusterID, rbdSnap.Pool, mon, rbdSnap.AdminID, credentials)
+}
+
+// checkProvisionCaps fails with PermissionDenied if the credentials of id
+// lack caps required to manage images in pool. The canary, run if the
+// credentials may not read their own caps, lists the images of the pool.
+func checkProvisionCaps(ctx context.Context, checker *util.CapsChecker, clusterID, pool, mon, id string, credentials map[string]string) error {
+	key, err := getRBDKey(clusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	authGet := func() (map[string]string, error) {
+		output, err := execCommand(ctx, "ceph", []string{"auth", "get", "client." + id, "-f", "json", "--id", id, "-m", mon, "--key=" + key})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the caps of client.%s, command output: %s", id, string(output))
+		}
+
+		var ents []cephEntity
+		if err = json.Unmarshal(output, &ents); err != nil || len(ents) != 1 {
+			return nil, errors.Errorf("failed to parse the caps of client.%s: %s", id, string(output))
+		}
+
+		return ents[0].Caps, nil
+	}
+
+	canary := func() error {
+		output, err := execCommand(ctx, "rbd", []string{"ls", "--pool", pool, "--id", id, "-m", mon, "--key=" + key})
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the images of pool %s, command output: %s", pool, string(output))
+		}
+		return nil
+	}
+
+	return checker.Check(util.CapsCheckKey(mon, id, key, util.OpClassProvision+"/"+pool), provisionCapRequirements(pool), authGet, canary)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkVolumeClusterNotFull fails with ResourceExhausted if the cluster of
+// the volume reached its full ratio, creating the image would hang otherwise
+func (cs *ControllerServer) checkVolumeClusterNotFull(ctx context.Context, rbdVol *rbdVolume, credentials map[string]string) error {
+	if cs.health == nil {
+		return nil
+	}
+
+	mon, err := getMon(rbdVol, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkClusterNotFull(ctx, cs.health, rbdVol.ClusterID, mon, rbdVol.AdminID, credentials)
+}
+
+// checkSnapshotClusterNotFull fails with ResourceExhausted if the cluster of
+// the snapshot reached its full ratio
+func (cs *ControllerServer) checkSnapshotClusterNotFull(ctx context.Context, rbdSnap *rbdSnapshot, credentials map[string]string) error {
+	if cs.health == nil {
+		return nil
+	}
+
+	mon, err := getSnapMon(rbdSnap, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkClusterNotFull(ctx, cs.health, rbdSnap.ClusterID, mon, rbdSnap.AdminID, credentials)
+}
+
+func checkClusterNotFull(ctx context.Context, checker *util.ClusterHealthChecker, clusterID, mon, id string, credentials map[string]string) error {
+	key, err := getRBDKey(clusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checker.CheckNotFull(mon, func() ([]byte, error) {
+		// warnings on stderr would fail the parsing, letting all operations
+		// through
+		var health json.RawMessage
+		output, err := execCommandJSON(ctx, &health, "ceph", []string{"health", "-f", "json", "--id", id, "-m", mon, "--key=" + key})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the health of the cluster, command output: %s", string(output))
+		}
+		return health, nil
+	})
+}
@@ -40,6 +40,30 @@ import (
 
 const (
 	oneGB = 1073741824
+
+	// parameters passed by the external-provisioner and external-snapshotter
+	// when started with --extra-create-metadata
+	pvcNamespaceKey      = "csi.storage.k8s.io/pvc/namespace"
+	snapshotNamespaceKey = "csi.storage.k8s.io/volumesnapshot/namespace"
+
+	allowCrossNamespaceRestoreKey = "allowCrossNamespaceRestore"
+
+	// VolumeContext key of the name of the image, set if it differs from
+	// the name of the volume
+	imageNameKey = "imageName"
+	// VolumeContext key of the ID of the pool of the volume, the node maps
+	// the image in the pool currently having the ID
+	poolIDKey = "poolID"
+)
+
+var (
+	// StorageClass and VolumeSnapshotClass parameters recognized by the
+	// driver, in addition to the common ones
+	volumeParameters = util.NewParameterValidator("clusterID", "adminid", "userid",
+		"imageFormat", "imageFeatures", "mounter", "exactSize", allowCrossNamespaceRestoreKey,
+		util.AppendPVCNameParameter)
+	snapshotParameters = util.NewParameterValidator("clusterID", "adminid", "userid",
+		"sparsifyOnLastSnapshotDelete")
 )
 
 // ControllerServer struct of rbd CSI driver with supported methods of CSI
@@ -47,6 +71,20 @@ const (
 type ControllerServer struct {
 	*csicommon.DefaultControllerServer
 	MetadataStore util.CachePersister
+	timeouts      util.OperationTimeouts
+	// attachments is nil unless attachment tracking is enabled
+	attachments *csicommon.AttachmentTracker
+	// verifySnapshotsOnRetry checks that snapshots found in the metadata
+	// store exist in the backend before answering CreateSnapshot retries
+	verifySnapshotsOnRetry bool
+	// backendMetadata maps the parameters set as image-meta of new images
+	backendMetadata util.BackendMetadataMapping
+	// caps is nil unless the caps of the credentials are checked
+	caps *util.CapsChecker
+	// health is nil unless operations on full clusters are rejected
+	health *util.ClusterHealthChecker
+	// policy is nil unless new volumes are reviewed by a policy webhook
+	policy *csicommon.PolicyWebhook
 }
 
 var (
@@ -55,19 +93,27 @@ var (
 )
 
 // LoadExDataFromMetadataStore loads the rbd volume and snapshot
-// info from metadata store
+// info from metadata store, replacing the info loaded before
 func (cs *ControllerServer) LoadExDataFromMetadataStore() error {
+	rbdVolumes = map[string]*rbdVolume{}
+	rbdSnapshots = map[string]*rbdSnapshot{}
+
+	// every entry is decoded into the same object, store copies of it
 	vol := &rbdVolume{}
 	// nolint
-	cs.MetadataStore.ForAll("csi-rbd-vol-", vol, func(identifier string) error {
-		rbdVolumes[identifier] = vol
+	cs.MetadataStore.ForAll("^"+util.RBDVolumePrefix, vol, func(identifier string) error {
+		v := *vol
+		rbdVolumes[identifier] = &v
+		*vol = rbdVolume{}
 		return nil
 	})
 
 	snap := &rbdSnapshot{}
 	// nolint
-	cs.MetadataStore.ForAll("csi-rbd-(.*)-snap-", snap, func(identifier string) error {
-		rbdSnapshots[identifier] = snap
+	cs.MetadataStore.ForAll("^"+util.RBDSnapshotPrefix+"(.*)"+util.RBDSnapshotInfix, snap, func(identifier string) error {
+		s := *snap
+		rbdSnapshots[identifier] = &s
+		*snap = rbdSnapshot{}
 		return nil
 	})
 
@@ -87,7 +133,7 @@ func (cs *ControllerServer) validateVolumeReq(req *csi.CreateVolumeRequest) erro
 	if req.VolumeCapabilities == nil {
 		return status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
-	return nil
+	return csicommon.ValidateCapacityRange(req.GetCapacityRange())
 }
 
 func parseVolCreateRequest(req *csi.CreateVolumeRequest) (*rbdVolume, error) {
@@ -110,6 +156,10 @@ func parseVolCreateRequest(req *csi.CreateVolumeRequest) (*rbdVolume, error) {
 		return nil, status.Error(codes.InvalidArgument, "multi node access modes are only supported on rbd `block` type volumes")
 	}
 
+	if err := volumeParameters.Validate(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	// if it's NOT SINGLE_NODE_WRITER and it's BLOCK we'll set the parameter to ignore the in-use checks
 	rbdVol, err := getRBDVolumeOptions(req.GetParameters(), (isMultiNode && isBlock))
 	if err != nil {
@@ -120,15 +170,38 @@ func parseVolCreateRequest(req *csi.CreateVolumeRequest) (*rbdVolume, error) {
 	volName := req.GetName()
 	uniqueID := uuid.NewUUID().String()
 	rbdVol.VolName = volName
-	volumeID := "csi-rbd-vol-" + uniqueID
+	suffix, err := util.BackendNameSuffix(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if suffix != "" {
+		rbdVol.VolName = volName + "-" + suffix
+		rbdVol.RequestName = volName
+	}
+	volumeID := util.RBDVolumePrefix + uniqueID
 	rbdVol.VolID = volumeID
-	// Volume Size - Default is 1 GiB
-	volSizeBytes := int64(oneGB)
-	if req.GetCapacityRange() != nil {
-		volSizeBytes = req.GetCapacityRange().GetRequiredBytes()
+	rbdVol.CreatedBy = rbdVol.AdminID
+	// Volume Size - Default is 1 GiB, or the limit if it's smaller
+	volSizeBytes := csicommon.CapacityToProvision(req.GetCapacityRange(), oneGB)
+
+	if exactSize, ok := req.GetParameters()["exactSize"]; ok {
+		if rbdVol.ExactSize, err = strconv.ParseBool(exactSize); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to parse exactSize: %v", err)
+		}
+	}
+
+	if rbdVol.ExactSize {
+		if volSizeBytes%rbdSectorSize != 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "exactSize requires a multiple of %d bytes, rbd images are sized in sectors", rbdSectorSize)
+		}
+		rbdVol.VolSize = volSizeBytes
+	} else {
+		rbdVol.VolSize = util.RoundUpToMiB(volSizeBytes) * util.MiB
 	}
 
-	rbdVol.VolSize = util.RoundUpToMiB(volSizeBytes)
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && rbdVol.VolSize > limit {
+		return nil, status.Errorf(codes.OutOfRange, "volume size of %d bytes, rounded up to MiB, exceeds the limit of %d bytes", rbdVol.VolSize, limit)
+	}
 
 	return rbdVol, nil
 }
@@ -148,7 +221,13 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if err := cs.validateVolumeReq(req); err != nil {
 		return nil, err
 	}
+
+	ctx, timer := util.WithPhaseTimer(ctx)
+	defer timer.LogIfSlow("CreateVolume", req.GetName())
+
+	endPhase := util.StartPhase(ctx, "lock")
 	volumeNameMutex.LockKey(req.GetName())
+	endPhase()
 	defer func() {
 		if err := volumeNameMutex.UnlockKey(req.GetName()); err != nil {
 			klog.Warningf("failed to unlock mutex volume:%s %v", req.GetName(), err)
@@ -159,80 +238,213 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	// check for the requested capacity and already allocated capacity
 	if exVol, err := getRBDVolumeByName(req.GetName()); err == nil {
 		// Since err is nil, it means the volume with the same name already exists
-		// need to check if the size of existing volume is the same as in new
-		// request
-		if exVol.VolSize >= req.GetCapacityRange().GetRequiredBytes() {
-			// existing volume is compatible with new request and should be reused.
-
-			if err = storeVolumeMetadata(exVol, cs.MetadataStore); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
+		// need to check if the size of existing volume is compatible with the
+		// capacity range of the new request
+		if err = csicommon.CheckExistingCapacity(req.GetCapacityRange(), req.GetName(), exVol.VolSize); err != nil {
+			return nil, err
+		}
 
-			// TODO (sbezverk) Do I need to make sure that RBD volume still exists?
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:      exVol.VolID,
-					CapacityBytes: exVol.VolSize,
-					VolumeContext: req.GetParameters(),
-				},
-			}, nil
+		// existing volume is compatible with new request and should be reused.
+		if err = storeVolumeMetadata(exVol, cs.MetadataStore); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
-		return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name: %s but with different size already exist", req.GetName())
+
+		// TODO (sbezverk) Do I need to make sure that RBD volume still exists?
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      exVol.VolID,
+				CapacityBytes: exVol.VolSize,
+				VolumeContext: volumeContext(req, exVol),
+			},
+		}, nil
+	}
+
+	// existing volumes were reviewed when they were created
+	endPhase = util.StartPhase(ctx, "reviewPolicy")
+	overrides, err := cs.policy.Review(ctx, req)
+	endPhase()
+	if err != nil {
+		klog.Errorf("can't create volume %s: %v", req.GetName(), err)
+		return nil, err
 	}
+	req = csicommon.OverrideParameters(req, overrides)
 
 	rbdVol, err := parseVolCreateRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
+	metadata, err := cs.backendMetadata.Metadata(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the image is removed again if it was created by this request, which
+	// fails later on
+	cleanup := util.NewCleanupStack("CreateVolume " + req.GetName())
+	defer func() {
+		cleanupCtx, cancel := cs.timeouts.WithTimeout(util.Detach(ctx), util.OpPurgeVolume)
+		defer cancel()
+		cleanup.Run(cleanupCtx)
+	}()
+
+	createCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpCreateVolume)
+	defer cancel()
+
+	if err = util.CheckContext(createCtx, "creating the image"); err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(createCtx, "checkFSID")
+	err = checkVolumeClusterFSID(createCtx, rbdVol, rbdVol.AdminID, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(createCtx, "checkCaps")
+	err = cs.checkVolumeCaps(createCtx, rbdVol, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(createCtx, "checkClusterFull")
+	err = cs.checkVolumeClusterNotFull(createCtx, rbdVol, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+
+	// volumes without a recorded FSID are deleted without verifying their
+	// cluster, this doesn't fail the volume
+	endPhase = util.StartPhase(createCtx, "getFSID")
+	rbdVol.ClusterFSID, err = volumeClusterFSID(createCtx, rbdVol, rbdVol.AdminID, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		klog.Warningf("not recording the cluster fsid of volume %s: %v", req.GetName(), err)
+	}
+
+	// volumes without a recorded pool ID keep using the name of their
+	// pool, they fail once it's renamed
+	endPhase = util.StartPhase(createCtx, "getPoolID")
+	rbdVol.PoolID, err = volumePoolID(createCtx, rbdVol, rbdVol.AdminID, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		klog.Warningf("not recording the pool ID of volume %s: %v", req.GetName(), err)
+	}
+
 	// Check if there is already RBD image with requested name
-	err = cs.checkRBDStatus(rbdVol, req, int(rbdVol.VolSize))
+	endPhase = util.StartPhase(createCtx, "createImage")
+	created, err := cs.checkRBDStatus(createCtx, rbdVol, req)
+	endPhase()
 	if err != nil {
 		return nil, err
 	}
-	// store volume size in  bytes (snapshot and check existing volume needs volume
-	// size in bytes)
-	rbdVol.VolSize = rbdVol.VolSize * util.MiB
+	if created {
+		cleanup.Push("image "+rbdVol.VolName, func(ctx context.Context) error {
+			return deleteRBDImage(ctx, rbdVol, rbdVol.AdminID, req.GetSecrets())
+		})
+	}
 
-	rbdVolumes[rbdVol.VolID] = rbdVol
+	if err = util.CheckContext(createCtx, "setting the image metadata"); err != nil {
+		return nil, err
+	}
 
-	if err = storeVolumeMetadata(rbdVol, cs.MetadataStore); err != nil {
+	endPhase = util.StartPhase(createCtx, "setMetadata")
+	err = util.SetBackendMetadata(metadata, func(key, value string) error {
+		return setImageMetadata(createCtx, rbdVol, key, value, rbdVol.AdminID, req.GetSecrets())
+	})
+	endPhase()
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// report the size of the image, which differs from the request when
+	// restoring a snapshot
+	endPhase = util.StartPhase(createCtx, "getImageSize")
+	rbdVol.VolSize, err = getImageSize(createCtx, rbdVol, rbdVol.AdminID, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	rbdVol.CreatedAt = ptypes.TimestampNow().GetSeconds()
+
+	if err = util.CheckContext(createCtx, "storing the volume metadata"); err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(createCtx, "storeMetadata")
+	err = storeVolumeMetadata(rbdVol, cs.MetadataStore)
+	endPhase()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the volume is only known once its metadata is stored, a retry would
+	// return it as existing otherwise
+	rbdVolumes[rbdVol.VolID] = rbdVol
+	cleanup.Done()
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      rbdVol.VolID,
 			CapacityBytes: rbdVol.VolSize,
-			VolumeContext: req.GetParameters(),
+			VolumeContext: volumeContext(req, rbdVol),
 		},
 	}, nil
 }
 
-func (cs *ControllerServer) checkRBDStatus(rbdVol *rbdVolume, req *csi.CreateVolumeRequest, volSizeMiB int) error {
+// volumeContext returns the parameters of the request, with the name of the
+// image if it differs from the name of the volume the node derives from the
+// target path, and the ID of the pool if it was recorded
+func volumeContext(req *csi.CreateVolumeRequest, rbdVol *rbdVolume) map[string]string {
+	if rbdVol.VolName == req.GetName() && rbdVol.PoolID == "" {
+		return req.GetParameters()
+	}
+
+	volContext := make(map[string]string, len(req.GetParameters())+2)
+	for k, v := range req.GetParameters() {
+		volContext[k] = v
+	}
+	if rbdVol.VolName != req.GetName() {
+		volContext[imageNameKey] = rbdVol.VolName
+	}
+	if rbdVol.PoolID != "" {
+		volContext[poolIDKey] = rbdVol.PoolID
+	}
+
+	return volContext
+}
+
+// checkRBDStatus creates the image unless it's in use already, it returns
+// whether the image was created
+func (cs *ControllerServer) checkRBDStatus(ctx context.Context, rbdVol *rbdVolume, req *csi.CreateVolumeRequest) (bool, error) {
 	var err error
 	// Check if there is already RBD image with requested name
 	//nolint
-	found, _, _ := rbdStatus(rbdVol, rbdVol.UserID, req.GetSecrets())
-	if !found {
-		// if VolumeContentSource is not nil, this request is for snapshot
-		if req.VolumeContentSource != nil {
-			if err = cs.checkSnapshot(req, rbdVol); err != nil {
-				return err
-			}
-		} else {
-			err = createRBDImage(rbdVol, volSizeMiB, rbdVol.AdminID, req.GetSecrets())
-			if err != nil {
-				klog.Warningf("failed to create volume: %v", err)
-				return status.Error(codes.Internal, err.Error())
-			}
+	found, _, _ := rbdStatus(ctx, rbdVol, rbdVol.UserID, req.GetSecrets())
+	if found {
+		return false, nil
+	}
 
-			klog.V(4).Infof("create volume %s", rbdVol.VolName)
+	// if VolumeContentSource is not nil, this request is for snapshot
+	if req.VolumeContentSource != nil {
+		if err = cs.checkSnapshot(ctx, req, rbdVol); err != nil {
+			return false, err
+		}
+	} else {
+		err = createRBDImage(ctx, rbdVol, rbdVol.VolSize, rbdVol.AdminID, req.GetSecrets())
+		if err != nil {
+			klog.Warningf("failed to create volume: %v", err)
+			return false, status.Error(codes.Internal, err.Error())
 		}
+
+		klog.V(4).Infof("create volume %s", rbdVol.VolName)
 	}
-	return nil
+	return true, nil
 }
-func (cs *ControllerServer) checkSnapshot(req *csi.CreateVolumeRequest, rbdVol *rbdVolume) error {
+func (cs *ControllerServer) checkSnapshot(ctx context.Context, req *csi.CreateVolumeRequest, rbdVol *rbdVolume) error {
 	snapshot := req.VolumeContentSource.GetSnapshot()
 	if snapshot == nil {
 		return status.Error(codes.InvalidArgument, "Volume Snapshot cannot be empty")
@@ -243,12 +455,32 @@ func (cs *ControllerServer) checkSnapshot(req *csi.CreateVolumeRequest, rbdVol *
 		return status.Error(codes.InvalidArgument, "Volume Snapshot ID cannot be empty")
 	}
 
+	// the snapshot must not be deleted while it's being restored
+	snapshotIDMutex.LockKey(snapshotID)
+
+	defer func() {
+		if err := snapshotIDMutex.UnlockKey(snapshotID); err != nil {
+			klog.Warningf("failed to unlock mutex snapshot:%s %v", snapshotID, err)
+		}
+	}()
+
 	rbdSnap := &rbdSnapshot{}
 	if err := cs.MetadataStore.Get(snapshotID, rbdSnap); err != nil {
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
 		return status.Error(codes.NotFound, err.Error())
 	}
 
-	err := restoreSnapshot(rbdVol, rbdSnap, rbdVol.AdminID, req.GetSecrets())
+	if err := checkRestoreNamespace(req.GetParameters(), rbdSnap); err != nil {
+		return err
+	}
+
+	if err := resolveSnapshotPool(ctx, rbdSnap, rbdVol.AdminID, req.GetSecrets()); err != nil {
+		return err
+	}
+
+	err := restoreSnapshot(ctx, rbdVol, rbdSnap, rbdVol.AdminID, req.GetSecrets())
 	if err != nil {
 		return status.Error(codes.Internal, err.Error())
 	}
@@ -256,6 +488,29 @@ func (cs *ControllerServer) checkSnapshot(req *csi.CreateVolumeRequest, rbdVol *
 	return nil
 }
 
+// checkRestoreNamespace refuses to restore a snapshot into a PVC of another
+// namespace than the one of the snapshot, unless the StorageClass explicitly
+// allows it
+func checkRestoreNamespace(parameters map[string]string, rbdSnap *rbdSnapshot) error {
+	pvcNamespace := parameters[pvcNamespaceKey]
+	if pvcNamespace == "" || pvcNamespace == rbdSnap.OwnerNamespace {
+		return nil
+	}
+
+	if rbdSnap.OwnerNamespace == "" {
+		klog.Warningf("namespace of snapshot %s is unknown, allowing restore into namespace %s", rbdSnap.SnapID, pvcNamespace)
+		return nil
+	}
+
+	if parameters[allowCrossNamespaceRestoreKey] == "true" {
+		klog.V(4).Infof("restoring snapshot %s of namespace %s into namespace %s", rbdSnap.SnapID, rbdSnap.OwnerNamespace, pvcNamespace)
+		return nil
+	}
+
+	return status.Errorf(codes.PermissionDenied, "snapshot %s of namespace %s cannot be restored into namespace %s, unless %s is \"true\"",
+		rbdSnap.SnapID, rbdSnap.OwnerNamespace, pvcNamespace, allowCrossNamespaceRestoreKey)
+}
+
 // DeleteVolume deletes the volume in backend and removes the volume metadata
 // from store
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -276,17 +531,32 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	rbdVol := &rbdVolume{}
 	if err := cs.MetadataStore.Get(volumeID, rbdVol); err != nil {
 		if err, ok := err.(*util.CacheEntryNotFound); ok {
-			klog.V(3).Infof("metadata for volume %s not found, assuming the volume to be already deleted (%v)", volumeID, err)
+			util.LogBenign("metadata for volume %s not found, assuming the volume to be already deleted (%v)", volumeID, err)
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, err
+	}
+
+	purgeCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpPurgeVolume)
+	defer cancel()
+
+	if err := util.CheckContext(purgeCtx, "deleting the image"); err != nil {
+		return nil, err
+	}
+
+	if err := checkVolumeCluster(purgeCtx, rbdVol, rbdVol.AdminID, req.GetSecrets()); err != nil {
 		return nil, err
 	}
 
 	volName := rbdVol.VolName
 	// Deleting rbd image
 	klog.V(4).Infof("deleting volume %s", volName)
-	if err := deleteRBDImage(rbdVol, rbdVol.AdminID, req.GetSecrets()); err != nil {
+	if err := deleteRBDImage(purgeCtx, rbdVol, rbdVol.AdminID, req.GetSecrets()); err != nil {
 		// TODO: can we detect "already deleted" situations here and proceed?
 		klog.V(3).Infof("failed to delete rbd image: %s/%s with error: %v", rbdVol.Pool, volName, err)
 		return nil, status.Error(codes.Internal, err.Error())
@@ -364,13 +634,21 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
-// ControllerUnpublishVolume returns success response
+// ControllerUnpublishVolume returns success response, after removing the
+// record of the attachment when attachment tracking is enabled
 func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if cs.attachments != nil {
+		return cs.attachments.ControllerUnpublishVolume(ctx, req)
+	}
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-// ControllerPublishVolume returns success response
+// ControllerPublishVolume returns success response, after recording the
+// attachment when attachment tracking is enabled
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if cs.attachments != nil {
+		return cs.attachments.ControllerPublishVolume(ctx, req)
+	}
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
@@ -382,6 +660,11 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	if err := cs.validateSnapshotReq(req); err != nil {
 		return nil, err
 	}
+
+	ctx, timer := util.WithPhaseTimer(ctx)
+	defer timer.LogIfSlow("CreateSnapshot", req.GetName())
+
+	endPhase := util.StartPhase(ctx, "lock")
 	snapshotNameMutex.LockKey(req.GetName())
 
 	defer func() {
@@ -390,27 +673,29 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		}
 	}()
 
+	// the source volume must not be deleted while it's being snapshotted
+	volumeIDMutex.LockKey(req.GetSourceVolumeId())
+	endPhase()
+
+	defer func() {
+		if err := volumeIDMutex.UnlockKey(req.GetSourceVolumeId()); err != nil {
+			klog.Warningf("failed to unlock mutex volume:%s %v", req.GetSourceVolumeId(), err)
+		}
+	}()
+
 	// Need to check for already existing snapshot name, and if found
 	// check for the requested source volume id and already allocated source volume id
-	if exSnap, err := getRBDSnapshotByName(req.GetName()); err == nil {
-		if req.SourceVolumeId == exSnap.SourceVolumeID {
-			if err = storeSnapshotMetadata(exSnap, cs.MetadataStore); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
+	endPhase = util.StartPhase(ctx, "lookupSnapshot")
+	exSnap, err := cs.lookupSnapshot(ctx, req)
+	endPhase()
+	if err != nil {
+		return nil, err
+	} else if exSnap != nil {
+		return &csi.CreateSnapshotResponse{Snapshot: exSnap}, nil
+	}
 
-			return &csi.CreateSnapshotResponse{
-				Snapshot: &csi.Snapshot{
-					SizeBytes:      exSnap.SizeBytes,
-					SnapshotId:     exSnap.SnapID,
-					SourceVolumeId: exSnap.SourceVolumeID,
-					CreationTime: &timestamp.Timestamp{
-						Seconds: exSnap.CreatedAt,
-					},
-					ReadyToUse: true,
-				},
-			}, nil
-		}
-		return nil, status.Errorf(codes.AlreadyExists, "Snapshot with the same name: %s but with different source volume id already exist", req.GetName())
+	if err = snapshotParameters.Validate(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	rbdSnap, err := getRBDSnapshotOptions(req.GetParameters())
@@ -431,12 +716,61 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 
 	rbdSnap.VolName = rbdVolume.VolName
 	rbdSnap.SnapName = snapName
-	snapshotID := "csi-rbd-" + rbdVolume.VolName + "-snap-" + uniqueID
+	snapshotID := util.RBDSnapshotPrefix + rbdVolume.VolName + util.RBDSnapshotInfix + uniqueID
 	rbdSnap.SnapID = snapshotID
 	rbdSnap.SourceVolumeID = req.GetSourceVolumeId()
 	rbdSnap.SizeBytes = rbdVolume.VolSize
+	rbdSnap.CreatedBy = rbdSnap.AdminID
+	rbdSnap.OwnerNamespace = req.GetParameters()[snapshotNamespaceKey]
+
+	snapCtx, cancel := cs.timeouts.WithTimeout(ctx, util.OpSnapshotCreate)
+	defer cancel()
+
+	if err = util.CheckContext(snapCtx, "creating the snapshot"); err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(snapCtx, "checkFSID")
+	err = checkSnapshotClusterFSID(snapCtx, rbdSnap, rbdSnap.AdminID, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot is taken in the pool of the source volume, regardless of
+	// the pool in the parameters, unless the volume was created before the
+	// ID of its pool was recorded
+	if rbdVolume.PoolID != "" {
+		endPhase = util.StartPhase(snapCtx, "resolvePool")
+		err = resolveVolumePool(snapCtx, rbdVolume, rbdSnap.AdminID, req.GetSecrets())
+		endPhase()
+		if err != nil {
+			return nil, err
+		}
+
+		if rbdSnap.Pool != rbdVolume.Pool {
+			klog.Warningf("rbd: snapshot %s of volume %s is taken in pool %s of the volume, instead of pool %s of the parameters",
+				req.GetName(), rbdVolume.VolID, rbdVolume.Pool, rbdSnap.Pool)
+		}
+		rbdSnap.Pool = rbdVolume.Pool
+		rbdSnap.PoolID = rbdVolume.PoolID
+	}
+
+	endPhase = util.StartPhase(snapCtx, "checkCaps")
+	err = cs.checkSnapshotCaps(snapCtx, rbdSnap, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
+
+	endPhase = util.StartPhase(snapCtx, "checkClusterFull")
+	err = cs.checkSnapshotClusterNotFull(snapCtx, rbdSnap, req.GetSecrets())
+	endPhase()
+	if err != nil {
+		return nil, err
+	}
 
-	err = cs.doSnapshot(rbdSnap, req.GetSecrets())
+	err = cs.doSnapshot(snapCtx, rbdSnap, req.GetSecrets())
 	// if we already have the snapshot, return the snapshot
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -446,7 +780,10 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 
 	rbdSnapshots[snapshotID] = rbdSnap
 
-	if err = storeSnapshotMetadata(rbdSnap, cs.MetadataStore); err != nil {
+	endPhase = util.StartPhase(snapCtx, "storeMetadata")
+	err = storeSnapshotMetadata(rbdSnap, cs.MetadataStore)
+	endPhase()
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -463,6 +800,77 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}, nil
 }
 
+// lookupSnapshot answers retries of CreateSnapshot from the metadata of the
+// snapshot, without any backend operations unless verifySnapshotsOnRetry is
+// set. It returns nil if the snapshot still has to be created.
+func (cs *ControllerServer) lookupSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.Snapshot, error) {
+	exSnap, err := getRBDSnapshotByName(req.GetName())
+	if err != nil {
+		return nil, nil
+	}
+	if recorded, err := cs.snapshotRecorded(exSnap.SnapID); err != nil || !recorded {
+		return nil, err
+	}
+	if req.GetSourceVolumeId() != exSnap.SourceVolumeID {
+		return nil, status.Errorf(codes.AlreadyExists, "Snapshot with the same name: %s but with different source volume id already exist", req.GetName())
+	}
+
+	if cs.verifySnapshotsOnRetry {
+		if err = resolveSnapshotPool(ctx, exSnap, exSnap.AdminID, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+
+		found, err := snapshotExists(ctx, exSnap, exSnap.AdminID, req.GetSecrets())
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !found {
+			klog.Warningf("rbd: snapshot %s is missing in the backend, creating it again", exSnap.SnapID)
+			if err = cs.MetadataStore.Delete(exSnap.SnapID); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			delete(rbdSnapshots, exSnap.SnapID)
+			return nil, nil
+		}
+	}
+
+	if err = storeSnapshotMetadata(exSnap, cs.MetadataStore); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	util.LogBenign("snapshot %s already exists, returning it", exSnap.SnapID)
+	return &csi.Snapshot{
+		SizeBytes:      exSnap.SizeBytes,
+		SnapshotId:     exSnap.SnapID,
+		SourceVolumeId: exSnap.SourceVolumeID,
+		CreationTime: &timestamp.Timestamp{
+			Seconds: exSnap.CreatedAt,
+		},
+		ReadyToUse: true,
+	}, nil
+}
+
+// snapshotRecorded checks that a snapshot known to the controller is still
+// in the metadata store, the snapshot garbage collector deletes snapshots
+// from it while the controller runs. Snapshots missing from it are dropped.
+func (cs *ControllerServer) snapshotRecorded(snapshotID string) (bool, error) {
+	if err := cs.MetadataStore.Get(snapshotID, &rbdSnapshot{}); err != nil {
+		if _, ok := err.(*util.CacheEntryNotFound); ok {
+			klog.Infof("rbd: snapshot %s was removed from the metadata store, forgetting it", snapshotID)
+			delete(rbdSnapshots, snapshotID)
+			return false, nil
+		}
+
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return false, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return false, status.Error(codes.Internal, err.Error())
+	}
+
+	return true, nil
+}
+
 func storeSnapshotMetadata(rbdSnap *rbdSnapshot, cp util.CachePersister) error {
 	if err := cp.Create(rbdSnap.SnapID, rbdSnap); err != nil {
 		klog.Errorf("failed to store metadata for snapshot %s: %v", rbdSnap.SnapID, err)
@@ -488,14 +896,14 @@ func (cs *ControllerServer) validateSnapshotReq(req *csi.CreateSnapshotRequest)
 	return nil
 }
 
-func (cs *ControllerServer) doSnapshot(rbdSnap *rbdSnapshot, secret map[string]string) error {
-	err := createSnapshot(rbdSnap, rbdSnap.AdminID, secret)
+func (cs *ControllerServer) doSnapshot(ctx context.Context, rbdSnap *rbdSnapshot, secret map[string]string) error {
+	err := createSnapshot(ctx, rbdSnap, rbdSnap.AdminID, secret)
 	// if we already have the snapshot, return the snapshot
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 				if status.ExitStatus() == int(syscall.EEXIST) {
-					klog.Warningf("Snapshot with the same name: %s, we return this.", rbdSnap.SnapName)
+					util.LogBenign("snapshot with the same name: %s, we return this", rbdSnap.SnapName)
 				} else {
 					klog.Warningf("failed to create snapshot: %v", err)
 					return err
@@ -510,10 +918,10 @@ func (cs *ControllerServer) doSnapshot(rbdSnap *rbdSnapshot, secret map[string]s
 		}
 	} else {
 		klog.V(4).Infof("create snapshot %s", rbdSnap.SnapName)
-		err = protectSnapshot(rbdSnap, rbdSnap.AdminID, secret)
+		err = protectSnapshot(ctx, rbdSnap, rbdSnap.AdminID, secret)
 
 		if err != nil {
-			err = deleteSnapshot(rbdSnap, rbdSnap.AdminID, secret)
+			err = deleteSnapshot(ctx, rbdSnap, rbdSnap.AdminID, secret)
 			if err != nil {
 				return fmt.Errorf("snapshot is created but failed to protect and delete snapshot: %v", err)
 			}
@@ -543,25 +951,67 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		}
 	}()
 
+	ctx, cancel := cs.timeouts.WithTimeout(ctx, util.OpSnapshotDelete)
+	defer cancel()
+
 	rbdSnap := &rbdSnapshot{}
 	if err := cs.MetadataStore.Get(snapshotID, rbdSnap); err != nil {
 		if err, ok := err.(*util.CacheEntryNotFound); ok {
-			klog.V(3).Infof("metadata for snapshot %s not found, assuming the snapshot to be already deleted (%v)", snapshotID, err)
+			util.LogBenign("metadata for snapshot %s not found, assuming the snapshot to be already deleted (%v)", snapshotID, err)
 			return &csi.DeleteSnapshotResponse{}, nil
 		}
 
+		if _, ok := err.(*util.CacheEntryCorrupted); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
+		return nil, err
+	}
+
+	if err := util.CheckContext(ctx, "deleting the snapshot"); err != nil {
+		return nil, err
+	}
+
+	if err := checkSnapshotClusterFSID(ctx, rbdSnap, rbdSnap.AdminID, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+
+	if err := resolveSnapshotPool(ctx, rbdSnap, rbdSnap.AdminID, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+
+	// the snapshot is left protected while clones of it exist
+	children, err := snapshotChildren(ctx, rbdSnap, rbdSnap.AdminID, req.GetSecrets())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list clones of snapshot: %s/%s with error: %v", rbdSnap.Pool, rbdSnap.SnapName, err)
+	}
+	if len(children) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s/%s has linked clones %v, delete or flatten them first", rbdSnap.Pool, rbdSnap.SnapName, children)
+	}
+
+	if err = util.CheckContext(ctx, "unprotecting the snapshot"); err != nil {
 		return nil, err
 	}
 
 	// Unprotect snapshot
-	err := unprotectSnapshot(rbdSnap, rbdSnap.AdminID, req.GetSecrets())
+	err = unprotectSnapshot(ctx, rbdSnap, rbdSnap.AdminID, req.GetSecrets())
 	if err != nil {
+		if errors.Cause(err) == errSnapshotInUse {
+			return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s/%s has pending clones, retry once they are created or deleted: %v", rbdSnap.Pool, rbdSnap.SnapName, err)
+		}
 		return nil, status.Errorf(codes.FailedPrecondition, "failed to unprotect snapshot: %s/%s with error: %v", rbdSnap.Pool, rbdSnap.SnapName, err)
 	}
 
+	if err = util.CheckContext(ctx, "removing the snapshot"); err != nil {
+		return nil, err
+	}
+
 	// Deleting snapshot
 	klog.V(4).Infof("deleting Snaphot %s", rbdSnap.SnapName)
-	if err := deleteSnapshot(rbdSnap, rbdSnap.AdminID, req.GetSecrets()); err != nil {
+	if err := deleteSnapshot(ctx, rbdSnap, rbdSnap.AdminID, req.GetSecrets()); err != nil {
+		if errors.Cause(err) == errSnapshotInUse {
+			return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s/%s has pending clones, retry once they are created or deleted: %v", rbdSnap.Pool, rbdSnap.SnapName, err)
+		}
 		return nil, status.Errorf(codes.FailedPrecondition, "failed to delete snapshot: %s/%s with error: %v", rbdSnap.Pool, rbdSnap.SnapName, err)
 	}
 
@@ -571,6 +1021,10 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 
 	delete(rbdSnapshots, snapshotID)
 
+	if rbdSnap.SparsifyOnLastSnapshotDelete {
+		scheduleSparsify(rbdSnap, req.GetSecrets())
+	}
+
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
@@ -588,6 +1042,11 @@ func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 
 	// list only a specific snapshot which has snapshot ID
 	if snapshotID := req.GetSnapshotId(); len(snapshotID) != 0 {
+		if _, ok := rbdSnapshots[snapshotID]; ok {
+			if _, err := cs.snapshotRecorded(snapshotID); err != nil {
+				return nil, err
+			}
+		}
 		if rbdSnap, ok := rbdSnapshots[snapshotID]; ok {
 			// if source volume ID also set, check source volume id on the cache.
 			if len(sourceVolumeID) != 0 && rbdSnap.SourceVolumeID != sourceVolumeID {
@@ -0,0 +1,744 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain fails the tests of the package if locks are still held once they
+// ran, i.e. some RPC returned without releasing them
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if held := csicommon.HeldLocks(); len(held) > 0 {
+		fmt.Fprintf(os.Stderr, "FAIL: locks still held after the tests: %v\n", held)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// auditLocks runs the call of the RPC method, failing the test if it returns
+// holding locks
+func auditLocks(t *testing.T, method string, call func()) {
+	t.Helper()
+	if err := csicommon.AuditLocks(method, call); err != nil {
+		t.Errorf("Failed: %v", err)
+	}
+}
+
+func TestCheckRestoreNamespace(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		owner      string
+		code       codes.Code
+	}{
+		{"same namespace", map[string]string{pvcNamespaceKey: "ns1"}, "ns1", codes.OK},
+		{"no pvc namespace", map[string]string{}, "ns1", codes.OK},
+		{"unknown snapshot namespace", map[string]string{pvcNamespaceKey: "ns2"}, "", codes.OK},
+		{"other namespace", map[string]string{pvcNamespaceKey: "ns2"}, "ns1", codes.PermissionDenied},
+		{"other namespace allowed", map[string]string{
+			pvcNamespaceKey:               "ns2",
+			allowCrossNamespaceRestoreKey: "true",
+		}, "ns1", codes.OK},
+	}
+
+	for _, tt := range tests {
+		err := checkRestoreNamespace(tt.parameters, &rbdSnapshot{SnapID: "snap", OwnerNamespace: tt.owner})
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: checkRestoreNamespace() = %v, expected code %v", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestParseVolCreateRequestSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		exactSize string
+		size      int64
+		limit     int64
+		expected  int64
+		code      codes.Code
+	}{
+		{"rounded", "", 1000, 0, util.MiB, codes.OK},
+		{"rounded MiB", "false", 3 * util.MiB, 0, 3 * util.MiB, codes.OK},
+		{"exact", "true", 1024, 0, 1024, codes.OK},
+		{"exact not sector aligned", "true", 1000, 0, 0, codes.InvalidArgument},
+		{"invalid exactSize", "yes please", 1024, 0, 0, codes.InvalidArgument},
+		// TEST: a byte is rounded up to a MiB, within the limit
+		{"rounded byte", "", 1, 0, util.MiB, codes.OK},
+		{"rounded within limit", "", 1, util.MiB, util.MiB, codes.OK},
+		{"rounded over limit", "", 1, 1000, 0, codes.OutOfRange},
+		{"exact within limit", "true", 1024, 1024, 1024, codes.OK},
+		// TEST: without a required size the default size is capped at the
+		// limit
+		{"only limit", "", 0, 10 * util.MiB, 10 * util.MiB, codes.OK},
+		{"only limit above default", "", 0, 2 * oneGB, oneGB, codes.OK},
+	}
+
+	for _, tt := range tests {
+		parameters := map[string]string{"pool": "rbd", "monitors": "mon1"}
+		if tt.exactSize != "" {
+			parameters["exactSize"] = tt.exactSize
+		}
+		req := &csi.CreateVolumeRequest{
+			Name:          "pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: tt.size, LimitBytes: tt.limit},
+			Parameters:    parameters,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		}
+
+		rbdVol, err := parseVolCreateRequest(req)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: parseVolCreateRequest() = %v, expected code %v", tt.name, err, tt.code)
+			continue
+		}
+		if err == nil && rbdVol.VolSize != tt.expected {
+			t.Errorf("%s: want (%d), got (%d)", tt.name, tt.expected, rbdVol.VolSize)
+		}
+	}
+}
+
+func TestParseVolCreateRequestPVCName(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		Parameters: map[string]string{
+			"pool":                        "rbd",
+			"monitors":                    "mon1",
+			util.AppendPVCNameParameter:   "true",
+			"csi.storage.k8s.io/pvc/name": "myapp-data",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	}
+
+	rbdVol, err := parseVolCreateRequest(req)
+	if err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+
+	// TEST: the image carries the PVC name, the node gets it in the volume
+	// context
+	if rbdVol.VolName != "pvc-1-myapp-data" {
+		t.Errorf("Failed: want (pvc-1-myapp-data), got (%s)", rbdVol.VolName)
+	}
+	if imageName := volumeContext(req, rbdVol)[imageNameKey]; imageName != rbdVol.VolName {
+		t.Errorf("Failed: want (%s), got (%s)", rbdVol.VolName, imageName)
+	}
+
+	// TEST: retries find the volume by the request name
+	rbdVolumes[rbdVol.VolID] = rbdVol
+	defer delete(rbdVolumes, rbdVol.VolID)
+	if exVol, err := getRBDVolumeByName("pvc-1"); err != nil || exVol != rbdVol {
+		t.Errorf("Failed: want the volume found by its request name, got (%v)", err)
+	}
+
+	// TEST: PVCs without suffix keep the volume context
+	delete(req.Parameters, util.AppendPVCNameParameter)
+	if rbdVol, err = parseVolCreateRequest(req); err != nil {
+		t.Fatalf("Failed: want (nil), got (%v)", err)
+	}
+	if _, ok := volumeContext(req, rbdVol)[imageNameKey]; ok || rbdVol.VolName != "pvc-1" {
+		t.Errorf("Failed: want image pvc-1 without imageName, got (%s)", rbdVol.VolName)
+	}
+}
+
+func TestCreateSnapshotLocksSourceVolume(t *testing.T) {
+	d := csicommon.NewCSIDriver("rbd.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	})
+	cs := NewControllerServer(d, nil, nil, false, false)
+
+	req := &csi.CreateSnapshotRequest{
+		Name:           "snap-1",
+		SourceVolumeId: "csi-rbd-vol-locked",
+		Parameters:     map[string]string{"pool": "rbd", "monitors": "mon1"},
+	}
+
+	// an operation on the source volume, like DeleteVolume, is in progress
+	volumeIDMutex.LockKey(req.GetSourceVolumeId())
+
+	done := make(chan struct{})
+	go func() {
+		// fails as the source volume is unknown, after taking the locks
+		_, _ = cs.CreateSnapshot(context.Background(), req) // nolint
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Failed: CreateSnapshot didn't wait for the source volume lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := volumeIDMutex.UnlockKey(req.GetSourceVolumeId()); err != nil {
+		t.Fatalf("Test error %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed: CreateSnapshot didn't finish after the source volume was unlocked")
+	}
+}
+
+// fakeRBD is a controller server using a node metadata store and an rbd
+// binary that only counts its calls
+type fakeRBD struct {
+	cs     *ControllerServer
+	store  *util.NodeCache
+	tmpDir string
+	path   string
+}
+
+func newFakeRBD(tb testing.TB, verifySnapshotsOnRetry bool) *fakeRBD {
+	tmpDir, err := ioutil.TempDir("", "rbd-fake")
+	if err != nil {
+		tb.Fatalf("Test setup error %s", err)
+	}
+	f := &fakeRBD{tmpDir: tmpDir, path: os.Getenv("PATH")}
+
+	script := "#!/bin/sh\necho \"$1\" >> " + filepath.Join(tmpDir, "calls") + "\n"
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "rbd"), []byte(script), 0755); err != nil {
+		f.cleanup()
+		tb.Fatalf("Test setup error %s", err)
+	}
+	if err = os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+f.path); err != nil {
+		f.cleanup()
+		tb.Fatalf("Test setup error %s", err)
+	}
+
+	f.store = &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = f.store.EnsureCacheDirectory(f.store.CacheDir); err != nil {
+		f.cleanup()
+		tb.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("rbd.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	})
+	f.cs = NewControllerServer(d, f.store, nil, false, verifySnapshotsOnRetry)
+
+	return f
+}
+
+func (f *fakeRBD) cleanup() {
+	os.Setenv("PATH", f.path) // nolint: errcheck
+	os.RemoveAll(f.tmpDir)    // nolint: errcheck
+}
+
+// calls returns the number of times rbd was run
+func (f *fakeRBD) calls(tb testing.TB) int {
+	out, err := ioutil.ReadFile(filepath.Join(f.tmpDir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		tb.Fatalf("Test error %s", err)
+	}
+	return len(strings.Fields(string(out)))
+}
+
+func (f *fakeRBD) snapshot() *rbdSnapshot {
+	return &rbdSnapshot{
+		VolName:        "csi-rbd-vol-retry",
+		SnapName:       "snap-retry",
+		SnapID:         "csi-rbd-csi-rbd-vol-retry-snap-retry",
+		SourceVolumeID: "csi-rbd-vol-retry",
+		Monitors:       "mon1",
+		Pool:           "rbd",
+		AdminID:        "admin",
+		SizeBytes:      1 << 30,
+	}
+}
+
+func TestDeleteSnapshotExpiredDeadline(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	snap := fake.snapshot()
+	if err := fake.store.Create(snap.SnapID, snap); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := fake.cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{
+		SnapshotId: snap.SnapID,
+		Secrets:    map[string]string{"admin": "key"},
+	})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("Failed: want (%v), got (%v)", codes.DeadlineExceeded, err)
+	}
+
+	if ops := fake.calls(t); ops != 0 {
+		t.Errorf("Failed: want (0) backend operations, got (%d)", ops)
+	}
+
+	// the snapshot is still known, a retry deletes it
+	if err = fake.store.Get(snap.SnapID, &rbdSnapshot{}); err != nil {
+		t.Errorf("Failed: snapshot metadata was removed: %v", err)
+	}
+}
+
+func TestSnapshotRemovedFromStore(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+	fake.cs.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	})
+
+	// the snapshot garbage collector deleted the snapshot while the
+	// controller knew it
+	snap := fake.snapshot()
+	rbdSnapshots[snap.SnapID] = snap
+	defer delete(rbdSnapshots, snap.SnapID)
+
+	// TEST: the snapshot isn't listed anymore
+	_, err := fake.cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snap.SnapID})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("Failed: want (%v), got (%v)", codes.NotFound, err)
+	}
+
+	// TEST: retries of CreateSnapshot create it again, rather than
+	// storing its metadata again
+	rbdSnapshots[snap.SnapID] = snap
+	found, err := fake.cs.lookupSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: snap.SnapName, SourceVolumeId: snap.SourceVolumeID})
+	if found != nil || err != nil {
+		t.Errorf("Failed: want (nil, nil), got (%v, %v)", found, err)
+	}
+	if _, ok := rbdSnapshots[snap.SnapID]; ok {
+		t.Errorf("Failed: want the snapshot forgotten")
+	}
+	if err = fake.store.Get(snap.SnapID, &rbdSnapshot{}); err == nil {
+		t.Errorf("Failed: want the metadata of the snapshot to stay removed")
+	}
+}
+
+func TestUnadvertisedCapabilities(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	// the fake driver only advertises CREATE_DELETE_SNAPSHOT
+	_, createErr := fake.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1"})
+	_, deleteErr := fake.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "csi-rbd-vol-1"})
+	_, listErr := fake.cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+
+	for _, err := range []error{createErr, deleteErr, listErr} {
+		if code := status.Code(err); code != codes.Unimplemented {
+			t.Errorf("Failed: want (%v), got (%v)", codes.Unimplemented, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "CREATE_DELETE_SNAPSHOT") {
+			t.Errorf("Failed: want the advertised capabilities in (%v)", err)
+		}
+	}
+}
+
+// BenchmarkCreateSnapshotRetry reports the number of backend operations per
+// retried CreateSnapshot, using an rbd binary that only counts its calls
+func BenchmarkCreateSnapshotRetry(b *testing.B) {
+	for _, verify := range []bool{false, true} {
+		name := "metadata"
+		if verify {
+			name = "verified"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkCreateSnapshotRetry(b, verify)
+		})
+	}
+}
+
+func benchmarkCreateSnapshotRetry(b *testing.B, verify bool) {
+	fake := newFakeRBD(b, verify)
+	defer fake.cleanup()
+
+	snap := fake.snapshot()
+	if err := fake.store.Create(snap.SnapID, snap); err != nil {
+		b.Fatalf("Test setup error %s", err)
+	}
+	rbdSnapshots[snap.SnapID] = snap
+	defer delete(rbdSnapshots, snap.SnapID)
+
+	req := &csi.CreateSnapshotRequest{
+		Name:           snap.SnapName,
+		SourceVolumeId: snap.SourceVolumeID,
+		Secrets:        map[string]string{"admin": "key"},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := fake.cs.CreateSnapshot(context.Background(), req)
+		if err != nil {
+			b.Fatalf("Failed: CreateSnapshot() = %v", err)
+		}
+		if resp.GetSnapshot().GetSnapshotId() != snap.SnapID {
+			b.Fatalf("Failed: want (%s), got (%s)", snap.SnapID, resp.GetSnapshot().GetSnapshotId())
+		}
+	}
+	b.StopTimer()
+
+	ops := fake.calls(b)
+	b.ReportMetric(float64(ops)/float64(b.N), "backendops/op")
+
+	if !verify && ops != 0 {
+		b.Errorf("Failed: want (0) backend operations, got (%d)", ops)
+	}
+}
+
+// failingStore is a metadata store which fails to store new entries
+type failingStore struct {
+	*util.NodeCache
+}
+
+func (s failingStore) Create(identifier string, data interface{}) error {
+	return errors.New("metadata store unavailable")
+}
+
+func TestCreateVolumeCleanup(t *testing.T) {
+	tests := []struct {
+		failAt      string // the rbd command failing, or storeMetadata
+		wantCode    codes.Code
+		wantImage   bool
+		wantRemoved bool
+	}{
+		// TEST: a successful request keeps the image and its metadata
+		{"", codes.OK, true, false},
+		// TEST: there's nothing to undo if the image isn't created
+		{"create", codes.Internal, false, false},
+		// TEST: the image is removed again if the request fails after
+		// creating it
+		{"image-meta", codes.Internal, false, true},
+		{"info", codes.Internal, false, true},
+		{"storeMetadata", codes.Internal, false, true},
+	}
+
+	for _, tt := range tests {
+		tmpDir, err := ioutil.TempDir("", "rbd-cleanup")
+		if err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		// images are files named after them, the subcommand given as failAt
+		// fails
+		script := `#!/bin/sh
+echo "$1" >> ` + filepath.Join(tmpDir, "calls") + `
+if [ "$1" = "` + tt.failAt + `" ]; then echo "injected failure"; exit 1; fi
+case "$1" in
+create) touch ` + tmpDir + `/image-"$2" ;;
+info) echo '{"size":1073741824}' ;;
+rm) rm ` + tmpDir + `/image-"$2" ;;
+esac
+`
+		if err = ioutil.WriteFile(filepath.Join(tmpDir, "rbd"), []byte(script), 0755); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		path := os.Getenv("PATH")
+		if err = os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+path); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		nodeCache := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+		if err = nodeCache.EnsureCacheDirectory(nodeCache.CacheDir); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		var store util.CachePersister = nodeCache
+		if tt.failAt == "storeMetadata" {
+			store = failingStore{nodeCache}
+		}
+
+		d := csicommon.NewCSIDriver("rbd.csi.ceph.com", version, "node")
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		})
+		cs := NewControllerServer(d, store, nil, false, false)
+		cs.backendMetadata = util.BackendMetadataMapping{"csi.storage.k8s.io/pvc/namespace": "k8s.namespace"}
+
+		name := "pvc-cleanup-" + tt.failAt
+		var resp *csi.CreateVolumeResponse
+		auditLocks(t, "CreateVolume", func() {
+			resp, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          name,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+				Parameters: map[string]string{"pool": "rbd", "monitors": "mon1", "csi.storage.k8s.io/pvc/namespace": "default"},
+				Secrets:    map[string]string{"admin": "key"},
+			})
+		})
+		os.Setenv("PATH", path) // nolint: errcheck
+
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("failing %q: Failed: want (%v), got (%v)", tt.failAt, tt.wantCode, err)
+		}
+
+		_, err = os.Stat(filepath.Join(tmpDir, "image-"+name))
+		if image := err == nil; image != tt.wantImage {
+			t.Errorf("failing %q: Failed: want image (%v), got (%v)", tt.failAt, tt.wantImage, image)
+		}
+
+		calls, err := ioutil.ReadFile(filepath.Join(tmpDir, "calls"))
+		if err != nil {
+			t.Fatalf("Test error %s", err)
+		}
+		if removed := strings.Contains(string(calls), "rm\n"); removed != tt.wantRemoved {
+			t.Errorf("failing %q: Failed: want image removed (%v), got (%v)", tt.failAt, tt.wantRemoved, removed)
+		}
+
+		// the volume is only known, and retries only find it, once its
+		// metadata is stored
+		entries, err := ioutil.ReadDir(filepath.Join(tmpDir, "controller"))
+		if err != nil {
+			t.Fatalf("Test error %s", err)
+		}
+		_, lookupErr := getRBDVolumeByName(name)
+		if wantKnown := tt.wantCode == codes.OK; (len(entries) == 1) != wantKnown || (lookupErr == nil) != wantKnown {
+			t.Errorf("failing %q: Failed: want volume known (%v), got (%d) metadata entries, lookup (%v)", tt.failAt, wantKnown, len(entries), lookupErr)
+		}
+
+		if resp != nil {
+			delete(rbdVolumes, resp.GetVolume().GetVolumeId())
+		}
+	}
+}
+
+func TestCreateVolumeExistingSize(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rbd-existing")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("rbd.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := NewControllerServer(d, store, nil, false, false)
+
+	// no rbd is run for volumes found by name
+	const volID = "csi-rbd-vol-existing"
+	rbdVolumes[volID] = &rbdVolume{VolID: volID, VolName: "pvc-existing", Pool: "rbd", Monitors: "mon1", VolSize: 2 << 30}
+	defer delete(rbdVolumes, volID)
+
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		wantCode codes.Code
+	}{
+		{"equal", &csi.CapacityRange{RequiredBytes: 2 << 30}, codes.OK},
+		{"larger compatible", &csi.CapacityRange{RequiredBytes: 1 << 30, LimitBytes: 4 << 30}, codes.OK},
+		// TEST: a smaller volume isn't handed back
+		{"smaller incompatible", &csi.CapacityRange{RequiredBytes: 3 << 30}, codes.AlreadyExists},
+		{"larger than limit", &csi.CapacityRange{RequiredBytes: 1 << 30, LimitBytes: 1 << 30}, codes.AlreadyExists},
+	}
+
+	for _, tt := range tests {
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-existing",
+			CapacityRange: tt.capRange,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: map[string]string{"pool": "rbd", "monitors": "mon1"},
+		})
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+			continue
+		}
+		if err == nil && (resp.GetVolume().GetVolumeId() != volID || resp.GetVolume().GetCapacityBytes() != 2<<30) {
+			t.Errorf("%s: Failed: want volume (%s) of (%d) bytes, got (%v)", tt.name, volID, 2<<30, resp.GetVolume())
+		}
+	}
+}
+
+func TestCreateVolumeExistingPolicy(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"apiVersion":"v1","allowed":false,"message":"quota exceeded"}`)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	var err error
+	fake.cs.Driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	if fake.cs.policy, err = csicommon.NewPolicyWebhook(server.URL, "rbd.csi.ceph.com", time.Second, csicommon.PolicyFailClosed); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	const volID = "csi-rbd-vol-policy"
+	rbdVolumes[volID] = &rbdVolume{VolID: volID, VolName: "pvc-policy", Pool: "rbd", Monitors: "mon1", VolSize: 1 << 30}
+	defer delete(rbdVolumes, volID)
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-policy",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{"pool": "rbd", "monitors": "mon1"},
+	}
+
+	// TEST: retries for existing volumes aren't reviewed again
+	resp, err := fake.cs.CreateVolume(context.Background(), req)
+	if err != nil || resp.GetVolume().GetVolumeId() != volID || calls != 0 {
+		t.Errorf("Failed: want volume (%s) without review, got (%v) after (%d) reviews, err (%v)", volID, resp.GetVolume(), calls, err)
+	}
+
+	// TEST: new volumes are
+	req.Name = "pvc-denied"
+	if _, err = fake.cs.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition || calls != 1 {
+		t.Errorf("Failed: want (%v) after (1) review, got (%v) after (%d)", codes.FailedPrecondition, err, calls)
+	}
+}
+
+func TestDeleteSnapshotWithClones(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	// the snapshot is protected until unprotected, its children are listed
+	// in the file children, rm fails while the file failrm exists, the
+	// snapshot is gone once the file removed exists. rbd warns on stderr.
+	state := func(name string) string { return filepath.Join(fake.tmpDir, name) }
+	script := `#!/bin/sh
+echo "$1" >> ` + state("calls") + `
+echo "did not load config file, using default settings." >&2
+if [ -e ` + state("removed") + ` ]; then echo "rbd: error opening snapshot: (2) No such file or directory" >&2; exit 2; fi
+case "$1 $2" in
+"children "*) cat ` + state("children") + ` 2>/dev/null || echo "[]" ;;
+"snap unprotect")
+	if [ "$(cat ` + state("children") + `)" != "[]" ]; then echo "librbd: cannot unprotect: at least 1 child(ren) in pool rbd" >&2; exit 16; fi
+	if [ -e ` + state("unprotected") + ` ]; then echo "librbd: snap_unprotect: snapshot is already unprotected" >&2; exit 22; fi
+	touch ` + state("unprotected") + ` ;;
+"snap rm")
+	if [ -e ` + state("failrm") + ` ]; then echo "rbd: failed to remove snapshot: (11) Resource temporarily unavailable" >&2; exit 11; fi ;;
+esac
+`
+	if err := ioutil.WriteFile(state("rbd"), []byte(script), 0755); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(state(name), []byte(content), 0644); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+
+	snap := fake.snapshot()
+	if err := fake.store.Create(snap.SnapID, snap); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	req := &csi.DeleteSnapshotRequest{SnapshotId: snap.SnapID, Secrets: map[string]string{"admin": "key"}}
+
+	// TEST: a snapshot with clones is rejected and left protected
+	write("children", `[{"pool":"rbd","pool_namespace":"","image":"csi-rbd-vol-clone"}]`)
+	var err error
+	auditLocks(t, "DeleteSnapshot", func() { _, err = fake.cs.DeleteSnapshot(context.Background(), req) })
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("Failed: want (%v), got (%v)", codes.FailedPrecondition, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "csi-rbd-vol-clone") {
+		t.Errorf("Failed: want the clones in the error, got (%v)", err)
+	}
+	if _, err = os.Stat(state("unprotected")); !os.IsNotExist(err) {
+		t.Errorf("Failed: want the snapshot left protected, got (%v)", err)
+	}
+
+	// TEST: pending clones failing the removal are FailedPrecondition too
+	write("children", "[]")
+	write("failrm", "")
+	auditLocks(t, "DeleteSnapshot", func() { _, err = fake.cs.DeleteSnapshot(context.Background(), req) })
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("Failed: want (%v), got (%v)", codes.FailedPrecondition, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "pending clones") {
+		t.Errorf("Failed: want pending clones in the error, got (%v)", err)
+	}
+
+	// TEST: the retry succeeds although the snapshot is already unprotected
+	if err = os.Remove(state("failrm")); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if _, err = fake.cs.DeleteSnapshot(context.Background(), req); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if err = fake.store.Get(snap.SnapID, &rbdSnapshot{}); err == nil {
+		t.Errorf("Failed: want the snapshot metadata removed")
+	}
+
+	// TEST: the retry after the snapshot was removed, but not its metadata,
+	// succeeds
+	write("removed", "")
+	if err = fake.store.Create(snap.SnapID, snap); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if _, err = fake.cs.DeleteSnapshot(context.Background(), req); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if err = fake.store.Get(snap.SnapID, &rbdSnapshot{}); err == nil {
+		t.Errorf("Failed: want the snapshot metadata removed")
+	}
+}
+
+func TestGetImageSizeWarnings(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	// rbd warns on stderr next to the JSON on stdout
+	script := "#!/bin/sh\necho 'did not load config file, using default settings.' >&2\necho '{\"size\":1073741824}'\n"
+	if err := ioutil.WriteFile(filepath.Join(fake.tmpDir, "rbd"), []byte(script), 0755); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	vol := &rbdVolume{VolName: "pvc-1", Pool: "rbd", Monitors: "mon1"}
+	size, err := getImageSize(context.Background(), vol, "admin", map[string]string{"admin": "key"})
+	if err != nil || size != 1<<30 {
+		t.Errorf("Failed: want (%d), got (%d), err (%v)", 1<<30, size, err)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var (
+	// FSIDs of the clusters reached with a cluster configuration, keyed by
+	// fsidCheckKey(). The key includes the expected FSID, the monitors and
+	// the credentials, changing any of them in the configuration leads to
+	// the FSID being verified again.
+	clusterFSIDs    = map[string]string{}
+	clusterFSIDsMtx sync.Mutex
+)
+
+func fsidCheckKey(clusterID, expectedFSID, mon, id, key string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%x", clusterID, expectedFSID, mon, id, sha256.Sum256([]byte(key)))
+}
+
+// checkVolumeClusterFSID verifies that the monitors of the volume belong to
+// the cluster with the FSID pinned in its cluster configuration
+func checkVolumeClusterFSID(ctx context.Context, pOpts *rbdVolume, id string, credentials map[string]string) error {
+	expectedFSID := clusterFSID(pOpts.ClusterID)
+	if expectedFSID == "" {
+		return nil
+	}
+
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkClusterFSID(ctx, pOpts.ClusterID, expectedFSID, mon, id, credentials)
+}
+
+// checkSnapshotClusterFSID verifies that the monitors of the snapshot belong
+// to the cluster with the FSID pinned in its cluster configuration
+func checkSnapshotClusterFSID(ctx context.Context, pOpts *rbdSnapshot, id string, credentials map[string]string) error {
+	expectedFSID := clusterFSID(pOpts.ClusterID)
+	if expectedFSID == "" {
+		return nil
+	}
+
+	mon, err := getSnapMon(pOpts, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return checkClusterFSID(ctx, pOpts.ClusterID, expectedFSID, mon, id, credentials)
+}
+
+// clusterFSID returns the FSID pinned in the cluster configuration, if any
+func clusterFSID(clusterID string) string {
+	if clusterID == "" || confStore == nil {
+		return ""
+	}
+
+	return confStore.FSID(clusterID)
+}
+
+func checkClusterFSID(ctx context.Context, clusterID, expectedFSID, mon, id string, credentials map[string]string) error {
+	key, err := getRBDKey(clusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fsid, cached, err := queryClusterFSID(ctx, fsidCheckKey(clusterID, expectedFSID, mon, id, key), clusterID, mon, id, key)
+	if err != nil {
+		return err
+	}
+
+	if fsid != expectedFSID {
+		klog.Errorf("rbd: monitors %s of cluster %s belong to the cluster with fsid %s, expected fsid %s", mon, clusterID, fsid, expectedFSID)
+		return status.Errorf(codes.FailedPrecondition, "cluster %s is configured with fsid %s, but its monitors belong to the cluster with fsid %s",
+			clusterID, expectedFSID, fsid)
+	}
+
+	if !cached {
+		klog.Infof("rbd: verified fsid %s of cluster %s", fsid, clusterID)
+	}
+
+	return nil
+}
+
+// queryClusterFSID returns the FSID of the cluster the monitors belong to,
+// and whether it was cached with cacheKey already
+func queryClusterFSID(ctx context.Context, cacheKey, clusterID, mon, id, key string) (string, bool, error) {
+	clusterFSIDsMtx.Lock()
+	fsid, ok := clusterFSIDs[cacheKey]
+	clusterFSIDsMtx.Unlock()
+	if ok {
+		return fsid, true, nil
+	}
+
+	output, err := execCommand(ctx, "ceph", []string{"fsid", "--id", id, "-m", mon, "--key=" + key})
+	if err != nil {
+		return "", false, status.Errorf(codes.Internal, "failed to get fsid of cluster %s: %v, command output: %s", clusterID, err, string(output))
+	}
+
+	// the output may be preceded by warnings
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fsid = strings.TrimSpace(lines[len(lines)-1])
+
+	clusterFSIDsMtx.Lock()
+	clusterFSIDs[cacheKey] = fsid
+	clusterFSIDsMtx.Unlock()
+
+	return fsid, false, nil
+}
+
+// volumeClusterFSID returns the FSID of the cluster the volume is created
+// on, to be recorded in its metadata
+func volumeClusterFSID(ctx context.Context, pOpts *rbdVolume, id string, credentials map[string]string) (string, error) {
+	// the monitors were verified to belong to the pinned cluster already
+	if fsid := clusterFSID(pOpts.ClusterID); fsid != "" {
+		return fsid, nil
+	}
+
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := getRBDKey(pOpts.ClusterID, id, credentials)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fsid, _, err := queryClusterFSID(ctx, fsidCheckKey(pOpts.ClusterID, "", mon, id, key), pOpts.ClusterID, mon, id, key)
+	return fsid, err
+}
+
+// checkVolumeCluster verifies that the monitors of the volume still belong
+// to the cluster it was created on, and that its pool exists there, before
+// the volume is deleted. Cluster configurations or secrets remapped to
+// another cluster since fail with FailedPrecondition, instead of the delete
+// targeting whatever has the volume's name on the other cluster. Volumes
+// created before their cluster's FSID was recorded are only checked
+// against the FSID pinned in their cluster configuration. The pool of
+// volumes with a recorded pool ID is updated to the current name of the
+// pool with the ID.
+func checkVolumeCluster(ctx context.Context, pOpts *rbdVolume, id string, credentials map[string]string) error {
+	if err := checkVolumeClusterFSID(ctx, pOpts, id, credentials); err != nil {
+		return err
+	}
+
+	if pOpts.ClusterFSID == "" {
+		return resolveVolumePool(ctx, pOpts, id, credentials)
+	}
+
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := getRBDKey(pOpts.ClusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fsid, _, err := queryClusterFSID(ctx, fsidCheckKey(pOpts.ClusterID, "", mon, id, key), pOpts.ClusterID, mon, id, key)
+	if err != nil {
+		return err
+	}
+	if fsid != pOpts.ClusterFSID {
+		klog.Errorf("rbd: volume %s was created on the cluster with fsid %s, but monitors %s belong to the cluster with fsid %s", pOpts.VolID, pOpts.ClusterFSID, mon, fsid)
+		return status.Errorf(codes.FailedPrecondition, "volume %s was created on the cluster with fsid %s, but its monitors belong to the cluster with fsid %s",
+			pOpts.VolID, pOpts.ClusterFSID, fsid)
+	}
+
+	if pOpts.PoolID != "" {
+		return resolveVolumePool(ctx, pOpts, id, credentials)
+	}
+
+	if _, err = getPoolID(ctx, pOpts.Pool, mon, id, key); status.Code(err) == codes.NotFound {
+		return status.Errorf(codes.FailedPrecondition, "pool %s of volume %s not found on the cluster with fsid %s", pOpts.Pool, pOpts.VolID, fsid)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckClusterFSID(t *testing.T) {
+	const (
+		fsidA = "b1ebd8d6-4f4c-11e9-8c1f-0242ac110002"
+		fsidB = "c3f9a1e2-4f4c-11e9-8c1f-0242ac110003"
+	)
+	credentials := map[string]string{"admin": "key"}
+
+	// the FSIDs of the clusters were already queried
+	clusterFSIDs[fsidCheckKey("cluster-a", fsidA, "mon-a:6789", "admin", "key")] = fsidA
+	clusterFSIDs[fsidCheckKey("cluster-b", fsidB, "mon-a:6789", "admin", "key")] = fsidA
+	defer func() {
+		clusterFSIDs = map[string]string{}
+	}()
+
+	tests := []struct {
+		clusterID    string
+		expectedFSID string
+		code         codes.Code
+	}{
+		{"cluster-a", fsidA, codes.OK},
+		// the secret of cluster A is used with the monitors of cluster B
+		{"cluster-b", fsidB, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		err := checkClusterFSID(context.Background(), tt.clusterID, tt.expectedFSID, "mon-a:6789", "admin", credentials)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("Failed: checkClusterFSID(%s) = %v, expected code %v", tt.clusterID, err, tt.code)
+		}
+	}
+}
+
+func TestCheckVolumeCluster(t *testing.T) {
+	const (
+		fsidA = "b1ebd8d6-4f4c-11e9-8c1f-0242ac110002"
+		fsidB = "c3f9a1e2-4f4c-11e9-8c1f-0242ac110003"
+	)
+
+	tmpDir, err := ioutil.TempDir("", "rbd-fake-ceph")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	path := os.Getenv("PATH")
+	defer func() {
+		os.Setenv("PATH", path) // nolint: errcheck
+		os.RemoveAll(tmpDir)    // nolint: errcheck
+		clusterFSIDs = map[string]string{}
+	}()
+
+	script := "#!/bin/sh\ncase \"$1\" in\nfsid) echo " + fsidA + " ;;\nosd) echo '[{\"poolnum\":1,\"poolname\":\"rbd\"},{\"poolnum\":2,\"poolname\":\"replicapool\"}]' ;;\nesac\n"
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "ceph"), []byte(script), 0755); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+path); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	credentials := map[string]string{"admin": "key"}
+	tests := []struct {
+		name        string
+		clusterFSID string
+		pool        string
+		code        codes.Code
+	}{
+		{"same cluster", fsidA, "replicapool", codes.OK},
+		// TEST: volumes created before the FSID was recorded aren't checked
+		{"no recorded fsid", "", "missing", codes.OK},
+		// TEST: the monitors were remapped to another cluster
+		{"other cluster", fsidB, "replicapool", codes.FailedPrecondition},
+		{"missing pool", fsidA, "replica", codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		vol := &rbdVolume{VolID: "csi-rbd-vol", Monitors: "mon-a:6789", Pool: tt.pool, ClusterFSID: tt.clusterFSID}
+		err = checkVolumeCluster(context.Background(), vol, "admin", credentials)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.code, err)
+		}
+	}
+
+	// TEST: the FSID recorded at create time is the one of the monitors
+	fsid, err := volumeClusterFSID(context.Background(), &rbdVolume{Monitors: "mon-a:6789"}, "admin", credentials)
+	if err != nil || fsid != fsidA {
+		t.Errorf("Failed: want (%s), got (%s, %v)", fsidA, fsid, err)
+	}
+}
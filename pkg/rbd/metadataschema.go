@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+	"k8s.io/klog"
+)
+
+// metadataSchema lists the migrations of the rbd metadata schema, append new
+// migrations at the end
+var metadataSchema = &util.MetadataSchema{
+	Name: "rbd",
+	Migrations: []util.SchemaMigration{
+		addVolumeCreatedAt,
+	},
+}
+
+// addVolumeCreatedAt migrates volumes to schema version 2, which records the
+// creation time of volumes. The time volumes were created at before is
+// unknown, it's set to the time of the migration.
+func addVolumeCreatedAt(cp util.CachePersister) error {
+	var ids []string
+
+	vol := &rbdVolume{}
+	err := cp.ForAll("^"+util.RBDVolumePrefix, vol, func(identifier string) error {
+		if vol.CreatedAt == 0 {
+			ids = append(ids, identifier)
+		}
+		*vol = rbdVolume{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		vol := &rbdVolume{}
+		if err = cp.Get(id, vol); err != nil {
+			// deleted since it was listed
+			if _, ok := err.(*util.CacheEntryNotFound); ok {
+				continue
+			}
+			return err
+		}
+
+		vol.CreatedAt = now
+		if err = cp.Update(id, vol); err != nil {
+			return err
+		}
+		klog.V(4).Infof("set createdAt of volume %s to %d", id, now)
+	}
+
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
@@ -37,9 +38,17 @@ import (
 // node server spec
 type NodeServer struct {
 	*csicommon.DefaultNodeServer
-	mounter mount.Interface
+	mounter  util.Mounter
+	timeouts util.OperationTimeouts
+	// MetadataStore is read to find the image of volumes whose mount is
+	// gone at NodeUnpublishVolume
+	MetadataStore util.CachePersister
 }
 
+// resolveBindMount returns the device bind mounted at a path, see
+// resolveBindMountedBlockDevice()
+var resolveBindMount = resolveBindMountedBlockDevice
+
 //TODO remove both stage and unstage methods
 //once https://github.com/kubernetes-csi/drivers/pull/145 is merged
 
@@ -72,6 +81,15 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// files left in the target by someone else would disappear under the
+	// mount
+	if !isBlock {
+		if err = util.CheckTargetEmpty(targetPath); err != nil {
+			klog.Errorf("rbd: not publishing volume %s: %v", req.GetVolumeId(), err)
+			return nil, err
+		}
+	}
+
 	// MULTI_NODE_MULTI_WRITER is supported by default for Block access type volumes
 	if req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
 		if isBlock {
@@ -87,12 +105,39 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, err
 	}
 	volOptions.VolName = volName
+	if imageName := req.GetVolumeContext()[imageNameKey]; imageName != "" {
+		volOptions.VolName = imageName
+	}
+	// a typo in the secret would only fail in rbd map otherwise
+	if err = validateNodeSecrets(volOptions, req.GetSecrets()); err != nil {
+		klog.Errorf("invalid secret for volume %s: %v", req.GetVolumeId(), err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mountCtx, cancel := ns.timeouts.WithTimeout(ctx, util.OpMount)
+	defer cancel()
+
+	if err = checkVolumeClusterFSID(mountCtx, volOptions, volOptions.UserID, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+
+	// the pool in the volume context is the name the pool had when the
+	// volume was created
+	volOptions.VolID = req.GetVolumeId()
+	volOptions.PoolID = req.GetVolumeContext()[poolIDKey]
+	if err = resolveVolumePool(mountCtx, volOptions, volOptions.UserID, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+
 	// Mapping RBD image
-	devicePath, err := attachRBDImage(volOptions, volOptions.UserID, req.GetSecrets())
+	devicePath, err := attachRBDImage(mountCtx, volOptions, volOptions.UserID, req.GetSecrets())
 	if err != nil {
+		if util.IsPermissionDenied(err) {
+			return nil, status.Errorf(codes.PermissionDenied, "mapping volume %s failed, %s: %v", req.GetVolumeId(), util.PermissionDeniedReason(err, volOptions.UserID), err)
+		}
 		return nil, err
 	}
-	klog.V(4).Infof("rbd image: %s/%s was successfully mapped at %s\n", req.GetVolumeId(), volOptions.Pool, devicePath)
+	util.V(util.LogMount, 4).Infof("rbd image: %s/%s was successfully mapped at %s\n", req.GetVolumeId(), volOptions.Pool, devicePath)
 
 	// Publish Path
 	err = ns.mountVolume(req, devicePath)
@@ -102,6 +147,17 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// validateNodeSecrets checks the key of the user mapping the image, the
+// secrets are keyed by the user ID. The key may be in the cluster
+// configuration instead.
+func validateNodeSecrets(volOptions *rbdVolume, secrets map[string]string) error {
+	if _, ok := secrets[volOptions.UserID]; !ok && volOptions.ClusterID != "" {
+		return nil
+	}
+
+	return util.ValidateSecretKey(secrets, volOptions.UserID)
+}
+
 func (ns *NodeServer) getVolumeName(req *csi.NodePublishVolumeRequest) (string, error) {
 	var volName string
 	isBlock := req.GetVolumeCapability().GetBlock() != nil
@@ -130,10 +186,10 @@ func (ns *NodeServer) mountVolume(req *csi.NodePublishVolumeRequest, devicePath
 	isBlock := req.GetVolumeCapability().GetBlock() != nil
 	targetPath := req.GetTargetPath()
 
-	klog.V(4).Infof("target %v\nisBlock %v\nfstype %v\ndevice %v\nreadonly %v\nattributes %v\n mountflags %v\n",
+	util.V(util.LogMount, 4).Infof("target %v\nisBlock %v\nfstype %v\ndevice %v\nreadonly %v\nattributes %v\n mountflags %v\n",
 		targetPath, isBlock, fsType, devicePath, readOnly, attrib, mountFlags)
 
-	diskMounter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: mount.NewOsExec()}
+	diskMounter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: util.NewExec()}
 	if isBlock {
 		options := []string{"bind"}
 		if err := diskMounter.Mount(devicePath, targetPath, fsType, options); err != nil {
@@ -154,7 +210,8 @@ func (ns *NodeServer) mountVolume(req *csi.NodePublishVolumeRequest, devicePath
 
 func (ns *NodeServer) createTargetPath(targetPath string, isBlock bool) (bool, error) {
 	// Check if that target path exists properly
-	notMnt, err := ns.mounter.IsNotMountPoint(targetPath)
+	mnt, err := util.IsMountPoint(ns.mounter, targetPath)
+	notMnt := !mnt
 	if err != nil {
 		if os.IsNotExist(err) {
 			if isBlock {
@@ -162,11 +219,11 @@ func (ns *NodeServer) createTargetPath(targetPath string, isBlock bool) (bool, e
 				// #nosec
 				targetPathFile, e := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, 0750)
 				if e != nil {
-					klog.V(4).Infof("Failed to create targetPath:%s with error: %v", targetPath, err)
+					util.V(util.LogMount, 4).Infof("Failed to create targetPath:%s with error: %v", targetPath, err)
 					return notMnt, status.Error(codes.Internal, e.Error())
 				}
 				if err = targetPathFile.Close(); err != nil {
-					klog.V(4).Infof("Failed to close targetPath:%s with error: %v", targetPath, err)
+					util.V(util.LogMount, 4).Infof("Failed to close targetPath:%s with error: %v", targetPath, err)
 					return notMnt, status.Error(codes.Internal, err.Error())
 				}
 			} else {
@@ -195,42 +252,32 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		}
 	}()
 
-	notMnt, err := ns.mounter.IsNotMountPoint(targetPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// targetPath has already been deleted
-			klog.V(4).Infof("targetPath: %s has already been deleted", targetPath)
-			return &csi.NodeUnpublishVolumeResponse{}, nil
-		}
-		return nil, status.Error(codes.NotFound, err.Error())
-	}
-	if notMnt {
-		// TODO should consider deleting path instead of returning error,
-		// once all codes become ready for csi 1.0.
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
-	}
-
-	devicePath, cnt, err := mount.GetDeviceNameFromMount(ns.mounter, targetPath)
+	err := util.RunTeardown(ctx, req.GetVolumeId(), func(ctx context.Context) error {
+		return ns.unmount(ctx, req.GetVolumeId(), targetPath)
+	})
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	if err = ns.unmount(targetPath, devicePath, cnt); err != nil {
 		return nil, err
 	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (ns *NodeServer) unmount(targetPath, devicePath string, cnt int) error {
-	var err error
+// unmount unmounts the target path and unmaps the device it was mounted from,
+// once it's not mounted anywhere else. Target paths which don't exist or
+// aren't mounted anymore are considered unmounted.
+func (ns *NodeServer) unmount(ctx context.Context, volID, targetPath string) error {
+	devicePath, cnt, err := mount.GetDeviceNameFromMount(ns.mounter, targetPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
 	// Bind mounted device needs to be resolved by using resolveBindMountedBlockDevice
 	if devicePath == "devtmpfs" {
-		devicePath, err = resolveBindMountedBlockDevice(targetPath)
+		devicePath, err = resolveBindMount(targetPath)
 		if err != nil {
 			return status.Error(codes.Internal, err.Error())
 		}
-		klog.V(4).Infof("NodeUnpublishVolume: devicePath: %s, (original)cnt: %d\n", devicePath, cnt)
+		util.V(util.LogMount, 4).Infof("NodeUnpublishVolume: devicePath: %s, (original)cnt: %d\n", devicePath, cnt)
 		// cnt for GetDeviceNameFromMount is broken for bind mouted device,
 		// it counts total number of mounted "devtmpfs", instead of counting this device.
 		// So, forcibly setting cnt to 1 here.
@@ -238,15 +285,20 @@ func (ns *NodeServer) unmount(targetPath, devicePath string, cnt int) error {
 		cnt = 1
 	}
 
-	klog.V(4).Infof("NodeUnpublishVolume: targetPath: %s, devicePath: %s\n", targetPath, devicePath)
+	util.V(util.LogMount, 4).Infof("NodeUnpublishVolume: targetPath: %s, devicePath: %s\n", targetPath, devicePath)
 
-	// Unmounting the image
-	err = ns.mounter.Unmount(targetPath)
-	if err != nil {
-		klog.V(3).Infof("failed to unmount targetPath: %s with error: %v", targetPath, err)
+	// Unmounting the image and removing targetPath
+	if err = util.UnmountTarget(ctx, ns.mounter, targetPath); err != nil {
+		util.V(util.LogMount, 3).Infof("failed to unmount targetPath: %s with error: %v", targetPath, err)
 		return status.Error(codes.Internal, err.Error())
 	}
 
+	if devicePath == "" {
+		// the mount is gone already, e.g. after a crash, but the image may
+		// still be mapped
+		return ns.detachUnusedDevice(ctx, volID, targetPath)
+	}
+
 	cnt--
 	if cnt != 0 {
 		// TODO should this be fixed not to success, so that driver can retry unmounting?
@@ -254,23 +306,89 @@ func (ns *NodeServer) unmount(targetPath, devicePath string, cnt int) error {
 	}
 
 	// Unmapping rbd device
-	if err = detachRBDDevice(devicePath); err != nil {
-		klog.V(3).Infof("failed to unmap rbd device: %s with error: %v", devicePath, err)
-		return err
+	if err = detachRBDDevice(ctx, devicePath); err != nil {
+		util.V(util.LogMount, 3).Infof("failed to unmap rbd device: %s with error: %v", devicePath, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// detachUnusedDevice unmaps the krbd device of the image of the volume
+// published to the target path, if it's mapped and not mounted anywhere
+func (ns *NodeServer) detachUnusedDevice(ctx context.Context, volID, targetPath string) error {
+	vol := &rbdVolume{}
+	if err := ns.MetadataStore.Get(volID, vol); err != nil {
+		if _, ok := err.(*util.CacheEntryNotFound); ok {
+			klog.Warningf("volume %s isn't in the metadata store, not unmapping its image", volID)
+			return nil
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// the image name may carry the PVC name, which the target path lacks
+	devicePath, found := getRbdDevFromImageAndPool(vol.Pool, vol.VolName)
+	if !found {
+		return nil
+	}
+
+	imagePath := vol.Pool + "/" + vol.VolName
+	attachdetachMutex.LockKey(imagePath)
+	defer func() {
+		if err := attachdetachMutex.UnlockKey(imagePath); err != nil {
+			klog.Warningf("failed to unlock mutex imagepath:%s %v", imagePath, err)
+		}
+	}()
+
+	inUse, err := ns.deviceMounted(devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if inUse {
+		util.V(util.LogMount, 4).Infof("rbd device %s of %s is still in use, not unmapping it", devicePath, imagePath)
+		return nil
+	}
+
+	klog.Infof("unmapping rbd device %s of %s, which isn't mounted at %s anymore", devicePath, imagePath, targetPath)
+	if err = detachRBDDevice(ctx, devicePath); err != nil {
+		util.V(util.LogMount, 3).Infof("failed to unmap rbd device: %s with error: %v", devicePath, err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// deviceMounted checks whether the device is mounted, or bind mounted as a
+// block volume, anywhere. Bind mounted devices are listed with the devtmpfs
+// of /dev as their device.
+func (ns *NodeServer) deviceMounted(devicePath string) (bool, error) {
+	mps, err := ns.mounter.List()
+	if err != nil {
+		return false, err
 	}
 
-	// Remove targetPath
-	if err = os.RemoveAll(targetPath); err != nil {
-		klog.V(3).Infof("failed to remove targetPath: %s with error: %v", targetPath, err)
+	for _, mp := range mps {
+		device := mp.Device
+		if (device == "devtmpfs" || device == "udev") && mp.Path != "/dev" && !strings.HasPrefix(mp.Path, "/dev/") {
+			if device, err = resolveBindMount(mp.Path); err != nil {
+				return false, fmt.Errorf("failed to resolve the device bind mounted at %s: %v", mp.Path, err)
+			}
+		}
+		if device == devicePath {
+			util.V(util.LogMount, 4).Infof("rbd device %s is mounted at %s", devicePath, mp.Path)
+			return true, nil
+		}
 	}
-	return err
+
+	return false, nil
 }
+
 func resolveBindMountedBlockDevice(mountPath string) (string, error) {
 	// #nosec
 	cmd := exec.Command("findmnt", "-n", "-o", "SOURCE", "--first-only", "--target", mountPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		klog.V(2).Infof("Failed findmnt command for path %s: %s %v", mountPath, out, err)
+		util.V(util.LogMount, 2).Infof("Failed findmnt command for path %s: %s %v", mountPath, out, err)
 		return "", err
 	}
 	return parseFindMntResolveSource(string(out))
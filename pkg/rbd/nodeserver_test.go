@@ -0,0 +1,228 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	// the image name carries the PVC name, see appendPVCNameToBackendName
+	vol := &rbdVolume{VolID: "csi-rbd-vol-1", VolName: "pvc-1-data", Pool: "rbd"}
+	if err := storeVolumeMetadata(vol, fake.store); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// mapped krbd devices of the image pvc-1-data in the pools other and rbd
+	sysfsPath, devicePrefix, resolve := rbdSysfsPath, rbdDevicePrefix, resolveBindMount
+	defer func() { rbdSysfsPath, rbdDevicePrefix, resolveBindMount = sysfsPath, devicePrefix, resolve }()
+	rbdSysfsPath = path.Join(fake.tmpDir, "sys")
+	rbdDevicePrefix = path.Join(fake.tmpDir, "rbd")
+	for id, pool := range []string{"other", "rbd"} {
+		dir := path.Join(rbdSysfsPath, strconv.Itoa(id))
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		for file, content := range map[string]string{
+			path.Join(dir, "pool"):             pool + "\n",
+			path.Join(dir, "name"):             "pvc-1-data\n",
+			rbdDevicePrefix + strconv.Itoa(id): "",
+		} {
+			if err := ioutil.WriteFile(file, []byte(content), 0640); err != nil {
+				t.Fatalf("Test setup error %s", err)
+			}
+		}
+	}
+	device := rbdDevicePrefix + "1"
+
+	// block volumes are bind mounts of the device from the devtmpfs of /dev
+	blockPath := path.Join(fake.tmpDir, "block")
+	resolveBindMount = func(mountPath string) (string, error) {
+		if mountPath == blockPath {
+			return device, nil
+		}
+		return "", fmt.Errorf("%s isn't a bind mounted device", mountPath)
+	}
+
+	tests := []struct {
+		name        string
+		volumeID    string
+		exists      bool
+		mountPoints []string
+		unmaps      int
+	}{
+		{"missing target, device still mapped", "csi-rbd-vol-1", false, nil, 1},
+		{"missing target, device used by another target", "csi-rbd-vol-1", false, []string{"other"}, 0},
+		{"missing target, device used by a block target", "csi-rbd-vol-1", false, []string{"block"}, 0},
+		{"mounted", "csi-rbd-vol-1", true, []string{"pvc-1"}, 1},
+		{"mount gone", "csi-rbd-vol-1", true, []string{"dev"}, 1},
+		{"mount gone, device used by another target", "csi-rbd-vol-1", true, []string{"other"}, 0},
+		{"mount gone, device used by a block target", "csi-rbd-vol-1", true, []string{"block"}, 0},
+		{"mount gone, volume unknown", "csi-rbd-vol-2", true, nil, 0},
+	}
+
+	for _, tt := range tests {
+		podPath := path.Join(fake.tmpDir, "pods", "pvc-1")
+		targetPath := path.Join(podPath, "mount")
+		if err := os.MkdirAll(podPath, 0750); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		if tt.exists {
+			if err := os.Mkdir(targetPath, 0750); err != nil {
+				t.Fatalf("Test setup error %s", err)
+			}
+		}
+
+		mounter := util.NewFakeMounter()
+		for _, mp := range tt.mountPoints {
+			switch mp {
+			case "pvc-1":
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: device, Path: targetPath})
+			case "block":
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "devtmpfs", Path: blockPath})
+			case "dev":
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "devtmpfs", Path: "/dev"})
+			default:
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: device, Path: path.Join(fake.tmpDir, mp)})
+			}
+		}
+		ns := &NodeServer{mounter: mounter, MetadataStore: fake.store}
+
+		calls := fake.calls(t)
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   tt.volumeID,
+			TargetPath: targetPath,
+		})
+		if err != nil {
+			t.Errorf("%s: NodeUnpublishVolume() = %v, want success", tt.name, err)
+		}
+
+		if _, err = os.Stat(targetPath); !os.IsNotExist(err) {
+			t.Errorf("%s: target path wasn't removed: %v", tt.name, err)
+		}
+
+		if unmaps := fake.calls(t) - calls; unmaps != tt.unmaps {
+			t.Errorf("%s: want (%d) unmaps, got (%d)", tt.name, tt.unmaps, unmaps)
+		}
+	}
+}
+
+func TestNodePublishVolumeMounted(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "rbd-node")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	tests := []struct {
+		name       string
+		targetPath string
+		capability *csi.VolumeCapability
+	}{
+		{"filesystem", path.Join(basePath, "pvc-1", "mount"), &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		{"block", path.Join(basePath, "pvc-2"), &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		}},
+	}
+
+	for _, tt := range tests {
+		if err = os.MkdirAll(tt.targetPath, 0750); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		mounter := util.NewFakeMounter()
+		mounter.MountPoints = []mount.MountPoint{{Device: "/dev/rbd0", Path: tt.targetPath}}
+		ns := &NodeServer{mounter: mounter}
+
+		// TEST: a mounted target is published without mapping the image again
+		_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-rbd-vol-1",
+			TargetPath:       tt.targetPath,
+			VolumeCapability: tt.capability,
+		})
+		if err != nil {
+			t.Errorf("%s: NodePublishVolume() = %v, want success", tt.name, err)
+		}
+		if len(mounter.Log) != 0 {
+			t.Errorf("%s: want no mounts, got (%v)", tt.name, mounter.Log)
+		}
+	}
+}
+
+func TestNodePublishVolumeSecrets(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	targetPath := path.Join(fake.tmpDir, "pvc-1", "mount")
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{"missing key", map[string]string{"other": "AQBBbYhcaMz0GBAAs0xmOq0Ha7iRaHTWnBQlHg=="}},
+		{"empty key", map[string]string{"admin": " "}},
+		{"invalid key", map[string]string{"admin": "not a cephx key"}},
+	}
+
+	for _, tt := range tests {
+		mounter := util.NewFakeMounter()
+		ns := &NodeServer{mounter: mounter}
+
+		// TEST: invalid secrets are rejected before mapping the image
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:   "csi-rbd-vol-1",
+			TargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			VolumeContext: map[string]string{"pool": "rbd", "monitors": "mon1", "userid": "admin"},
+			Secrets:       tt.secrets,
+		})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Errorf("%s: want (%v), got (%v)", tt.name, codes.InvalidArgument, err)
+		}
+		if len(mounter.Log) != 0 {
+			t.Errorf("%s: want no mounts, got (%v)", tt.name, mounter.Log)
+		}
+	}
+
+	if calls := fake.calls(t); calls != 0 {
+		t.Errorf("Failed: want (0) rbd calls, got (%d)", calls)
+	}
+}
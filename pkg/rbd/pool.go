@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Pools are renamed keeping their ID. Volumes and snapshots record the ID of
+// their pool when they're created, and every later operation on them
+// resolves the current name of the pool from the ID, instead of trusting the
+// name in their metadata or in the parameters of the request. Volumes and
+// snapshots created before the ID was recorded keep using the recorded name.
+
+// listPools returns the pools of the cluster the monitors belong to
+func listPools(ctx context.Context, mon, id, key string) ([]util.CephPool, error) {
+	pools, err := util.ListPools(func() ([]byte, error) {
+		stdout, stderr, err := execCommandStdout(ctx, "ceph", []string{"osd", "lspools", "--format=json", "--id", id, "-m", mon, "--key=" + key})
+		if err != nil {
+			return nil, fmt.Errorf("%v, command output: %s", err, string(stderr))
+		}
+		return stdout, nil
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return pools, nil
+}
+
+// getPoolID returns the ID of the pool with the given name
+func getPoolID(ctx context.Context, pool, mon, id, key string) (string, error) {
+	pools, err := listPools(ctx, mon, id, key)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range pools {
+		if p.Name == pool {
+			return strconv.FormatInt(p.ID, 10), nil
+		}
+	}
+
+	return "", status.Errorf(codes.NotFound, "pool %s not found", pool)
+}
+
+// getPoolName returns the current name of the pool with the given ID,
+// FailedPrecondition if there's no such pool
+func getPoolName(ctx context.Context, poolID, mon, id, key string) (string, error) {
+	pools, err := listPools(ctx, mon, id, key)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range pools {
+		if strconv.FormatInt(p.ID, 10) == poolID {
+			return p.Name, nil
+		}
+	}
+
+	return "", status.Errorf(codes.FailedPrecondition, "pool with ID %s not found", poolID)
+}
+
+// resolvePoolName returns the current name of the pool with the ID recorded
+// for an object, which was last known as pool. Renames are logged, so that
+// the StorageClasses still referring to the old name get updated.
+func resolvePoolName(ctx context.Context, object, pool, poolID, mon, id, key string) (string, error) {
+	name, err := getPoolName(ctx, poolID, mon, id, key)
+	if err != nil {
+		return "", status.Errorf(status.Code(err), "failed to resolve the pool of %s: %v", object, status.Convert(err).Message())
+	}
+
+	if name != pool {
+		klog.Warningf("rbd: pool %s (ID %s) of %s was renamed to %s, update the StorageClasses and VolumeSnapshotClasses referring to %s",
+			pool, poolID, object, name, pool)
+	}
+
+	return name, nil
+}
+
+// volumePoolID returns the ID of the pool the volume is created in, to be
+// recorded in its metadata
+func volumePoolID(ctx context.Context, pOpts *rbdVolume, id string, credentials map[string]string) (string, error) {
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := getRBDKey(pOpts.ClusterID, id, credentials)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return getPoolID(ctx, pOpts.Pool, mon, id, key)
+}
+
+// resolveVolumePool updates the pool of the volume to the current name of
+// the pool with its recorded ID
+func resolveVolumePool(ctx context.Context, pOpts *rbdVolume, id string, credentials map[string]string) error {
+	if pOpts.PoolID == "" {
+		return nil
+	}
+
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := getRBDKey(pOpts.ClusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pOpts.Pool, err = resolvePoolName(ctx, "volume "+pOpts.VolID, pOpts.Pool, pOpts.PoolID, mon, id, key)
+	return err
+}
+
+// resolveSnapshotPool updates the pool of the snapshot to the current name
+// of the pool with its recorded ID
+func resolveSnapshotPool(ctx context.Context, pOpts *rbdSnapshot, id string, credentials map[string]string) error {
+	if pOpts.PoolID == "" {
+		return nil
+	}
+
+	mon, err := getSnapMon(pOpts, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	key, err := getRBDKey(pOpts.ClusterID, id, credentials)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pOpts.Pool, err = resolvePoolName(ctx, "snapshot "+pOpts.SnapID, pOpts.Pool, pOpts.PoolID, mon, id, key)
+	return err
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPoolRename(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rbd-pool-rename")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	path := os.Getenv("PATH")
+	defer func() {
+		os.Setenv("PATH", path) // nolint: errcheck
+		os.RemoveAll(tmpDir)    // nolint: errcheck
+		clusterFSIDs = map[string]string{}
+	}()
+
+	pools := filepath.Join(tmpDir, "pools")
+	setPools := func(content string) {
+		if err = ioutil.WriteFile(pools, []byte(content), 0644); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+	setPools(`[{"poolnum":3,"poolname":"replicapool"}]`)
+
+	// rbd fails to open pools which don't exist
+	rbdScript := `#!/bin/sh
+echo "$*" >> ` + filepath.Join(tmpDir, "calls") + `
+prev=""
+for arg in "$@"; do
+	if [ "$prev" = "--pool" ] && ! grep -q "\"poolname\":\"$arg\"" ` + pools + `; then
+		echo "rbd: error opening pool '$arg': (2) No such file or directory"
+		exit 2
+	fi
+	prev="$arg"
+done
+case "$1" in
+info) echo '{"size":1073741824}' ;;
+children) echo '[]' ;;
+esac
+`
+	cephScript := "#!/bin/sh\ncase \"$1\" in\nfsid) echo b1ebd8d6-4f4c-11e9-8c1f-0242ac110002 ;;\nosd) cat " + pools + " ;;\nesac\n"
+	for name, script := range map[string]string{"rbd": rbdScript, "ceph": cephScript} {
+		if err = ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(script), 0755); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+	if err = os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+path); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	store := &util.NodeCache{BasePath: tmpDir, CacheDir: "controller"}
+	if err = store.EnsureCacheDirectory(store.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	d := csicommon.NewCSIDriver("rbd.csi.ceph.com", version, "node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	})
+	cs := NewControllerServer(d, store, nil, false, false)
+
+	// the classes keep referring to the pool by its old name
+	parameters := map[string]string{"pool": "replicapool", "monitors": "mon1", "imageFeatures": "layering"}
+	secrets := map[string]string{"admin": "key"}
+
+	volResp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-rename",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: parameters,
+		Secrets:    secrets,
+	})
+	if err != nil {
+		t.Fatalf("Failed: CreateVolume: %v", err)
+	}
+	volID := volResp.GetVolume().GetVolumeId()
+	defer delete(rbdVolumes, volID)
+
+	// TEST: the node is given the ID of the pool
+	if poolID := volResp.GetVolume().GetVolumeContext()[poolIDKey]; poolID != "3" {
+		t.Errorf("Failed: want pool ID (3), got (%s)", poolID)
+	}
+
+	setPools(`[{"poolnum":3,"poolname":"fastpool"}]`)
+
+	// TEST: the snapshot is taken in the renamed pool of the volume
+	snapResp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-rename",
+		SourceVolumeId: volID,
+		Parameters:     parameters,
+		Secrets:        secrets,
+	})
+	if err != nil {
+		t.Fatalf("Failed: CreateSnapshot: %v", err)
+	}
+	snapID := snapResp.GetSnapshot().GetSnapshotId()
+	defer delete(rbdSnapshots, snapID)
+
+	snap := &rbdSnapshot{}
+	if err = store.Get(snapID, snap); err != nil {
+		t.Fatalf("Test error %s", err)
+	}
+	if snap.Pool != "fastpool" || snap.PoolID != "3" {
+		t.Errorf("Failed: want snapshot in pool (fastpool) of ID (3), got (%s) of ID (%s)", snap.Pool, snap.PoolID)
+	}
+
+	setPools(`[{"poolnum":3,"poolname":"slowpool"}]`)
+
+	// TEST: deletes resolve the pool again, regardless of the name recorded
+	if _, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapID, Secrets: secrets}); err != nil {
+		t.Errorf("Failed: DeleteSnapshot: %v", err)
+	}
+	if _, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID, Secrets: secrets}); err != nil {
+		t.Errorf("Failed: DeleteVolume: %v", err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(tmpDir, "calls"))
+	if err != nil {
+		t.Fatalf("Test error %s", err)
+	}
+	for _, call := range []string{"snap rm --pool slowpool", "rm pvc-rename --pool slowpool"} {
+		if !strings.Contains(string(calls), call) {
+			t.Errorf("Failed: want call (%s), got (%s)", call, string(calls))
+		}
+	}
+
+	// TEST: volumes of deleted pools aren't deleted in another pool
+	setPools(`[{"poolnum":4,"poolname":"replicapool"}]`)
+	vol := &rbdVolume{VolID: volID, Monitors: "mon1", Pool: "replicapool", PoolID: "3"}
+	if err = resolveVolumePool(context.Background(), vol, "admin", secrets); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Failed: want (%v), got (%v)", codes.FailedPrecondition, err)
+	}
+}
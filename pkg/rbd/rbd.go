@@ -64,15 +64,21 @@ func NewIdentityServer(d *csicommon.CSIDriver) *IdentityServer {
 }
 
 // NewControllerServer initialize a controller server for rbd CSI driver
-func NewControllerServer(d *csicommon.CSIDriver, cachePersister util.CachePersister) *ControllerServer {
-	return &ControllerServer{
+func NewControllerServer(d *csicommon.CSIDriver, cachePersister util.CachePersister, timeouts util.OperationTimeouts, trackAttachments, verifySnapshotsOnRetry bool) *ControllerServer {
+	cs := &ControllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		MetadataStore:           cachePersister,
+		timeouts:                timeouts,
+		verifySnapshotsOnRetry:  verifySnapshotsOnRetry,
 	}
+	if trackAttachments {
+		cs.attachments = &csicommon.AttachmentTracker{MetadataStore: cachePersister}
+	}
+	return cs
 }
 
 // NewNodeServer initialize a node server for rbd CSI driver.
-func NewNodeServer(d *csicommon.CSIDriver, containerized bool) (*NodeServer, error) {
+func NewNodeServer(d *csicommon.CSIDriver, cachePersister util.CachePersister, containerized bool, timeouts util.OperationTimeouts) (*NodeServer, error) {
 	mounter := mount.New("")
 	if containerized {
 		ne, err := nsenter.NewNsenter(nsenter.DefaultHostRootFsPath, exec.New())
@@ -83,24 +89,76 @@ func NewNodeServer(d *csicommon.CSIDriver, containerized bool) (*NodeServer, err
 	}
 	return &NodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
-		mounter:           mounter,
+		mounter:           util.NewMounter(mounter),
+		timeouts:          timeouts,
+		MetadataStore:     cachePersister,
 	}, nil
 }
 
+// DriverOptions configures the rbd driver
+type DriverOptions struct {
+	// DriverName and NodeID identify the driver and the node it runs on
+	DriverName string
+	NodeID     string
+	// Endpoint is the unix:// or tcp:// endpoint the driver serves on
+	Endpoint string
+	// ConfigRoot is the directory of the cluster configurations, or
+	// k8s_objects
+	ConfigRoot string
+	// Containerized runs the node server in a container
+	Containerized bool
+	// TrackAttachments records the nodes volumes are published to
+	TrackAttachments bool
+	// VerifySnapshotsOnRetry checks that snapshots exist in the backend
+	// before answering CreateSnapshot retries
+	VerifySnapshotsOnRetry bool
+	// ReadAffinity localizes reads to the OSDs closest to the node, with
+	// the crush location of the node labels in CrushLocationLabels
+	ReadAffinity        bool
+	CrushLocationLabels string
+	// RejectUnknownParameters fails requests with unknown parameters
+	RejectUnknownParameters bool
+	// BackendMetadata maps the parameters set as image-meta of new images
+	BackendMetadata util.BackendMetadataMapping
+	// SkipCapsCheck and SkipFullCheck don't check the caps of the
+	// credentials and the health of the cluster before creating volumes
+	// and snapshots
+	SkipCapsCheck bool
+	SkipFullCheck bool
+	// UpgradeMetadataSchema migrates the metadata store before serving
+	UpgradeMetadataSchema bool
+	// Timeouts of the backend operations
+	Timeouts util.OperationTimeouts
+	// CachePersister is the metadata store
+	CachePersister util.CachePersister
+	// ServerOptions configures the gRPC server
+	ServerOptions csicommon.ServerOptions
+}
+
 // Run start a non-blocking grpc controller,node and identityserver for
 // rbd CSI driver which can serve multiple parallel requests
-func (r *Driver) Run(driverName, nodeID, endpoint, configRoot string, containerized bool, cachePersister util.CachePersister) {
+func (r *Driver) Run(opts DriverOptions) {
 	var err error
-	klog.Infof("Driver: %v version: %v", driverName, version)
+	klog.Infof("Driver: %v version: %v", opts.DriverName, version)
 
 	// Initialize config store
-	confStore, err = util.NewConfigStore(configRoot)
+	confStore, err = util.NewConfigStore(opts.ConfigRoot)
 	if err != nil {
 		klog.Fatalln("Failed to initialize config store.")
 	}
 
+	volumeParameters.RejectUnknown = opts.RejectUnknownParameters
+	volumeParameters.Recognize(opts.BackendMetadata.Parameters()...)
+	snapshotParameters.RejectUnknown = opts.RejectUnknownParameters
+
+	if opts.ReadAffinity {
+		if crushLocation, err = util.GetCrushLocationMap(opts.CrushLocationLabels, opts.NodeID); err != nil {
+			klog.Fatalf("failed to get crush location of node %s: %v", opts.NodeID, err)
+		}
+	}
+
 	// Initialize default library driver
-	r.cd = csicommon.NewCSIDriver(driverName, version, nodeID)
+	r.cd = csicommon.NewCSIDriver(opts.DriverName, version, opts.NodeID)
 	if r.cd == nil {
 		klog.Fatalln("Failed to initialize CSI Driver.")
 	}
@@ -123,18 +181,41 @@ func (r *Driver) Run(driverName, nodeID, endpoint, configRoot string, containeri
 
 	// Create GRPC servers
 	r.ids = NewIdentityServer(r.cd)
-	r.ns, err = NewNodeServer(r.cd, containerized)
+	r.ns, err = NewNodeServer(r.cd, opts.CachePersister, opts.Containerized, opts.Timeouts)
 	if err != nil {
 		klog.Fatalf("failed to start node server, err %v\n", err)
 	}
 
-	r.cs = NewControllerServer(r.cd, cachePersister)
-
-	if err = r.cs.LoadExDataFromMetadataStore(); err != nil {
+	r.cs = NewControllerServer(r.cd, opts.CachePersister, opts.Timeouts, opts.TrackAttachments, opts.VerifySnapshotsOnRetry)
+	r.cs.backendMetadata = opts.BackendMetadata
+	if !opts.SkipCapsCheck {
+		r.cs.caps = util.NewCapsChecker()
+	}
+	if !opts.SkipFullCheck {
+		r.cs.health = util.NewClusterHealthChecker()
+	}
+	r.cs.policy = opts.ServerOptions.PolicyWebhook
+
+	// the metadata is migrated while no RPCs are served, before it's
+	// loaded
+	loadMetadata := func() error {
+		if opts.UpgradeMetadataSchema {
+			if err := metadataSchema.Upgrade(opts.CachePersister); err != nil {
+				return err
+			}
+		}
+		return r.cs.LoadExDataFromMetadataStore()
+	}
+	if gate := opts.ServerOptions.ControllerGate; gate != nil {
+		// other replicas may have provisioned volumes and snapshots
+		// while this one stood by, they are reloaded each time it
+		// becomes the leader
+		gate.BeforeAdmitting(loadMetadata)
+	} else if err = loadMetadata(); err != nil {
 		klog.Fatalf("failed to load metadata from store, err %v\n", err)
 	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(endpoint, r.ids, r.cs, r.ns)
+	s := csicommon.NewNonBlockingGRPCServer(opts.ServerOptions)
+	s.Start(opts.Endpoint, r.ids, r.cs, r.ns)
 	s.Wait()
 }
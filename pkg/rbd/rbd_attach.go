@@ -17,14 +17,17 @@ limitations under the License.
 package rbd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ceph/ceph-csi/pkg/util"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
@@ -39,6 +42,14 @@ const (
 var (
 	hostRootFS = "/"
 	hasNBD     = false
+
+	// krbd devices are listed in rbdSysfsPath, and named rbdDevicePrefix<id>
+	rbdSysfsPath    = "/sys/bus/rbd/devices"
+	rbdDevicePrefix = "/dev/rbd"
+
+	// crushLocation of the node, reads are served from the closest OSD to
+	// it when read affinity is enabled
+	crushLocation map[string]string
 )
 
 func init() {
@@ -51,45 +62,49 @@ func init() {
 
 // Search /sys/bus for rbd device that matches given pool and image.
 func getRbdDevFromImageAndPool(pool string, image string) (string, bool) {
+	devicePath, _, found := findRbdDevice(func(p, name string) bool {
+		return p == pool && name == image
+	})
+	return devicePath, found
+}
+
+// findRbdDevice returns the first existing rbd device, and its pool, whose
+// pool and image match
+func findRbdDevice(match func(pool, image string) bool) (string, string, bool) {
 	// /sys/bus/rbd/devices/X/name and /sys/bus/rbd/devices/X/pool
-	sysPath := "/sys/bus/rbd/devices"
-	if dirs, err := ioutil.ReadDir(sysPath); err == nil {
+	if dirs, err := ioutil.ReadDir(rbdSysfsPath); err == nil {
 		for _, f := range dirs {
 			// Pool and name format:
 			// see rbd_pool_show() and rbd_name_show() at
 			// https://github.com/torvalds/linux/blob/master/drivers/block/rbd.c
 			name := f.Name()
-			// First match pool, then match name.
-			poolFile := path.Join(sysPath, name, "pool")
+			poolFile := path.Join(rbdSysfsPath, name, "pool")
 			// #nosec
 			poolBytes, err := ioutil.ReadFile(poolFile)
 			if err != nil {
-				klog.V(4).Infof("error reading %s: %v", poolFile, err)
+				util.V(util.LogMount, 4).Infof("error reading %s: %v", poolFile, err)
 				continue
 			}
-			if strings.TrimSpace(string(poolBytes)) != pool {
-				klog.V(4).Infof("device %s is not %q: %q", name, pool, string(poolBytes))
-				continue
-			}
-			imgFile := path.Join(sysPath, name, "name")
+			imgFile := path.Join(rbdSysfsPath, name, "name")
 			// #nosec
 			imgBytes, err := ioutil.ReadFile(imgFile)
 			if err != nil {
-				klog.V(4).Infof("error reading %s: %v", imgFile, err)
+				util.V(util.LogMount, 4).Infof("error reading %s: %v", imgFile, err)
 				continue
 			}
-			if strings.TrimSpace(string(imgBytes)) != image {
-				klog.V(4).Infof("device %s is not %q: %q", name, image, string(imgBytes))
+			pool := strings.TrimSpace(string(poolBytes))
+			if !match(pool, strings.TrimSpace(string(imgBytes))) {
+				util.V(util.LogMount, 4).Infof("device %s doesn't match: %q/%q", name, pool, string(imgBytes))
 				continue
 			}
 			// Found a match, check if device exists.
-			devicePath := "/dev/rbd" + name
+			devicePath := rbdDevicePrefix + name
 			if _, err := os.Lstat(devicePath); err == nil {
-				return devicePath, true
+				return devicePath, pool, true
 			}
 		}
 	}
-	return "", false
+	return "", "", false
 }
 
 func getMaxNbds() (int, error) {
@@ -102,7 +117,7 @@ func getMaxNbds() (int, error) {
 		return 0, fmt.Errorf("rbd-nbd: failed to retrieve max_nbds from %s err: %q", maxNbdsPath, err)
 	}
 
-	klog.V(4).Infof("found nbds max parameters file at %s", maxNbdsPath)
+	util.V(util.LogMount, 4).Infof("found nbds max parameters file at %s", maxNbdsPath)
 
 	maxNbdBytes, err := ioutil.ReadFile(maxNbdsPath)
 	if err != nil {
@@ -114,7 +129,7 @@ func getMaxNbds() (int, error) {
 		return 0, fmt.Errorf("rbd-nbd: failed to read max_nbds err: %q", err)
 	}
 
-	klog.V(4).Infof("rbd-nbd: max_nbds: %d", maxNbds)
+	util.V(util.LogMount, 4).Infof("rbd-nbd: max_nbds: %d", maxNbds)
 	return maxNbds, nil
 }
 
@@ -131,7 +146,7 @@ func getNbdDevFromImageAndPool(pool string, image string) (string, bool) {
 
 	maxNbds, maxNbdsErr := getMaxNbds()
 	if maxNbdsErr != nil {
-		klog.V(4).Infof("error reading nbds_max %v", maxNbdsErr)
+		util.V(util.LogMount, 4).Infof("error reading nbds_max %v", maxNbdsErr)
 		return "", false
 	}
 
@@ -150,20 +165,20 @@ func getnbdDevicePath(nbdPath, imgPath string, count int) (string, error) {
 
 	_, err := os.Lstat(nbdPath)
 	if err != nil {
-		klog.V(4).Infof("error reading nbd info directory %s: %v", nbdPath, err)
+		util.V(util.LogMount, 4).Infof("error reading nbd info directory %s: %v", nbdPath, err)
 		return "", err
 	}
 	// #nosec
 	pidBytes, err := ioutil.ReadFile(path.Join(nbdPath, "pid"))
 	if err != nil {
-		klog.V(5).Infof("did not find valid pid file in dir %s: %v", nbdPath, err)
+		util.V(util.LogMount, 5).Infof("did not find valid pid file in dir %s: %v", nbdPath, err)
 		return "", err
 	}
 	cmdlineFileName := path.Join(hostRootFS, "/proc", strings.TrimSpace(string(pidBytes)), "cmdline")
 	// #nosec
 	rawCmdline, err := ioutil.ReadFile(cmdlineFileName)
 	if err != nil {
-		klog.V(4).Infof("failed to read cmdline file %s: %v", cmdlineFileName, err)
+		util.V(util.LogMount, 4).Infof("failed to read cmdline file %s: %v", cmdlineFileName, err)
 		return "", err
 	}
 	cmdlineArgs := strings.FieldsFunc(string(rawCmdline), func(r rune) bool {
@@ -173,12 +188,12 @@ func getnbdDevicePath(nbdPath, imgPath string, count int) (string, error) {
 	// Only accepted pattern of cmdline is from execRbdMap:
 	// rbd-nbd map pool/image ...
 	if len(cmdlineArgs) < 3 || cmdlineArgs[0] != rbdTonbd || cmdlineArgs[1] != "map" {
-		klog.V(4).Infof("nbd device %s is not used by rbd", nbdPath)
+		util.V(util.LogMount, 4).Infof("nbd device %s is not used by rbd", nbdPath)
 		return "", err
 
 	}
 	if cmdlineArgs[2] != imgPath {
-		klog.V(4).Infof("rbd-nbd device %s did not match expected image path: %s with path found: %s",
+		util.V(util.LogMount, 4).Infof("rbd-nbd device %s did not match expected image path: %s with path found: %s",
 			nbdPath, imgPath, cmdlineArgs[2])
 		return "", err
 	}
@@ -211,20 +226,21 @@ func waitForPath(pool, image string, maxRetries int, useNbdDriver bool) (string,
 
 // Check if rbd-nbd tools are installed.
 func checkRbdNbdTools() bool {
-	_, err := execCommand("modprobe", []string{"nbd"})
+	ctx := context.Background()
+	_, err := execCommand(ctx, "modprobe", []string{"nbd"})
 	if err != nil {
-		klog.V(3).Infof("rbd-nbd: nbd modprobe failed with error %v", err)
+		util.V(util.LogMount, 3).Infof("rbd-nbd: nbd modprobe failed with error %v", err)
 		return false
 	}
-	if _, err := execCommand(rbdTonbd, []string{"--version"}); err != nil {
-		klog.V(3).Infof("rbd-nbd: running rbd-nbd --version failed with error %v", err)
+	if _, err := execCommand(ctx, rbdTonbd, []string{"--version"}); err != nil {
+		util.V(util.LogMount, 3).Infof("rbd-nbd: running rbd-nbd --version failed with error %v", err)
 		return false
 	}
-	klog.V(3).Infof("rbd-nbd tools were found.")
+	util.V(util.LogMount, 3).Infof("rbd-nbd tools were found.")
 	return true
 }
 
-func attachRBDImage(volOptions *rbdVolume, userID string, credentials map[string]string) (string, error) {
+func attachRBDImage(ctx context.Context, volOptions *rbdVolume, userID string, credentials map[string]string) (string, error) {
 	var err error
 
 	image := volOptions.VolName
@@ -247,7 +263,7 @@ func attachRBDImage(volOptions *rbdVolume, userID string, credentials map[string
 			}
 		}()
 
-		_, err = execCommand("modprobe", []string{moduleName})
+		_, err = execCommand(ctx, "modprobe", []string{moduleName})
 		if err != nil {
 			klog.Warningf("rbd: failed to load rbd kernel module:%v", err)
 			return "", err
@@ -259,18 +275,18 @@ func attachRBDImage(volOptions *rbdVolume, userID string, credentials map[string
 			Steps:    rbdImageWatcherSteps,
 		}
 
-		err = waitForrbdImage(backoff, volOptions, userID, credentials)
+		err = waitForrbdImage(ctx, backoff, volOptions, userID, credentials)
 
 		if err != nil {
 			return "", err
 		}
-		devicePath, err = createPath(volOptions, userID, credentials)
+		devicePath, err = createPath(ctx, volOptions, userID, credentials)
 	}
 
 	return devicePath, err
 }
 
-func createPath(volOpt *rbdVolume, userID string, creds map[string]string) (string, error) {
+func createPath(ctx context.Context, volOpt *rbdVolume, userID string, creds map[string]string) (string, error) {
 	image := volOpt.VolName
 	imagePath := fmt.Sprintf("%s/%s", volOpt.Pool, image)
 
@@ -279,7 +295,7 @@ func createPath(volOpt *rbdVolume, userID string, creds map[string]string) (stri
 		return "", err
 	}
 
-	klog.V(5).Infof("rbd: map mon %s", mon)
+	util.V(util.LogMount, 5).Infof("rbd: map mon %s", mon)
 	key, err := getRBDKey(volOpt.ClusterID, userID, creds)
 	if err != nil {
 		return "", err
@@ -292,8 +308,9 @@ func createPath(volOpt *rbdVolume, userID string, creds map[string]string) (stri
 		cmdName = rbdTonbd
 	}
 
-	output, err := execCommand(cmdName, []string{
-		"map", imagePath, "--id", userID, "-m", mon, "--key=" + key})
+	args := []string{"map", imagePath, "--id", userID, "-m", mon, "--key=" + key}
+	args = append(args, readAffinityMapArgs(useNBD)...)
+	output, err := execCommand(ctx, cmdName, args)
 	if err != nil {
 		klog.Warningf("rbd: map error %v, rbd output: %s", err, string(output))
 		return "", fmt.Errorf("rbd: map failed %v, rbd output: %s", err, string(output))
@@ -305,17 +322,47 @@ func createPath(volOpt *rbdVolume, userID string, creds map[string]string) (stri
 	return devicePath, nil
 }
 
-func waitForrbdImage(backoff wait.Backoff, volOptions *rbdVolume, userID string, credentials map[string]string) error {
+// readAffinityMapArgs returns the map arguments localizing reads to the crush
+// location of the node, if read affinity is enabled and the location is known
+func readAffinityMapArgs(useNBD bool) []string {
+	if len(crushLocation) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(crushLocation))
+	for k := range crushLocation {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if useNBD {
+		// librbd options
+		location := make([]string, 0, len(keys))
+		for _, k := range keys {
+			location = append(location, k+"="+crushLocation[k])
+		}
+		return []string{"--rbd_read_from_replica_policy=localize", "--crush_location=" + strings.Join(location, " ")}
+	}
+
+	// krbd map options
+	location := make([]string, 0, len(keys))
+	for _, k := range keys {
+		location = append(location, k+":"+crushLocation[k])
+	}
+	return []string{"--options", "read_from_replica=localize,crush_location=" + strings.Join(location, "|")}
+}
+
+func waitForrbdImage(ctx context.Context, backoff wait.Backoff, volOptions *rbdVolume, userID string, credentials map[string]string) error {
 	image := volOptions.VolName
 	imagePath := fmt.Sprintf("%s/%s", volOptions.Pool, image)
 
 	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		used, rbdOutput, err := rbdStatus(volOptions, userID, credentials)
+		used, rbdOutput, err := rbdStatus(ctx, volOptions, userID, credentials)
 		if err != nil {
 			return false, fmt.Errorf("fail to check rbd image status with: (%v), rbd output: (%s)", err, rbdOutput)
 		}
 		if (volOptions.DisableInUseChecks) && (used) {
-			klog.V(2).Info("valid multi-node attach requested, ignoring watcher in-use result")
+			util.V(util.LogMount, 2).Info("valid multi-node attach requested, ignoring watcher in-use result")
 			return used, nil
 		}
 		return !used, nil
@@ -328,18 +375,18 @@ func waitForrbdImage(backoff wait.Backoff, volOptions *rbdVolume, userID string,
 	return err
 }
 
-func detachRBDDevice(devicePath string) error {
+func detachRBDDevice(ctx context.Context, devicePath string) error {
 	var err error
 	var output []byte
 
-	klog.V(3).Infof("rbd: unmap device %s", devicePath)
+	util.V(util.LogMount, 3).Infof("rbd: unmap device %s", devicePath)
 
 	cmdName := rbd
 	if strings.HasPrefix(devicePath, "/dev/nbd") {
 		cmdName = rbdTonbd
 	}
 
-	output, err = execCommand(cmdName, []string{"unmap", devicePath})
+	output, err = execCommand(ctx, cmdName, []string{"unmap", devicePath})
 	if err != nil {
 		return fmt.Errorf("rbd: unmap failed %v, rbd output: %s", err, string(output))
 	}
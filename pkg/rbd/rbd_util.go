@@ -17,15 +17,21 @@ limitations under the License.
 package rbd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
 	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
-	"k8s.io/kubernetes/pkg/util/keymutex"
 )
 
 const (
@@ -37,6 +43,8 @@ const (
 	rbdImageWatcherFactor    = 1.4
 	rbdImageWatcherSteps     = 10
 	rbdDefaultMounter        = "rbd"
+	// images of exactSize volumes are sized in sectors
+	rbdSectorSize = 512
 )
 
 type rbdVolume struct {
@@ -53,6 +61,27 @@ type rbdVolume struct {
 	Mounter            string `json:"mounter"`
 	DisableInUseChecks bool   `json:"disableInUseChecks"`
 	ClusterID          string `json:"clusterId"`
+	CreatedBy          string `json:"createdBy,omitempty"`
+	CreatedAt          int64  `json:"createdAt"`
+	// ExactSize skips rounding up the size of the image to MiB
+	ExactSize bool `json:"exactSize,omitempty"`
+	// RequestName is the name of the CreateVolume request, if VolName
+	// carries the PVC name too
+	RequestName string `json:"requestName,omitempty"`
+	// ClusterFSID is the FSID of the cluster the volume was created on, it
+	// is verified before the volume is deleted
+	ClusterFSID string `json:"clusterFSID,omitempty"`
+	// PoolID is the ID of Pool when the volume was created, the current
+	// name of the pool is resolved from it, pools are renamed keeping it
+	PoolID string `json:"poolID,omitempty"`
+}
+
+// requestName returns the name of the CreateVolume request of the volume
+func (rv *rbdVolume) requestName() string {
+	if rv.RequestName != "" {
+		return rv.RequestName
+	}
+	return rv.VolName
 }
 
 type rbdSnapshot struct {
@@ -68,21 +97,37 @@ type rbdSnapshot struct {
 	AdminID            string `json:"adminId"`
 	UserID             string `json:"userId"`
 	ClusterID          string `json:"clusterId"`
+	CreatedBy          string `json:"createdBy,omitempty"`
+	// OwnerNamespace is the namespace of the VolumeSnapshot, if known
+	OwnerNamespace string `json:"ownerNamespace,omitempty"`
+	// SparsifyOnLastSnapshotDelete schedules sparsifying the image once
+	// its last snapshot is deleted
+	SparsifyOnLastSnapshotDelete bool `json:"sparsifyOnLastSnapshotDelete,omitempty"`
+	// PoolID is the ID of Pool when the snapshot was created, the current
+	// name of the pool is resolved from it
+	PoolID string `json:"poolID,omitempty"`
 }
 
+// Controller operations lock the request name first, then the ID of the volume
+// they work on, then the ID of the snapshot they work on, never in another
+// order to avoid deadlocks:
+// - CreateVolume: volumeNameMutex, snapshotIDMutex when restoring a snapshot
+// - DeleteVolume: volumeIDMutex
+// - CreateSnapshot: snapshotNameMutex, volumeIDMutex of the source volume
+// - DeleteSnapshot: snapshotIDMutex
 var (
 	// serializes operations based on "<rbd pool>/<rbd image>" as key
-	attachdetachMutex = keymutex.NewHashed(0)
+	attachdetachMutex = csicommon.NewKeyMutex("attachdetach")
 	// serializes operations based on "volume name" as key
-	volumeNameMutex = keymutex.NewHashed(0)
+	volumeNameMutex = csicommon.NewKeyMutex("volumeName")
 	// serializes operations based on "volume id" as key
-	volumeIDMutex = keymutex.NewHashed(0)
+	volumeIDMutex = csicommon.NewKeyMutex("volumeID")
 	// serializes operations based on "snapshot name" as key
-	snapshotNameMutex = keymutex.NewHashed(0)
+	snapshotNameMutex = csicommon.NewKeyMutex("snapshotName")
 	// serializes operations based on "snapshot id" as key
-	snapshotIDMutex = keymutex.NewHashed(0)
+	snapshotIDMutex = csicommon.NewKeyMutex("snapshotID")
 	// serializes operations based on "mount target path" as key
-	targetPathMutex = keymutex.NewHashed(0)
+	targetPathMutex = csicommon.NewKeyMutex("targetPath")
 
 	supportedFeatures = sets.NewString("layering")
 )
@@ -123,11 +168,13 @@ func getMon(pOpts *rbdVolume, credentials map[string]string) (string, error) {
 		mon = val
 
 	}
-	return mon, nil
+	return util.NormalizeMonitors(mon)
 }
 
 // CreateImage creates a new ceph image with provision and volume options.
-func createRBDImage(pOpts *rbdVolume, volSz int, adminID string, credentials map[string]string) error {
+func createRBDImage(ctx context.Context, pOpts *rbdVolume, volSzBytes int64, adminID string, credentials map[string]string) error {
+	defer util.StartPhase(ctx, "rbdCreate")()
+
 	var output []byte
 
 	mon, err := getMon(pOpts, credentials)
@@ -136,22 +183,25 @@ func createRBDImage(pOpts *rbdVolume, volSz int, adminID string, credentials map
 	}
 
 	image := pOpts.VolName
-	volSzMiB := fmt.Sprintf("%dM", volSz)
+	volSzMiB := fmt.Sprintf("%dM", volSzBytes/util.MiB)
+	if volSzBytes%util.MiB != 0 {
+		volSzMiB = fmt.Sprintf("%dB", volSzBytes)
+	}
 
 	key, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
 	if err != nil {
 		return err
 	}
 	if pOpts.ImageFormat == rbdImageFormat2 {
-		klog.V(4).Infof("rbd: create %s size %s format %s (features: %s) using mon %s, pool %s ", image, volSzMiB, pOpts.ImageFormat, pOpts.ImageFeatures, mon, pOpts.Pool)
+		util.V(util.LogBackend, 4).Infof("rbd: create %s size %s format %s (features: %s) using mon %s, pool %s, id %s", image, volSzMiB, pOpts.ImageFormat, pOpts.ImageFeatures, mon, pOpts.Pool, adminID)
 	} else {
-		klog.V(4).Infof("rbd: create %s size %s format %s using mon %s, pool %s", image, volSzMiB, pOpts.ImageFormat, mon, pOpts.Pool)
+		util.V(util.LogBackend, 4).Infof("rbd: create %s size %s format %s using mon %s, pool %s, id %s", image, volSzMiB, pOpts.ImageFormat, mon, pOpts.Pool, adminID)
 	}
 	args := []string{"create", image, "--size", volSzMiB, "--pool", pOpts.Pool, "--id", adminID, "-m", mon, "--key=" + key, "--image-format", pOpts.ImageFormat}
 	if pOpts.ImageFormat == rbdImageFormat2 {
 		args = append(args, "--image-feature", pOpts.ImageFeatures)
 	}
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
 		return errors.Wrapf(err, "failed to create rbd image, command output: %s", string(output))
@@ -160,9 +210,60 @@ func createRBDImage(pOpts *rbdVolume, volSz int, adminID string, credentials map
 	return nil
 }
 
+type rbdImageInfo struct {
+	Size int64 `json:"size"`
+}
+
+// getImageSize returns the size of the image in the backend in bytes
+func getImageSize(ctx context.Context, pOpts *rbdVolume, adminID string, credentials map[string]string) (int64, error) {
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	util.V(util.LogBackend, 4).Infof("rbd: info %s using mon %s, pool %s", pOpts.VolName, mon, pOpts.Pool)
+	args := []string{"info", pOpts.VolName, "--format", "json", "--pool", pOpts.Pool, "--id", adminID, "-m", mon, "--key=" + key}
+
+	var info rbdImageInfo
+	output, err := execCommandJSON(ctx, &info, "rbd", args)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get info of image %s, command output: %s", pOpts.VolName, string(output))
+	}
+
+	return info.Size, nil
+}
+
+// setImageMetadata sets the image-meta key of the image to value
+func setImageMetadata(ctx context.Context, pOpts *rbdVolume, key, value, adminID string, credentials map[string]string) error {
+	mon, err := getMon(pOpts, credentials)
+	if err != nil {
+		return err
+	}
+
+	rbdKey, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
+	if err != nil {
+		return err
+	}
+
+	util.V(util.LogBackend, 4).Infof("rbd: image-meta set %s %s using mon %s, pool %s", pOpts.VolName, key, mon, pOpts.Pool)
+	args := []string{"image-meta", "set", pOpts.VolName, key, value, "--pool", pOpts.Pool, "--id", adminID, "-m", mon, "--key=" + rbdKey}
+
+	output, err := execCommand(ctx, "rbd", args)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set image metadata, command output: %s", string(output))
+	}
+
+	return nil
+}
+
 // rbdStatus checks if there is watcher on the image.
 // It returns true if there is a watcher on the image, otherwise returns false.
-func rbdStatus(pOpts *rbdVolume, userID string, credentials map[string]string) (bool, string, error) {
+func rbdStatus(ctx context.Context, pOpts *rbdVolume, userID string, credentials map[string]string) (bool, string, error) {
 	var output string
 	var cmd []byte
 
@@ -179,9 +280,9 @@ func rbdStatus(pOpts *rbdVolume, userID string, credentials map[string]string) (
 		return false, "", err
 	}
 
-	klog.V(4).Infof("rbd: status %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: status %s using mon %s, pool %s", image, mon, pOpts.Pool)
 	args := []string{"status", image, "--pool", pOpts.Pool, "-m", mon, "--id", userID, "--key=" + key}
-	cmd, err = execCommand("rbd", args)
+	cmd, err = execCommand(ctx, "rbd", args)
 	output = string(cmd)
 
 	if err, ok := err.(*exec.Error); ok {
@@ -198,18 +299,18 @@ func rbdStatus(pOpts *rbdVolume, userID string, credentials map[string]string) (
 	}
 
 	if strings.Contains(output, imageWatcherStr) {
-		klog.V(4).Infof("rbd: watchers on %s: %s", image, output)
+		util.V(util.LogBackend, 4).Infof("rbd: watchers on %s: %s", image, output)
 		return true, output, nil
 	}
-	klog.Warningf("rbd: no watchers on %s", image)
+	util.V(util.LogBackend, 4).Infof("rbd: no watchers on %s", image)
 	return false, output, nil
 }
 
 // DeleteImage deletes a ceph image with provision and volume options.
-func deleteRBDImage(pOpts *rbdVolume, adminID string, credentials map[string]string) error {
+func deleteRBDImage(ctx context.Context, pOpts *rbdVolume, adminID string, credentials map[string]string) error {
 	var output []byte
 	image := pOpts.VolName
-	found, _, err := rbdStatus(pOpts, adminID, credentials)
+	found, _, err := rbdStatus(ctx, pOpts, adminID, credentials)
 	if err != nil {
 		return err
 	}
@@ -226,9 +327,9 @@ func deleteRBDImage(pOpts *rbdVolume, adminID string, credentials map[string]str
 		return err
 	}
 
-	klog.V(4).Infof("rbd: rm %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: rm %s using mon %s, pool %s", image, mon, pOpts.Pool)
 	args := []string{"rm", image, "--pool", pOpts.Pool, "--id", adminID, "-m", mon, "--key=" + key}
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 	if err == nil {
 		return nil
 	}
@@ -236,37 +337,95 @@ func deleteRBDImage(pOpts *rbdVolume, adminID string, credentials map[string]str
 	return err
 }
 
-func execCommand(command string, args []string) ([]byte, error) {
+func execCommand(ctx context.Context, command string, args []string) ([]byte, error) {
+	return execCommandWithStdin(ctx, nil, command, args)
+}
+
+// execCommandWithStdin runs the command like execCommand, with stdin streamed
+// to its standard input if it's not nil
+func execCommandWithStdin(ctx context.Context, stdin io.Reader, command string, args []string) ([]byte, error) {
+	release, err := util.StartExec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var out bytes.Buffer
 	// #nosec
 	cmd := exec.Command(command, args...)
-	return cmd.CombinedOutput()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = util.RunCommandWithStdin(ctx, cmd, stdin)
+	return out.Bytes(), util.PIDLimitError(err)
+}
+
+// execCommandStdout runs the command like execCommand, but returns its
+// standard output apart from its standard error, on which rbd and ceph print
+// warnings
+func execCommandStdout(ctx context.Context, command string, args []string) (stdout, stderr []byte, err error) {
+	release, err := util.StartExec(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	// #nosec
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	err = util.RunCommand(ctx, cmd)
+	return stdoutBuf.Bytes(), stderrBuf.Bytes(), util.PIDLimitError(err)
+}
+
+// execCommandJSON runs the command like execCommand and decodes its standard
+// output into v. Warnings on standard error would break the decoding, it's
+// only returned, for the errors of the command.
+func execCommandJSON(ctx context.Context, v interface{}, command string, args []string) ([]byte, error) {
+	stdout, stderr, err := execCommandStdout(ctx, command, args)
+	if err != nil {
+		return stderr, err
+	}
+
+	if err = json.Unmarshal(stdout, v); err != nil {
+		return stderr, fmt.Errorf("failed to unmarshal JSON for %s %v: %s: %v", command, util.StripSecretInArgs(args), stdout, err)
+	}
+
+	return stderr, nil
 }
 
 func getMonsAndClusterID(options map[string]string) (monitors, clusterID, monInSecret string, err error) {
 	var ok bool
 
 	monitors, ok = options["monitors"]
-	if !ok {
-		// if mons are not set in options, check if they are set in secret
-		if monInSecret, ok = options["monValueFromSecret"]; !ok {
-			// if mons are not in secret, check if we have a cluster-id
-			if clusterID, ok = options["clusterID"]; !ok {
-				err = errors.New("either monitors or monValueFromSecret or clusterID must be set")
-				return
-			}
+	if ok {
+		if monitors, err = util.NormalizeMonitors(monitors); err != nil {
+			err = fmt.Errorf("invalid monitors: %v", err)
+		}
+		return
+	}
 
-			if monitors, err = confStore.Mons(clusterID); err != nil {
-				klog.Errorf("failed getting mons (%s)", err)
-				err = fmt.Errorf("failed to fetch monitor list using clusterID (%s)", clusterID)
-				return
-			}
+	// if mons are not set in options, check if they are set in secret
+	if monInSecret, ok = options["monValueFromSecret"]; !ok {
+		// if mons are not in secret, check if we have a cluster-id
+		if clusterID, ok = options["clusterID"]; !ok {
+			err = errors.New("either monitors or monValueFromSecret or clusterID must be set")
+			return
+		}
+
+		if monitors, err = confStore.Mons(clusterID); err != nil {
+			klog.Errorf("failed getting mons (%s)", err)
+			err = fmt.Errorf("failed to fetch monitor list using clusterID (%s)", clusterID)
+			return
 		}
 	}
 
 	return
 }
 
-func getIDs(options map[string]string, clusterID string) (adminID, userID string, err error) {
+// getIDs returns the admin and user IDs, the admin ID is the one mapped to the
+// operation class opClass in the cluster config if there is any
+func getIDs(options map[string]string, clusterID, opClass string) (adminID, userID string, err error) {
 	var ok bool
 
 	adminID, ok = options["adminid"]
@@ -277,6 +436,7 @@ func getIDs(options map[string]string, clusterID string) (adminID, userID string
 			klog.Errorf("failed getting adminID (%s)", err)
 			return "", "", fmt.Errorf("failed to fetch adminID for clusterID (%s)", clusterID)
 		}
+		adminID = confStore.IDForOperation(clusterID, opClass, adminID)
 	default:
 		adminID = rbdDefaultAdminID
 	}
@@ -289,6 +449,7 @@ func getIDs(options map[string]string, clusterID string) (adminID, userID string
 			klog.Errorf("failed getting userID (%s)", err)
 			return "", "", fmt.Errorf("failed to fetch userID using clusterID (%s)", clusterID)
 		}
+		userID = confStore.IDForOperation(clusterID, util.OpClassNode, userID)
 	default:
 		userID = rbdDefaultUserID
 	}
@@ -334,7 +495,7 @@ func getRBDVolumeOptions(volOptions map[string]string, disableInUseChecks bool)
 
 	}
 
-	klog.V(3).Infof("setting disableInUseChecks on rbd volume to: %v", disableInUseChecks)
+	util.V(util.LogBackend, 3).Infof("setting disableInUseChecks on rbd volume to: %v", disableInUseChecks)
 	rbdVol.DisableInUseChecks = disableInUseChecks
 
 	err = getCredsFromVol(rbdVol, volOptions)
@@ -351,7 +512,7 @@ func getCredsFromVol(rbdVol *rbdVolume, volOptions map[string]string) error {
 		err error
 	)
 
-	rbdVol.AdminID, rbdVol.UserID, err = getIDs(volOptions, rbdVol.ClusterID)
+	rbdVol.AdminID, rbdVol.UserID, err = getIDs(volOptions, rbdVol.ClusterID, util.OpClassProvision)
 	if err != nil {
 		return err
 	}
@@ -381,10 +542,16 @@ func getRBDSnapshotOptions(snapOptions map[string]string) (*rbdSnapshot, error)
 		return nil, err
 	}
 
-	rbdSnap.AdminID, rbdSnap.UserID, err = getIDs(snapOptions, rbdSnap.ClusterID)
+	rbdSnap.AdminID, rbdSnap.UserID, err = getIDs(snapOptions, rbdSnap.ClusterID, util.OpClassSnapshot)
 	if err != nil {
 		return nil, err
 	}
+
+	if sparsify, ok := snapOptions["sparsifyOnLastSnapshotDelete"]; ok {
+		if rbdSnap.SparsifyOnLastSnapshotDelete, err = strconv.ParseBool(sparsify); err != nil {
+			return nil, fmt.Errorf("invalid value %q for sparsifyOnLastSnapshotDelete: %v", sparsify, err)
+		}
+	}
 	return rbdSnap, nil
 }
 
@@ -407,7 +574,7 @@ func getRBDVolumeByID(volumeID string) (*rbdVolume, error) {
 
 func getRBDVolumeByName(volName string) (*rbdVolume, error) {
 	for _, rbdVol := range rbdVolumes {
-		if rbdVol.VolName == volName {
+		if rbdVol.requestName() == volName {
 			return rbdVol, nil
 		}
 	}
@@ -437,10 +604,12 @@ func getSnapMon(pOpts *rbdSnapshot, credentials map[string]string) (string, erro
 		}
 		mon = val
 	}
-	return mon, nil
+	return util.NormalizeMonitors(mon)
 }
 
-func protectSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+func protectSnapshot(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+	defer util.StartPhase(ctx, "snapProtect")()
+
 	var output []byte
 
 	image := pOpts.VolName
@@ -455,10 +624,10 @@ func protectSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]
 		return err
 	}
 
-	klog.V(4).Infof("rbd: snap protect %s using mon %s, pool %s ", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: snap protect %s using mon %s, pool %s ", image, mon, pOpts.Pool)
 	args := []string{"snap", "protect", "--pool", pOpts.Pool, "--snap", snapID, image, "--id", adminID, "-m", mon, "--key=" + key}
 
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
 		return errors.Wrapf(err, "failed to protect snapshot, command output: %s", string(output))
@@ -498,7 +667,9 @@ func extractStoredVolOpt(r *rbdVolume) map[string]string {
 	return volOptions
 }
 
-func createSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+func createSnapshot(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+	defer util.StartPhase(ctx, "snapCreate")()
+
 	var output []byte
 
 	mon, err := getSnapMon(pOpts, credentials)
@@ -513,10 +684,10 @@ func createSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]s
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("rbd: snap create %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: snap create %s using mon %s, pool %s, id %s", image, mon, pOpts.Pool, adminID)
 	args := []string{"snap", "create", "--pool", pOpts.Pool, "--snap", snapID, image, "--id", adminID, "-m", mon, "--key=" + key}
 
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
 		return errors.Wrapf(err, "failed to create snapshot, command output: %s", string(output))
@@ -525,7 +696,34 @@ func createSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]s
 	return nil
 }
 
-func unprotectSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+// snapshotExists checks whether the snapshot exists in the backend, a missing
+// image is reported the same way as a missing snapshot
+func snapshotExists(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) (bool, error) {
+	mon, err := getSnapMon(pOpts, credentials)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
+	if err != nil {
+		return false, err
+	}
+
+	util.V(util.LogBackend, 4).Infof("rbd: info %s@%s using mon %s, pool %s", pOpts.VolName, pOpts.SnapID, mon, pOpts.Pool)
+	args := []string{"info", "--pool", pOpts.Pool, "--snap", pOpts.SnapID, pOpts.VolName, "--id", adminID, "-m", mon, "--key=" + key}
+
+	output, err := execCommand(ctx, "rbd", args)
+	if err != nil {
+		if rbdNotFound(output) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to get snapshot info, command output: %s", string(output))
+	}
+
+	return true, nil
+}
+
+func unprotectSnapshot(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
 	var output []byte
 
 	mon, err := getSnapMon(pOpts, credentials)
@@ -540,19 +738,106 @@ func unprotectSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[strin
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("rbd: snap unprotect %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: snap unprotect %s using mon %s, pool %s", image, mon, pOpts.Pool)
 	args := []string{"snap", "unprotect", "--pool", pOpts.Pool, "--snap", snapID, image, "--id", adminID, "-m", mon, "--key=" + key}
 
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
+		// a retry after the snapshot was unprotected but not removed
+		if snapshotNotProtected(output) {
+			util.LogBenign("snapshot %s@%s is already unprotected", image, snapID)
+			return nil
+		}
+		if snapshotInUse(output) {
+			return errors.Wrapf(errSnapshotInUse, "command output: %s", string(output))
+		}
+		// a retry after the snapshot was removed but not its metadata
+		if rbdNotFound(output) {
+			util.LogBenign("snapshot %s@%s is already deleted", image, snapID)
+			return nil
+		}
 		return errors.Wrapf(err, "failed to unprotect snapshot, command output: %s", string(output))
 	}
 
 	return nil
 }
 
-func deleteSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+// snapshotChildren returns the images cloned from the snapshot, which keep
+// it from being unprotected and removed
+func snapshotChildren(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) ([]string, error) {
+	mon, err := getSnapMon(pOpts, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
+	if err != nil {
+		return nil, err
+	}
+	util.V(util.LogBackend, 4).Infof("rbd: children %s@%s using mon %s, pool %s", pOpts.VolName, pOpts.SnapID, mon, pOpts.Pool)
+	args := []string{"children", "--pool", pOpts.Pool, "--snap", pOpts.SnapID, pOpts.VolName, "--id", adminID, "-m", mon, "--key=" + key, "--format", "json"}
+
+	// mimic lists the children as pool/image, nautilus as objects
+	var list []json.RawMessage
+	output, err := execCommandJSON(ctx, &list, "rbd", args)
+	if err != nil {
+		// a retry after the snapshot was removed but not its metadata
+		if rbdNotFound(output) {
+			util.LogBenign("snapshot %s@%s is already deleted", pOpts.VolName, pOpts.SnapID)
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to list snapshot children, command output: %s", string(output))
+	}
+
+	children := make([]string, 0, len(list))
+	for _, raw := range list {
+		var name string
+		if err = json.Unmarshal(raw, &name); err == nil {
+			children = append(children, name)
+			continue
+		}
+
+		child := struct {
+			Pool  string `json:"pool"`
+			Image string `json:"image"`
+		}{}
+		if err = json.Unmarshal(raw, &child); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse snapshot child %s", string(raw))
+		}
+		children = append(children, child.Pool+"/"+child.Image)
+	}
+
+	return children, nil
+}
+
+// rbdNotFound tells whether rbd failed because the image or snapshot doesn't
+// exist
+func rbdNotFound(output []byte) bool {
+	return strings.Contains(string(output), "No such file or directory")
+}
+
+// errSnapshotInUse is the cause of the errors of snapshots which can't be
+// unprotected or removed while images cloned from them exist
+var errSnapshotInUse = errors.New("snapshot has linked clones")
+
+// snapshotInUse tells whether rbd failed because of the clones of the
+// snapshot: EBUSY while they are linked, EAGAIN while they are pending
+func snapshotInUse(output []byte) bool {
+	out := string(output)
+	return strings.Contains(out, "child(ren)") ||
+		strings.Contains(out, "(16) Device or resource busy") ||
+		strings.Contains(out, "(11) Resource temporarily unavailable")
+}
+
+// snapshotNotProtected tells whether rbd failed to unprotect a snapshot
+// because it isn't protected
+func snapshotNotProtected(output []byte) bool {
+	out := string(output)
+	return strings.Contains(out, "already unprotected") || strings.Contains(out, "not protected")
+}
+
+func deleteSnapshot(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
 	var output []byte
 
 	mon, err := getSnapMon(pOpts, credentials)
@@ -567,19 +852,28 @@ func deleteSnapshot(pOpts *rbdSnapshot, adminID string, credentials map[string]s
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("rbd: snap rm %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: snap rm %s using mon %s, pool %s", image, mon, pOpts.Pool)
 	args := []string{"snap", "rm", "--pool", pOpts.Pool, "--snap", snapID, image, "--id", adminID, "-m", mon, "--key=" + key}
 
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
+		if snapshotInUse(output) {
+			return errors.Wrapf(errSnapshotInUse, "command output: %s", string(output))
+		}
+		if rbdNotFound(output) {
+			util.LogBenign("snapshot %s@%s is already deleted", image, snapID)
+			return nil
+		}
 		return errors.Wrapf(err, "failed to delete snapshot, command output: %s", string(output))
 	}
 
 	return nil
 }
 
-func restoreSnapshot(pVolOpts *rbdVolume, pSnapOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+func restoreSnapshot(ctx context.Context, pVolOpts *rbdVolume, pSnapOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+	defer util.StartPhase(ctx, "rbdClone")()
+
 	var output []byte
 
 	mon, err := getMon(pVolOpts, credentials)
@@ -594,10 +888,10 @@ func restoreSnapshot(pVolOpts *rbdVolume, pSnapOpts *rbdSnapshot, adminID string
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("rbd: clone %s using mon %s, pool %s", image, mon, pVolOpts.Pool)
+	util.V(util.LogBackend, 4).Infof("rbd: clone %s using mon %s, pool %s", image, mon, pVolOpts.Pool)
 	args := []string{"clone", pSnapOpts.Pool + "/" + pSnapOpts.VolName + "@" + snapID, pVolOpts.Pool + "/" + image, "--id", adminID, "-m", mon, "--key=" + key}
 
-	output, err = execCommand("rbd", args)
+	output, err = execCommand(ctx, "rbd", args)
 
 	if err != nil {
 		return errors.Wrapf(err, "failed to restore snapshot, command output: %s", string(output))
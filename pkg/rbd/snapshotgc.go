@@ -0,0 +1,193 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/ceph/ceph-csi/pkg/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	volumeSnapshotContentsPath = "/apis/snapshot.storage.k8s.io/v1alpha1/volumesnapshotcontents"
+
+	// external-snapshotter names snapshots "snapshot-<uid>" in
+	// CreateSnapshot requests, and their contents "snapcontent-<uid>"
+	snapshotRequestPrefix = "snapshot-"
+	snapshotContentPrefix = "snapcontent-"
+)
+
+type volumeSnapshotContentList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			CSIVolumeSnapshotSource struct {
+				SnapshotHandle string `json:"snapshotHandle"`
+			} `json:"csiVolumeSnapshotSource"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// snapshotContents holds the names and snapshot handles of the
+// VolumeSnapshotContents in the cluster
+type snapshotContents map[string]bool
+
+func listSnapshotContents(client *k8s.Clientset) (snapshotContents, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(volumeSnapshotContentsPath).DoRaw()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list VolumeSnapshotContents")
+	}
+
+	var list volumeSnapshotContentList
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, errors.Wrap(err, "failed to parse VolumeSnapshotContents")
+	}
+
+	contents := snapshotContents{}
+	for _, item := range list.Items {
+		contents[item.Metadata.Name] = true
+		if handle := item.Spec.CSIVolumeSnapshotSource.SnapshotHandle; handle != "" {
+			contents[handle] = true
+		}
+	}
+
+	return contents, nil
+}
+
+// hasContent returns true if a VolumeSnapshotContent refers to the snapshot,
+// by its ID or by the name of its CreateSnapshot request
+func (c snapshotContents) hasContent(rbdSnap *rbdSnapshot) bool {
+	if c[rbdSnap.SnapID] {
+		return true
+	}
+
+	return strings.HasPrefix(rbdSnap.SnapName, snapshotRequestPrefix) &&
+		c[snapshotContentPrefix+strings.TrimPrefix(rbdSnap.SnapName, snapshotRequestPrefix)]
+}
+
+// findOrphanedSnapshots returns the snapshots without VolumeSnapshotContent
+// created before the deadline. Snapshots without creation time are skipped.
+func findOrphanedSnapshots(snaps []*rbdSnapshot, contents snapshotContents, deadline time.Time) []*rbdSnapshot {
+	var orphans []*rbdSnapshot
+	for _, rbdSnap := range snaps {
+		if contents.hasContent(rbdSnap) {
+			continue
+		}
+
+		if rbdSnap.CreatedAt == 0 {
+			klog.Warningf("snapshot-gc: snapshot %s has no VolumeSnapshotContent, but its creation time is unknown, skipping", rbdSnap.SnapID)
+			continue
+		}
+
+		if time.Unix(rbdSnap.CreatedAt, 0).Before(deadline) {
+			orphans = append(orphans, rbdSnap)
+		}
+	}
+
+	return orphans
+}
+
+// RunSnapshotGC deletes the snapshots known to the metadata store which have
+// no VolumeSnapshotContent anymore, and are older than olderThan. Without
+// access to the Kubernetes API, or with dryRun, orphans are only reported.
+// Snapshots are deleted with the credentials of their cluster
+// configuration, the ones provisioned without clusterID are only reported,
+// their monitors and credentials are in secrets only the CO passes.
+func (r *Driver) RunSnapshotGC(driverName, configRoot string, olderThan time.Duration, dryRun bool, timeouts util.OperationTimeouts, cachePersister util.CachePersister) error {
+	var err error
+
+	confStore, err = util.NewConfigStore(configRoot)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize config store")
+	}
+
+	var contents snapshotContents
+	client, err := util.NewK8sClientIfConfigured()
+	if err != nil {
+		klog.Warningf("snapshot-gc: no access to the Kubernetes API, orphaned snapshots are only reported: %v", err)
+		dryRun = true
+		contents = snapshotContents{}
+	} else if contents, err = listSnapshotContents(client); err != nil {
+		return err
+	}
+
+	r.cd = csicommon.NewCSIDriver(driverName, version, "snapshot-gc")
+	if r.cd == nil {
+		return errors.New("failed to initialize CSI driver")
+	}
+	r.cd.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	})
+	r.cs = NewControllerServer(r.cd, cachePersister, timeouts, false, false)
+
+	var snaps []*rbdSnapshot
+	snap := &rbdSnapshot{}
+	err = cachePersister.ForAll("^"+util.RBDSnapshotPrefix+"(.*)"+util.RBDSnapshotInfix, snap, func(identifier string) error {
+		s := *snap
+		snaps = append(snaps, &s)
+		*snap = rbdSnapshot{}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list snapshots in the metadata store")
+	}
+
+	orphans := findOrphanedSnapshots(snaps, contents, time.Now().Add(-olderThan))
+	klog.Infof("snapshot-gc: %d of %d snapshots have no VolumeSnapshotContent and are older than %v", len(orphans), len(snaps), olderThan)
+
+	var failed int
+	for _, rbdSnap := range orphans {
+		if dryRun {
+			klog.Infof("snapshot-gc: would delete snapshot %s (name %s, source volume %s)", rbdSnap.SnapID, rbdSnap.SnapName, rbdSnap.SourceVolumeID)
+			continue
+		}
+
+		if rbdSnap.ClusterID == "" {
+			klog.Warningf("snapshot-gc: not deleting snapshot %s (name %s, source volume %s), it was provisioned without clusterID "+
+				"and its credentials are in the secrets of its StorageClass, delete it manually", rbdSnap.SnapID, rbdSnap.SnapName, rbdSnap.SourceVolumeID)
+			continue
+		}
+
+		ctx, cancel := timeouts.WithTimeout(context.Background(), util.OpSnapshotDelete)
+		_, err = r.cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: rbdSnap.SnapID})
+		cancel()
+		if err != nil {
+			klog.Errorf("snapshot-gc: failed to delete snapshot %s: %v", rbdSnap.SnapID, err)
+			failed++
+			continue
+		}
+
+		klog.Infof("snapshot-gc: deleted snapshot %s (name %s, source volume %s)", rbdSnap.SnapID, rbdSnap.SnapName, rbdSnap.SourceVolumeID)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("failed to delete %d snapshots", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindOrphanedSnapshots(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour).Unix()
+	recent := now.Unix()
+
+	snaps := []*rbdSnapshot{
+		{SnapID: "csi-rbd-vol-snap-1", SnapName: "snapshot-1", CreatedAt: old},
+		{SnapID: "csi-rbd-vol-snap-2", SnapName: "snapshot-2", CreatedAt: old},
+		{SnapID: "csi-rbd-vol-snap-3", SnapName: "snapshot-3", CreatedAt: old},
+		{SnapID: "csi-rbd-vol-snap-4", SnapName: "snapshot-4", CreatedAt: recent},
+		{SnapID: "csi-rbd-vol-snap-5", SnapName: "snapshot-5"},
+		{SnapID: "csi-rbd-vol-snap-6", SnapName: "manual", CreatedAt: old},
+	}
+	contents := snapshotContents{
+		// by snapshot handle
+		"csi-rbd-vol-snap-1": true,
+		// by the name of the request
+		"snapcontent-2": true,
+	}
+
+	var got []string
+	for _, rbdSnap := range findOrphanedSnapshots(snaps, contents, now.Add(-time.Minute)) {
+		got = append(got, rbdSnap.SnapID)
+	}
+
+	if want := "csi-rbd-vol-snap-3,csi-rbd-vol-snap-6"; strings.Join(got, ",") != want {
+		t.Errorf("Failed: want (%s), got (%s)", want, strings.Join(got, ","))
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// maximum number of images sparsified at the same time
+	maxConcurrentSparsify = 2
+	sparsifyTimeout       = time.Hour
+
+	// image metadata key recording when the image was last sparsified
+	imageMetaSparsifiedAt = "csi.sparsified-at"
+	// images sparsified within sparsifyInterval aren't sparsified again
+	sparsifyInterval = 24 * time.Hour
+)
+
+var (
+	sparsifySlots = make(chan struct{}, maxConcurrentSparsify)
+
+	// images being sparsified, sparsify is not issued again for them
+	sparsifyInFlight    = map[string]bool{}
+	sparsifyInFlightMtx sync.Mutex
+)
+
+// scheduleSparsify sparsifies the image of the snapshot in the background,
+// if the image has no snapshots left. Failures are only logged.
+func scheduleSparsify(rbdSnap *rbdSnapshot, credentials map[string]string) {
+	imagePath := rbdSnap.Pool + "/" + rbdSnap.VolName
+
+	sparsifyInFlightMtx.Lock()
+	defer sparsifyInFlightMtx.Unlock()
+	if sparsifyInFlight[imagePath] {
+		klog.V(4).Infof("rbd: sparsify of %s already scheduled", imagePath)
+		return
+	}
+	sparsifyInFlight[imagePath] = true
+
+	go func() {
+		defer func() {
+			sparsifyInFlightMtx.Lock()
+			delete(sparsifyInFlight, imagePath)
+			sparsifyInFlightMtx.Unlock()
+		}()
+
+		sparsifySlots <- struct{}{}
+		defer func() { <-sparsifySlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), sparsifyTimeout)
+		defer cancel()
+
+		if err := sparsifyImage(ctx, rbdSnap, rbdSnap.AdminID, credentials); err != nil {
+			klog.Warningf("rbd: failed to sparsify %s: %v", imagePath, err)
+		}
+	}()
+}
+
+// sparsifyImage sparsifies the image of the snapshot if it has no snapshots
+// left, and records the time it was sparsified at in the image metadata
+func sparsifyImage(ctx context.Context, pOpts *rbdSnapshot, adminID string, credentials map[string]string) error {
+	mon, err := getSnapMon(pOpts, credentials)
+	if err != nil {
+		return err
+	}
+
+	key, err := getRBDKey(pOpts.ClusterID, adminID, credentials)
+	if err != nil {
+		return err
+	}
+
+	image := pOpts.VolName
+	connArgs := []string{"--pool", pOpts.Pool, "--id", adminID, "-m", mon, "--key=" + key}
+
+	sparsifiedAt, err := imageSparsifiedAt(ctx, image, connArgs)
+	if err != nil {
+		return err
+	}
+	if since := time.Since(sparsifiedAt); since < sparsifyInterval {
+		klog.V(4).Infof("rbd: %s was sparsified %v ago, not sparsifying", image, since.Round(time.Second))
+		return nil
+	}
+
+	var snaps []interface{}
+	output, err := execCommandJSON(ctx, &snaps, "rbd", append([]string{"snap", "ls", image, "--format", "json"}, connArgs...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list snapshots, command output: %s", string(output))
+	}
+	if len(snaps) > 0 {
+		klog.V(4).Infof("rbd: %s still has %d snapshots, not sparsifying", image, len(snaps))
+		return nil
+	}
+
+	klog.V(4).Infof("rbd: sparsify %s using mon %s, pool %s", image, mon, pOpts.Pool)
+	output, err = execCommand(ctx, "rbd", append([]string{"sparsify", image}, connArgs...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to sparsify, command output: %s", string(output))
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	output, err = execCommand(ctx, "rbd", append([]string{"image-meta", "set", image, imageMetaSparsifiedAt, now}, connArgs...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to record sparsify in image metadata, command output: %s", string(output))
+	}
+
+	klog.Infof("rbd: sparsified %s/%s", pOpts.Pool, image)
+	return nil
+}
+
+// imageSparsifiedAt returns the time the image was last sparsified at, the
+// zero time if it never was
+func imageSparsifiedAt(ctx context.Context, image string, connArgs []string) (time.Time, error) {
+	stdout, stderr, err := execCommandStdout(ctx, "rbd", append([]string{"image-meta", "get", image, imageMetaSparsifiedAt}, connArgs...))
+	if err != nil {
+		// rbd fails with ENOENT for keys which aren't set
+		if rbdNotFound(stderr) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errors.Wrapf(err, "failed to get %s of %s, command output: %s", imageMetaSparsifiedAt, image, string(stderr))
+	}
+
+	value := strings.TrimSpace(string(stdout))
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		klog.Warningf("rbd: invalid %s %q of %s, sparsifying it: %v", imageMetaSparsifiedAt, value, image, err)
+		return time.Time{}, nil
+	}
+
+	return time.Unix(seconds, 0), nil
+}
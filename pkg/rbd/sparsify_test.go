@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSparsifyImage(t *testing.T) {
+	fake := newFakeRBD(t, false)
+	defer fake.cleanup()
+
+	// the image has no snapshots, it was sparsified at the time in the file
+	// sparsified-at, if any. rbd warns on stderr.
+	state := func(name string) string { return filepath.Join(fake.tmpDir, name) }
+	script := `#!/bin/sh
+echo "$1" >> ` + state("calls") + `
+echo "did not load config file, using default settings." >&2
+case "$1 $2" in
+"image-meta get")
+	if [ ! -e ` + state("sparsified-at") + ` ]; then echo "failed to get metadata: (2) No such file or directory" >&2; exit 2; fi
+	cat ` + state("sparsified-at") + ` ;;
+"snap ls") echo "[]" ;;
+esac
+`
+	if err := ioutil.WriteFile(state("rbd"), []byte(script), 0755); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		sparsifiedAt time.Time
+		wantSparsify bool
+	}{
+		{"never sparsified", time.Time{}, true},
+		{"sparsified long ago", time.Now().Add(-2 * sparsifyInterval), true},
+		// TEST: images sparsified recently aren't sparsified again
+		{"sparsified recently", time.Now().Add(-time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		if !tt.sparsifiedAt.IsZero() {
+			at := strconv.FormatInt(tt.sparsifiedAt.Unix(), 10) + "\n"
+			if err := ioutil.WriteFile(state("sparsified-at"), []byte(at), 0644); err != nil {
+				t.Fatalf("Test setup error %s", err)
+			}
+		}
+		if err := ioutil.WriteFile(state("calls"), nil, 0644); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		if err := sparsifyImage(context.Background(), fake.snapshot(), "admin", map[string]string{"admin": "key"}); err != nil {
+			t.Errorf("%s: Failed: want (nil), got (%v)", tt.name, err)
+		}
+
+		calls, err := ioutil.ReadFile(state("calls"))
+		if err != nil {
+			t.Fatalf("Test error %s", err)
+		}
+		if sparsified := strings.Contains(string(calls), "sparsify"); sparsified != tt.wantSparsify {
+			t.Errorf("%s: Failed: want sparsify (%t), got calls (%q)", tt.name, tt.wantSparsify, calls)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// limits of the metadata set on backend objects, which is stored along with
+// them by the cluster
+const (
+	maxBackendMetadataKeys     = 16
+	maxBackendMetadataKeyLen   = 64
+	maxBackendMetadataValueLen = 256
+)
+
+var backendMetadataKeyRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// BackendMetadataMapping maps volume parameters, including the ones passed
+// by the CO like csi.storage.k8s.io/pvc/namespace, to the keys of the
+// metadata set on the backend objects of new volumes
+type BackendMetadataMapping map[string]string
+
+// ParseBackendMetadataMapping parses a comma separated list of
+// <parameter>=<backend key> pairs, e.g.
+// "csi.storage.k8s.io/pvc/namespace=k8s.namespace,costCenter=cost-center"
+func ParseBackendMetadataMapping(s string) (BackendMetadataMapping, error) {
+	m := BackendMetadataMapping{}
+	if s == "" {
+		return m, nil
+	}
+
+	backendKeys := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid backend metadata mapping %q, expected <parameter>=<backend key>", pair)
+		}
+
+		if _, ok := m[kv[0]]; ok {
+			return nil, fmt.Errorf("parameter %q is mapped twice", kv[0])
+		}
+
+		if len(kv[1]) > maxBackendMetadataKeyLen || !backendMetadataKeyRx.MatchString(kv[1]) {
+			return nil, fmt.Errorf("invalid backend metadata key %q, expected at most %d alphanumerics, dots, dashes and underscores", kv[1], maxBackendMetadataKeyLen)
+		}
+
+		if backendKeys[kv[1]] {
+			return nil, fmt.Errorf("backend metadata key %q is mapped twice", kv[1])
+		}
+
+		m[kv[0]] = kv[1]
+		backendKeys[kv[1]] = true
+	}
+
+	if len(m) > maxBackendMetadataKeys {
+		return nil, fmt.Errorf("%d parameters are mapped to backend metadata, at most %d are allowed", len(m), maxBackendMetadataKeys)
+	}
+
+	return m, nil
+}
+
+// Parameters returns the mapped parameters which aren't set by the CO, these
+// have to be recognized by the parameter validators
+func (m BackendMetadataMapping) Parameters() []string {
+	var parameters []string
+	for p := range m {
+		if !strings.HasPrefix(p, csiParameterPrefix) {
+			parameters = append(parameters, p)
+		}
+	}
+
+	sort.Strings(parameters)
+	return parameters
+}
+
+// Metadata returns the backend metadata of a volume with the parameters,
+// mapped parameters which aren't set are skipped
+func (m BackendMetadataMapping) Metadata(parameters map[string]string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for p, key := range m {
+		value, ok := parameters[p]
+		if !ok {
+			continue
+		}
+
+		if len(value) > maxBackendMetadataValueLen {
+			return nil, fmt.Errorf("value of parameter %s exceeds the %d characters allowed in backend metadata", p, maxBackendMetadataValueLen)
+		}
+
+		metadata[key] = value
+	}
+
+	return metadata, nil
+}
+
+// SetBackendMetadata sets the metadata with the backend specific set, in the
+// order of the keys
+func SetBackendMetadata(metadata map[string]string, set func(key, value string) error) error {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := set(k, metadata[k]); err != nil {
+			return fmt.Errorf("failed to set backend metadata %s: %v", k, err)
+		}
+	}
+
+	return nil
+}
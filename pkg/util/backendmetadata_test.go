@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBackendMetadataMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		wantErr bool
+	}{
+		{"", false},
+		{"csi.storage.k8s.io/pvc/namespace=k8s.namespace, costCenter=cost-center", false},
+		{"costCenter", true},
+		{"=cost-center", true},
+		// TEST: backend keys are restricted to safe characters
+		{"costCenter=cost center", true},
+		{"costCenter=" + strings.Repeat("k", maxBackendMetadataKeyLen+1), true},
+		// TEST: neither parameters nor backend keys may be mapped twice
+		{"costCenter=a,costCenter=b", true},
+		{"costCenter=a,team=a", true},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseBackendMetadataMapping(tt.mapping); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Failed: want error (%v), got (%v)", tt.mapping, tt.wantErr, err)
+		}
+	}
+
+	// TEST: the number of backend keys is capped
+	pairs := make([]string, maxBackendMetadataKeys+1)
+	for i := range pairs {
+		pairs[i] = strings.Repeat("p", i+1) + "=" + strings.Repeat("k", i+1)
+	}
+	if _, err := ParseBackendMetadataMapping(strings.Join(pairs, ",")); err == nil {
+		t.Errorf("Failed: want an error for %d mapped parameters", len(pairs))
+	}
+}
+
+func TestBackendMetadata(t *testing.T) {
+	m, err := ParseBackendMetadataMapping("csi.storage.k8s.io/pvc/namespace=k8s.namespace,costCenter=cost-center,team=team")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// TEST: parameters set by the CO don't need to be recognized
+	if got, want := m.Parameters(), []string{"costCenter", "team"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Failed: want (%v), got (%v)", want, got)
+	}
+
+	// TEST: parameters which aren't set are skipped
+	metadata, err := m.Metadata(map[string]string{"csi.storage.k8s.io/pvc/namespace": "default", "costCenter": "0x42", "pool": "rbd"})
+	want := map[string]string{"k8s.namespace": "default", "cost-center": "0x42"}
+	if err != nil || !reflect.DeepEqual(metadata, want) {
+		t.Errorf("Failed: want (%v), got (%v) error (%v)", want, metadata, err)
+	}
+
+	// TEST: oversized values are rejected
+	if _, err = m.Metadata(map[string]string{"team": strings.Repeat("v", maxBackendMetadataValueLen+1)}); err == nil {
+		t.Errorf("Failed: want an error for an oversized value")
+	}
+
+	// TEST: the metadata is set in the order of the keys
+	var keys []string
+	err = SetBackendMetadata(metadata, func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if want := []string{"cost-center", "k8s.namespace"}; err != nil || !reflect.DeepEqual(keys, want) {
+		t.Errorf("Failed: want (%v), got (%v) error (%v)", want, keys, err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 
 	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/keymutex"
 )
 
 const (
@@ -27,6 +28,20 @@ const (
 	PluginFolder = "/var/lib/kubelet/plugins"
 )
 
+// cacheEntryMutex serializes the operations on an entry of the metadata
+// store. Entries are visited by ForAll without taking it, the store
+// implementations have to make sure that entries are replaced atomically.
+var cacheEntryMutex = keymutex.NewHashed(0)
+
+func lockCacheEntry(identifier string) func() {
+	cacheEntryMutex.LockKey(identifier)
+	return func() {
+		if err := cacheEntryMutex.UnlockKey(identifier); err != nil {
+			klog.Warningf("failed to unlock mutex cache entry:%s %v", identifier, err)
+		}
+	}
+}
+
 // ForAllFunc is a unary predicate for visiting all cache entries
 // matching the `pattern' in CachePersister's ForAll function.
 type ForAllFunc func(identifier string) error
@@ -36,27 +51,32 @@ type CacheEntryNotFound struct {
 	error
 }
 
-// CachePersister interface implemented for store
+// CachePersister interface implemented for store, it's safe for concurrent
+// use
 type CachePersister interface {
 	Create(identifier string, data interface{}) error
+	Update(identifier string, data interface{}) error
 	Get(identifier string, data interface{}) error
 	ForAll(pattern string, destObj interface{}, f ForAllFunc) error
 	Delete(identifier string) error
 }
 
-// NewCachePersister returns CachePersister based on store
-func NewCachePersister(metadataStore, driverName string) (CachePersister, error) {
+// NewCachePersister returns CachePersister based on store, checksums enables
+// writing entries with a checksum
+func NewCachePersister(metadataStore, driverName string, checksums bool) (CachePersister, error) {
 	if metadataStore == "k8s_configmap" {
 		klog.Infof("cache-perister: using kubernetes configmap as metadata cache persister")
 		k8scm := &K8sCMCache{}
 		k8scm.Client = NewK8sClient()
 		k8scm.Namespace = GetK8sNamespace()
+		k8scm.Checksums = checksums
 		return k8scm, nil
 	} else if metadataStore == "node" {
 		klog.Infof("cache-persister: using node as metadata cache persister")
 		nc := &NodeCache{}
 		nc.BasePath = PluginFolder + "/" + driverName
 		nc.CacheDir = "controller"
+		nc.Checksums = checksums
 		return nc, nil
 	}
 	return nil, errors.New("cache-persister: couldn't parse metadatastorage flag")
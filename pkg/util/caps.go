@@ -0,0 +1,249 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// insufficient caps are checked again after capsDeniedValidity, in case
+// the admin fixed them in the meantime. Sufficient caps are checked once.
+const capsDeniedValidity = time.Minute
+
+// CapRequirement is a capability the credentials of an operation class need
+type CapRequirement struct {
+	// Daemon is the daemon type the capability is granted for, e.g. mon
+	Daemon string
+	// Perms are the permissions required, e.g. rwx
+	Perms string
+	// Pool the osd permissions have to cover, if any
+	Pool string
+	// Purpose tells what the capability is required for
+	Purpose string
+}
+
+func (r CapRequirement) String() string {
+	grant := "allow " + r.Perms
+	if r.Pool != "" {
+		grant += " pool=" + r.Pool
+	}
+	return fmt.Sprintf("%s '%s' required for %s", r.Daemon, grant, r.Purpose)
+}
+
+type capsCheckResult struct {
+	err     error
+	checked time.Time
+}
+
+// CapsChecker verifies that credentials have the capabilities their
+// operations require before running them, so that insufficient caps fail
+// with PermissionDenied instead of the error of the first backend call
+// hitting them. A nil checker lets all credentials through.
+type CapsChecker struct {
+	mtx     sync.Mutex
+	results map[string]capsCheckResult
+}
+
+// NewCapsChecker returns a checker without cached results
+func NewCapsChecker() *CapsChecker {
+	return &CapsChecker{results: make(map[string]capsCheckResult)}
+}
+
+// CapsCheckKey returns the key the result of the check of the credentials
+// of the operation class on the cluster is cached with
+func CapsCheckKey(monitors, id, key, opClass string) string {
+	return fmt.Sprintf("%s/%s/%x/%s", monitors, id, sha256.Sum256([]byte(key)), opClass)
+}
+
+// Check returns PermissionDenied, with the missing capabilities spelled out,
+// if the capabilities returned by authGet, keyed by daemon type, don't
+// satisfy reqs. If the credentials may not read their own capabilities,
+// canary is run instead, an operation of the class which fails with
+// permission denied unless the capabilities are there. Checks which can't be
+// concluded let the operation through.
+func (c *CapsChecker) Check(cacheKey string, reqs []CapRequirement, authGet func() (map[string]string, error), canary func() error) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	res, ok := c.results[cacheKey]
+	c.mtx.Unlock()
+	if ok && (res.err == nil || time.Since(res.checked) < capsDeniedValidity) {
+		return res.err
+	}
+
+	concluded, err := checkCaps(reqs, authGet, canary)
+	if !concluded {
+		return nil
+	}
+
+	c.mtx.Lock()
+	c.results[cacheKey] = capsCheckResult{err: err, checked: time.Now()}
+	c.mtx.Unlock()
+
+	return err
+}
+
+// checkCaps returns whether the check was concluded, and its result
+func checkCaps(reqs []CapRequirement, authGet func() (map[string]string, error), canary func() error) (bool, error) {
+	caps, err := authGet()
+	if err != nil {
+		if !IsPermissionDenied(err) {
+			klog.Warningf("failed to get the caps of the credentials, not checking them: %v", err)
+			return false, nil
+		}
+
+		klog.V(4).Infof("credentials may not read their caps, running a canary operation: %v", err)
+		if err = canary(); err != nil {
+			if IsPermissionDenied(err) {
+				return true, capsDenied(reqs)
+			}
+			klog.Warningf("canary operation failed, not checking the caps of the credentials: %v", err)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	var missing []CapRequirement
+	for _, r := range reqs {
+		satisfied, concluded := capsSatisfy(caps[r.Daemon], r)
+		if !concluded {
+			klog.V(4).Infof("can't tell whether %s caps %q satisfy %s, not checking them", r.Daemon, caps[r.Daemon], r)
+			continue
+		}
+		if !satisfied {
+			missing = append(missing, r)
+		}
+	}
+
+	if len(missing) > 0 {
+		return true, capsDenied(missing)
+	}
+	return true, nil
+}
+
+func capsDenied(reqs []CapRequirement) error {
+	descs := make([]string, 0, len(reqs))
+	for _, r := range reqs {
+		descs = append(descs, r.String())
+	}
+	return status.Errorf(codes.PermissionDenied, "insufficient caps: %s", strings.Join(descs, ", "))
+}
+
+// IsPermissionDenied tells whether the error of a ceph command is due to
+// missing capabilities, or a mount or map failed as the credentials were
+// refused
+func IsPermissionDenied(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"EACCES", "Permission denied", "access denied", "Operation not permitted"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionDeniedReason words a permission denied error of the user by its
+// cause, EPERM is returned for missing capabilities, EACCES for refused
+// credentials
+func PermissionDeniedReason(err error, user string) string {
+	msg := err.Error()
+	if strings.Contains(msg, "EPERM") || strings.Contains(msg, "Operation not permitted") {
+		return fmt.Sprintf("the caps of user %s don't permit the operation", user)
+	}
+	return fmt.Sprintf("the credentials of user %s were refused", user)
+}
+
+// profiles grant fixed permissions per daemon type
+var capProfiles = map[string]map[string]string{
+	"rbd":           {"mon": "r", "osd": "rwx"},
+	"rbd-read-only": {"mon": "r", "osd": "r"},
+}
+
+// capsSatisfy tells whether the caps of a daemon type, e.g.
+// "allow rw pool=a, profile rbd pool=b", grant the required permissions.
+// The check isn't concluded if the required permissions aren't granted and
+// some grants aren't understood, like path or namespace restrictions.
+func capsSatisfy(caps string, r CapRequirement) (satisfied, concluded bool) {
+	var (
+		granted    string
+		unresolved bool
+	)
+
+	for _, grant := range strings.Split(caps, ",") {
+		tokens := strings.Fields(grant)
+		if len(tokens) < 2 {
+			unresolved = unresolved || len(tokens) == 1
+			continue
+		}
+
+		var perms string
+		switch {
+		case tokens[0] == "profile" || (tokens[0] == "allow" && tokens[1] == "profile" && len(tokens) > 2):
+			if tokens[0] == "allow" {
+				tokens = tokens[1:]
+			}
+			profile, ok := capProfiles[tokens[1]]
+			if !ok {
+				unresolved = true
+				continue
+			}
+			perms = profile[r.Daemon]
+		case tokens[0] == "allow" && strings.Trim(tokens[1], "rwxp*s") == "":
+			perms = tokens[1]
+		default:
+			unresolved = true
+			continue
+		}
+
+		applies := true
+		for _, restriction := range tokens[2:] {
+			kv := strings.SplitN(restriction, "=", 2)
+			switch {
+			case len(kv) == 2 && kv[0] == "pool":
+				applies = applies && (r.Pool == "" || kv[1] == r.Pool)
+			case len(kv) == 2 && kv[0] == "path" && kv[1] == "/":
+			default:
+				unresolved = true
+				applies = false
+			}
+		}
+
+		if applies {
+			granted += perms
+		}
+	}
+
+	if strings.Contains(granted, "*") {
+		return true, true
+	}
+	for _, p := range r.Perms {
+		if !strings.ContainsRune(granted, p) {
+			return false, !unresolved
+		}
+	}
+	return true, true
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCapsSatisfy(t *testing.T) {
+	osd := CapRequirement{Daemon: "osd", Perms: "rwx", Pool: "rbd"}
+	tests := []struct {
+		caps          string
+		req           CapRequirement
+		wantSatisfied bool
+		wantConcluded bool
+	}{
+		{"allow *", osd, true, true},
+		{"allow rwx", osd, true, true},
+		{"allow rwx pool=rbd", osd, true, true},
+		{"profile rbd pool=rbd", osd, true, true},
+		{"allow profile rbd", osd, true, true},
+		// TEST: permissions add up across the grants which apply
+		{"allow r, allow wx pool=rbd", osd, true, true},
+		{"allow rw", osd, false, true},
+		{"allow rwx pool=other", osd, false, true},
+		{"profile rbd-read-only pool=rbd", osd, false, true},
+		{"", osd, false, true},
+		// TEST: grants which aren't understood leave the check open, unless
+		// the permissions are granted anyway
+		{"allow rwx namespace=ns", osd, false, false},
+		{"allow rwx tag cephfs data=fs", osd, false, false},
+		{"allow rw, allow command \"auth get\"", CapRequirement{Daemon: "mon", Perms: "rwx"}, false, false},
+		{"allow rwx pool=rbd, profile unknown", osd, true, true},
+		{"allow rwp path=/", CapRequirement{Daemon: "mds", Perms: "rwp"}, true, true},
+	}
+
+	for _, tt := range tests {
+		satisfied, concluded := capsSatisfy(tt.caps, tt.req)
+		if satisfied != tt.wantSatisfied || concluded != tt.wantConcluded {
+			t.Errorf("%q: Failed: want (%v, %v), got (%v, %v)", tt.caps, tt.wantSatisfied, tt.wantConcluded, satisfied, concluded)
+		}
+	}
+}
+
+func TestCapsCheckerCheck(t *testing.T) {
+	reqs := []CapRequirement{
+		{Daemon: "mon", Perms: "r", Purpose: "image operations"},
+		{Daemon: "osd", Perms: "rwx", Pool: "rbd", Purpose: "image operations"},
+	}
+	denied := errors.New("Error EACCES: access denied")
+
+	var authGets, canaries int
+	authGet := func(caps map[string]string, err error) func() (map[string]string, error) {
+		return func() (map[string]string, error) {
+			authGets++
+			return caps, err
+		}
+	}
+	canary := func(err error) func() error {
+		return func() error {
+			canaries++
+			return err
+		}
+	}
+
+	// TEST: missing caps are spelled out
+	c := NewCapsChecker()
+	err := c.Check("a", reqs, authGet(map[string]string{"mon": "allow r", "osd": "allow r"}, nil), canary(nil))
+	if status.Code(err) != codes.PermissionDenied || !strings.Contains(err.Error(), "osd 'allow rwx pool=rbd' required for image operations") {
+		t.Errorf("Failed: want (%v) with the missing osd caps, got (%v)", codes.PermissionDenied, err)
+	}
+	if strings.Contains(err.Error(), "mon") {
+		t.Errorf("Failed: want only the missing caps, got (%v)", err)
+	}
+
+	// TEST: sufficient caps are checked once per key
+	for i := 0; i < 2; i++ {
+		if err = c.Check("b", reqs, authGet(map[string]string{"mon": "profile rbd", "osd": "profile rbd"}, nil), canary(nil)); err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	}
+	if authGets != 2 {
+		t.Errorf("Failed: want (2) caps lookups, got (%d)", authGets)
+	}
+
+	// TEST: the canary decides if the caps can't be read
+	if err = c.Check("c", reqs, authGet(nil, denied), canary(denied)); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Failed: want (%v), got (%v)", codes.PermissionDenied, err)
+	}
+	if err = c.Check("d", reqs, authGet(nil, denied), canary(nil)); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if canaries != 2 {
+		t.Errorf("Failed: want (2) canary runs, got (%d)", canaries)
+	}
+
+	// TEST: other failures let the operation through, and aren't cached
+	for i := 0; i < 2; i++ {
+		if err = c.Check("e", reqs, authGet(nil, errors.New("timed out")), canary(nil)); err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	}
+	if authGets != 6 {
+		t.Errorf("Failed: want (6) caps lookups, got (%d)", authGets)
+	}
+
+	// TEST: a nil checker doesn't check
+	c = nil
+	if err = c.Check("a", reqs, authGet(nil, denied), canary(denied)); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
+
+func TestPermissionDeniedReason(t *testing.T) {
+	tests := []struct {
+		err  string
+		want string
+	}{
+		{"rbd: map failed: (1) Operation not permitted", "the caps of user csi don't permit the operation"},
+		{"mount error 13 = Permission denied", "the credentials of user csi were refused"},
+		{"Error EACCES: access denied", "the credentials of user csi were refused"},
+	}
+
+	for _, tt := range tests {
+		if got := PermissionDeniedReason(errors.New(tt.err), "csi"); got != tt.want {
+			t.Errorf("Failed: want (%s), got (%s)", tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Entries of the metadata store written with checksums are followed by a
+// trailer line "crc32:<version>:<checksum>", version 1 being the CRC32 (IEEE)
+// of the JSON encoded entry. Entries without trailer are read as plain JSON.
+const (
+	checksumPrefix  = "crc32:"
+	checksumVersion = 1
+)
+
+// CacheEntryCorrupted is an error type for cache entries whose content
+// doesn't match their checksum
+type CacheEntryCorrupted struct {
+	error
+}
+
+// encodeCacheEntry encodes the entry as JSON, followed by its checksum if
+// checksums is set
+func encodeCacheEntry(data interface{}, checksums bool) ([]byte, error) {
+	entry, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !checksums {
+		return entry, nil
+	}
+
+	return append(entry, fmt.Sprintf("\n%s%d:%08x\n", checksumPrefix, checksumVersion, crc32.ChecksumIEEE(entry))...), nil
+}
+
+// decodeCacheEntry verifies the checksum of the entry, if it has one, and
+// decodes it. Checksums are verified even if the store doesn't write them, so
+// that they can be disabled again.
+func decodeCacheEntry(identifier string, raw []byte, data interface{}) error {
+	entry := bytes.TrimRight(raw, "\n")
+	if i := bytes.LastIndexByte(entry, '\n'); i >= 0 && bytes.HasPrefix(entry[i+1:], []byte(checksumPrefix)) {
+		if err := verifyChecksum(entry[:i], string(entry[i+1+len(checksumPrefix):])); err != nil {
+			return &CacheEntryCorrupted{errors.Wrapf(err, "metadata of %s is corrupted", identifier)}
+		}
+		entry = entry[:i]
+	}
+
+	return json.Unmarshal(entry, data)
+}
+
+func verifyChecksum(entry []byte, trailer string) error {
+	var (
+		version  int
+		checksum string
+	)
+	if n, err := fmt.Sscanf(trailer, "%d:%s", &version, &checksum); err != nil || n != 2 {
+		return fmt.Errorf("malformed checksum %q", trailer)
+	}
+
+	if version != checksumVersion {
+		return fmt.Errorf("unsupported checksum version %d", version)
+	}
+
+	expected, err := strconv.ParseUint(checksum, 16, 32)
+	if err != nil {
+		return fmt.Errorf("malformed checksum %q", trailer)
+	}
+
+	if actual := crc32.ChecksumIEEE(entry); uint32(expected) != actual {
+		return fmt.Errorf("checksum mismatch: expected %08x, got %08x", expected, actual)
+	}
+
+	return nil
+}
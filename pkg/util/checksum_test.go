@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDecodeCacheEntry(t *testing.T) {
+	checksummed, err := encodeCacheEntry(&testCacheEntry{Name: "csi-vol-1"}, true)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		raw       []byte
+		corrupted bool
+	}{
+		{"legacy", []byte(`{"name":"csi-vol-1"}`), false},
+		{"legacy with newline", []byte("{\"name\":\"csi-vol-1\"}\n"), false},
+		{"checksum", checksummed, false},
+		{"garbled", bytes.Replace(checksummed, []byte("vol"), []byte("vel"), 1), true},
+		{"unknown version", bytes.Replace(checksummed, []byte("crc32:1:"), []byte("crc32:2:"), 1), true},
+		{"malformed checksum", append(append([]byte{}, bytes.TrimRight(checksummed, "\n")...), 'x'), true},
+	}
+
+	for _, tt := range tests {
+		entry := &testCacheEntry{}
+		err := decodeCacheEntry("csi-vol-1", tt.raw, entry)
+		if _, ok := err.(*CacheEntryCorrupted); ok != tt.corrupted {
+			t.Errorf("%s: decodeCacheEntry() = %v, want corrupted (%t)", tt.name, err, tt.corrupted)
+			continue
+		}
+
+		if !tt.corrupted && (err != nil || entry.Name != "csi-vol-1") {
+			t.Errorf("%s: want (csi-vol-1), got (%s) err %v", tt.name, entry.Name, err)
+		}
+	}
+}
+
+func TestNodeCacheChecksums(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "nodecache")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	nc := &NodeCache{BasePath: basePath, CacheDir: "controller", Checksums: true}
+	if err = nc.EnsureCacheDirectory(nc.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	for _, id := range []string{"csi-vol-1", "csi-vol-2"} {
+		if err = nc.Create(id, &testCacheEntry{Name: id}); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+
+	// garble csi-vol-2, as after a disk incident
+	file := path.Join(basePath, nc.CacheDir, "csi-vol-2.json")
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = ioutil.WriteFile(file, bytes.Replace(raw, []byte("vol-2"), []byte("vol-X"), 1), 0644); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// TEST: the corrupted entry is reported as such
+	if err = nc.Get("csi-vol-2", &testCacheEntry{}); err == nil {
+		t.Errorf("Failed: corrupted entry was decoded")
+	} else if _, ok := err.(*CacheEntryCorrupted); !ok {
+		t.Errorf("Failed: want CacheEntryCorrupted, got (%v)", err)
+	}
+
+	// TEST: the corrupted entry is skipped by ForAll
+	var visited []string
+	entry := &testCacheEntry{}
+	err = nc.ForAll("^csi-vol-", entry, func(identifier string) error {
+		visited = append(visited, identifier)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Failed: unexpected error %s", err)
+	}
+	if len(visited) != 1 || visited[0] != "csi-vol-1" {
+		t.Errorf("Failed: want (csi-vol-1), got (%v)", visited)
+	}
+
+	// TEST: a store without checksums still verifies them
+	legacy := &NodeCache{BasePath: basePath, CacheDir: "controller"}
+	if err = legacy.Get("csi-vol-1", entry); err != nil || entry.Name != "csi-vol-1" {
+		t.Errorf("Failed: want (csi-vol-1), got (%s) err %v", entry.Name, err)
+	}
+	if err = legacy.Get("csi-vol-2", entry); err == nil {
+		t.Errorf("Failed: corrupted entry was decoded without checksums enabled")
+	}
+}
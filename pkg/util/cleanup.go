@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+
+	"k8s.io/klog"
+)
+
+// CleanupStack collects the steps undoing what a multi-step operation
+// created so far. Unless the operation is marked as done, the steps are run
+// in the reverse order they were pushed in. Whether they run doesn't depend
+// on the error returned by the operation, which may be wrapped or reassigned
+// by later steps.
+type CleanupStack struct {
+	op    string
+	steps []cleanupStep
+	done  bool
+}
+
+type cleanupStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// NewCleanupStack returns an empty cleanup stack for the operation op, e.g.
+// "CreateVolume pvc-1", which is used in the logs
+func NewCleanupStack(op string) *CleanupStack {
+	return &CleanupStack{op: op}
+}
+
+// Push adds the step undoing the artifact name, it's run before the steps
+// pushed earlier
+func (s *CleanupStack) Push(name string, undo func(ctx context.Context) error) {
+	s.steps = append(s.steps, cleanupStep{name: name, undo: undo})
+}
+
+// Done marks the operation as completed, Run skips all steps
+func (s *CleanupStack) Done() {
+	s.done = true
+}
+
+// Run runs the steps in reverse order unless the operation is done, a step
+// failing doesn't prevent the others from running. It returns the names of
+// the steps which failed, meant to be deferred right after the stack is
+// created. ctx must not be the one of the operation, which may be done
+// already.
+func (s *CleanupStack) Run(ctx context.Context) []string {
+	var failed []string
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		if s.done {
+			klog.V(4).Infof("%s: completed, skipping cleanup step %s", s.op, step.name)
+			continue
+		}
+
+		klog.Infof("%s: failed, running cleanup step %s", s.op, step.name)
+		if err := step.undo(ctx); err != nil {
+			klog.Errorf("%s: cleanup step %s failed: %v", s.op, step.name, err)
+			failed = append(failed, step.name)
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCleanupStack(t *testing.T) {
+	var undone []string
+	newStack := func() *CleanupStack {
+		undone = nil
+		s := NewCleanupStack("CreateVolume pvc-1")
+		for _, name := range []string{"volume", "user", "export"} {
+			name := name
+			s.Push(name, func(ctx context.Context) error {
+				undone = append(undone, name)
+				if name == "user" {
+					return errors.New("user is in use")
+				}
+				return nil
+			})
+		}
+		return s
+	}
+
+	// TEST: steps run in reverse order, a failing step doesn't stop the
+	// ones pushed before it
+	failed := newStack().Run(context.Background())
+	if want := []string{"export", "user", "volume"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("Failed: want (%v), got (%v)", want, undone)
+	}
+	if want := []string{"user"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("Failed: want failed steps (%v), got (%v)", want, failed)
+	}
+
+	// TEST: nothing is undone once the operation is done
+	s := newStack()
+	s.Done()
+	if failed = s.Run(context.Background()); len(undone) != 0 || len(failed) != 0 {
+		t.Errorf("Failed: want no steps run, got (%v)", undone)
+	}
+}
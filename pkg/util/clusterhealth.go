@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// the health of a cluster is shared by the operations within
+// clusterHealthValidity, so that the check doesn't cost a ceph health each
+const clusterHealthValidity = 30 * time.Second
+
+// fullHealthChecks are the health checks ceph reports once writes are
+// blocked: OSD_FULL once an OSD exceeded the full ratio, POOL_FULL once a
+// pool reached its quota
+var fullHealthChecks = []struct {
+	name        string
+	description string
+}{
+	{"OSD_FULL", "cluster full"},
+	{"POOL_FULL", "pool full"},
+}
+
+// cephHealth is the output of ceph health -f json
+type cephHealth struct {
+	Status string `json:"status"`
+	Checks map[string]struct {
+		Severity string `json:"severity"`
+		Summary  struct {
+			Message string `json:"message"`
+		} `json:"summary"`
+	} `json:"checks"`
+}
+
+type clusterHealthResult struct {
+	err     error
+	checked time.Time
+}
+
+// ClusterHealthChecker rejects operations writing to a cluster which
+// reached its full ratio, so that they fail right away instead of hanging
+// in the backend until they time out. A nil checker lets all operations
+// through.
+type ClusterHealthChecker struct {
+	mtx     sync.Mutex
+	results map[string]clusterHealthResult
+}
+
+// NewClusterHealthChecker returns a checker without cached results
+func NewClusterHealthChecker() *ClusterHealthChecker {
+	return &ClusterHealthChecker{results: make(map[string]clusterHealthResult)}
+}
+
+// CheckNotFull returns ResourceExhausted if the output of ceph health -f
+// json returned by health reports the cluster or a pool full. The result is cached
+// with the monitors of the cluster for clusterHealthValidity. A health which
+// can't be read lets the operation through.
+func (c *ClusterHealthChecker) CheckNotFull(monitors string, health func() ([]byte, error)) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	res, ok := c.results[monitors]
+	c.mtx.Unlock()
+	if ok && time.Since(res.checked) < clusterHealthValidity {
+		return res.err
+	}
+
+	err := checkNotFull(health)
+
+	c.mtx.Lock()
+	c.results[monitors] = clusterHealthResult{err: err, checked: time.Now()}
+	c.mtx.Unlock()
+
+	return err
+}
+
+func checkNotFull(health func() ([]byte, error)) error {
+	output, err := health()
+	if err != nil {
+		klog.Warningf("failed to get the health of the cluster, not checking whether it's full: %v", err)
+		return nil
+	}
+
+	var h cephHealth
+	if err = json.Unmarshal(output, &h); err != nil {
+		klog.Warningf("failed to parse the health of the cluster, not checking whether it's full: %v", err)
+		return nil
+	}
+
+	for _, full := range fullHealthChecks {
+		check, ok := h.Checks[full.name]
+		if !ok {
+			continue
+		}
+
+		msg := fmt.Sprintf("%s: %s %s", full.description, h.Status, full.name)
+		if check.Summary.Message != "" {
+			msg += ": " + check.Summary.Message
+		}
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+
+	return nil
+}
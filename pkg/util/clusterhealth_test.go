@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	healthOK   = `{"checks":{},"status":"HEALTH_OK"}`
+	healthWarn = `{"checks":{"OSD_NEARFULL":{"severity":"HEALTH_WARN","summary":{"message":"1 nearfull osd(s)"}}},"status":"HEALTH_WARN"}`
+	healthFull = `{"checks":{"OSD_FULL":{"severity":"HEALTH_ERR","summary":{"message":"1 full osd(s)"}},` +
+		`"POOL_FULL":{"severity":"HEALTH_WARN","summary":{"message":"3 pool(s) full"}}},"status":"HEALTH_ERR"}`
+	healthPoolFull = `{"checks":{"POOL_FULL":{"severity":"HEALTH_WARN","summary":{"message":"1 pool(s) full"}}},"status":"HEALTH_WARN"}`
+)
+
+func TestClusterHealthChecker(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		err      error
+		wantCode codes.Code
+		wantMsg  string
+	}{
+		{"healthy", healthOK, nil, codes.OK, ""},
+		{"nearfull", healthWarn, nil, codes.OK, ""},
+		// TEST: a full cluster fails right away
+		{"full", healthFull, nil, codes.ResourceExhausted, "cluster full: HEALTH_ERR OSD_FULL: 1 full osd(s)"},
+		// TEST: a pool at its quota blocks writes too
+		{"pool full", healthPoolFull, nil, codes.ResourceExhausted, "pool full: HEALTH_WARN POOL_FULL: 1 pool(s) full"},
+		// TEST: a health which can't be read lets the operation through
+		{"denied", "", errors.New("Error EACCES: access denied"), codes.OK, ""},
+		{"garbage", "HEALTH_OK", nil, codes.OK, ""},
+	}
+
+	for _, tt := range tests {
+		c := NewClusterHealthChecker()
+		err := c.CheckNotFull("mon1", func() ([]byte, error) { return []byte(tt.output), tt.err })
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: Failed: want (%v), got (%v)", tt.name, tt.wantCode, err)
+		}
+		if tt.wantMsg != "" && !strings.Contains(err.Error(), tt.wantMsg) {
+			t.Errorf("%s: Failed: want the health check in (%v)", tt.name, err)
+		}
+	}
+
+	// TEST: the health is read once within clusterHealthValidity
+	calls := 0
+	c := NewClusterHealthChecker()
+	for i := 0; i < 3; i++ {
+		err := c.CheckNotFull("mon1", func() ([]byte, error) {
+			calls++
+			return []byte(healthFull), nil
+		})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Failed: want (%v), got (%v)", codes.ResourceExhausted, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Failed: want (1) ceph health, got (%d)", calls)
+	}
+
+	// TEST: a nil checker lets all operations through
+	c = nil
+	if err := c.CheckNotFull("mon1", func() ([]byte, error) { return []byte(healthFull), nil }); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
@@ -37,6 +37,10 @@ type StoreReader interface {
 - csAdminKey: key, for adminID in csProvisionerUser
 - csUserKey: key, for userID in csPublisherUser
 - csPools: Pool list, comma separated
+- <class>userid: ID to use for operations of the operation class <class>,
+  instead of csAdminID (or csUserID for the node class)
+- <class>userkey: key, for the ID in <class>userid
+- csFSID: optional FSID the monitors have to belong to
 */
 
 // Constants for various ConfigKeys
@@ -47,8 +51,22 @@ const (
 	csAdminKey = "adminkey"
 	csUserKey  = "userkey"
 	csPools    = "pools"
+	csFSID     = "fsid"
+
+	csOpUserIDSuffix  = "userid"
+	csOpUserKeySuffix = "userkey"
+)
+
+// Operation classes, which may be mapped to dedicated IDs in the cluster config
+const (
+	OpClassProvision = "provision"
+	OpClassSnapshot  = "snapshot"
+	OpClassExpand    = "expand"
+	OpClassNode      = "node"
 )
 
+var opClasses = []string{OpClassProvision, OpClassSnapshot, OpClassExpand, OpClassNode}
+
 // ConfigStore provides various gettors for ConfigKeys
 type ConfigStore struct {
 	StoreReader
@@ -63,9 +81,15 @@ func (dc *ConfigStore) dataForKey(clusterID, key string) (string, error) {
 	return "", errors.New("config store location uninitialized")
 }
 
-// Mons returns a comma separated MON list from the cluster config represented by clusterID
+// Mons returns a comma separated MON list from the cluster config represented by clusterID,
+// normalized with NormalizeMonitors
 func (dc *ConfigStore) Mons(clusterID string) (string, error) {
-	return dc.dataForKey(clusterID, csMonitors)
+	mons, err := dc.dataForKey(clusterID, csMonitors)
+	if err != nil {
+		return "", err
+	}
+
+	return NormalizeMonitors(mons)
 }
 
 // Pools returns a list of pool names from the cluster config represented by clusterID
@@ -78,6 +102,17 @@ func (dc *ConfigStore) Pools(clusterID string) ([]string, error) {
 	return strings.Split(content, ","), nil
 }
 
+// FSID returns the FSID pinned in the cluster config represented by
+// clusterID, or an empty string if it's not pinned
+func (dc *ConfigStore) FSID(clusterID string) string {
+	fsid, err := dc.dataForKey(clusterID, csFSID)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(fsid)
+}
+
 // AdminID returns the admin ID from the cluster config represented by clusterID
 func (dc *ConfigStore) AdminID(clusterID string) (string, error) {
 	return dc.dataForKey(clusterID, csAdminID)
@@ -88,6 +123,20 @@ func (dc *ConfigStore) UserID(clusterID string) (string, error) {
 	return dc.dataForKey(clusterID, csUserID)
 }
 
+// IDForOperation returns the ID mapped to the operation class opClass in the
+// cluster config represented by clusterID, or fallbackID if the class is not
+// mapped to an ID
+func (dc *ConfigStore) IDForOperation(clusterID, opClass, fallbackID string) string {
+	id, err := dc.dataForKey(clusterID, opClass+csOpUserIDSuffix)
+	if err != nil {
+		klog.V(4).Infof("no ID for operation class %s in cluster configuration of (%s), using %s (%s)",
+			opClass, clusterID, fallbackID, err)
+		return fallbackID
+	}
+
+	return id
+}
+
 // KeyForUser returns the key for the requested user ID from the cluster config
 // represented by clusterID
 func (dc *ConfigStore) KeyForUser(clusterID, userID string) (data string, err error) {
@@ -99,18 +148,20 @@ func (dc *ConfigStore) KeyForUser(clusterID, userID string) (data string, err er
 
 	if user == userID {
 		fetchKey = csAdminKey
+	} else if user, err = dc.UserID(clusterID); err == nil && user == userID {
+		fetchKey = csUserKey
 	} else {
-		user, err = dc.UserID(clusterID)
-		if err != nil {
-			return
+		for _, opClass := range opClasses {
+			if user, err = dc.dataForKey(clusterID, opClass+csOpUserIDSuffix); err == nil && user == userID {
+				fetchKey = opClass + csOpUserKeySuffix
+				break
+			}
 		}
 
-		if user != userID {
+		if fetchKey == "" {
 			err = fmt.Errorf("requested user (%s) not found in cluster configuration of (%s)", userID, clusterID)
 			return
 		}
-
-		fetchKey = csUserKey
 	}
 
 	return dc.dataForKey(clusterID, fetchKey)
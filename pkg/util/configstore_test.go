@@ -152,9 +152,55 @@ func TestConfigStore(t *testing.T) {
 		t.Errorf("Failed: want (%s), got (%s), err (%s)", data, content, err)
 	}
 
+	// TEST: Operation class without a mapped ID should use the fallback ID
+	content = cs.IDForOperation(clusterID, OpClassSnapshot, "provuser")
+	if content != "provuser" {
+		t.Errorf("Failed: want (%s), got (%s)", "provuser", content)
+	}
+
+	data = "snapuser"
+	err = ioutil.WriteFile(testDir+"/"+OpClassSnapshot+csOpUserIDSuffix, []byte(data), 0644)
+	if err != nil {
+		t.Errorf("Test setup error %s", err)
+	}
+
+	// TEST: Fetching snapuser for the snapshot class should succeed
+	content = cs.IDForOperation(clusterID, OpClassSnapshot, "provuser")
+	if content != data {
+		t.Errorf("Failed: want (%s), got (%s)", data, content)
+	}
+
+	data = "snapkey"
+	err = ioutil.WriteFile(testDir+"/"+OpClassSnapshot+csOpUserKeySuffix, []byte(data), 0644)
+	if err != nil {
+		t.Errorf("Test setup error %s", err)
+	}
+
+	// TEST: Fetching snapkey should succeed
+	content, err = cs.KeyForUser(clusterID, "snapuser")
+	if err != nil || content != data {
+		t.Errorf("Failed: want (%s), got (%s), err (%s)", data, content, err)
+	}
+
 	// TEST: Fetching random user key should fail
 	_, err = cs.KeyForUser(clusterID, "random")
 	if err == nil {
 		t.Errorf("Failed: Expected to fail fetching random user key")
 	}
+
+	// TEST: FSID should be empty if it's not pinned
+	if content = cs.FSID(clusterID); content != "" {
+		t.Errorf("Failed: want (), got (%s)", content)
+	}
+
+	data = "b1ebd8d6-4f4c-11e9-8c1f-0242ac110002"
+	err = ioutil.WriteFile(testDir+"/"+csFSID, []byte(data+"\n"), 0644)
+	if err != nil {
+		t.Errorf("Test setup error %s", err)
+	}
+
+	// TEST: Fetching the pinned FSID should succeed
+	if content = cs.FSID(clusterID); content != data {
+		t.Errorf("Failed: want (%s), got (%s)", data, content)
+	}
 }
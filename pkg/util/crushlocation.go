@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// GetCrushLocationMap returns the crush location of the node nodeName, built
+// from the comma separated list of node labels crushLocationLabels. A label
+// like topology.kubernetes.io/zone=zone1 becomes the location zone=zone1,
+// labels missing on the node are skipped.
+func GetCrushLocationMap(crushLocationLabels, nodeName string) (map[string]string, error) {
+	if crushLocationLabels == "" {
+		return nil, nil
+	}
+
+	node, err := NewK8sClient().CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get node %s", nodeName)
+	}
+
+	crushLocation := getCrushLocationMap(strings.Split(crushLocationLabels, ","), node.GetLabels())
+	klog.Infof("crush location of node %s: %v", nodeName, crushLocation)
+	return crushLocation, nil
+}
+
+func getCrushLocationMap(labels []string, nodeLabels map[string]string) map[string]string {
+	crushLocation := map[string]string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		value, ok := nodeLabels[label]
+		if !ok || label == "" || value == "" {
+			continue
+		}
+
+		key := label[strings.LastIndex(label, "/")+1:]
+		crushLocation[key] = value
+	}
+
+	return crushLocation
+}
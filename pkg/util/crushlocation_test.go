@@ -0,0 +1,50 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetCrushLocationMap(t *testing.T) {
+	nodeLabels := map[string]string{
+		"topology.kubernetes.io/zone":   "zone1",
+		"topology.kubernetes.io/region": "region1",
+		"rack":                          "rack1",
+		"kubernetes.io/hostname":        "node1",
+	}
+
+	tests := []struct {
+		name   string
+		labels []string
+		want   map[string]string
+	}{
+		{"prefixed labels", []string{"topology.kubernetes.io/zone", "topology.kubernetes.io/region"},
+			map[string]string{"zone": "zone1", "region": "region1"}},
+		{"label without prefix", []string{"rack"}, map[string]string{"rack": "rack1"}},
+		{"missing labels", []string{"topology.kubernetes.io/zone", "datacenter"}, map[string]string{"zone": "zone1"}},
+		{"no labels on node", []string{"datacenter"}, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		got := getCrushLocationMap(tt.labels, nodeLabels)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getCrushLocationMap() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
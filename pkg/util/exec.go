@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// LogBackendCalls logs the commands run against the backend, as they are
+// at verbosity 5, without raising the verbosity of the other logs
+var LogBackendCalls bool
+
+// RunCommand runs cmd in its own process group, which is killed as a whole
+// once ctx is done. Killing only cmd, like exec.CommandContext does, leaves
+// the processes it forked running, e.g. mount.ceph under mount, which may
+// complete their operation long after the request gave up on it.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	return RunCommandWithStdin(ctx, cmd, nil)
+}
+
+// RunCommandWithStdin runs cmd like RunCommand, streaming stdin to its
+// standard input, e.g. keys or JSON which would have to be written to files
+// otherwise. The input is never logged. Unlike with cmd.Stdin, a stdin
+// blocked in Read doesn't keep the call from returning once cmd is killed,
+// and stdin failing to read fails the call even if cmd succeeded with the
+// truncated input.
+func RunCommandWithStdin(ctx context.Context, cmd *exec.Cmd, stdin io.Reader) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	var pipe io.WriteCloser
+	if stdin != nil {
+		var err error
+		if pipe, err = cmd.StdinPipe(); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		logBackendCall(cmd, start, err)
+		return err
+	}
+
+	// the read error is sent before the pipe is closed, cmd only sees the
+	// end of its input after it
+	readErr := make(chan error, 1)
+	if stdin != nil {
+		go func() {
+			r := &errReader{r: stdin}
+			// writes fail once cmd exited, Wait closes the pipe
+			io.Copy(pipe, r) // nolint: errcheck, gosec
+			readErr <- r.err
+			pipe.Close() // nolint: errcheck, gosec
+		}()
+	}
+
+	exited := make(chan struct{})
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+
+		select {
+		case <-ctx.Done():
+			// the negative pid signals the process group led by cmd
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				klog.Warningf("failed to kill the process group of %s (%d): %v", cmd.Path, cmd.Process.Pid, err)
+			}
+		case <-exited:
+		}
+	}()
+
+	// the output pipes are only closed once the processes of the group
+	// holding them exited, Wait returns after the kill
+	err := cmd.Wait()
+	close(exited)
+	<-killed
+
+	select {
+	case rerr := <-readErr:
+		if rerr != nil && err == nil {
+			err = fmt.Errorf("failed to read the input of %s: %v", cmd.Path, rerr)
+		}
+	default:
+	}
+
+	logBackendCall(cmd, start, err)
+	return err
+}
+
+// errReader records the error Read of r failed with, other than io.EOF
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF {
+		er.err = err
+	}
+	return n, err
+}
+
+// logBackendCall logs the command with its secrets stripped, its duration
+// and exit status, if LogBackendCalls is set or at verbosity 5
+func logBackendCall(cmd *exec.Cmd, start time.Time, err error) {
+	if !LogBackendCalls && !bool(V(LogBackend, 5)) {
+		return
+	}
+
+	var args []string
+	if len(cmd.Args) > 1 {
+		args = StripSecretInArgs(cmd.Args[1:])
+	}
+
+	klog.Infof("backend call: program=%s args=%q duration=%v exit=%s", cmd.Path, args, time.Since(start), exitStatus(err))
+}
+
+// exitStatus returns the exit code of a command run, the signal it was
+// killed with, or the error it failed to run with
+func exitStatus(err error) string {
+	if err == nil {
+		return "0"
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return strconv.Quote(err.Error())
+	}
+
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return strconv.Quote(exitErr.Error())
+	}
+	if ws.Signaled() {
+		return ws.Signal().String()
+	}
+	return strconv.Itoa(ws.ExitStatus())
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-exec")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// TEST: commands which complete aren't affected
+	var out bytes.Buffer
+	cmd := exec.Command("echo", "mounted")
+	cmd.Stdout = &out
+	if err = RunCommand(context.Background(), cmd); err != nil || out.String() != "mounted\n" {
+		t.Errorf("Failed: want (mounted), got (%q) error (%v)", out.String(), err)
+	}
+
+	// TEST: the processes forked by a hung helper are killed with it, like a
+	// mount.ceph run by mount completing late
+	marker := path.Join(dir, "mounted")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	out.Reset()
+	cmd = exec.Command("sh", "-c", "(sleep 1; touch "+marker+") & wait")
+	cmd.Stdout = &out
+
+	start := time.Now()
+	if err = RunCommand(ctx, cmd); err == nil {
+		t.Errorf("Failed: want the hung helper killed")
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Failed: want the helper killed on cancellation, returned after %v", d)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err = os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Failed: the forked process outlived the cancellation (%v)", err)
+	}
+}
+
+// blockingReader returns data, then blocks until unblock is closed
+type blockingReader struct {
+	data    io.Reader
+	unblock chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	if n, err := br.data.Read(p); err != io.EOF {
+		return n, err
+	}
+	<-br.unblock
+	return 0, io.EOF
+}
+
+// failingReader returns data, then fails
+type failingReader struct {
+	data io.Reader
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if n, err := fr.data.Read(p); err != io.EOF {
+		return n, err
+	}
+	return 0, errors.New("secret not found")
+}
+
+func TestRunCommandWithStdin(t *testing.T) {
+	// TEST: the input is streamed to the command, larger than a pipe buffer
+	input := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	var out bytes.Buffer
+	cmd := exec.Command("cat")
+	cmd.Stdout = &out
+	if err := RunCommandWithStdin(context.Background(), cmd, bytes.NewReader(input)); err != nil || !bytes.Equal(out.Bytes(), input) {
+		t.Errorf("Failed: want (%d) bytes, got (%d) error (%v)", len(input), out.Len(), err)
+	}
+
+	// TEST: a command reading its input mid-write is killed on cancellation,
+	// while the input blocks
+	unblock := make(chan struct{})
+	defer close(unblock)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	out.Reset()
+	cmd = exec.Command("cat")
+	cmd.Stdout = &out
+	start := time.Now()
+	err := RunCommandWithStdin(ctx, cmd, &blockingReader{data: bytes.NewReader(input), unblock: unblock})
+	if err == nil {
+		t.Errorf("Failed: want the command killed")
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Failed: want the command killed on cancellation, returned after %v", d)
+	}
+
+	// TEST: failing to read the input fails the command run with it
+	cmd = exec.Command("cat")
+	cmd.Stdout = ioutil.Discard
+	if err = RunCommandWithStdin(context.Background(), cmd, &failingReader{data: bytes.NewReader(input)}); err == nil {
+		t.Errorf("Failed: want the read error, got (nil)")
+	}
+
+	// TEST: commands which don't read their input aren't affected
+	cmd = exec.Command("true")
+	if err = RunCommandWithStdin(context.Background(), cmd, bytes.NewReader(input)); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		cmd  *exec.Cmd
+		want string
+	}{
+		{exec.Command("true"), "0"},
+		{exec.Command("sh", "-c", "exit 3"), "3"},
+		{exec.Command("sh", "-c", "kill -9 $$"), "killed"},
+		{exec.Command("/nonexistent/rbd"), `"fork/exec /nonexistent/rbd: no such file or directory"`},
+	}
+
+	for _, tt := range tests {
+		if got := exitStatus(tt.cmd.Run()); got != tt.want {
+			t.Errorf("%v: Failed: want (%s), got (%s)", tt.cmd.Args, tt.want, got)
+		}
+	}
+}
@@ -17,7 +17,6 @@ limitations under the License.
 package util
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
@@ -37,6 +36,8 @@ import (
 type K8sCMCache struct {
 	Client    *k8s.Clientset
 	Namespace string
+	// Checksums enables writing entries with a checksum
+	Checksums bool
 }
 
 const (
@@ -60,28 +61,32 @@ func GetK8sNamespace() string {
 
 // NewK8sClient create kubernetes client
 func NewK8sClient() *k8s.Clientset {
+	client, err := NewK8sClientIfConfigured()
+	if err != nil {
+		klog.Errorf("Failed to create client with error: %v\n", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// NewK8sClientIfConfigured creates a kubernetes client, it returns an error
+// instead of exiting when no cluster config is available
+func NewK8sClientIfConfigured() (*k8s.Clientset, error) {
 	var cfg *rest.Config
 	var err error
 	cPath := os.Getenv("KUBERNETES_CONFIG_PATH")
 	if cPath != "" {
 		cfg, err = clientcmd.BuildConfigFromFlags("", cPath)
 		if err != nil {
-			klog.Errorf("Failed to get cluster config with error: %v\n", err)
-			os.Exit(1)
+			return nil, errors.Wrap(err, "failed to get cluster config")
 		}
 	} else {
 		cfg, err = rest.InClusterConfig()
 		if err != nil {
-			klog.Errorf("Failed to get cluster config with error: %v\n", err)
-			os.Exit(1)
+			return nil, errors.Wrap(err, "failed to get cluster config")
 		}
 	}
-	client, err := k8s.NewForConfig(cfg)
-	if err != nil {
-		klog.Errorf("Failed to create client with error: %v\n", err)
-		os.Exit(1)
-	}
-	return client
+	return k8s.NewForConfig(cfg)
 }
 
 func (k8scm *K8sCMCache) getMetadataCM(resourceID string) (*v1.ConfigMap, error) {
@@ -109,7 +114,11 @@ func (k8scm *K8sCMCache) ForAll(pattern string, destObj interface{}, f ForAllFun
 		if !match {
 			continue
 		}
-		if err = json.Unmarshal([]byte(data), destObj); err != nil {
+		if err = decodeCacheEntry(cm.ObjectMeta.Name, []byte(data), destObj); err != nil {
+			if _, ok := err.(*CacheEntryCorrupted); ok {
+				klog.Errorf("k8s-cm-cache: skipping configmap %s: %v", cm.ObjectMeta.Name, err)
+				continue
+			}
 			return errors.Wrapf(err, "k8s-cm-cache: JSON unmarshaling failed for configmap %s", cm.ObjectMeta.Name)
 		}
 		if err = f(cm.ObjectMeta.Name); err != nil {
@@ -121,12 +130,18 @@ func (k8scm *K8sCMCache) ForAll(pattern string, destObj interface{}, f ForAllFun
 
 // Create stores the metadata in configmaps with identifier name
 func (k8scm *K8sCMCache) Create(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
+	return k8scm.create(identifier, data)
+}
+
+func (k8scm *K8sCMCache) create(identifier string, data interface{}) error {
 	cm, err := k8scm.getMetadataCM(identifier)
 	if cm != nil && err == nil {
-		klog.V(4).Infof("k8s-cm-cache: configmap %s already exists, skipping configmap creation", identifier)
+		V(LogMetadata, 4).Infof("k8s-cm-cache: configmap %s already exists, skipping configmap creation", identifier)
 		return nil
 	}
-	dataJSON, err := json.Marshal(data)
+	dataJSON, err := encodeCacheEntry(data, k8scm.Checksums)
 	if err != nil {
 		return errors.Wrapf(err, "k8s-cm-cache: JSON marshaling failed for configmap %s", identifier)
 	}
@@ -145,18 +160,50 @@ func (k8scm *K8sCMCache) Create(identifier string, data interface{}) error {
 	_, err = k8scm.Client.CoreV1().ConfigMaps(k8scm.Namespace).Create(cm)
 	if err != nil {
 		if apierrs.IsAlreadyExists(err) {
-			klog.V(4).Infof("k8s-cm-cache: configmap %s already exists", identifier)
+			V(LogMetadata, 4).Infof("k8s-cm-cache: configmap %s already exists", identifier)
 			return nil
 		}
 		return errors.Wrapf(err, "k8s-cm-cache: couldn't persist %s metadata as configmap", identifier)
 	}
 
-	klog.V(4).Infof("k8s-cm-cache: configmap %s successfully created", identifier)
+	V(LogMetadata, 4).Infof("k8s-cm-cache: configmap %s successfully created", identifier)
+	return nil
+}
+
+// Update replaces the metadata in the configmap with identifier name
+func (k8scm *K8sCMCache) Update(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
+	cm, err := k8scm.getMetadataCM(identifier)
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return k8scm.create(identifier, data)
+		}
+
+		return errors.Wrapf(err, "k8s-cm-cache: couldn't get metadata configmap %s", identifier)
+	}
+
+	dataJSON, err := encodeCacheEntry(data, k8scm.Checksums)
+	if err != nil {
+		return errors.Wrapf(err, "k8s-cm-cache: JSON marshaling failed for configmap %s", identifier)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[cmDataKey] = string(dataJSON)
+
+	if _, err = k8scm.Client.CoreV1().ConfigMaps(k8scm.Namespace).Update(cm); err != nil {
+		return errors.Wrapf(err, "k8s-cm-cache: couldn't update metadata configmap %s", identifier)
+	}
+
+	V(LogMetadata, 4).Infof("k8s-cm-cache: configmap %s successfully updated", identifier)
 	return nil
 }
 
 // Get retrieves the metadata in configmaps with identifier name
 func (k8scm *K8sCMCache) Get(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
 	cm, err := k8scm.getMetadataCM(identifier)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
@@ -165,8 +212,11 @@ func (k8scm *K8sCMCache) Get(identifier string, data interface{}) error {
 
 		return err
 	}
-	err = json.Unmarshal([]byte(cm.Data[cmDataKey]), data)
+	err = decodeCacheEntry(identifier, []byte(cm.Data[cmDataKey]), data)
 	if err != nil {
+		if _, ok := err.(*CacheEntryCorrupted); ok {
+			return err
+		}
 		return errors.Wrapf(err, "k8s-cm-cache: JSON unmarshaling failed for configmap %s", identifier)
 	}
 	return nil
@@ -174,15 +224,17 @@ func (k8scm *K8sCMCache) Get(identifier string, data interface{}) error {
 
 // Delete deletes the metadata in configmaps with identifier name
 func (k8scm *K8sCMCache) Delete(identifier string) error {
+	defer lockCacheEntry(identifier)()
+
 	err := k8scm.Client.CoreV1().ConfigMaps(k8scm.Namespace).Delete(identifier, nil)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
-			klog.V(4).Infof("k8s-cm-cache: cannot delete missing metadata configmap %s, assuming it's already deleted", identifier)
+			V(LogMetadata, 4).Infof("k8s-cm-cache: cannot delete missing metadata configmap %s, assuming it's already deleted", identifier)
 			return nil
 		}
 
 		return errors.Wrapf(err, "k8s-cm-cache: couldn't delete metadata configmap %s", identifier)
 	}
-	klog.V(4).Infof("k8s-cm-cache: successfully deleted metadata configmap %s", identifier)
+	V(LogMetadata, 4).Infof("k8s-cm-cache: successfully deleted metadata configmap %s", identifier)
 	return nil
 }
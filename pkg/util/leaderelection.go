@@ -0,0 +1,386 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+// LeaderElectionConfig configures the election of the replica serving the
+// controller RPCs
+type LeaderElectionConfig struct {
+	// LeaseName is the name of the Lease the replicas compete for
+	LeaseName string
+	// Namespace of the Lease
+	Namespace string
+	// Identity of the replica, recorded as holder of the Lease
+	Identity string
+	// LeaseDuration is the time standby replicas wait after the last
+	// renewal they observed before taking over the Lease
+	LeaseDuration time.Duration
+	// RenewDeadline is the time the leader tries to renew the Lease for
+	// before giving up the leadership
+	RenewDeadline time.Duration
+	// RetryPeriod is the time between attempts to acquire or renew the Lease
+	RetryPeriod time.Duration
+}
+
+// Validate checks that the leader gives up before standby replicas take over
+func (c *LeaderElectionConfig) Validate() error {
+	if c.LeaseName == "" || c.Namespace == "" || c.Identity == "" {
+		return fmt.Errorf("leader election requires a lease name, namespace and identity")
+	}
+	if c.RetryPeriod <= 0 || c.RenewDeadline <= c.RetryPeriod || c.LeaseDuration <= c.RenewDeadline {
+		return fmt.Errorf("leader election requires lease duration (%v) > renew deadline (%v) > retry period (%v) > 0",
+			c.LeaseDuration, c.RenewDeadline, c.RetryPeriod)
+	}
+	return nil
+}
+
+// LeaderElector elects one of the controller replicas through a
+// coordination.k8s.io Lease. Only the leader serves controller RPCs, the
+// operation locks of the drivers are per process and don't guard against
+// conflicting operations of several replicas.
+type LeaderElector struct {
+	cfg    LeaderElectionConfig
+	leases coordinationclient.LeaseInterface
+
+	mtx    sync.Mutex
+	leader bool
+	// run before admitting RPCs each time the replica becomes the leader
+	beforeAdmitting []func() error
+	// RPCs admitted while leading, drained before the leadership is
+	// given up
+	inflight sync.WaitGroup
+	// done once the leadership is lost, cancelling the RPCs in flight
+	leading       context.Context
+	cancelLeading context.CancelFunc
+
+	// the record of the Lease last observed and when, standby replicas
+	// take over once it didn't change for LeaseDuration
+	observedRecord coordinationv1beta1.LeaseSpec
+	observedTime   time.Time
+
+	now func() time.Time
+}
+
+// NewLeaderElector returns an elector competing for the Lease in the
+// kubernetes cluster the driver runs in
+func NewLeaderElector(cfg LeaderElectionConfig) (*LeaderElector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := NewK8sClientIfConfigured()
+	if err != nil {
+		return nil, fmt.Errorf("leader election requires a kubernetes client: %v", err)
+	}
+
+	return newLeaderElector(cfg, client.CoordinationV1beta1().Leases(cfg.Namespace)), nil
+}
+
+func newLeaderElector(cfg LeaderElectionConfig, leases coordinationclient.LeaseInterface) *LeaderElector {
+	return &LeaderElector{cfg: cfg, leases: leases, now: time.Now}
+}
+
+// LeaderElectionIdentity returns the hostname, the pod name in kubernetes
+func LeaderElectionIdentity() (string, error) {
+	return os.Hostname()
+}
+
+// IsLeader tells whether the replica currently holds the Lease
+func (le *LeaderElector) IsLeader() bool {
+	le.mtx.Lock()
+	defer le.mtx.Unlock()
+	return le.leader
+}
+
+// Enter admits an RPC while the replica leads, returning the context to
+// serve it with and the function to call once it's done. The context is
+// cancelled once the leadership is lost, the RPC must not outlive it.
+// Standby replicas fail RPCs with Unavailable.
+func (le *LeaderElector) Enter(ctx context.Context) (context.Context, func(), error) {
+	le.mtx.Lock()
+	defer le.mtx.Unlock()
+
+	if !le.leader {
+		holder := ""
+		if le.observedRecord.HolderIdentity != nil {
+			holder = *le.observedRecord.HolderIdentity
+		}
+		return nil, nil, status.Errorf(codes.Unavailable, "%s is a standby replica, the controller is served by the leader %q", le.cfg.Identity, holder)
+	}
+
+	le.inflight.Add(1)
+	leading := le.leading
+	rpcCtx, cancel := context.WithCancel(context.WithValue(ctx, leadingKey{}, leading))
+	go func() {
+		select {
+		case <-leading.Done():
+			cancel()
+		case <-rpcCtx.Done():
+		}
+	}()
+
+	return rpcCtx, func() {
+		cancel()
+		le.inflight.Done()
+	}, nil
+}
+
+type leadingKey struct{}
+
+// Detach returns a context which isn't done when ctx is, e.g. to clean up
+// after an RPC which was cancelled. It's still done once the replica which
+// admitted the RPC lost the leadership.
+func Detach(ctx context.Context) context.Context {
+	if leading, ok := ctx.Value(leadingKey{}).(context.Context); ok {
+		return leading
+	}
+	return context.Background()
+}
+
+// BeforeAdmitting registers f to run each time the replica becomes the
+// leader, before it admits RPCs. Other replicas may have changed the state
+// of the driver while it stood by.
+func (le *LeaderElector) BeforeAdmitting(f func() error) {
+	le.mtx.Lock()
+	le.beforeAdmitting = append(le.beforeAdmitting, f)
+	le.mtx.Unlock()
+}
+
+// Run competes for the Lease until the context is done. The leader renews
+// it every RetryPeriod and gives up the leadership if it can't within
+// RenewDeadline, after draining the RPCs in flight, before competing again.
+func (le *LeaderElector) Run(ctx context.Context) {
+	for {
+		if !le.acquire(ctx) {
+			return
+		}
+
+		le.lead(ctx)
+		le.setLeader(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// acquire retries to acquire the Lease every RetryPeriod, it returns false
+// if the context is done before
+func (le *LeaderElector) acquire(ctx context.Context) bool {
+	for {
+		if le.tryAcquireOrRenew() {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(le.cfg.RetryPeriod):
+		}
+	}
+}
+
+// lead renews the Lease every RetryPeriod, until it fails to for
+// RenewDeadline or the context is done. RPCs are admitted once the
+// functions registered with BeforeAdmitting succeeded, they are retried
+// every RetryPeriod until then.
+func (le *LeaderElector) lead(ctx context.Context) {
+	lastRenew := le.now()
+	for {
+		if !le.IsLeader() {
+			if err := le.prepare(); err != nil {
+				klog.Errorf("%s failed to prepare serving controller RPCs, retrying: %v", le.cfg.Identity, err)
+			} else if le.tryAcquireOrRenew() {
+				// preparing may take a while, the Lease is renewed
+				// before admitting RPCs
+				lastRenew = le.now()
+				le.setLeader(true)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(le.cfg.RetryPeriod):
+		}
+
+		if le.tryAcquireOrRenew() {
+			lastRenew = le.now()
+			continue
+		}
+
+		if le.now().Sub(lastRenew) > le.cfg.RenewDeadline {
+			klog.Errorf("failed to renew lease %s/%s within %v", le.cfg.Namespace, le.cfg.LeaseName, le.cfg.RenewDeadline)
+			return
+		}
+	}
+}
+
+// prepare runs the functions registered with BeforeAdmitting
+func (le *LeaderElector) prepare() error {
+	le.mtx.Lock()
+	funcs := le.beforeAdmitting
+	le.mtx.Unlock()
+
+	for _, f := range funcs {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (le *LeaderElector) setLeader(leader bool) {
+	le.mtx.Lock()
+	le.leader = leader
+	if leader {
+		le.leading, le.cancelLeading = context.WithCancel(context.Background())
+	} else if le.cancelLeading != nil {
+		le.cancelLeading()
+	}
+	le.mtx.Unlock()
+
+	if leader {
+		klog.Infof("%s became the leader of lease %s/%s, serving controller RPCs", le.cfg.Identity, le.cfg.Namespace, le.cfg.LeaseName)
+		return
+	}
+
+	// new RPCs are refused already, the ones in flight are cancelled and
+	// must return before another replica may take over, LeaseDuration
+	// after the last renewal it observed
+	klog.Warningf("%s lost the leadership of lease %s/%s, cancelling the controller RPCs in flight", le.cfg.Identity, le.cfg.Namespace, le.cfg.LeaseName)
+	start := le.now()
+	le.inflight.Wait()
+	if drained := le.now().Sub(start); drained > le.cfg.LeaseDuration-le.cfg.RenewDeadline {
+		klog.Errorf("%s took %v to drain the controller RPCs, longer than another replica may wait to take over lease %s/%s",
+			le.cfg.Identity, drained, le.cfg.Namespace, le.cfg.LeaseName)
+	}
+	klog.Infof("%s is a standby replica of lease %s/%s", le.cfg.Identity, le.cfg.Namespace, le.cfg.LeaseName)
+}
+
+// tryAcquireOrRenew takes the Lease if it's free or expired, or renews it if
+// the replica holds it. Conflicting updates of other replicas fail through
+// the resource version of the Lease.
+func (le *LeaderElector) tryAcquireOrRenew() bool {
+	now := le.now()
+	renewTime := metav1.NewMicroTime(now)
+	leaseDurationSeconds := int32(le.cfg.LeaseDuration / time.Second)
+	identity := le.cfg.Identity
+
+	lease, err := le.leases.Get(le.cfg.LeaseName, metav1.GetOptions{})
+	if err != nil {
+		if !apierrs.IsNotFound(err) {
+			klog.Errorf("failed to get lease %s/%s: %v", le.cfg.Namespace, le.cfg.LeaseName, err)
+			return false
+		}
+
+		lease = &coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: le.cfg.LeaseName, Namespace: le.cfg.Namespace},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		if lease, err = le.leases.Create(lease); err != nil {
+			klog.Errorf("failed to create lease %s/%s: %v", le.cfg.Namespace, le.cfg.LeaseName, err)
+			return false
+		}
+		le.observe(lease.Spec, now)
+		return true
+	}
+
+	if !leaseRecordEqual(lease.Spec, le.observedRecord) {
+		le.observe(lease.Spec, now)
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder != identity && holder != "" && now.Before(le.observedTime.Add(le.cfg.LeaseDuration)) {
+		return false
+	}
+
+	spec := lease.Spec.DeepCopy()
+	if holder != identity {
+		transitions := int32(0)
+		if spec.LeaseTransitions != nil {
+			transitions = *spec.LeaseTransitions
+		}
+		if holder != "" {
+			transitions++
+		}
+		spec.LeaseTransitions = &transitions
+		spec.AcquireTime = &renewTime
+	}
+	spec.HolderIdentity = &identity
+	spec.LeaseDurationSeconds = &leaseDurationSeconds
+	spec.RenewTime = &renewTime
+	lease.Spec = *spec
+
+	if lease, err = le.leases.Update(lease); err != nil {
+		klog.Errorf("failed to update lease %s/%s: %v", le.cfg.Namespace, le.cfg.LeaseName, err)
+		return false
+	}
+	le.observe(lease.Spec, now)
+	return true
+}
+
+func (le *LeaderElector) observe(record coordinationv1beta1.LeaseSpec, now time.Time) {
+	le.mtx.Lock()
+	le.observedRecord = *record.DeepCopy()
+	le.observedTime = now
+	le.mtx.Unlock()
+}
+
+// leaseRecordEqual compares the holder and renew time of Lease records, the
+// record changes with every renewal of the holder
+func leaseRecordEqual(a, b coordinationv1beta1.LeaseSpec) bool {
+	aHolder, bHolder := "", ""
+	if a.HolderIdentity != nil {
+		aHolder = *a.HolderIdentity
+	}
+	if b.HolderIdentity != nil {
+		bHolder = *b.HolderIdentity
+	}
+	if aHolder != bHolder {
+		return false
+	}
+
+	if a.RenewTime == nil || b.RenewTime == nil {
+		return a.RenewTime == b.RenewTime
+	}
+	return a.RenewTime.Equal(b.RenewTime)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+// fakeLeases stores one Lease, updates with a stale resource version fail
+// like they do with the API server
+type fakeLeases struct {
+	coordinationclient.LeaseInterface
+
+	mtx   sync.Mutex
+	lease *coordinationv1beta1.Lease
+}
+
+var leasesResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+func (f *fakeLeases) Get(name string, options metav1.GetOptions) (*coordinationv1beta1.Lease, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.lease == nil {
+		return nil, apierrs.NewNotFound(leasesResource, name)
+	}
+	return f.lease.DeepCopy(), nil
+}
+
+func (f *fakeLeases) Create(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.lease != nil {
+		return nil, apierrs.NewAlreadyExists(leasesResource, lease.Name)
+	}
+	f.lease = lease.DeepCopy()
+	f.lease.ResourceVersion = "1"
+	return f.lease.DeepCopy(), nil
+}
+
+func (f *fakeLeases) Update(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.lease == nil || f.lease.ResourceVersion != lease.ResourceVersion {
+		return nil, apierrs.NewConflict(leasesResource, lease.Name, nil)
+	}
+	version, _ := strconv.Atoi(lease.ResourceVersion) // nolint: errcheck
+	f.lease = lease.DeepCopy()
+	f.lease.ResourceVersion = strconv.Itoa(version + 1)
+	return f.lease.DeepCopy(), nil
+}
+
+func TestLeaderElectionConfigValidate(t *testing.T) {
+	valid := LeaderElectionConfig{LeaseName: "rbd.csi.ceph.com", Namespace: "default", Identity: "a",
+		LeaseDuration: 15 * time.Second, RenewDeadline: 10 * time.Second, RetryPeriod: 2 * time.Second}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	// TEST: the leader has to give up before standby replicas take over
+	invalid := valid
+	invalid.RenewDeadline = invalid.LeaseDuration
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("Failed: want an error for renew deadline (%v) >= lease duration (%v)", invalid.RenewDeadline, invalid.LeaseDuration)
+	}
+	invalid = valid
+	invalid.RetryPeriod = 0
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("Failed: want an error for retry period (0)")
+	}
+}
+
+func TestLeaderElector(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	leases := &fakeLeases{}
+	cfg := LeaderElectionConfig{LeaseName: "rbd.csi.ceph.com", Namespace: "default",
+		LeaseDuration: 15 * time.Second, RenewDeadline: 10 * time.Second, RetryPeriod: 2 * time.Second}
+	newElector := func(identity string) *LeaderElector {
+		c := cfg
+		c.Identity = identity
+		le := newLeaderElector(c, leases)
+		le.now = clock
+		return le
+	}
+	a, b := newElector("a"), newElector("b")
+
+	// TEST: the first replica creates the lease, the other one stands by
+	if !a.tryAcquireOrRenew() {
+		t.Fatalf("Failed: want a to acquire the free lease")
+	}
+	if b.tryAcquireOrRenew() {
+		t.Errorf("Failed: want b to stand by while a holds the lease")
+	}
+	a.setLeader(true)
+
+	_, done, err := a.Enter(context.Background())
+	if err != nil {
+		t.Errorf("Failed: want the leader to serve, got (%v)", err)
+	} else {
+		done()
+	}
+	if _, _, err = b.Enter(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Errorf("Failed: want (%v) from the standby replica, got (%v)", codes.Unavailable, err)
+	}
+
+	// TEST: renewals keep the standby replica waiting
+	now = now.Add(10 * time.Second)
+	if !a.tryAcquireOrRenew() {
+		t.Errorf("Failed: want a to renew the lease")
+	}
+	now = now.Add(10 * time.Second)
+	if b.tryAcquireOrRenew() {
+		t.Errorf("Failed: want b to stand by after a renewed the lease")
+	}
+
+	// TEST: the standby replica takes over once the lease expired
+	now = now.Add(16 * time.Second)
+	if !b.tryAcquireOrRenew() {
+		t.Fatalf("Failed: want b to take over the expired lease")
+	}
+	if holder := *leases.lease.Spec.HolderIdentity; holder != "b" {
+		t.Errorf("Failed: want holder (b), got (%s)", holder)
+	}
+	if transitions := *leases.lease.Spec.LeaseTransitions; transitions != 1 {
+		t.Errorf("Failed: want (1) transitions, got (%d)", transitions)
+	}
+	if a.tryAcquireOrRenew() {
+		t.Errorf("Failed: want a to stand by after b took over")
+	}
+}
+
+func TestLeaderElectorDrain(t *testing.T) {
+	le := newLeaderElector(LeaderElectionConfig{Identity: "a"}, &fakeLeases{})
+	le.setLeader(true)
+
+	ctx, done, err := le.Enter(context.Background())
+	if err != nil {
+		t.Fatalf("Failed: want the leader to serve, got (%v)", err)
+	}
+	cleanupCtx := Detach(ctx)
+
+	// TEST: losing the leadership cancels the RPCs in flight, waits for
+	// them, and refuses new ones meanwhile
+	lost := make(chan struct{})
+	go func() {
+		le.setLeader(false)
+		close(lost)
+	}()
+
+	select {
+	case <-lost:
+		t.Fatalf("Failed: the leadership was given up with an RPC in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, c := range []context.Context{ctx, cleanupCtx} {
+		select {
+		case <-c.Done():
+		default:
+			t.Errorf("Failed: want the context of the RPC in flight cancelled")
+		}
+	}
+
+	if _, _, err = le.Enter(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Errorf("Failed: want (%v) while draining, got (%v)", codes.Unavailable, err)
+	}
+
+	done()
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Errorf("Failed: the leadership wasn't given up after the RPC finished")
+	}
+}
+
+func TestLeaderElectorBeforeAdmitting(t *testing.T) {
+	le := newLeaderElector(LeaderElectionConfig{LeaseName: "rbd.csi.ceph.com", Namespace: "default", Identity: "a",
+		LeaseDuration: 3 * time.Second, RenewDeadline: 2 * time.Second, RetryPeriod: 10 * time.Millisecond}, &fakeLeases{})
+
+	// TEST: RPCs are refused until the registered functions succeeded
+	var mtx sync.Mutex
+	calls := 0
+	le.BeforeAdmitting(func() error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls++
+		if calls == 1 {
+			return errors.New("metadata store unavailable")
+		}
+		if le.IsLeader() {
+			t.Errorf("Failed: want the function to run before RPCs are admitted")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		le.Run(ctx)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !le.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, done, err := le.Enter(context.Background()); err != nil {
+		t.Errorf("Failed: want the leader to serve once prepared, got (%v)", err)
+	} else {
+		done()
+	}
+
+	mtx.Lock()
+	if calls != 2 {
+		t.Errorf("Failed: want (2) calls, got (%d)", calls)
+	}
+	mtx.Unlock()
+
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"k8s.io/klog"
+)
+
+// benignLogLevel is the verbosity at which expected conditions are logged
+const benignLogLevel = 4
+
+// LogBenign logs a condition that is expected during normal operation, like
+// an idempotent retry finding its work already done. Such conditions are
+// logged at V(4) with a "benign=true" marker, so that they don't trigger
+// log-based alerts meant for failed RPCs.
+func LogBenign(format string, args ...interface{}) {
+	klog.V(benignLogLevel).Infof("benign=true "+format, args...)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"k8s.io/klog"
+)
+
+func TestLogBenign(t *testing.T) {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+
+	var buf bytes.Buffer
+	klog.SetOutput(&buf)
+
+	tests := []struct {
+		verbosity string
+		logged    bool
+	}{
+		{"0", false},
+		{"3", false},
+		{"4", true},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		if err := fs.Set("v", tt.verbosity); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+
+		LogBenign("volume %s already exists", "vol-1")
+		klog.Flush()
+
+		out := buf.String()
+		if !tt.logged {
+			if out != "" {
+				t.Errorf("v=%s: expected no output, got %q", tt.verbosity, out)
+			}
+			continue
+		}
+
+		// klog prefixes every line with its severity, benign conditions
+		// must never be logged at Warning level or above
+		if !strings.HasPrefix(out, "I") {
+			t.Errorf("v=%s: expected Info level, got %q", tt.verbosity, out)
+		}
+		if !strings.Contains(out, "benign=true volume vol-1 already exists") {
+			t.Errorf("v=%s: expected benign marker, got %q", tt.verbosity, out)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+// LogModule tags the verbose logs of a subsystem, whose verbosity can be set
+// apart from the global one with SetLogLevels
+type LogModule string
+
+const (
+	// LogMount tags the mounts, unmounts, maps and unmaps of nodes
+	LogMount LogModule = "mount"
+	// LogBackend tags the commands run against the cluster
+	LogBackend LogModule = "backend"
+	// LogMetadata tags the metadata stores
+	LogMetadata LogModule = "metadata"
+
+	// logDefault sets the verbosity of the modules without their own
+	logDefault LogModule = "default"
+)
+
+var logModules = map[LogModule]bool{LogMount: true, LogBackend: true, LogMetadata: true, logDefault: true}
+
+// logLevels holds the map[LogModule]klog.Level set by SetLogLevels
+var logLevels atomic.Value
+
+// ParseLogLevels parses comma separated <module>=<level> verbosities, e.g.
+// "mount=5,default=2". Modules this driver doesn't have, e.g. journal, are
+// logged and ignored, so that settings shared with other versions still
+// apply.
+func ParseLogLevels(spec string) (map[LogModule]klog.Level, error) {
+	levels := make(map[LogModule]klog.Level)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid log level %q, expected <module>=<level>", pair)
+		}
+		module := LogModule(strings.TrimSpace(kv[0]))
+		level, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid level of log module %s: %v", module, err)
+		}
+		if !logModules[module] {
+			klog.Warningf("ignoring the level of unknown log module %q, expected one of mount, backend, metadata or default", module)
+			continue
+		}
+		levels[module] = klog.Level(level)
+	}
+
+	return levels, nil
+}
+
+// SetLogLevels sets the verbosity of the log modules, replacing the ones set
+// before. Modules left out log at the default level if it's set, at the
+// global verbosity otherwise.
+func SetLogLevels(spec string) error {
+	levels, err := ParseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+
+	logLevels.Store(levels)
+	return nil
+}
+
+// V is klog.V for the logs of module. Untagged logs, with an empty module,
+// always use the global verbosity.
+func V(module LogModule, level klog.Level) klog.Verbose {
+	levels, _ := logLevels.Load().(map[LogModule]klog.Level) // nolint: errcheck
+	if module != "" {
+		if l, ok := levels[module]; ok {
+			return klog.Verbose(level <= l)
+		}
+		if l, ok := levels[logDefault]; ok {
+			return klog.Verbose(level <= l)
+		}
+	}
+
+	return klog.V(level)
+}
+
+// LoadLogLevels sets the log levels in the file at path, in the format of
+// ParseLogLevels
+func LoadLogLevels(path string) error {
+	// #nosec
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return SetLogLevels(strings.TrimSpace(string(content)))
+}
+
+// WatchLogLevels loads the log levels in the file at path again on SIGHUP,
+// until the context is done. Invalid files are logged and leave the levels
+// unchanged. Without a file SIGHUP is only logged, instead of terminating
+// the driver.
+func WatchLogLevels(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if path == "" {
+			klog.Infof("received SIGHUP without a log levels file, nothing to reload")
+			continue
+		}
+		if err := LoadLogLevels(path); err != nil {
+			klog.Errorf("failed to reload log levels file %s, keeping the previous levels: %v", path, err)
+			continue
+		}
+		klog.Infof("reloaded log levels from %s", path)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/klog"
+)
+
+func TestLogLevels(t *testing.T) {
+	defer SetLogLevels("") // nolint: errcheck
+
+	if err := SetLogLevels("mount=5, default=2"); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	tests := []struct {
+		module LogModule
+		level  klog.Level
+		want   bool
+	}{
+		// TEST: a module logs up to its own level
+		{LogMount, 5, true},
+		{LogMount, 6, false},
+		// TEST: modules without their own level log up to the default
+		{LogBackend, 2, true},
+		{LogBackend, 3, false},
+	}
+	for _, tt := range tests {
+		if got := bool(V(tt.module, tt.level)); got != tt.want {
+			t.Errorf("Failed: V(%q, %d): want (%v), got (%v)", tt.module, tt.level, tt.want, got)
+		}
+	}
+
+	// TEST: untagged logs follow the global verbosity
+	if V("", 9) != klog.V(9) {
+		t.Errorf("Failed: want untagged logs at the global verbosity")
+	}
+
+	// TEST: without default the other modules follow the global verbosity
+	if err := SetLogLevels("metadata=4"); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if V(LogMetadata, 4) != true || V(LogMount, 9) != klog.V(9) {
+		t.Errorf("Failed: want metadata at (4) and mount at the global verbosity")
+	}
+
+	// TEST: unknown modules are ignored
+	if err := SetLogLevels("journal=5,metadata=4"); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if V(LogMetadata, 4) != true {
+		t.Errorf("Failed: want metadata at (4) next to an unknown module")
+	}
+
+	for _, spec := range []string{"journal=high", "mount", "mount=high", "mount=-1"} {
+		if err := SetLogLevels(spec); err == nil {
+			t.Errorf("Failed: want an error for (%s), got (nil)", spec)
+		}
+	}
+	// TEST: an invalid setting keeps the previous levels
+	if V(LogMetadata, 4) != true {
+		t.Errorf("Failed: want the levels kept after an invalid setting")
+	}
+}
+
+func TestLoadLogLevels(t *testing.T) {
+	defer SetLogLevels("") // nolint: errcheck
+
+	tmpDir, err := ioutil.TempDir("", "loglevels")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "loglevels")
+	if err = ioutil.WriteFile(path, []byte("backend=5\n"), 0600); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = LoadLogLevels(path); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if V(LogBackend, 5) != true {
+		t.Errorf("Failed: want backend logs at (5)")
+	}
+
+	if err = LoadLogLevels(filepath.Join(tmpDir, "missing")); err == nil {
+		t.Errorf("Failed: want an error for a missing file, got (nil)")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+// Prefixes of the identifiers of entries in the metadata store. Patterns used
+// to list entries of one kind must not match entries of any other kind.
+const (
+	// RBDVolumePrefix prefixes the IDs of rbd volumes
+	RBDVolumePrefix = "csi-rbd-vol-"
+	// RBDSnapshotPrefix and RBDSnapshotInfix surround the name of the source
+	// volume in the IDs of rbd snapshots
+	RBDSnapshotPrefix = "csi-rbd-"
+	RBDSnapshotInfix  = "-snap-"
+	// CephFSVolumePrefix prefixes the IDs of cephfs volumes
+	CephFSVolumePrefix = "csi-cephfs-"
+	// AttachmentPrefix prefixes the records of volume attachments
+	AttachmentPrefix = "attachment-"
+
+	// schemaVersionPrefix prefixes the entry recording the schema version
+	schemaVersionPrefix = "metadata-schema-"
+)
+
+// SchemaMigration migrates the entries in the metadata store from a version
+// of the schema to the next one. Migrations may be interrupted, so they have
+// to be idempotent.
+type SchemaMigration func(cp CachePersister) error
+
+// MetadataSchema describes the schema of the entries a driver keeps in the
+// metadata store
+type MetadataSchema struct {
+	// Name distinguishes the schemas of drivers sharing a metadata store
+	Name string
+	// Migrations[i] migrates entries from version i+1 to version i+2,
+	// entries written before the schema was versioned are at version 1
+	Migrations []SchemaMigration
+}
+
+type schemaVersion struct {
+	Version int `json:"version"`
+}
+
+// Version returns the current version of the schema
+func (s *MetadataSchema) Version() int {
+	return len(s.Migrations) + 1
+}
+
+// Upgrade migrates the entries in the metadata store to the current version of
+// the schema, and records the version in the store. Migrations update the
+// entries they read before, they must not run while RPCs are served.
+func (s *MetadataSchema) Upgrade(cp CachePersister) error {
+	id := schemaVersionPrefix + s.Name
+	sv := &schemaVersion{}
+	stored := true
+	if err := cp.Get(id, sv); err != nil {
+		if _, ok := err.(*CacheEntryNotFound); !ok {
+			return errors.Wrapf(err, "failed to get %s metadata schema version", s.Name)
+		}
+		sv.Version = 1
+		stored = false
+	}
+
+	if sv.Version > s.Version() {
+		return fmt.Errorf("%s metadata schema version %d is newer than the supported version %d",
+			s.Name, sv.Version, s.Version())
+	}
+
+	for sv.Version < s.Version() {
+		klog.Infof("migrating %s metadata from schema version %d to %d", s.Name, sv.Version, sv.Version+1)
+		if err := s.Migrations[sv.Version-1](cp); err != nil {
+			return errors.Wrapf(err, "failed to migrate %s metadata from schema version %d", s.Name, sv.Version)
+		}
+
+		sv.Version++
+		if err := cp.Update(id, sv); err != nil {
+			return errors.Wrapf(err, "failed to store %s metadata schema version", s.Name)
+		}
+	}
+
+	if stored {
+		return nil
+	}
+
+	// record the version on first use
+	return cp.Update(id, sv)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// nolint: gocyclo
+func TestMetadataSchemaUpgrade(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "metadataschema")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	nc := &NodeCache{BasePath: basePath, CacheDir: "controller"}
+	if err = nc.EnsureCacheDirectory(nc.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	var migrated []int
+	migration := func(version int) SchemaMigration {
+		return func(cp CachePersister) error {
+			migrated = append(migrated, version)
+			return nil
+		}
+	}
+
+	// TEST: a new store should be migrated from version 1 and versioned
+	schema := &MetadataSchema{Name: "test", Migrations: []SchemaMigration{migration(1)}}
+	if err = schema.Upgrade(nc); err != nil {
+		t.Errorf("Failed: unexpected error %s", err)
+	}
+	if len(migrated) != 1 || migrated[0] != 1 {
+		t.Errorf("Failed: want migrations [1], got %v", migrated)
+	}
+
+	sv := &schemaVersion{}
+	if err = nc.Get(schemaVersionPrefix+"test", sv); err != nil || sv.Version != 2 {
+		t.Errorf("Failed: want version 2, got %d, err (%v)", sv.Version, err)
+	}
+
+	// TEST: only migrations newer than the stored version should run
+	migrated = nil
+	schema.Migrations = append(schema.Migrations, migration(2), migration(3))
+	if err = schema.Upgrade(nc); err != nil {
+		t.Errorf("Failed: unexpected error %s", err)
+	}
+	if len(migrated) != 2 || migrated[0] != 2 || migrated[1] != 3 {
+		t.Errorf("Failed: want migrations [2 3], got %v", migrated)
+	}
+
+	// TEST: a failed migration should keep the version it failed at
+	schema.Migrations = append(schema.Migrations, func(cp CachePersister) error {
+		return errors.New("migration failed")
+	})
+	if err = schema.Upgrade(nc); err == nil {
+		t.Errorf("Failed: expected migration error")
+	}
+	if err = nc.Get(schemaVersionPrefix+"test", sv); err != nil || sv.Version != 4 {
+		t.Errorf("Failed: want version 4, got %d, err (%v)", sv.Version, err)
+	}
+
+	// TEST: a store at a newer version than supported should be refused
+	schema.Migrations = schema.Migrations[:1]
+	if err = schema.Upgrade(nc); err == nil {
+		t.Errorf("Failed: expected error for newer schema version")
+	}
+}
+
+func TestMetadataSchemaUpgradeFailed(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "metadataschema")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	nc := &NodeCache{BasePath: basePath, CacheDir: "controller"}
+	if err = nc.EnsureCacheDirectory(nc.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// TEST: a failed upgrade keeps the version, the next one migrates again
+	attempts := 0
+	schema := &MetadataSchema{Name: "test", Migrations: []SchemaMigration{
+		func(cp CachePersister) error {
+			attempts++
+			if attempts < 2 {
+				return errors.New("update forbidden")
+			}
+			return nil
+		},
+	}}
+
+	if err = schema.Upgrade(nc); err == nil {
+		t.Errorf("Failed: expected error for failed migration")
+	}
+	sv := &schemaVersion{}
+	if err = nc.Get(schemaVersionPrefix+"test", sv); err == nil {
+		t.Errorf("Failed: want no version recorded, got %d", sv.Version)
+	}
+
+	if err = schema.Upgrade(nc); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if err = nc.Get(schemaVersionPrefix+"test", sv); err != nil || sv.Version != 2 {
+		t.Errorf("Failed: want version 2, got %d, err (%v)", sv.Version, err)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NormalizeMonitors validates the addresses in the comma separated monitor
+// list, and returns them deduplicated and sorted, so that the same monitors
+// always result in the same list, e.g. in mount device strings
+func NormalizeMonitors(mons string) (string, error) {
+	seen := map[string]bool{}
+	var normalized []string
+
+	for _, mon := range strings.Split(mons, ",") {
+		mon = strings.TrimSpace(mon)
+		if mon == "" {
+			continue
+		}
+
+		if err := validateMonitor(mon); err != nil {
+			return "", err
+		}
+
+		if !seen[mon] {
+			seen[mon] = true
+			normalized = append(normalized, mon)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return "", fmt.Errorf("empty monitor list")
+	}
+
+	sort.Strings(normalized)
+	return strings.Join(normalized, ","), nil
+}
+
+// validateMonitor validates a monitor address of the form host, host:port,
+// IPv6 or [IPv6]:port
+func validateMonitor(mon string) error {
+	host, port := mon, ""
+	if strings.HasPrefix(mon, "[") || strings.Count(mon, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(mon); err != nil {
+			return fmt.Errorf("invalid monitor address %q: %v", mon, err)
+		}
+	} else if strings.Contains(mon, ":") && net.ParseIP(mon) == nil {
+		return fmt.Errorf("invalid monitor address %q", mon)
+	}
+
+	if host == "" || strings.ContainsAny(host, " /@") {
+		return fmt.Errorf("invalid monitor address %q: invalid host", mon)
+	}
+
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid monitor address %q: invalid port", mon)
+		}
+	}
+
+	return nil
+}
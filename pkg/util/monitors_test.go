@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestNormalizeMonitors(t *testing.T) {
+	tests := []struct {
+		mons  string
+		want  string
+		valid bool
+	}{
+		{"mon1:6789", "mon1:6789", true},
+		{"mon2:6789,mon1:6789", "mon1:6789,mon2:6789", true},
+		// overlapping lists, as merged from the config and a secret
+		{"mon1:6789, mon2:6789,mon1:6789,mon3", "mon1:6789,mon2:6789,mon3", true},
+		{"10.0.0.2:6789,10.0.0.1:6789,", "10.0.0.1:6789,10.0.0.2:6789", true},
+		{"[fd00::2]:6789,fd00::1", "[fd00::2]:6789,fd00::1", true},
+		{"mon1:6789,mon1:3300", "mon1:3300,mon1:6789", true},
+		{"", "", false},
+		{" , ", "", false},
+		{"mon1:port", "", false},
+		{"mon1:70000", "", false},
+		{"mon1:6789,:6789", "", false},
+		{"mon 1:6789", "", false},
+		{"fd00::1::2", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeMonitors(tt.mons)
+		if (err == nil) != tt.valid {
+			t.Errorf("Failed: NormalizeMonitors(%q) = %v, want valid (%t)", tt.mons, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Failed: want (%s), got (%s)", tt.want, got)
+		}
+	}
+}
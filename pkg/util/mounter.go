@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Mounter is the mount boundary of the node servers, all mounts, unmounts and
+// mount point checks of node operations go through it, so that they can be
+// tested with FakeMounter
+type Mounter interface {
+	Unmounter
+	// BindMount bind-mounts from to to, read-only if readOnly is set
+	BindMount(ctx context.Context, from, to string, readOnly bool) error
+}
+
+type nodeMounter struct {
+	mount.Interface
+}
+
+// NewMounter returns a Mounter using the mounter, and umount -l for lazy
+// unmounts. The mount and umount helpers are throttled below the pid limit
+// like the other exec'd helpers.
+func NewMounter(mounter mount.Interface) Mounter {
+	return &nodeMounter{mounter}
+}
+
+func (m *nodeMounter) Mount(source, target, fstype string, options []string) error {
+	release, err := StartExec(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return PIDLimitError(m.Interface.Mount(source, target, fstype, options))
+}
+
+func (m *nodeMounter) Unmount(target string) error {
+	release, err := StartExec(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return PIDLimitError(m.Interface.Unmount(target))
+}
+
+func (m *nodeMounter) UnmountLazy(target string) error {
+	release, err := StartExec(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// #nosec
+	out, err := exec.Command("umount", "-l", target).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("lazy unmount of %s failed: %v: %s", target, PIDLimitError(err), out)
+	}
+	return nil
+}
+
+type nodeExec struct {
+	mount.Exec
+}
+
+// NewExec returns the mount.Exec formatting devices with
+// mount.SafeFormatAndMount, its mkfs and blkid runs are throttled below the
+// pid limit like the other exec'd helpers
+func NewExec() mount.Exec {
+	return &nodeExec{mount.NewOsExec()}
+}
+
+func (e *nodeExec) Run(cmd string, args ...string) ([]byte, error) {
+	release, err := StartExec(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	out, err := e.Exec.Run(cmd, args...)
+	return out, PIDLimitError(err)
+}
+
+func (m *nodeMounter) BindMount(ctx context.Context, from, to string, readOnly bool) error {
+	return bindMount(m, from, to, readOnly)
+}
+
+func bindMount(m mount.Interface, from, to string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		// the mounter remounts the bind-mount read-only
+		options = append(options, "ro")
+	}
+
+	if err := m.Mount(from, to, "", options); err != nil {
+		return errors.Wrapf(err, "failed to bind-mount %s to %s", from, to)
+	}
+	return nil
+}
+
+// IsMountPoint returns whether the target is mounted. A corrupted mount, e.g.
+// of a ceph-fuse process which is gone, is unmounted and reported as not
+// mounted, so that the caller mounts it again. Missing targets are reported
+// with an error satisfying os.IsNotExist.
+func IsMountPoint(m Mounter, target string) (bool, error) {
+	notMnt, err := mount.IsNotMountPoint(m, target)
+	if err == nil {
+		return !notMnt, nil
+	}
+
+	if !mount.IsCorruptedMnt(err) {
+		return false, err
+	}
+
+	klog.Warningf("%s is a corrupted mount, unmounting it to mount it again: %v", target, err)
+	if err = m.Unmount(target); err != nil && !isNotMountedError(err) {
+		return false, errors.Wrapf(err, "failed to unmount corrupted mount %s", target)
+	}
+
+	return false, nil
+}
+
+// FakeMounter is a Mounter for unit tests of the node servers, mounts and
+// unmounts are recorded in the Log of the embedded mount.FakeMounter
+type FakeMounter struct {
+	*mount.FakeMounter
+	// LazyUnmounts lists the targets which were unmounted lazily
+	LazyUnmounts []string
+}
+
+// NewFakeMounter returns a FakeMounter without mount points
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{FakeMounter: &mount.FakeMounter{MountCheckErrors: make(map[string]error)}}
+}
+
+// UnmountLazy records the target and unmounts it
+func (f *FakeMounter) UnmountLazy(target string) error {
+	f.LazyUnmounts = append(f.LazyUnmounts, target)
+	return f.FakeMounter.Unmount(target)
+}
+
+// BindMount records a bind-mount, read-only mounts have the "ro" option in
+// their MountPoint
+func (f *FakeMounter) BindMount(ctx context.Context, from, to string, readOnly bool) error {
+	return bindMount(f.FakeMounter, from, to, readOnly)
+}
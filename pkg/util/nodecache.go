@@ -17,7 +17,6 @@ limitations under the License.
 package util
 
 import (
-	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
@@ -33,6 +32,8 @@ import (
 type NodeCache struct {
 	BasePath string
 	CacheDir string
+	// Checksums enables writing entries with a checksum
+	Checksums bool
 }
 
 var errDec = errors.New("file not found")
@@ -64,13 +65,16 @@ func (nc *NodeCache) ForAll(pattern string, destObj interface{}, f ForAllFunc) e
 		err = decodeObj(path, pattern, file, destObj)
 		if err == errDec {
 			continue
-		} else if err == nil {
-			if err = f(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))); err != nil {
-				return err
-			}
+		} else if _, ok := err.(*CacheEntryCorrupted); ok {
+			klog.Errorf("node-cache: skipping %s: %v", file.Name(), err)
+			continue
+		} else if err != nil {
+			return err
 		}
-		return err
 
+		if err = f(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -84,50 +88,86 @@ func decodeObj(filepath, pattern string, file os.FileInfo, destObj interface{})
 		return errDec
 	}
 	// #nosec
-	fp, err := os.Open(path.Join(filepath, file.Name()))
+	raw, err := ioutil.ReadFile(path.Join(filepath, file.Name()))
 	if err != nil {
 		klog.Infof("node-cache: open file: %s err %v", file.Name(), err)
 		return errDec
 	}
-	decoder := json.NewDecoder(fp)
-	if err = decoder.Decode(destObj); err != nil {
-		if err = fp.Close(); err != nil {
-			return errors.Wrapf(err, "failed to close file %s", file.Name())
 
+	identifier := strings.TrimSuffix(file.Name(), ".json")
+	if err = decodeCacheEntry(identifier, raw, destObj); err != nil {
+		if _, ok := err.(*CacheEntryCorrupted); ok {
+			return err
 		}
 		return errors.Wrapf(err, "node-cache: couldn't decode file %s", file.Name())
 	}
 	return nil
-
 }
 
 // Create creates the metadata file in cache directory with identifier name
 func (nc *NodeCache) Create(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
+	return nc.write(identifier, data)
+}
+
+// write replaces the metadata file atomically, by writing to a temporary file
+// renamed over it
+func (nc *NodeCache) write(identifier string, data interface{}) error {
 	file := path.Join(nc.BasePath, nc.CacheDir, identifier+".json")
-	fp, err := os.Create(file)
+	fp, err := ioutil.TempFile(path.Join(nc.BasePath, nc.CacheDir), identifier+"-*.tmp")
 	if err != nil {
 		return errors.Wrapf(err, "node-cache: failed to create metadata storage file %s\n", file)
 	}
 
 	defer func() {
-		if err = fp.Close(); err != nil {
-			klog.Warningf("failed to close file:%s %v", fp.Name(), err)
+		if err = os.Remove(fp.Name()); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to remove file:%s %v", fp.Name(), err)
 		}
 	}()
 
-	encoder := json.NewEncoder(fp)
-	if err = encoder.Encode(data); err != nil {
+	entry, err := encodeCacheEntry(data, nc.Checksums)
+	if err != nil {
+		fp.Close() // nolint: errcheck, gosec
 		return errors.Wrapf(err, "node-cache: failed to encode metadata for file: %s\n", file)
 	}
-	klog.V(4).Infof("node-cache: successfully saved metadata into file: %s\n", file)
+
+	if _, err = fp.Write(entry); err != nil {
+		fp.Close() // nolint: errcheck, gosec
+		return errors.Wrapf(err, "node-cache: failed to write metadata storage file %s\n", file)
+	}
+
+	if err = fp.Sync(); err != nil {
+		fp.Close() // nolint: errcheck, gosec
+		return errors.Wrapf(err, "node-cache: failed to sync metadata storage file %s\n", file)
+	}
+
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "node-cache: failed to close metadata storage file %s\n", file)
+	}
+
+	if err = os.Rename(fp.Name(), file); err != nil {
+		return errors.Wrapf(err, "node-cache: failed to save metadata storage file %s\n", file)
+	}
+
+	V(LogMetadata, 4).Infof("node-cache: successfully saved metadata into file: %s\n", file)
 	return nil
 }
 
+// Update replaces the metadata file in cache directory with identifier name
+func (nc *NodeCache) Update(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
+	return nc.write(identifier, data)
+}
+
 // Get retrieves the metadata from cache directory with identifier name
 func (nc *NodeCache) Get(identifier string, data interface{}) error {
+	defer lockCacheEntry(identifier)()
+
 	file := path.Join(nc.BasePath, nc.CacheDir, identifier+".json")
 	// #nosec
-	fp, err := os.Open(file)
+	raw, err := ioutil.ReadFile(file)
 	if err != nil {
 		if os.IsNotExist(errors.Cause(err)) {
 			return &CacheEntryNotFound{err}
@@ -136,14 +176,10 @@ func (nc *NodeCache) Get(identifier string, data interface{}) error {
 		return errors.Wrapf(err, "node-cache: open error for %s", file)
 	}
 
-	defer func() {
-		if err = fp.Close(); err != nil {
-			klog.Warningf("failed to close file:%s %v", fp.Name(), err)
+	if err = decodeCacheEntry(identifier, raw, data); err != nil {
+		if _, ok := err.(*CacheEntryCorrupted); ok {
+			return err
 		}
-	}()
-
-	decoder := json.NewDecoder(fp)
-	if err = decoder.Decode(data); err != nil {
 		return errors.Wrap(err, "rbd: decode error")
 	}
 
@@ -152,17 +188,19 @@ func (nc *NodeCache) Get(identifier string, data interface{}) error {
 
 // Delete deletes the metadata file from cache directory with identifier name
 func (nc *NodeCache) Delete(identifier string) error {
+	defer lockCacheEntry(identifier)()
+
 	file := path.Join(nc.BasePath, nc.CacheDir, identifier+".json")
 	err := os.Remove(file)
 	if err != nil {
-		if err == os.ErrNotExist {
-			klog.V(4).Infof("node-cache: cannot delete missing metadata storage file %s, assuming it's already deleted", file)
+		if os.IsNotExist(err) {
+			V(LogMetadata, 4).Infof("node-cache: cannot delete missing metadata storage file %s, assuming it's already deleted", file)
 			return nil
 		}
 
 		return errors.Wrapf(err, "node-cache: error removing file %s", file)
 
 	}
-	klog.V(4).Infof("node-cache: successfully deleted metadata storage file at: %+v\n", file)
+	V(LogMetadata, 4).Infof("node-cache: successfully deleted metadata storage file at: %+v\n", file)
 	return nil
 }
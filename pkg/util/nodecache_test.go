@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testCacheEntry struct {
+	Name string `json:"name"`
+}
+
+func TestNodeCacheForAll(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "nodecache")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	nc := &NodeCache{BasePath: basePath, CacheDir: "controller"}
+	if err = nc.EnsureCacheDirectory(nc.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	for _, id := range []string{"csi-vol-1", "csi-vol-2", "attachment-csi-vol-1-node", "csi-vol-3"} {
+		if err = nc.Create(id, &testCacheEntry{Name: id}); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+
+	// TEST: all entries matching the pattern should be visited
+	var visited []string
+	entry := &testCacheEntry{}
+	err = nc.ForAll("^csi-vol-", entry, func(identifier string) error {
+		if identifier != entry.Name {
+			t.Errorf("Failed: identifier (%s) doesn't match entry (%s)", identifier, entry.Name)
+		}
+		visited = append(visited, identifier)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Failed: unexpected error %s", err)
+	}
+
+	sort.Strings(visited)
+	if want := "csi-vol-1,csi-vol-2,csi-vol-3"; strings.Join(visited, ",") != want {
+		t.Errorf("Failed: want (%s), got (%s)", want, strings.Join(visited, ","))
+	}
+}
+
+func TestNodeCacheConcurrentUse(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "nodecache")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	nc := &NodeCache{BasePath: basePath, CacheDir: "controller"}
+	if err = nc.EnsureCacheDirectory(nc.CacheDir); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	const (
+		workers    = 8
+		iterations = 100
+	)
+	ids := []string{"csi-vol-1", "csi-vol-2"}
+
+	// TEST: entries are never seen partially written, whatever the
+	// interleaving of the operations
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				id := ids[(w+i)%len(ids)]
+				name := strings.Repeat(id, 1+(w+i)%16)
+				if err := nc.Update(id, &testCacheEntry{Name: name}); err != nil {
+					errs <- err
+				}
+
+				entry := &testCacheEntry{}
+				if err := nc.Get(id, entry); err != nil {
+					if _, ok := err.(*CacheEntryNotFound); !ok {
+						errs <- err
+					}
+				} else if !strings.HasPrefix(entry.Name, id) {
+					t.Errorf("Failed: entry %s has unexpected content (%s)", id, entry.Name)
+				}
+
+				err := nc.ForAll("^csi-vol-", &testCacheEntry{}, func(identifier string) error {
+					return nil
+				})
+				if err != nil {
+					errs <- err
+				}
+
+				if i%10 == 0 {
+					if err := nc.Delete(id); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Failed: unexpected error %s", err)
+	}
+
+	files, err := ioutil.ReadDir(basePath + "/controller")
+	if err != nil {
+		t.Fatalf("Test error %s", err)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			t.Errorf("Failed: temporary file %s left behind", file.Name())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// OperationTracker remembers the last known state of long running operations
+// for a short time, so that retries of the CO are answered without going to
+// the metadata store and the backend. It is only a cache, the operations must
+// still be correct if it is empty, e.g. after a restart.
+type OperationTracker struct {
+	validity   time.Duration
+	maxEntries int
+
+	mtx        sync.Mutex
+	operations map[string]trackedOperation
+}
+
+type trackedOperation struct {
+	state   string
+	expires time.Time
+}
+
+// NewOperationTracker returns a tracker whose states are valid for validity,
+// tracking at most maxEntries operations
+func NewOperationTracker(validity time.Duration, maxEntries int) *OperationTracker {
+	return &OperationTracker{
+		validity:   validity,
+		maxEntries: maxEntries,
+		operations: make(map[string]trackedOperation),
+	}
+}
+
+// Set records the state of the operation, replacing the previous one
+func (t *OperationTracker) Set(name, state string) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := time.Now()
+	if _, ok := t.operations[name]; !ok && len(t.operations) >= t.maxEntries {
+		t.evict(now)
+	}
+
+	t.operations[name] = trackedOperation{state: state, expires: now.Add(t.validity)}
+}
+
+// Get returns the state of the operation, if it was recorded within the
+// validity window
+func (t *OperationTracker) Get(name string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	op, ok := t.operations[name]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(op.expires) {
+		delete(t.operations, name)
+		return "", false
+	}
+
+	return op.state, true
+}
+
+// Forget drops the operation, on any transition of its state which isn't
+// recorded with Set
+func (t *OperationTracker) Forget(name string) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.operations, name)
+}
+
+// evict drops the expired operations, or the one expiring first if none did,
+// t.mtx must be held
+func (t *OperationTracker) evict(now time.Time) {
+	var (
+		first   string
+		expires time.Time
+	)
+
+	for name, op := range t.operations {
+		if now.After(op.expires) {
+			delete(t.operations, name)
+			continue
+		}
+
+		if first == "" || op.expires.Before(expires) {
+			first, expires = name, op.expires
+		}
+	}
+
+	if len(t.operations) >= t.maxEntries {
+		delete(t.operations, first)
+	}
+}
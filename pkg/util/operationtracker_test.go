@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tracker := NewOperationTracker(time.Minute, 2)
+
+	// TEST: a recorded state is returned within the validity window
+	tracker.Set("csi-vol-1", "10 removed")
+	tracker.Set("csi-vol-1", "20 removed")
+	if state, ok := tracker.Get("csi-vol-1"); !ok || state != "20 removed" {
+		t.Errorf("Failed: want (20 removed), got (%s) found %t", state, ok)
+	}
+
+	// TEST: a forgotten operation isn't returned anymore
+	tracker.Forget("csi-vol-1")
+	if _, ok := tracker.Get("csi-vol-1"); ok {
+		t.Errorf("Failed: forgotten operation was returned")
+	}
+
+	// TEST: the operation expiring first is evicted once the tracker is full
+	for _, name := range []string{"csi-vol-1", "csi-vol-2", "csi-vol-3"} {
+		tracker.Set(name, "in progress")
+	}
+	if _, ok := tracker.Get("csi-vol-1"); ok {
+		t.Errorf("Failed: want csi-vol-1 evicted")
+	}
+	for _, name := range []string{"csi-vol-2", "csi-vol-3"} {
+		if _, ok := tracker.Get(name); !ok {
+			t.Errorf("Failed: want %s tracked", name)
+		}
+	}
+
+	// TEST: expired states aren't returned
+	expiring := NewOperationTracker(0, 2)
+	expiring.Set("csi-vol-1", "in progress")
+	time.Sleep(time.Millisecond)
+	if _, ok := expiring.Get("csi-vol-1"); ok {
+		t.Errorf("Failed: expired operation was returned")
+	}
+
+	// TEST: a nil tracker tracks nothing
+	var disabled *OperationTracker
+	disabled.Set("csi-vol-1", "in progress")
+	if _, ok := disabled.Get("csi-vol-1"); ok {
+		t.Errorf("Failed: nil tracker returned an operation")
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// csiParameterPrefix prefixes the parameters set by the CO, like the secret
+// references and the PVC name, these are never flagged as unknown
+const csiParameterPrefix = "csi.storage.k8s.io/"
+
+const (
+	// AppendPVCNameParameter opts in to backend names carrying the PVC name
+	AppendPVCNameParameter = "appendPVCNameToBackendName"
+	// pvcNameParameter is passed by the external-provisioner when started
+	// with --extra-create-metadata
+	pvcNameParameter = csiParameterPrefix + "pvc/name"
+
+	// maxBackendNameSuffix caps the length of the PVC name appended to
+	// backend names
+	maxBackendNameSuffix = 32
+)
+
+// commonParameters are recognized by all drivers
+var commonParameters = []string{"monitors", "monValueFromSecret", "pool"}
+
+// ParameterValidator checks StorageClass and VolumeSnapshotClass parameters
+// against the ones recognized by the driver, to catch typos
+type ParameterValidator struct {
+	known map[string]bool
+	// RejectUnknown makes Validate fail on unknown parameters, instead of
+	// only logging them
+	RejectUnknown bool
+}
+
+// NewParameterValidator returns a validator recognizing the common
+// parameters and the driver specific ones
+func NewParameterValidator(driverParameters ...string) *ParameterValidator {
+	pv := &ParameterValidator{known: map[string]bool{}}
+	for _, p := range append(commonParameters, driverParameters...) {
+		pv.known[p] = true
+	}
+	return pv
+}
+
+// Recognize adds parameters configured at runtime to the recognized ones
+func (pv *ParameterValidator) Recognize(parameters ...string) {
+	for _, p := range parameters {
+		pv.known[p] = true
+	}
+}
+
+// Validate logs the unknown parameters, and returns an error listing them
+// if RejectUnknown is set
+func (pv *ParameterValidator) Validate(parameters map[string]string) error {
+	var unknown []string
+	for p := range parameters {
+		if !pv.known[p] && !strings.HasPrefix(p, csiParameterPrefix) {
+			unknown = append(unknown, p)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	if pv.RejectUnknown {
+		return fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+
+	klog.Warningf("ignoring unknown parameters: %s", strings.Join(unknown, ", "))
+	return nil
+}
+
+// BackendNameSuffix returns the PVC name to append to the backend name of the
+// volume, or "" if the StorageClass didn't opt in with
+// appendPVCNameToBackendName. The suffix is only a hint for humans, backend
+// names stay unique through the volume name they are composed of. The PVC
+// name is sanitized to lowercase alphanumerics and dashes, and capped to
+// maxBackendNameSuffix characters.
+func BackendNameSuffix(parameters map[string]string) (string, error) {
+	appendPVCName, ok := parameters[AppendPVCNameParameter]
+	if !ok {
+		return "", nil
+	}
+
+	enabled, err := strconv.ParseBool(appendPVCName)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", AppendPVCNameParameter, err)
+	}
+	if !enabled {
+		return "", nil
+	}
+
+	pvcName := parameters[pvcNameParameter]
+	if pvcName == "" {
+		return "", fmt.Errorf("%s requires the PVC name, run the external-provisioner with --extra-create-metadata", AppendPVCNameParameter)
+	}
+
+	suffix := []byte(strings.ToLower(pvcName))
+	for i, c := range suffix {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			suffix[i] = '-'
+		}
+	}
+	if len(suffix) > maxBackendNameSuffix {
+		suffix = suffix[:maxBackendNameSuffix]
+	}
+
+	return strings.Trim(string(suffix), "-"), nil
+}
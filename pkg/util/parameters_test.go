@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParameterValidator(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantErr    bool
+	}{
+		{"known parameters", map[string]string{"monitors": "mon1", "pool": "rbd", "imageFeatures": "layering"}, false},
+		{"csi prefixed parameters", map[string]string{
+			"pool": "rbd",
+			"csi.storage.k8s.io/provisioner-secret-name":      "secret",
+			"csi.storage.k8s.io/provisioner-secret-namespace": "default",
+			"csi.storage.k8s.io/pvc/name":                     "pvc",
+			"csi.storage.k8s.io/pvc/namespace":                "default",
+		}, false},
+		{"unknown parameter", map[string]string{"pool": "rbd", "imagefeatures": "layering"}, true},
+		{"parameter of the other driver", map[string]string{"pool": "rbd", "provisionVolume": "true"}, true},
+		{"prefix without csi domain", map[string]string{"storage.k8s.io/pvc/name": "pvc"}, true},
+	}
+
+	pv := NewParameterValidator("imageFeatures")
+	for _, tt := range tests {
+		pv.RejectUnknown = false
+		if err := pv.Validate(tt.parameters); err != nil {
+			t.Errorf("Failed: %s: unexpected error with RejectUnknown unset: %s", tt.name, err)
+		}
+
+		pv.RejectUnknown = true
+		if err := pv.Validate(tt.parameters); (err != nil) != tt.wantErr {
+			t.Errorf("Failed: %s: want error (%t), got (%v)", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestBackendNameSuffix(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		suffix     string
+		wantErr    bool
+	}{
+		{"not opted in", map[string]string{pvcNameParameter: "data"}, "", false},
+		{"disabled", map[string]string{AppendPVCNameParameter: "false", pvcNameParameter: "data"}, "", false},
+		{"pvc name", map[string]string{AppendPVCNameParameter: "true", pvcNameParameter: "myapp-data"}, "myapp-data", false},
+		{"sanitized", map[string]string{AppendPVCNameParameter: "true", pvcNameParameter: "MyApp.data_1"}, "myapp-data-1", false},
+		{"capped", map[string]string{AppendPVCNameParameter: "true", pvcNameParameter: "a-very-long-persistent-volume-claim-name"}, "a-very-long-persistent-volume-cl", false},
+		{"no trailing dash", map[string]string{AppendPVCNameParameter: "true", pvcNameParameter: "a-very-long-persistent-volume-c-laim"}, "a-very-long-persistent-volume-c", false},
+		{"without extra metadata", map[string]string{AppendPVCNameParameter: "true"}, "", true},
+		{"invalid", map[string]string{AppendPVCNameParameter: "yes", pvcNameParameter: "data"}, "", true},
+	}
+
+	for _, tt := range tests {
+		suffix, err := BackendNameSuffix(tt.parameters)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Failed: %s: want error (%t), got (%v)", tt.name, tt.wantErr, err)
+		}
+		if suffix != tt.suffix {
+			t.Errorf("Failed: %s: want (%s), got (%s)", tt.name, tt.suffix, suffix)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// SlowCallThreshold is the duration of an RPC above which its phase timings
+// are logged, 0 disables the logging
+var SlowCallThreshold = 30 * time.Second
+
+type phaseTimerKey struct{}
+
+// PhaseTimer times the named phases of an RPC, phases may overlap and be
+// entered several times
+type PhaseTimer struct {
+	start time.Time
+
+	mtx    sync.Mutex
+	phases []*phaseTiming
+}
+
+type phaseTiming struct {
+	name       string
+	start, end time.Time
+}
+
+// WithPhaseTimer returns a context carrying a new timer for the phases of the
+// RPC, the backend helpers called with it can add their phases
+func WithPhaseTimer(ctx context.Context) (context.Context, *PhaseTimer) {
+	t := &PhaseTimer{start: time.Now()}
+	return context.WithValue(ctx, phaseTimerKey{}, t), t
+}
+
+// StartPhase starts timing the phase of the RPC of ctx, the returned function
+// ends it. It does nothing if ctx carries no timer.
+func StartPhase(ctx context.Context, name string) func() {
+	t, ok := ctx.Value(phaseTimerKey{}).(*PhaseTimer)
+	if !ok {
+		return func() {}
+	}
+
+	p := &phaseTiming{name: name, start: time.Now()}
+	t.mtx.Lock()
+	t.phases = append(t.phases, p)
+	t.mtx.Unlock()
+
+	return func() {
+		t.mtx.Lock()
+		if p.end.IsZero() {
+			p.end = time.Now()
+		}
+		t.mtx.Unlock()
+	}
+}
+
+// summary returns the total duration of each phase, in the order they were
+// first entered, phases which didn't end are timed until now
+func (t *PhaseTimer) summary(now time.Time) string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var (
+		names     []string
+		durations = make(map[string]time.Duration)
+	)
+	for _, p := range t.phases {
+		end := p.end
+		if end.IsZero() {
+			end = now
+		}
+
+		if _, ok := durations[p.name]; !ok {
+			names = append(names, p.name)
+		}
+		durations[p.name] += end.Sub(p.start)
+	}
+
+	timings := make([]string, 0, len(names))
+	for _, name := range names {
+		timings = append(timings, fmt.Sprintf("%s=%v", name, durations[name]))
+	}
+
+	return strings.Join(timings, ",")
+}
+
+// LogIfSlow logs a single line with the phase timings of the RPC op on name,
+// if it took longer than SlowCallThreshold
+func (t *PhaseTimer) LogIfSlow(op, name string) {
+	now := time.Now()
+	d := now.Sub(t.start)
+	if SlowCallThreshold <= 0 || d < SlowCallThreshold {
+		return
+	}
+
+	klog.Warningf("slow call: op=%s name=%s duration=%v phases=%s", op, name, d, t.summary(now))
+}
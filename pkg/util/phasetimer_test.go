@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimer(t *testing.T) {
+	// TEST: phases are ignored without a timer
+	StartPhase(context.Background(), "createImage")()
+
+	ctx, timer := WithPhaseTimer(context.Background())
+	// the timer is passed on to derived contexts
+	childCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	endPhase := StartPhase(childCtx, "createImage")
+	endPhase()
+	endPhase() // ending a phase twice keeps the first end
+	StartPhase(childCtx, "storeMetadata")
+	StartPhase(childCtx, "createImage")()
+
+	if len(timer.phases) != 3 {
+		t.Fatalf("Failed: want (3) phases, got (%d)", len(timer.phases))
+	}
+
+	// TEST: phases are summed by name, in the order they were entered, and
+	// phases which didn't end are timed until now
+	now := time.Now()
+	for i, p := range timer.phases {
+		p.start = now.Add(-time.Duration(10*(i+1)) * time.Second)
+		if p.name == "createImage" {
+			p.end = p.start.Add(time.Second)
+		}
+	}
+	want := "createImage=2s,storeMetadata=20s"
+	if got := timer.summary(now); got != want {
+		t.Errorf("Failed: want (%s), got (%s)", want, got)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+var (
+	// pids cgroup of the pod, cgroup v1 and v2 locations
+	pidsCgroupPaths = []string{"/sys/fs/cgroup/pids", "/sys/fs/cgroup"}
+
+	// execSlots caps the concurrently exec'd helpers, nil if they aren't
+	// throttled
+	execSlots chan struct{}
+	// execWaiting counts the helpers waiting for a slot, accessed atomically
+	execWaiting int32
+)
+
+// SetPIDLimit throttles the exec'd helpers below the pid limit of the pod. A
+// limit of -1 reads it from the pids cgroup, 0 disables the throttling. Half
+// of the pids left are used for helpers, as mount helpers fork further
+// processes.
+func SetPIDLimit(limit int) error {
+	var current int
+	switch {
+	case limit == 0:
+		execSlots = nil
+		return nil
+	case limit == -1:
+		var err error
+		if limit, current, err = readPIDLimit(); err != nil {
+			return err
+		}
+		if limit == 0 {
+			klog.Infof("the pod has no pid limit, exec'd helpers aren't throttled")
+			execSlots = nil
+			return nil
+		}
+	case limit < 0:
+		return fmt.Errorf("invalid pid limit %d, expected -1, 0 or a positive limit", limit)
+	default:
+		// the pids in use are subtracted if the pids cgroup can be read
+		_, current, _ = readPIDLimit() // nolint: errcheck
+	}
+
+	slots := (limit - current) / 2
+	if slots < 1 {
+		slots = 1
+	}
+	execSlots = make(chan struct{}, slots)
+	klog.Infof("pid limit %d with %d pids in use, running up to %d helpers concurrently", limit, current, slots)
+
+	return nil
+}
+
+// readPIDLimit returns the pids.max and pids.current of the pids cgroup, the
+// limit is 0 if there is none
+func readPIDLimit() (limit, current int, err error) {
+	for _, p := range pidsCgroupPaths {
+		// #nosec
+		max, err := ioutil.ReadFile(p + "/pids.max")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read the pid limit: %v", err)
+		}
+
+		if s := strings.TrimSpace(string(max)); s != "max" {
+			if limit, err = strconv.Atoi(s); err != nil {
+				return 0, 0, fmt.Errorf("invalid pid limit %q in %s/pids.max", s, p)
+			}
+		}
+
+		// pids.current is informational, the limit applies without it
+		// #nosec
+		if cur, err := ioutil.ReadFile(p + "/pids.current"); err == nil {
+			current, _ = strconv.Atoi(strings.TrimSpace(string(cur))) // nolint: errcheck
+		}
+
+		return limit, current, nil
+	}
+
+	return 0, 0, fmt.Errorf("no pids cgroup found in %v", pidsCgroupPaths)
+}
+
+// StartExec waits for a slot to exec a helper, the returned function frees
+// it once the helper exited
+func StartExec(ctx context.Context) (func(), error) {
+	slots := execSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	default:
+	}
+
+	waiting := atomic.AddInt32(&execWaiting, 1)
+	defer atomic.AddInt32(&execWaiting, -1)
+	V(LogBackend, 4).Infof("all %d exec slots are used, %d helpers waiting", cap(slots), waiting)
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a free exec slot, %d helpers waiting: %v", waiting, ctx.Err())
+	}
+}
+
+// PIDLimitError explains fork failures of exec'd helpers, which fail like
+// out of memory errors once the pid limit of the pod is reached
+func PIDLimitError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errnoCause(err) == syscall.EAGAIN || strings.Contains(err.Error(), "fork: Resource temporarily unavailable") {
+		return fmt.Errorf("pid limit reached, increase pod pidsLimit: %v", err)
+	}
+
+	return err
+}
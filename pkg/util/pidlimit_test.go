@@ -0,0 +1,150 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestSetPIDLimit(t *testing.T) {
+	cgroupPath, err := ioutil.TempDir("", "pids")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(cgroupPath)
+
+	paths := pidsCgroupPaths
+	defer func() {
+		pidsCgroupPaths = paths
+		execSlots = nil
+	}()
+	pidsCgroupPaths = []string{path.Join(cgroupPath, "missing"), cgroupPath}
+
+	tests := []struct {
+		name       string
+		limit      int
+		pidsMax    string
+		slots      int
+		expectFail bool
+	}{
+		{"disabled", 0, "100", 0, false},
+		{"configured", 40, "100", 15, false},
+		{"detected", -1, "100", 45, false},
+		{"no limit", -1, "max", 0, false},
+		{"nearly exhausted", -1, "11", 1, false},
+		{"invalid limit", -2, "", 0, true},
+		{"invalid pids.max", -1, "abc", 0, true},
+	}
+
+	for _, tt := range tests {
+		for file, content := range map[string]string{"pids.max": tt.pidsMax + "\n", "pids.current": "10\n"} {
+			if err = ioutil.WriteFile(path.Join(cgroupPath, file), []byte(content), 0640); err != nil {
+				t.Fatalf("Test setup error %s", err)
+			}
+		}
+
+		err = SetPIDLimit(tt.limit)
+		if (err != nil) != tt.expectFail {
+			t.Errorf("%s: SetPIDLimit() = %v, want failure (%t)", tt.name, err, tt.expectFail)
+			continue
+		}
+		if tt.expectFail {
+			continue
+		}
+
+		if cap(execSlots) != tt.slots {
+			t.Errorf("%s: want (%d) slots, got (%d)", tt.name, tt.slots, cap(execSlots))
+		}
+	}
+}
+
+func TestStartExec(t *testing.T) {
+	defer func() { execSlots = nil }()
+	execSlots = make(chan struct{}, 1)
+
+	release, err := StartExec(context.Background())
+	if err != nil {
+		t.Fatalf("Failed: want a slot, got (%v)", err)
+	}
+
+	// TEST: a helper waits until a slot is freed or the call ran out of time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = StartExec(ctx); err == nil {
+		t.Errorf("Failed: want no slot while all are used")
+	}
+
+	release()
+	if release, err = StartExec(context.Background()); err != nil {
+		t.Errorf("Failed: want the freed slot, got (%v)", err)
+	}
+	release()
+}
+
+func TestMounterThrottled(t *testing.T) {
+	defer func() { execSlots = nil }()
+	execSlots = make(chan struct{}, 1)
+
+	fake := &mount.FakeMounter{}
+	m := NewMounter(fake)
+
+	release, err := StartExec(context.Background())
+	if err != nil {
+		t.Fatalf("Failed: want a slot, got (%v)", err)
+	}
+
+	// TEST: bind mounts wait for a slot like the other helpers
+	mounted := make(chan error)
+	go func() { mounted <- m.BindMount(context.Background(), "/staging", "/target", false) }()
+	select {
+	case err = <-mounted:
+		t.Fatalf("Failed: want the mount to wait for a slot, got (%v)", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	if err = <-mounted; err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if len(fake.Log) != 1 || fake.Log[0].Action != mount.FakeActionMount {
+		t.Errorf("Failed: want one mount, got (%v)", fake.Log)
+	}
+	if len(execSlots) != 0 {
+		t.Errorf("Failed: want the slot freed, got (%d) used", len(execSlots))
+	}
+}
+
+func TestPIDLimitError(t *testing.T) {
+	forkErr := &os.PathError{Op: "fork/exec", Path: "/usr/bin/rbd", Err: syscall.EAGAIN}
+	if err := PIDLimitError(forkErr); err == nil || !strings.Contains(err.Error(), "pid limit reached") {
+		t.Errorf("Failed: want the pid limit explained, got (%v)", err)
+	}
+
+	otherErr := &os.PathError{Op: "fork/exec", Path: "/usr/bin/rbd", Err: syscall.ENOENT}
+	if err := PIDLimitError(otherErr); err != otherErr {
+		t.Errorf("Failed: want (%v), got (%v)", otherErr, err)
+	}
+}
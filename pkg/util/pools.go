@@ -0,0 +1,45 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// CephPool is a pool as listed by ceph osd lspools -f json
+type CephPool struct {
+	ID   int64  `json:"poolnum"`
+	Name string `json:"poolname"`
+}
+
+// ListPools returns the pools in the output of ceph osd lspools -f json
+// returned by lspools
+func ListPools(lspools func() ([]byte, error)) ([]CephPool, error) {
+	output, err := lspools()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the pools")
+	}
+
+	var pools []CephPool
+	if err = json.Unmarshal(output, &pools); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the pools %q", output)
+	}
+
+	return pools, nil
+}
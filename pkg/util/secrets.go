@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ValidateSecretID returns an error naming the field if it's missing or empty
+// in the secrets
+func ValidateSecretID(secrets map[string]string, field string) error {
+	if strings.TrimSpace(secrets[field]) == "" {
+		if _, ok := secrets[field]; ok {
+			return fmt.Errorf("field %q of the secret is empty", field)
+		}
+		return fmt.Errorf("missing field %q in the secret", field)
+	}
+
+	return nil
+}
+
+// ValidateSecretKey returns an error naming the field if it's missing or
+// empty in the secrets, or if its value isn't a base64 encoded cephx key like
+// the ones `ceph auth get-key` prints. The value itself is never part of the
+// error.
+func ValidateSecretKey(secrets map[string]string, field string) error {
+	if err := ValidateSecretID(secrets, field); err != nil {
+		return err
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secrets[field])); err != nil {
+		return fmt.Errorf("field %q of the secret isn't a base64 encoded cephx key", field)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSecretKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    string
+	}{
+		{"valid key", map[string]string{"admin": "AQBvAbVcAAAAABAAjwnmzOwM9GDg7hDpeiYn7g==\n"}, ""},
+		{"missing key", map[string]string{"user": "AQBvAbVcAAAAABAAjwnmzOwM9GDg7hDpeiYn7g=="}, `missing field "admin"`},
+		{"empty key", map[string]string{"admin": " "}, `field "admin" of the secret is empty`},
+		{"wrong key", map[string]string{"admin": "not-a-key!"}, `field "admin" of the secret isn't a base64 encoded cephx key`},
+	}
+
+	for _, tt := range tests {
+		err := ValidateSecretKey(tt.secrets, "admin")
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: Failed: want (nil), got (%v)", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Failed: want (%s), got (%v)", tt.name, tt.want, err)
+			continue
+		}
+		// TEST: the value of the secret is never part of the error
+		if strings.Contains(err.Error(), "not-a-key") {
+			t.Errorf("%s: Failed: the error leaks the key: %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidateSecretID(t *testing.T) {
+	if err := ValidateSecretID(map[string]string{"userID": "user"}, "userID"); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if err := ValidateSecretID(map[string]string{}, "userID"); err == nil {
+		t.Errorf("Failed: want an error for a missing ID, got (nil)")
+	}
+}
@@ -22,55 +22,50 @@ import (
 
 const (
 	keyArg              = "--key="
+	keyFlag             = "--key"
 	secretArg           = "secret="
 	optionsArgSeparator = ','
-	strippedKey         = "--key=***stripped***"
-	strippedSecret      = "secret=***stripped***"
+	stripped            = "***stripped***"
 )
 
-// StripSecretInArgs strips values of either "--key" or "secret=".
+// StripSecretInArgs strips the values of "--key=<key>", "--key <key>" and of
+// all "secret=" options, e.g. in "name=admin,secret=<key>,mds_namespace=fs".
 // `args` is left unchanged.
-// Expects only one occurrence of either "--key" or "secret=".
 func StripSecretInArgs(args []string) []string {
 	out := make([]string, len(args))
 	copy(out, args)
 
-	if !stripKey(out) {
-		stripSecret(out)
-	}
-
-	return out
-}
-
-func stripKey(out []string) bool {
 	for i := range out {
-		if strings.HasPrefix(out[i], keyArg) {
-			out[i] = strippedKey
-			return true
+		switch {
+		case strings.HasPrefix(out[i], keyArg):
+			out[i] = keyArg + stripped
+		case out[i] == keyFlag && i+1 < len(out):
+			out[i+1] = stripped
+		default:
+			out[i] = stripSecretOptions(out[i])
 		}
 	}
 
-	return false
+	return out
 }
 
-func stripSecret(out []string) bool {
-	for i := range out {
-		arg := out[i]
+// stripSecretOptions strips the values of the secret= options in arg
+func stripSecretOptions(arg string) string {
+	var b strings.Builder
+	for {
 		begin := strings.Index(arg, secretArg)
-
 		if begin == -1 {
-			continue
+			b.WriteString(arg)
+			return b.String()
 		}
 
-		end := strings.IndexByte(arg[begin+len(secretArg):], optionsArgSeparator)
+		b.WriteString(arg[:begin] + secretArg + stripped)
+		arg = arg[begin+len(secretArg):]
 
-		out[i] = arg[:begin] + strippedSecret
-		if end != -1 {
-			out[i] += arg[end+len(secretArg):]
+		end := strings.IndexByte(arg, optionsArgSeparator)
+		if end == -1 {
+			return b.String()
 		}
-
-		return true
+		arg = arg[end:]
 	}
-
-	return false
 }
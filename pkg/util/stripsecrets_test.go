@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStripSecretInArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"rm", "img", "--id", "admin", "--key=AQD"},
+			[]string{"rm", "img", "--id", "admin", "--key=***stripped***"},
+		},
+		// TEST: the key may be a separate argument
+		{
+			[]string{"fsid", "--key", "AQD", "-m", "mon1"},
+			[]string{"fsid", "--key", "***stripped***", "-m", "mon1"},
+		},
+		// TEST: options following the secret are kept, without the secret
+		{
+			[]string{"-t", "ceph", "mon1:/", "/mnt", "-o", "name=admin,secret=AQD,mds_namespace=fs"},
+			[]string{"-t", "ceph", "mon1:/", "/mnt", "-o", "name=admin,secret=***stripped***,mds_namespace=fs"},
+		},
+		// TEST: all occurrences are stripped
+		{
+			[]string{"--key=AQD", "secret=AQE,secret=AQF", "--key=AQG"},
+			[]string{"--key=***stripped***", "secret=***stripped***,secret=***stripped***", "--key=***stripped***"},
+		},
+		{
+			[]string{"ls", "--pool", "rbd"},
+			[]string{"ls", "--pool", "rbd"},
+		},
+	}
+
+	for _, tt := range tests {
+		args := append([]string(nil), tt.args...)
+		if got := StripSecretInArgs(args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Failed: want (%q), got (%q)", tt.want, got)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Failed: the args were modified (%q)", args)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AllowNonEmptyTargets lets volumes be published on target directories
+// which have files in them, the mount shadows the files
+var AllowNonEmptyTargets bool
+
+// the number of entries of a non-empty target named in the error
+const maxListedTargetEntries = 3
+
+// CheckTargetEmpty returns FailedPrecondition, naming a few of the entries
+// found, if the target directory isn't empty, unless AllowNonEmptyTargets is
+// set. It has to be called once the target is known not to be mounted
+// already. Targets which don't exist or aren't directories pass.
+func CheckTargetEmpty(target string) error {
+	if AllowNonEmptyTargets {
+		return nil
+	}
+
+	// #nosec
+	dir, err := os.Open(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "failed to open target path %s: %v", target, err)
+	}
+	defer dir.Close() // nolint: errcheck
+
+	if fi, err := dir.Stat(); err != nil || !fi.IsDir() {
+		return nil
+	}
+
+	names, err := dir.Readdirnames(maxListedTargetEntries + 1)
+	if err != nil && err != io.EOF {
+		return status.Errorf(codes.Internal, "failed to read target path %s: %v", target, err)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	found := names
+	if len(names) > maxListedTargetEntries {
+		found = append(names[:maxListedTargetEntries:maxListedTargetEntries], "...")
+	}
+	return status.Errorf(codes.FailedPrecondition, "target path %s isn't empty, the volume would shadow %s", target, strings.Join(found, ", "))
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckTargetEmpty(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "target")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	target := filepath.Join(tmpDir, "target")
+	// TEST: missing and empty targets pass
+	if err = CheckTargetEmpty(target); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+	if err = os.Mkdir(target, 0750); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	if err = CheckTargetEmpty(target); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if err = ioutil.WriteFile(filepath.Join(target, name), nil, 0600); err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+	}
+
+	// TEST: a few of the entries are named
+	err = CheckTargetEmpty(target)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Failed: want (%v), got (%v)", codes.FailedPrecondition, err)
+	}
+	found := strings.SplitN(err.Error(), "would shadow ", 2)
+	if len(found) != 2 || len(strings.Split(found[1], ", ")) != maxListedTargetEntries+1 || !strings.HasSuffix(found[1], "...") {
+		t.Errorf("Failed: want (%d) entries and ..., got (%v)", maxListedTargetEntries, err)
+	}
+
+	// TEST: block volume targets are files
+	file := filepath.Join(target, "a")
+	if err = CheckTargetEmpty(file); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+
+	AllowNonEmptyTargets = true
+	defer func() { AllowNonEmptyTargets = false }()
+	if err = CheckTargetEmpty(target); err != nil {
+		t.Errorf("Failed: want (nil), got (%v)", err)
+	}
+}
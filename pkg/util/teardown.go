@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var (
+	// teardownWorkers caps the concurrently running teardowns, nil if they
+	// run in the RPC handlers
+	teardownWorkers chan struct{}
+	// teardownTimeout bounds the teardowns run on the workers, so that hung
+	// unmounts and unmaps don't hold a worker forever
+	teardownTimeout time.Duration
+	// teardownQueued counts the teardowns queued or running, accessed
+	// atomically
+	teardownQueued int32
+
+	// teardownTails are the done channels of the last teardown queued for
+	// each key
+	teardownTails    = map[string]chan struct{}{}
+	teardownTailsMtx sync.Mutex
+)
+
+// SetTeardownWorkers funnels the unmounts and unmaps of node operations
+// through the given number of workers, so that a storm of NodeUnpublish
+// calls doesn't fork hundreds of helpers at once. 0 runs them in the RPC
+// handlers. Teardowns on the workers time out after the given timeout, the
+// ones in the RPC handlers are bound to the RPC.
+func SetTeardownWorkers(workers int, timeout time.Duration) error {
+	teardownTimeout = timeout
+	switch {
+	case workers < 0:
+		return fmt.Errorf("invalid number of teardown workers %d, expected 0 or more", workers)
+	case workers == 0:
+		teardownWorkers = nil
+	default:
+		teardownWorkers = make(chan struct{}, workers)
+		klog.Infof("running up to %d unmounts and unmaps concurrently", workers)
+	}
+
+	return nil
+}
+
+// TeardownQueueDepth returns the number of teardowns queued or running
+func TeardownQueueDepth() int {
+	return int(atomic.LoadInt32(&teardownQueued))
+}
+
+// RunTeardown runs the teardown on a worker once the teardowns queued before
+// for the same key, usually the volume ID, completed. It waits for the
+// teardown until the context is done, returning DeadlineExceeded or Canceled
+// then. The teardown still completes in the background, it has to be
+// idempotent for the retry of the RPC to succeed.
+func RunTeardown(ctx context.Context, key string, teardown func(context.Context) error) error {
+	workers := teardownWorkers
+	if workers == nil {
+		return teardown(ctx)
+	}
+
+	done := make(chan struct{})
+	teardownTailsMtx.Lock()
+	previous := teardownTails[key]
+	teardownTails[key] = done
+	teardownTailsMtx.Unlock()
+
+	queued := atomic.AddInt32(&teardownQueued, 1)
+	if int(queued) > cap(workers) {
+		V(LogMount, 4).Infof("%d teardowns queued for %d workers", queued, cap(workers))
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			teardownTailsMtx.Lock()
+			if teardownTails[key] == done {
+				delete(teardownTails, key)
+			}
+			teardownTailsMtx.Unlock()
+			close(done)
+			atomic.AddInt32(&teardownQueued, -1)
+		}()
+
+		if previous != nil {
+			<-previous
+		}
+		workers <- struct{}{}
+		defer func() { <-workers }()
+
+		// the caller may be gone already, the teardown isn't bound to its
+		// context
+		teardownCtx, cancel := context.WithCancel(context.Background())
+		if teardownTimeout > 0 {
+			teardownCtx, cancel = context.WithTimeout(context.Background(), teardownTimeout)
+		}
+		defer cancel()
+		result <- teardown(teardownCtx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		klog.Warningf("stopped waiting for the teardown of %s, %d teardowns queued: %v", key, TeardownQueueDepth(), ctx.Err())
+		if ctx.Err() == context.DeadlineExceeded {
+			return status.Errorf(codes.DeadlineExceeded, "deadline exceeded waiting for the teardown of %s, it completes in the background", key)
+		}
+		return status.Errorf(codes.Canceled, "request canceled waiting for the teardown of %s, it completes in the background", key)
+	}
+}
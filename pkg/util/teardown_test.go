@@ -0,0 +1,180 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRunTeardownInline(t *testing.T) {
+	if err := SetTeardownWorkers(0, 0); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	want := errors.New("umount failed")
+	err := RunTeardown(context.Background(), "vol", func(context.Context) error { return want })
+	if err != want {
+		t.Errorf("Failed: want (%v), got (%v)", want, err)
+	}
+
+	if err = SetTeardownWorkers(-1, 0); err == nil {
+		t.Errorf("Failed: want an error for -1 workers, got (nil)")
+	}
+}
+
+func TestRunTeardownBoundedWorkers(t *testing.T) {
+	if err := SetTeardownWorkers(2, 0); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer SetTeardownWorkers(0, 0) // nolint: errcheck
+
+	var (
+		running    int32
+		maxRunning int32
+		wg         sync.WaitGroup
+	)
+	for _, key := range []string{"vol-1", "vol-2", "vol-3", "vol-4", "vol-5"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			err := RunTeardown(context.Background(), key, func(context.Context) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Failed: teardown of %s: %v", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	// TEST: no more teardowns than workers run at once
+	if maxRunning > 2 {
+		t.Errorf("Failed: want at most (2) concurrent teardowns, got (%d)", maxRunning)
+	}
+	if depth := TeardownQueueDepth(); depth != 0 {
+		t.Errorf("Failed: want an empty queue, got (%d)", depth)
+	}
+}
+
+func TestRunTeardownDeadline(t *testing.T) {
+	if err := SetTeardownWorkers(4, 0); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer SetTeardownWorkers(0, 0) // nolint: errcheck
+
+	var (
+		mtx   sync.Mutex
+		order []string
+	)
+	record := func(name string) {
+		mtx.Lock()
+		order = append(order, name)
+		mtx.Unlock()
+	}
+
+	release := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// TEST: the caller stops waiting at its deadline
+	err := RunTeardown(ctx, "vol", func(context.Context) error {
+		<-release
+		record("first")
+		return nil
+	})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("Failed: want (%v), got (%v)", codes.DeadlineExceeded, err)
+	}
+
+	// TEST: the retry runs once the first teardown of the volume completed
+	done := make(chan error, 1)
+	go func() {
+		done <- RunTeardown(context.Background(), "vol", func(context.Context) error {
+			record("retry")
+			return nil
+		})
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("Failed: the retry didn't wait for the first teardown, got (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed: the retry didn't complete")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(order) != 2 || order[0] != "first" || order[1] != "retry" {
+		t.Errorf("Failed: want ([first retry]), got (%v)", order)
+	}
+}
+
+func TestRunTeardownTimeout(t *testing.T) {
+	if err := SetTeardownWorkers(1, 50*time.Millisecond); err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+	defer SetTeardownWorkers(0, 0) // nolint: errcheck
+
+	// TEST: a hung teardown is canceled at the teardown timeout, freeing
+	// its worker for the next volume
+	err := RunTeardown(context.Background(), "hung", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Failed: want (%v), got (%v)", context.DeadlineExceeded, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- RunTeardown(context.Background(), "vol", func(context.Context) error { return nil })
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Failed: want (nil), got (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed: the worker wasn't freed")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Logical backend operations with a configurable timeout
+const (
+	OpCreateVolume   = "createVolume"
+	OpPurgeVolume    = "purgeVolume"
+	OpSnapshotCreate = "snapshotCreate"
+	OpSnapshotDelete = "snapshotDelete"
+	OpMount          = "mount"
+)
+
+var defaultOperationTimeouts = map[string]time.Duration{
+	OpCreateVolume:   2 * time.Minute,
+	OpPurgeVolume:    10 * time.Minute,
+	OpSnapshotCreate: 2 * time.Minute,
+	OpSnapshotDelete: 2 * time.Minute,
+	OpMount:          2 * time.Minute,
+}
+
+// OperationTimeouts maps logical backend operations to their timeout
+type OperationTimeouts map[string]time.Duration
+
+// ParseOperationTimeouts parses a comma separated list of
+// <operation>=<duration> pairs, e.g. "purgeVolume=30m,mount=1m".
+// Operations which are not listed keep their default timeout.
+func ParseOperationTimeouts(s string) (OperationTimeouts, error) {
+	t := make(OperationTimeouts, len(defaultOperationTimeouts))
+	for op, d := range defaultOperationTimeouts {
+		t[op] = d
+	}
+
+	if s == "" {
+		return t, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid operation timeout %q, expected <operation>=<duration>", pair)
+		}
+
+		if _, ok := defaultOperationTimeouts[kv[0]]; !ok {
+			return nil, fmt.Errorf("unknown operation %q in operation timeouts", kv[0])
+		}
+
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for operation %q: %v", kv[0], err)
+		}
+
+		if d <= 0 {
+			return nil, fmt.Errorf("timeout for operation %q must be positive", kv[0])
+		}
+
+		t[kv[0]] = d
+	}
+
+	return t, nil
+}
+
+// WithTimeout derives a context for the backend operation op. The timeout
+// never extends the deadline of ctx, so the remaining RPC deadline always
+// caps the per-operation timeout.
+func (t OperationTimeouts) WithTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	d, ok := t[op]
+	if !ok {
+		d = defaultOperationTimeouts[op]
+	}
+
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// CheckContext returns a DeadlineExceeded or Canceled error if the context is
+// done, so that handlers stop before starting the next phase of the operation
+// instead of keeping the backend busy after the CO gave up on the request.
+// Phases have to be idempotent, a retry resumes from where the handler
+// stopped.
+func CheckContext(ctx context.Context, phase string) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+
+	klog.Warningf("aborting before %s: %v", phase, err)
+	if err == context.DeadlineExceeded {
+		return status.Errorf(codes.DeadlineExceeded, "deadline exceeded before %s", phase)
+	}
+	return status.Errorf(codes.Canceled, "request canceled before %s", phase)
+}
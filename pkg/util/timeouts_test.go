@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseOperationTimeouts(t *testing.T) {
+	timeouts, err := ParseOperationTimeouts("")
+	if err != nil {
+		t.Errorf("Failed: unexpected error for empty timeouts: %v", err)
+	}
+	if timeouts[OpPurgeVolume] != defaultOperationTimeouts[OpPurgeVolume] {
+		t.Errorf("Failed: want default (%v), got (%v)", defaultOperationTimeouts[OpPurgeVolume], timeouts[OpPurgeVolume])
+	}
+
+	timeouts, err = ParseOperationTimeouts("purgeVolume=30m, mount=10s")
+	if err != nil {
+		t.Errorf("Failed: unexpected error: %v", err)
+	}
+	if timeouts[OpPurgeVolume] != 30*time.Minute || timeouts[OpMount] != 10*time.Second {
+		t.Errorf("Failed: timeouts not applied: %v", timeouts)
+	}
+	if timeouts[OpCreateVolume] != defaultOperationTimeouts[OpCreateVolume] {
+		t.Errorf("Failed: unlisted operation lost its default: %v", timeouts)
+	}
+
+	for _, invalid := range []string{"purgeVolume", "unknown=1m", "mount=abc", "mount=0s", "mount=-1m"} {
+		if _, err = ParseOperationTimeouts(invalid); err == nil {
+			t.Errorf("Failed: expected error for %q", invalid)
+		}
+	}
+}
+
+func TestOperationTimeoutsWithTimeout(t *testing.T) {
+	timeouts, err := ParseOperationTimeouts("mount=1h")
+	if err != nil {
+		t.Fatalf("Test setup error %s", err)
+	}
+
+	// TEST: the operation timeout applies when the parent has no deadline
+	ctx, cancel := timeouts.WithTimeout(context.Background(), OpMount)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Hour {
+		t.Errorf("Failed: expected a deadline of at most 1h, got %v", deadline)
+	}
+
+	// TEST: the parent deadline caps the operation timeout
+	parent, parentCancel := context.WithTimeout(context.Background(), time.Second)
+	defer parentCancel()
+	ctx, cancel = timeouts.WithTimeout(parent, OpMount)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	parentDeadline, _ := parent.Deadline()
+	if deadline.After(parentDeadline) {
+		t.Errorf("Failed: operation deadline %v exceeds RPC deadline %v", deadline, parentDeadline)
+	}
+}
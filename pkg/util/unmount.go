@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+var (
+	// busy targets are retried for unmountBusyTimeout before being unmounted
+	// lazily
+	unmountBusyTimeout   = 10 * time.Second
+	unmountRetryInterval = 500 * time.Millisecond
+)
+
+// Unmounter unmounts the targets of node operations
+type Unmounter interface {
+	mount.Interface
+	// UnmountLazy detaches the target, the filesystem is cleaned up once it
+	// isn't busy anymore
+	UnmountLazy(target string) error
+}
+
+// UnmountTarget unmounts the target and removes it. A missing target, or a
+// target which isn't mounted, is considered unmounted already, so that
+// retries after a crash succeed. Busy targets are retried for a bounded time,
+// then unmounted lazily.
+func UnmountTarget(ctx context.Context, u Unmounter, target string) error {
+	mounted, err := isTargetMounted(u, target)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if err = unmountBusyTarget(ctx, u, target); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove %s", target)
+	}
+
+	return nil
+}
+
+func isTargetMounted(u Unmounter, target string) (bool, error) {
+	notMnt, err := mount.IsNotMountPoint(u, target)
+	switch {
+	case err == nil:
+		return !notMnt, nil
+	case os.IsNotExist(err):
+		// the mount table may still list the target if it was removed from
+		// another mount namespace, there's nothing to unmount by its path
+		if isStaleMountTableEntry(u, target) {
+			klog.Warningf("%s doesn't exist anymore, but is still listed in the mount table", target)
+		}
+		return false, nil
+	case mount.IsCorruptedMnt(err):
+		// e.g. the ceph-fuse process serving the mount is gone
+		klog.Warningf("%s is a corrupted mount, unmounting it: %v", target, err)
+		return true, nil
+	}
+
+	return false, errors.Wrapf(err, "failed to check whether %s is mounted", target)
+}
+
+func isStaleMountTableEntry(u Unmounter, target string) bool {
+	mps, err := u.List()
+	if err != nil {
+		return false
+	}
+
+	for _, mp := range mps {
+		// the kernel appends " (deleted)" to removed mount points, escaped in
+		// /proc/mounts
+		path := strings.TrimSuffix(strings.TrimSuffix(mp.Path, `\040(deleted)`), " (deleted)")
+		if path == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unmountBusyTarget(ctx context.Context, u Unmounter, target string) error {
+	deadline := time.Now().Add(unmountBusyTimeout)
+	for {
+		err := u.Unmount(target)
+		if err == nil || isNotMountedError(err) {
+			return nil
+		}
+
+		if !isBusyError(err) {
+			return errors.Wrapf(err, "failed to unmount %s", target)
+		}
+
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			klog.Warningf("%s is still busy, unmounting it lazily: %v", target, err)
+			return u.UnmountLazy(target)
+		}
+
+		V(LogMount, 4).Infof("%s is busy, retrying to unmount it: %v", target, err)
+		time.Sleep(unmountRetryInterval)
+	}
+}
+
+func isBusyError(err error) bool {
+	return errnoCause(err) == syscall.EBUSY || strings.Contains(err.Error(), "is busy")
+}
+
+func isNotMountedError(err error) bool {
+	return errnoCause(err) == syscall.EINVAL || strings.Contains(err.Error(), "not mounted")
+}
+
+func errnoCause(err error) error {
+	err = errors.Cause(err)
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Ceph-CSI Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// fakeUnmounter fails the first busy unmounts with EBUSY
+type fakeUnmounter struct {
+	*mount.FakeMounter
+	busy int
+	lazy []string
+}
+
+func (f *fakeUnmounter) Unmount(target string) error {
+	if f.busy > 0 {
+		f.busy--
+		return &os.PathError{Op: "umount", Path: target, Err: syscall.EBUSY}
+	}
+	return f.FakeMounter.Unmount(target)
+}
+
+func (f *fakeUnmounter) UnmountLazy(target string) error {
+	f.lazy = append(f.lazy, target)
+	return f.FakeMounter.Unmount(target)
+}
+
+func TestUnmountTarget(t *testing.T) {
+	unmountRetryInterval = time.Millisecond
+	defer func() {
+		unmountRetryInterval = 500 * time.Millisecond
+		unmountBusyTimeout = 10 * time.Second
+	}()
+
+	tests := []struct {
+		name       string
+		exists     bool
+		mounted    bool
+		stale      bool
+		busy       int
+		busyTime   time.Duration
+		unmounted  bool
+		lazy       bool
+		expectFail bool
+	}{
+		{name: "missing target", exists: false},
+		{name: "missing target in mount table", exists: false, stale: true},
+		{name: "not mounted", exists: true},
+		{name: "mounted", exists: true, mounted: true, unmounted: true},
+		{name: "busy", exists: true, mounted: true, busy: 2, busyTime: time.Minute, unmounted: true},
+		{name: "busy until timeout", exists: true, mounted: true, busy: 1000, busyTime: 0, unmounted: true, lazy: true},
+	}
+
+	for _, tt := range tests {
+		basePath, err := ioutil.TempDir("", "unmount")
+		if err != nil {
+			t.Fatalf("Test setup error %s", err)
+		}
+		target := path.Join(basePath, "target")
+
+		fake := &fakeUnmounter{FakeMounter: &mount.FakeMounter{}, busy: tt.busy}
+		if tt.exists {
+			if err = os.Mkdir(target, 0750); err != nil {
+				t.Fatalf("Test setup error %s", err)
+			}
+		}
+		if tt.mounted {
+			fake.MountPoints = append(fake.MountPoints, mount.MountPoint{Device: "/dev/rbd0", Path: target})
+		}
+		if tt.stale {
+			fake.MountPoints = append(fake.MountPoints, mount.MountPoint{Device: "/dev/rbd0", Path: target + `\040(deleted)`})
+		}
+		unmountBusyTimeout = tt.busyTime
+
+		err = UnmountTarget(context.Background(), fake, target)
+		if err != nil {
+			t.Errorf("%s: UnmountTarget() = %v, want success", tt.name, err)
+		}
+
+		if _, err = os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("%s: target wasn't removed: %v", tt.name, err)
+		}
+
+		var unmounts int
+		for _, action := range fake.Log {
+			if action.Action == mount.FakeActionUnmount {
+				unmounts++
+			}
+		}
+		if tt.unmounted != (unmounts == 1) {
+			t.Errorf("%s: want unmounted (%t), got (%d) unmounts", tt.name, tt.unmounted, unmounts)
+		}
+		if tt.lazy != (len(fake.lazy) == 1) {
+			t.Errorf("%s: want lazy unmount (%t), got (%v)", tt.name, tt.lazy, fake.lazy)
+		}
+
+		os.RemoveAll(basePath) // nolint: errcheck
+	}
+}
@@ -48,7 +48,7 @@ func roundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
 }
 
 // CreatePersistanceStorage creates storage path and initializes new cache
-func CreatePersistanceStorage(sPath, metaDataStore, driverName string) (CachePersister, error) {
+func CreatePersistanceStorage(sPath, metaDataStore, driverName string, checksums bool) (CachePersister, error) {
 	var err error
 	if err = createPersistentStorage(path.Join(sPath, "controller")); err != nil {
 		klog.Errorf("failed to create persistent storage for controller: %v", err)
@@ -60,7 +60,7 @@ func CreatePersistanceStorage(sPath, metaDataStore, driverName string) (CachePer
 		return nil, err
 	}
 
-	cp, err := NewCachePersister(metaDataStore, driverName)
+	cp, err := NewCachePersister(metaDataStore, driverName, checksums)
 	if err != nil {
 		klog.Errorf("failed to define cache persistence method: %v", err)
 		return nil, err